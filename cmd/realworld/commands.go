@@ -0,0 +1,618 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/config"
+	"github.com/delaneyj/realworld-datastar/sql"
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/realworld-datastar/web"
+	"github.com/delaneyj/toolbelt"
+	"golang.org/x/crypto/bcrypt"
+	"zombiezen.com/go/sqlite"
+)
+
+// subcommand splits the action off the front of args, falling back to
+// defaultAction if there is one and no action was given.
+func subcommand(command string, args []string, defaultAction string, actions ...string) (string, []string, error) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		if !slices.Contains(actions, args[0]) {
+			return "", nil, fmt.Errorf("unknown %s action %q, expected one of %s", command, args[0], strings.Join(actions, ", "))
+		}
+		return args[0], args[1:], nil
+	}
+	if defaultAction == "" {
+		return "", nil, fmt.Errorf("%s needs an action, one of %s", command, strings.Join(actions, ", "))
+	}
+	return defaultAction, args, nil
+}
+
+func migrate(ctx context.Context, args []string) error {
+	action, args, err := subcommand("migrate", args, "status", "status", "up", "down")
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("realworld migrate "+action, flag.ContinueOnError)
+	opts := sql.MigrateOptions{Out: os.Stdout}
+	steps := 1
+	if action != "status" {
+		fs.BoolVar(&opts.DryRun, "dry-run", false, "print the SQL that would run without running it")
+	}
+	if action == "down" {
+		fs.IntVar(&steps, "steps", steps, "number of migrations to revert")
+	}
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.OpenDBWithoutMigrating(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch action {
+	case "up":
+		applied, err := sql.MigrateUp(ctx, db, opts)
+		if err != nil {
+			return err
+		}
+		if !opts.DryRun {
+			for _, m := range applied {
+				fmt.Println("applied", m.Name)
+			}
+		}
+		return nil
+
+	case "down":
+		reverted, err := sql.MigrateDown(ctx, db, steps, opts)
+		if err != nil {
+			return err
+		}
+		if !opts.DryRun {
+			for _, m := range reverted {
+				fmt.Println("reverted", m.Name)
+			}
+		}
+		return nil
+	}
+
+	statuses, err := sql.ReadMigrationStatus(ctx, db)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "MIGRATION\tSTATE\tAPPLIED AT")
+	for _, status := range statuses {
+		appliedAt := ""
+		if !status.AppliedAt.IsZero() {
+			appliedAt = status.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", status.Name, status.State, appliedAt)
+	}
+	return w.Flush()
+}
+
+func seed(ctx context.Context, args []string) error {
+	opts := sql.DefaultSeedOptions()
+
+	fs := flag.NewFlagSet("realworld seed", flag.ContinueOnError)
+	fs.IntVar(&opts.Users, "users", opts.Users, "number of users to create, including the admin user")
+	fs.IntVar(&opts.Articles, "articles", opts.Articles, "number of articles to create")
+	fs.Int64Var(&opts.Seed, "seed", opts.Seed, "random seed, use a different one to add more data to a seeded database")
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if opts.Users < 1 || opts.Articles < 0 {
+		return errors.New("users must be at least 1 and articles can't be negative")
+	}
+
+	db, err := sql.OpenDB(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := sql.SeedDB(ctx, db, opts); err != nil {
+		return err
+	}
+	fmt.Printf("seeded %d users and %d articles\n", opts.Users, opts.Articles)
+	return nil
+}
+
+func user(ctx context.Context, args []string) error {
+	action, args, err := subcommand("user", args, "", "create", "reset-password", "reset-two-factor", "unlock", "delete")
+	if err != nil {
+		return err
+	}
+
+	var (
+		username, email, password string
+		isAdmin                   bool
+	)
+	fs := flag.NewFlagSet("realworld user "+action, flag.ContinueOnError)
+	if action == "create" {
+		fs.StringVar(&username, "username", "", "username of the new user")
+		fs.BoolVar(&isAdmin, "admin", false, "allow the user to download backups")
+	}
+	fs.StringVar(&email, "email", "", "email of the user")
+	needsPassword := action == "create" || action == "reset-password"
+	if needsPassword {
+		fs.StringVar(&password, "password", "", "new password, read from stdin if empty")
+	}
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return errors.New("email is required")
+	}
+	if action == "create" {
+		username = strings.TrimSpace(username)
+		if username == "" {
+			return errors.New("username is required")
+		}
+	}
+
+	var passwordHash []byte
+	if needsPassword {
+		if password == "" {
+			if password, err = readPassword(); err != nil {
+				return err
+			}
+		}
+		if len(password) < 8 {
+			return errors.New("password must be at least 8 characters")
+		}
+		passwordHash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("failed to hash password: %w", err)
+		}
+	}
+
+	db, err := sql.OpenDB(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var userID int64
+	if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+		u, err := zz.OnceUserByEmail(tx, email)
+		if err != nil {
+			return fmt.Errorf("failed to get user by email: %w", err)
+		}
+
+		switch action {
+		case "create":
+			if u != nil {
+				return errors.New("email is already in use")
+			}
+			usernameUser, err := zz.OnceUserByUsername(tx, username)
+			if err != nil {
+				return fmt.Errorf("failed to get user by username: %w", err)
+			}
+			if usernameUser != nil {
+				return errors.New("username is already in use")
+			}
+
+			userID = toolbelt.NextID()
+			if err := zz.OnceCreateUser(tx, &zz.UserModel{
+				Id:           userID,
+				Username:     username,
+				Email:        email,
+				PasswordHash: passwordHash,
+				ImageUrl:     web.DefaultAvatarURL(userID),
+				IsAdmin:      isAdmin,
+				// Created by whoever runs the site, who vouches for it
+				EmailVerifiedAt: time.Now(),
+			}); err != nil {
+				return fmt.Errorf("failed to create user: %w", err)
+			}
+
+		case "reset-password":
+			if u == nil {
+				return errors.New("user not found")
+			}
+			userID = u.Id
+			account, err := zz.OnceReadByIDUser(tx, u.Id)
+			if err != nil {
+				return fmt.Errorf("failed to get user: %w", err)
+			}
+			account.PasswordHash = passwordHash
+			// Whoever knew the old password is signed out too
+			account.SessionVersion++
+			if err := zz.OnceUpdateUser(tx, account); err != nil {
+				return fmt.Errorf("failed to update user: %w", err)
+			}
+
+		case "reset-two-factor":
+			if u == nil {
+				return errors.New("user not found")
+			}
+			userID = u.Id
+			if _, err := web.ResetTwoFactor(tx, u.Id); err != nil {
+				return err
+			}
+
+		case "unlock":
+			if u == nil {
+				return errors.New("user not found")
+			}
+			userID = u.Id
+			if err := web.ClearLoginAttempts(tx, u.Email, ""); err != nil {
+				return err
+			}
+
+		case "delete":
+			if u == nil {
+				return errors.New("user not found")
+			}
+			userID = u.Id
+			if err := zz.OnceDeleteUser(tx, u.Id); err != nil {
+				return fmt.Errorf("failed to delete user: %w", err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s user %d <%s>\n", action, userID, email)
+	return nil
+}
+
+// readPassword takes the first line of stdin so passwords can be piped in
+// instead of showing up in the process list.
+func readPassword() (string, error) {
+	fmt.Fprint(os.Stderr, "password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func database(ctx context.Context, args []string) error {
+	action, args, err := subcommand("db", args, "", "vacuum", "integrity-check")
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("realworld db "+action, flag.ContinueOnError)
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.OpenDBWithoutMigrating(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch action {
+	case "vacuum":
+		if err := sql.Vacuum(ctx, db); err != nil {
+			return err
+		}
+		fmt.Println("vacuumed", sql.DBFilename(cfg))
+
+	case "integrity-check":
+		problems, err := sql.IntegrityCheck(ctx, db)
+		if err != nil {
+			return err
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("found %d integrity problems", len(problems))
+		}
+		fmt.Println("ok")
+	}
+	return nil
+}
+
+func reset(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("realworld reset", flag.ContinueOnError)
+	yes := fs.Bool("yes", false, "confirm deleting all data")
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if cfg.IsProduction() {
+		return errors.New("refusing to reset a production database")
+	}
+	if !*yes {
+		return fmt.Errorf("this deletes everything in %s, run again with -yes to confirm", sql.DBFilename(cfg))
+	}
+
+	cfg.ClearData = true
+	db, err := sql.SetupDB(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to reset database: %w", err)
+	}
+	if err := db.Close(); err != nil {
+		return fmt.Errorf("failed to close database: %w", err)
+	}
+	fmt.Println("reset", sql.DBFilename(cfg))
+	return nil
+}
+
+func backup(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("realworld backup", flag.ContinueOnError)
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.OpenDBWithoutMigrating(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	filename, err := sql.Backup(ctx, db, cfg.BackupFolder())
+	if err != nil {
+		return err
+	}
+	if err := sql.PruneBackups(cfg.BackupFolder(), cfg.BackupRetention); err != nil {
+		return err
+	}
+	fmt.Println("backed up to", filename)
+	return nil
+}
+
+func restore(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("realworld restore", flag.ContinueOnError)
+	from := fs.String("from", "", "backup file to restore, defaults to the newest in the backup folder")
+	yes := fs.Bool("yes", false, "confirm replacing all data")
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	filename := *from
+	if filename == "" {
+		backups, err := sql.ListBackups(cfg.BackupFolder())
+		if err != nil {
+			return err
+		}
+		if len(backups) == 0 {
+			return fmt.Errorf("no backups in %s", cfg.BackupFolder())
+		}
+		filename = backups[0].Path
+	}
+
+	if err := sql.VerifyBackup(filename); err != nil {
+		return err
+	}
+	if !*yes {
+		return fmt.Errorf("%s is intact, run again with -yes to replace %s with it", filename, sql.DBFilename(cfg))
+	}
+	if err := replaceDatabase(ctx, cfg, filename); err != nil {
+		return err
+	}
+	fmt.Println("restored", filename)
+	return nil
+}
+
+// replaceDatabase restores the verified database in filename over the live
+// one, keeping a copy of what it replaced.
+func replaceDatabase(ctx context.Context, cfg *config.Config, filename string) error {
+	db, err := sql.OpenDBWithoutMigrating(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Keep what is being replaced in case the wrong backup was picked, outside
+	// of the rotation so it isn't pruned
+	previous := filepath.Join(cfg.BackupFolder(), "pre-restore-"+time.Now().UTC().Format("20060102T150405Z")+".sqlite")
+	if err := sql.BackupTo(ctx, db, previous); err != nil {
+		return fmt.Errorf("failed to backup current database: %w", err)
+	}
+	fmt.Println("backed up current database to", previous)
+
+	if err := sql.Restore(ctx, db, filename); err != nil {
+		return err
+	}
+	if _, err := sql.MigrateUp(ctx, db, sql.MigrateOptions{}); err != nil {
+		return fmt.Errorf("failed to migrate restored database: %w", err)
+	}
+	return nil
+}
+
+func replicate(ctx context.Context, args []string) error {
+	action, args, err := subcommand("replicate", args, "status", "status", "restore")
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("realworld replicate "+action, flag.ContinueOnError)
+	var (
+		timestamp, output *string
+		yes               *bool
+	)
+	if action == "restore" {
+		timestamp = fs.String("timestamp", "", "RFC 3339 time to restore to, defaults to the latest")
+		output = fs.String("output", "", "write the restored database to this file instead of replacing the live one")
+		yes = fs.Bool("yes", false, "confirm replacing all data")
+	}
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+	if cfg.ReplicaDir == "" {
+		return errors.New("replica-dir is not set")
+	}
+	target := sql.NewFileReplica(cfg.ReplicaDir)
+
+	if action == "status" {
+		generations, err := target.Generations(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "GENERATION\tSNAPSHOT\tSEGMENTS\tLATEST")
+		for _, generation := range generations {
+			snapshotAt, err := sql.GenerationTime(generation)
+			if err != nil {
+				return err
+			}
+			segments, err := target.Segments(ctx, generation)
+			if err != nil {
+				return err
+			}
+			latest := snapshotAt
+			if len(segments) > 0 {
+				latest = segments[len(segments)-1].CreatedAt
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", generation, snapshotAt.Format(time.RFC3339), len(segments), latest.Format(time.RFC3339Nano))
+		}
+		return w.Flush()
+	}
+
+	var at time.Time
+	if *timestamp != "" {
+		if at, err = time.Parse(time.RFC3339, *timestamp); err != nil {
+			return fmt.Errorf("invalid -timestamp: %w", err)
+		}
+	}
+
+	filename := *output
+	if filename == "" {
+		dir, err := os.MkdirTemp("", "conduit-replica-")
+		if err != nil {
+			return fmt.Errorf("failed to create temp folder: %w", err)
+		}
+		defer os.RemoveAll(dir)
+		filename = filepath.Join(dir, "conduit.sqlite")
+	}
+
+	restoredAt, err := sql.RestoreReplica(ctx, target, filename, at)
+	if err != nil {
+		return err
+	}
+	if err := sql.VerifyBackup(filename); err != nil {
+		return err
+	}
+
+	if *output != "" {
+		fmt.Printf("restored replica as of %s to %s\n", restoredAt.Format(time.RFC3339Nano), *output)
+		return nil
+	}
+	if !*yes {
+		return fmt.Errorf("replica as of %s is intact, run again with -yes to replace %s with it", restoredAt.Format(time.RFC3339Nano), sql.DBFilename(cfg))
+	}
+	if err := replaceDatabase(ctx, cfg, filename); err != nil {
+		return err
+	}
+	fmt.Println("restored replica as of", restoredAt.Format(time.RFC3339Nano))
+	return nil
+}
+
+func articles(ctx context.Context, args []string) error {
+	action, args, err := subcommand("articles", args, "", "import", "export")
+	if err != nil {
+		return err
+	}
+
+	fs := flag.NewFlagSet("realworld articles "+action, flag.ContinueOnError)
+	email := fs.String("email", "", "email of the author")
+	var output *string
+	if action == "export" {
+		output = fs.String("output", "", "zip file to write, defaults to <username>-articles.zip")
+	}
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *email == "" {
+		return errors.New("email is required")
+	}
+	if action == "import" && fs.NArg() == 0 {
+		return errors.New("import needs the .md files, folders or zips to import")
+	}
+
+	db, err := sql.OpenDB(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var author *zz.UserByEmailRes
+	if err := db.ReadTX(ctx, func(tx *sqlite.Conn) (err error) {
+		author, err = zz.OnceUserByEmail(tx, *email)
+		if err != nil {
+			return fmt.Errorf("failed to get user by email: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if author == nil {
+		return errors.New("user not found")
+	}
+
+	if action == "export" {
+		filename := *output
+		if filename == "" {
+			filename = author.Username + "-articles.zip"
+		}
+		f, err := os.Create(filename)
+		if err != nil {
+			return fmt.Errorf("failed to create export: %w", err)
+		}
+		defer f.Close()
+
+		if err := web.ExportArticles(ctx, db, f, author.Id, true); err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to write export: %w", err)
+		}
+		fmt.Println("exported to", filename)
+		return nil
+	}
+
+	var files []*web.ArticleFile
+	for _, name := range fs.Args() {
+		found, err := web.ReadArticleFiles(name)
+		if err != nil {
+			return err
+		}
+		files = append(files, found...)
+	}
+
+	failed := 0
+	for _, result := range web.ImportArticles(ctx, db, author.Id, files) {
+		if result.Error != "" {
+			failed++
+			fmt.Printf("%s: %s\n", result.File, result.Error)
+			continue
+		}
+		fmt.Printf("%s: imported as /articles/%s\n", result.File, result.Slug)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed to import", failed, len(files))
+	}
+	return nil
+}
@@ -2,34 +2,173 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 
+	"github.com/delaneyj/realworld-datastar/config"
 	"github.com/delaneyj/realworld-datastar/sql"
 	"github.com/delaneyj/realworld-datastar/web"
 )
 
+const usage = `usage: realworld <command> [flags]
+
+commands:
+  serve                                                      run the web server (default)
+  migrate [status|up|down]                                   show, apply or revert schema migrations
+  seed                                                       add fake users and articles
+  user create|reset-password|reset-two-factor|unlock|delete  manage users
+  articles import|export                                     move articles in and out as Markdown
+  db vacuum|integrity-check                                  database maintenance
+  reset                                                      delete and recreate the database
+  backup                                                     write a backup to the backup folder
+  restore                                                    replace the database with a backup
+  replicate status|restore                                   list or restore from the WAL replica
+
+Every command accepts the config flags, run "realworld <command> -h" to list them.
+`
+
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
-	if err := run(ctx); err != nil {
+	if err := run(ctx, os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
 		log.Fatal(err)
 	}
 }
 
-func run(ctx context.Context) error {
+func run(ctx context.Context, args []string) error {
+	command := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "serve":
+		return serve(ctx, args)
+	case "migrate":
+		return migrate(ctx, args)
+	case "seed":
+		return seed(ctx, args)
+	case "user":
+		return user(ctx, args)
+	case "articles":
+		return articles(ctx, args)
+	case "db":
+		return database(ctx, args)
+	case "reset":
+		return reset(ctx, args)
+	case "backup":
+		return backup(ctx, args)
+	case "restore":
+		return restore(ctx, args)
+	case "replicate":
+		return replicate(ctx, args)
+	case "help":
+		fmt.Print(usage)
+		return nil
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
 
-	db, err := sql.SetupDB(ctx, "data", false)
+// loadConfig parses args for a command with the shared config flags on top of
+// the command's own flags in fs.
+func loadConfig(fs *flag.FlagSet, args []string) (*config.Config, error) {
+	cfg, err := config.Load(fs, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	return cfg, nil
+}
+
+func serve(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("realworld serve", flag.ContinueOnError)
+	cfg, err := loadConfig(fs, args)
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.SetupDB(ctx, cfg)
 	if err != nil {
 		return fmt.Errorf("failed to setup database: %w", err)
 	}
 
 	defer db.Close()
 
-	return web.RunHTTPServer(ctx, db)
+	if cfg.BackupInterval > 0 {
+		backupCtx, stopBackups := context.WithCancel(ctx)
+		backingUp := make(chan struct{})
+		go func() {
+			defer close(backingUp)
+			sql.RunPeriodicBackups(backupCtx, db, cfg.BackupFolder(), cfg.BackupInterval, cfg.BackupRetention)
+		}()
+		// Same as replicating, a backup in progress has to finish before the
+		// database is closed
+		defer func() {
+			stopBackups()
+			<-backingUp
+		}()
+	}
+
+	if cfg.ReplicaDir != "" {
+		replicator := sql.NewReplicator(db, sql.DBFilename(cfg), sql.NewFileReplica(cfg.ReplicaDir), sql.ReplicatorOptions{
+			Interval:         cfg.ReplicaInterval,
+			SnapshotInterval: cfg.ReplicaSnapshotInterval,
+			Retention:        cfg.ReplicaRetention,
+		})
+		replicateCtx, stopReplicating := context.WithCancel(ctx)
+		replicating := make(chan struct{})
+		go func() {
+			defer close(replicating)
+			if err := replicator.Run(replicateCtx); err != nil {
+				log.Printf("Replication stopped: %v", err)
+			}
+		}()
+		// The server can stop before ctx is done, so stop replicating
+		// explicitly and let the last frames be shipped before the database
+		// is closed
+		defer func() {
+			stopReplicating()
+			<-replicating
+		}()
+	}
+
+	tokens, err := tokenAuthorityFromConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to setup token authority: %w", err)
+	}
+
+	return web.RunHTTPServer(ctx, cfg, db, tokens)
+}
+
+func tokenAuthorityFromConfig(cfg *config.Config) (*web.TokenAuthority, error) {
+	keys, err := web.ParseTokenKeys(cfg.JWTKeys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid jwt-keys: %w", err)
+	}
+	if len(keys) == 0 {
+		log.Printf("jwt-keys not set, API tokens will be invalidated on restart")
+		return web.NewEphemeralTokenAuthority(cfg.JWTExpiry)
+	}
+
+	signingKeyID := cfg.JWTSigningKeyID
+	if signingKeyID == "" {
+		signingKeyID = keys[0].ID
+	}
+
+	return web.NewTokenAuthority(signingKeyID, cfg.JWTExpiry, keys...)
 }
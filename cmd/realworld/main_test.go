@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/config"
+	"github.com/delaneyj/realworld-datastar/sql"
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"zombiezen.com/go/sqlite"
+)
+
+// runIn runs the command line against a database in dataFolder.
+func runIn(t *testing.T, dataFolder string, args ...string) error {
+	t.Helper()
+
+	// Flags go after the command and its action
+	return run(context.Background(), append(args, "-data-folder", dataFolder))
+}
+
+func openTestDB(t *testing.T, dataFolder string) *toolbelt.Database {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.DataFolder = dataFolder
+	db, err := sql.OpenDB(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func userByEmail(t *testing.T, db *toolbelt.Database, email string) *zz.UserModel {
+	t.Helper()
+
+	var u *zz.UserModel
+	if err := db.ReadTX(context.Background(), func(tx *sqlite.Conn) error {
+		res, err := zz.OnceUserByEmail(tx, email)
+		if err != nil || res == nil {
+			return err
+		}
+		u, err = zz.OnceReadByIDUser(tx, res.Id)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestSubcommand(t *testing.T) {
+	for name, tc := range map[string]struct {
+		args       []string
+		defaultAct string
+		wantAction string
+		wantArgs   int
+		wantErr    string
+	}{
+		"action":         {args: []string{"up", "-dry-run"}, wantAction: "up", wantArgs: 1},
+		"default":        {args: []string{"-dry-run"}, defaultAct: "status", wantAction: "status", wantArgs: 1},
+		"unknown action": {args: []string{"sideways"}, defaultAct: "status", wantErr: `unknown migrate action "sideways"`},
+		"missing action": {args: nil, wantErr: "migrate needs an action"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			action, args, err := subcommand("migrate", tc.args, tc.defaultAct, "status", "up", "down")
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if action != tc.wantAction || len(args) != tc.wantArgs {
+				t.Errorf("got %q with %v", action, args)
+			}
+		})
+	}
+}
+
+func TestRunUnknownCommand(t *testing.T) {
+	if err := run(context.Background(), []string{"fly"}); err == nil || !strings.Contains(err.Error(), `unknown command "fly"`) {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestUserCommands(t *testing.T) {
+	dataFolder := t.TempDir()
+
+	if err := runIn(t, dataFolder, "user", "create", "-username", "jake", "-email", "jake@example.com", "-password", "password1234", "-admin"); err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t, dataFolder)
+	u := userByEmail(t, db, "jake@example.com")
+	if u == nil {
+		t.Fatal("user wasn't created")
+	}
+	if u.Username != "jake" || !u.IsAdmin || u.EmailVerifiedAt.IsZero() {
+		t.Errorf("got %+v", u)
+	}
+
+	for name, args := range map[string][]string{
+		"email in use":    {"user", "create", "-username", "jane", "-email", "jake@example.com", "-password", "password1234"},
+		"username in use": {"user", "create", "-username", "jake", "-email", "jane@example.com", "-password", "password1234"},
+		"short password":  {"user", "create", "-username", "jane", "-email", "jane@example.com", "-password", "short"},
+		"no email":        {"user", "delete"},
+		"unknown user":    {"user", "delete", "-email", "nobody@example.com"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := runIn(t, dataFolder, args...); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+
+	u.Bio = "Dragon trainer"
+	if err := db.WriteTX(context.Background(), func(tx *sqlite.Conn) error {
+		return zz.OnceUpdateUser(tx, u)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runIn(t, dataFolder, "user", "reset-password", "-email", "jake@example.com", "-password", "new-password"); err != nil {
+		t.Fatal(err)
+	}
+	reset := userByEmail(t, db, "jake@example.com")
+	if string(reset.PasswordHash) == string(u.PasswordHash) {
+		t.Error("password wasn't changed")
+	}
+	if reset.SessionVersion != u.SessionVersion+1 {
+		t.Error("resetting the password didn't sign the user out everywhere")
+	}
+	// Everything else stays as it was
+	if reset.Bio != u.Bio || reset.ImageUrl != u.ImageUrl || !reset.IsAdmin || !reset.EmailVerifiedAt.Equal(u.EmailVerifiedAt) {
+		t.Errorf("got %+v after resetting the password", reset)
+	}
+
+	if err := runIn(t, dataFolder, "user", "delete", "-email", "jake@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if userByEmail(t, db, "jake@example.com") != nil {
+		t.Error("user wasn't deleted")
+	}
+}
+
+func TestSeedCommand(t *testing.T) {
+	dataFolder := t.TempDir()
+
+	if err := runIn(t, dataFolder, "seed", "-users", "3", "-articles", "5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runIn(t, dataFolder, "seed", "-users", "0"); err == nil {
+		t.Error("got no error seeding without users")
+	}
+
+	db := openTestDB(t, dataFolder)
+	if err := db.ReadTX(context.Background(), func(tx *sqlite.Conn) error {
+		users, err := zz.OnceCountUsers(tx)
+		if err != nil {
+			return err
+		}
+		if users != 3 {
+			t.Errorf("got %d users, want 3", users)
+		}
+		articles, err := zz.OnceGlobalFeedArticleCount(tx)
+		if err != nil {
+			return err
+		}
+		if articles != 5 {
+			t.Errorf("got %d articles, want 5", articles)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDatabaseCommands(t *testing.T) {
+	dataFolder := t.TempDir()
+	if err := runIn(t, dataFolder, "seed", "-users", "1", "-articles", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, action := range []string{"integrity-check", "vacuum"} {
+		if err := runIn(t, dataFolder, "db", action); err != nil {
+			t.Errorf("db %s: %v", action, err)
+		}
+	}
+}
+
+func TestResetCommand(t *testing.T) {
+	dataFolder := t.TempDir()
+	if err := runIn(t, dataFolder, "user", "create", "-username", "jake", "-email", "jake@example.com", "-password", "password1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runIn(t, dataFolder, "reset"); err == nil || !strings.Contains(err.Error(), "-yes") {
+		t.Errorf("got error %v without -yes", err)
+	}
+	if err := runIn(t, dataFolder, "reset", "-yes", "-env", "production", "-session-secret", strings.Repeat("s", 32), "-base-url", "https://example.com"); err == nil {
+		t.Error("reset a production database")
+	}
+
+	if err := runIn(t, dataFolder, "reset", "-yes"); err != nil {
+		t.Fatal(err)
+	}
+	if userByEmail(t, openTestDB(t, dataFolder), "jake@example.com") != nil {
+		t.Error("user is still there after resetting")
+	}
+}
+
+func TestResetTwoFactorCommand(t *testing.T) {
+	dataFolder := t.TempDir()
+	if err := runIn(t, dataFolder, "user", "create", "-username", "jake", "-email", "jake@example.com", "-password", "password1234"); err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t, dataFolder)
+	u := userByEmail(t, db, "jake@example.com")
+
+	// Set up as if they had confirmed an authenticator app
+	now := time.Now()
+	if err := db.WriteTX(context.Background(), func(tx *sqlite.Conn) error {
+		if err := zz.OnceCreateTotpCredential(tx, &zz.TotpCredentialModel{
+			Id:          toolbelt.NextID(),
+			UserId:      u.Id,
+			Secret:      "JBSWY3DPEHPK3PXP",
+			ConfirmedAt: now,
+			CreatedAt:   now,
+		}); err != nil {
+			return err
+		}
+		return zz.OnceCreateRecoveryCode(tx, &zz.RecoveryCodeModel{
+			Id:        toolbelt.NextID(),
+			UserId:    u.Id,
+			CodeHash:  "hash",
+			CreatedAt: now,
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runIn(t, dataFolder, "user", "reset-two-factor", "-email", "jake@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReadTX(context.Background(), func(tx *sqlite.Conn) error {
+		cred, err := zz.OnceTotpCredentialByUser(tx, u.Id)
+		if err != nil {
+			return err
+		}
+		if cred != nil {
+			t.Error("authenticator app is still set up")
+		}
+		recoveryCode, err := zz.OnceRecoveryCodeByHash(tx, zz.RecoveryCodeByHashParams{UserId: u.Id, CodeHash: "hash"})
+		if err != nil {
+			return err
+		}
+		if recoveryCode != nil {
+			t.Error("recovery code is still there")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runIn(t, dataFolder, "user", "reset-two-factor", "-email", "nobody@example.com"); err == nil || !strings.Contains(err.Error(), "user not found") {
+		t.Errorf("got error %v for an unknown user", err)
+	}
+}
+
+func TestUnlockCommand(t *testing.T) {
+	dataFolder := t.TempDir()
+	if err := runIn(t, dataFolder, "user", "create", "-username", "jake", "-email", "jake@example.com", "-password", "password1234"); err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t, dataFolder)
+
+	loginAttempts := func(t *testing.T, email string) int {
+		t.Helper()
+
+		var n int
+		if err := db.ReadTX(context.Background(), func(tx *sqlite.Conn) error {
+			res, err := zz.OnceLoginAttemptsByEmail(tx, zz.LoginAttemptsByEmailParams{
+				Email: email,
+				Since: time.Now().Add(-time.Hour),
+				Limit: 100,
+			})
+			n = len(res)
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// Locked out after failing to sign in, as has someone else
+	now := time.Now()
+	if err := db.WriteTX(context.Background(), func(tx *sqlite.Conn) error {
+		for _, email := range []string{"jake@example.com", "jake@example.com", "jane@example.com"} {
+			if err := zz.OnceCreateLoginAttempt(tx, &zz.LoginAttemptModel{
+				Id:        toolbelt.NextID(),
+				Email:     email,
+				Ip:        "127.0.0.1",
+				CreatedAt: now,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runIn(t, dataFolder, "user", "unlock", "-email", "jake@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if n := loginAttempts(t, "jake@example.com"); n != 0 {
+		t.Errorf("got %d attempts left, want none", n)
+	}
+	if n := loginAttempts(t, "jane@example.com"); n != 1 {
+		t.Errorf("got %d attempts of someone else, want 1", n)
+	}
+
+	if err := runIn(t, dataFolder, "user", "unlock", "-email", "nobody@example.com"); err == nil || !strings.Contains(err.Error(), "user not found") {
+		t.Errorf("got error %v for an unknown user", err)
+	}
+}
@@ -0,0 +1,441 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	EnvDevelopment = "development"
+	EnvProduction  = "production"
+
+	// DefaultSessionSecret is only good enough for local development, the
+	// server refuses to start with it in production.
+	DefaultSessionSecret = "conduit"
+
+	// EnvPrefix is prepended to the upper snake case flag name to get the
+	// environment variable for a setting, e.g. -http-addr is CONDUIT_HTTP_ADDR.
+	EnvPrefix = "CONDUIT_"
+)
+
+type Config struct {
+	Env        string `yaml:"env"`
+	DataFolder string `yaml:"data-folder"`
+	ClearData  bool   `yaml:"clear-data"`
+
+	HTTPAddr      string        `yaml:"http-addr"`
+	SessionSecret string        `yaml:"session-secret"`
+	SessionMaxAge time.Duration `yaml:"session-max-age"`
+	FeedPageSize  int64         `yaml:"feed-page-size"`
+
+	// BaseURL is where users reach the site, for links in emails. Outside
+	// production it defaults to the host each request came in on
+	BaseURL string `yaml:"base-url"`
+
+	// RobotsDisallow are comma separated paths robots.txt keeps crawlers out of
+	RobotsDisallow string `yaml:"robots-disallow"`
+
+	// BackupDir defaults to backups in the data folder
+	BackupDir       string        `yaml:"backup-dir"`
+	BackupInterval  time.Duration `yaml:"backup-interval"`
+	BackupRetention int           `yaml:"backup-retention"`
+
+	// UploadDir defaults to uploads in the data folder
+	UploadDir     string `yaml:"upload-dir"`
+	UploadMaxSize int64  `yaml:"upload-max-size"`
+
+	// SMTPAddr is the host:port mail is sent through, without it mail is
+	// written to MailDir, which defaults to mail in the data folder
+	SMTPAddr     string `yaml:"smtp-addr"`
+	SMTPUsername string `yaml:"smtp-username"`
+	SMTPPassword string `yaml:"smtp-password"`
+	MailFrom     string `yaml:"mail-from"`
+	MailDir      string `yaml:"mail-dir"`
+
+	PasswordResetExpiry     time.Duration `yaml:"password-reset-expiry"`
+	EmailVerificationExpiry time.Duration `yaml:"email-verification-expiry"`
+	// RequireVerifiedEmail keeps users from posting articles, comments and
+	// images until they verified their email
+	RequireVerifiedEmail bool `yaml:"require-verified-email"`
+
+	// LoginMaxFailures failed sign ins in a row lock an email out for
+	// LoginLockout, LoginIPMaxFailures the address they come from
+	LoginMaxFailures   int           `yaml:"login-max-failures"`
+	LoginIPMaxFailures int           `yaml:"login-ip-max-failures"`
+	LoginLockout       time.Duration `yaml:"login-lockout"`
+	// TrustedProxies are comma separated addresses or prefixes of reverse
+	// proxies, requests from them take the client's address from
+	// X-Forwarded-For
+	TrustedProxies string `yaml:"trusted-proxies"`
+
+	// ReplicaDir enables continuous WAL replication into it when set
+	ReplicaDir              string        `yaml:"replica-dir"`
+	ReplicaInterval         time.Duration `yaml:"replica-interval"`
+	ReplicaSnapshotInterval time.Duration `yaml:"replica-snapshot-interval"`
+	ReplicaRetention        int           `yaml:"replica-retention"`
+
+	// JWTKeys are comma separated kid:secret pairs
+	JWTKeys         string        `yaml:"jwt-keys"`
+	JWTSigningKeyID string        `yaml:"jwt-signing-key-id"`
+	JWTExpiry       time.Duration `yaml:"jwt-expiry"`
+
+	// OIDCProviders can only be set in the config file
+	OIDCProviders []OIDCProvider `yaml:"oidc-providers"`
+}
+
+// OIDCProvider is an OpenID Connect identity provider users can sign in
+// with. Its redirect URL is /auth/oidc/<id>/callback on the site.
+type OIDCProvider struct {
+	ID           string   `yaml:"id"`
+	Name         string   `yaml:"name"`
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client-id"`
+	ClientSecret string   `yaml:"client-secret"`
+	Scopes       []string `yaml:"scopes"`
+
+	// LinkByEmail signs users in to the existing account with the email the
+	// provider verified for them, only for providers trusted to verify it
+	LinkByEmail bool `yaml:"link-by-email"`
+}
+
+func Default() *Config {
+	return &Config{
+		Env:             EnvDevelopment,
+		DataFolder:      "data",
+		HTTPAddr:        ":8080",
+		SessionSecret:   DefaultSessionSecret,
+		SessionMaxAge:   24 * time.Hour,
+		FeedPageSize:    3,
+		RobotsDisallow:  "/settings,/auth,/articles/new,/articles/*/edit,/articles/import,/admin,/api",
+		BackupInterval:  24 * time.Hour,
+		BackupRetention: 7,
+		UploadMaxSize:   10 << 20,
+
+		MailFrom:                "Conduit <conduit@localhost>",
+		PasswordResetExpiry:     time.Hour,
+		EmailVerificationExpiry: 48 * time.Hour,
+
+		LoginMaxFailures:   5,
+		LoginIPMaxFailures: 20,
+		LoginLockout:       15 * time.Minute,
+
+		ReplicaInterval:         time.Second,
+		ReplicaSnapshotInterval: 24 * time.Hour,
+		ReplicaRetention:        2,
+
+		JWTExpiry: 72 * time.Hour,
+	}
+}
+
+func (c *Config) IsProduction() bool {
+	return c.Env == EnvProduction
+}
+
+func (c *Config) BackupFolder() string {
+	if c.BackupDir != "" {
+		return c.BackupDir
+	}
+	return filepath.Join(c.DataFolder, "backups")
+}
+
+func (c *Config) UploadFolder() string {
+	if c.UploadDir != "" {
+		return c.UploadDir
+	}
+	return filepath.Join(c.DataFolder, "uploads")
+}
+
+func (c *Config) MailFolder() string {
+	if c.MailDir != "" {
+		return c.MailDir
+	}
+	return filepath.Join(c.DataFolder, "mail")
+}
+
+func (c *Config) RobotsDisallowPaths() []string {
+	var paths []string
+	for _, path := range strings.Split(c.RobotsDisallow, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// TrustedProxyPrefixes parses TrustedProxies, a single address being a
+// prefix of its full length.
+func (c *Config) TrustedProxyPrefixes() ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, proxy := range strings.Split(c.TrustedProxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy == "" {
+			continue
+		}
+		if !strings.Contains(proxy, "/") {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("trusted-proxies must be addresses or prefixes, got %q", proxy)
+			}
+			proxy = netip.PrefixFrom(addr, addr.BitLen()).String()
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted-proxies must be addresses or prefixes, got %q", proxy)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Load builds the config from, lowest to highest precedence, the defaults, the
+// YAML file named by -config or CONDUIT_CONFIG, CONDUIT_* environment
+// variables and finally command line flags. The settings are registered on fs
+// next to any flags the caller already defined, args are parsed with it and
+// positional arguments are left in fs.Args().
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg := Default()
+
+	// Flags the caller defined aren't settings
+	callerFlags := map[string]struct{}{}
+	fs.VisitAll(func(f *flag.Flag) {
+		callerFlags[f.Name] = struct{}{}
+	})
+
+	configPath := fs.String("config", os.Getenv(EnvPrefix+"CONFIG"), "path to a YAML config file")
+	fs.StringVar(&cfg.Env, "env", cfg.Env, "environment, development or production")
+	fs.StringVar(&cfg.DataFolder, "data-folder", cfg.DataFolder, "folder for the database and other data")
+	fs.BoolVar(&cfg.ClearData, "clear-data", cfg.ClearData, "delete the database on startup")
+	fs.StringVar(&cfg.HTTPAddr, "http-addr", cfg.HTTPAddr, "address to listen on")
+	fs.StringVar(&cfg.BaseURL, "base-url", cfg.BaseURL, "URL users reach the site at, for links in emails, required in production")
+	fs.StringVar(&cfg.SessionSecret, "session-secret", cfg.SessionSecret, "secret used to sign session cookies")
+	fs.DurationVar(&cfg.SessionMaxAge, "session-max-age", cfg.SessionMaxAge, "how long a session cookie is valid")
+	fs.Int64Var(&cfg.FeedPageSize, "feed-page-size", cfg.FeedPageSize, "articles per page in feeds")
+	fs.StringVar(&cfg.RobotsDisallow, "robots-disallow", cfg.RobotsDisallow, "comma separated paths robots.txt disallows, empty allows everything")
+	fs.StringVar(&cfg.BackupDir, "backup-dir", cfg.BackupDir, "folder for database backups, defaults to backups in the data folder")
+	fs.DurationVar(&cfg.BackupInterval, "backup-interval", cfg.BackupInterval, "how often the server backs up the database, 0 disables it")
+	fs.IntVar(&cfg.BackupRetention, "backup-retention", cfg.BackupRetention, "number of backups to keep")
+	fs.StringVar(&cfg.UploadDir, "upload-dir", cfg.UploadDir, "folder for uploaded images, defaults to uploads in the data folder")
+	fs.Int64Var(&cfg.UploadMaxSize, "upload-max-size", cfg.UploadMaxSize, "largest image upload accepted, in bytes")
+	fs.StringVar(&cfg.SMTPAddr, "smtp-addr", cfg.SMTPAddr, "host:port of the SMTP server mail is sent through, empty writes mail to mail-dir")
+	fs.StringVar(&cfg.SMTPUsername, "smtp-username", cfg.SMTPUsername, "SMTP username, empty sends without authenticating")
+	fs.StringVar(&cfg.SMTPPassword, "smtp-password", cfg.SMTPPassword, "SMTP password")
+	fs.StringVar(&cfg.MailFrom, "mail-from", cfg.MailFrom, "address mail is sent from")
+	fs.StringVar(&cfg.MailDir, "mail-dir", cfg.MailDir, "maildir mail is written to without an SMTP server, defaults to mail in the data folder")
+	fs.DurationVar(&cfg.PasswordResetExpiry, "password-reset-expiry", cfg.PasswordResetExpiry, "how long a password reset link can be used")
+	fs.DurationVar(&cfg.EmailVerificationExpiry, "email-verification-expiry", cfg.EmailVerificationExpiry, "how long an email verification link can be used")
+	fs.BoolVar(&cfg.RequireVerifiedEmail, "require-verified-email", cfg.RequireVerifiedEmail, "only let users with a verified email post articles, comments and images")
+	fs.IntVar(&cfg.LoginMaxFailures, "login-max-failures", cfg.LoginMaxFailures, "failed sign ins in a row that lock an email out")
+	fs.IntVar(&cfg.LoginIPMaxFailures, "login-ip-max-failures", cfg.LoginIPMaxFailures, "failed sign ins in a row that lock an address out")
+	fs.DurationVar(&cfg.LoginLockout, "login-lockout", cfg.LoginLockout, "how long a lockout after failed sign ins lasts")
+	fs.StringVar(&cfg.TrustedProxies, "trusted-proxies", cfg.TrustedProxies, "comma separated addresses or prefixes of reverse proxies whose X-Forwarded-For is trusted")
+	fs.StringVar(&cfg.ReplicaDir, "replica-dir", cfg.ReplicaDir, "folder to continuously replicate the database into, empty disables it")
+	fs.DurationVar(&cfg.ReplicaInterval, "replica-interval", cfg.ReplicaInterval, "how often new WAL frames are shipped to the replica")
+	fs.DurationVar(&cfg.ReplicaSnapshotInterval, "replica-snapshot-interval", cfg.ReplicaSnapshotInterval, "how often the replica starts over from a fresh snapshot")
+	fs.IntVar(&cfg.ReplicaRetention, "replica-retention", cfg.ReplicaRetention, "number of replica generations to keep")
+	fs.StringVar(&cfg.JWTKeys, "jwt-keys", cfg.JWTKeys, "comma separated kid:secret pairs for API tokens")
+	fs.StringVar(&cfg.JWTSigningKeyID, "jwt-signing-key-id", cfg.JWTSigningKeyID, "key used to sign new API tokens, defaults to the first key")
+	fs.DurationVar(&cfg.JWTExpiry, "jwt-expiry", cfg.JWTExpiry, "API token lifetime")
+
+	settings := map[string]struct{}{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := callerFlags[f.Name]; !ok && f.Name != "config" {
+			settings[f.Name] = struct{}{}
+		}
+	})
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// Flags have been written into cfg already, remember the ones that were
+	// given so they can be applied again on top of the file and environment.
+	explicit := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		if _, ok := settings[f.Name]; ok {
+			explicit[f.Name] = f.Value.String()
+		}
+	})
+
+	*cfg = *Default()
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := settings[f.Name]; !ok {
+			return
+		}
+		if value, ok := explicit[f.Name]; ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("invalid -%s: %w", f.Name, err))
+			}
+			return
+		}
+		envName := EnvName(f.Name)
+		if value, ok := os.LookupEnv(envName); ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %w", envName, err))
+			}
+		}
+	})
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// EnvName is the environment variable for a flag name.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Config) Validate() error {
+	var errs []error
+
+	switch c.Env {
+	case EnvDevelopment, EnvProduction:
+	default:
+		errs = append(errs, fmt.Errorf("env must be %q or %q, got %q", EnvDevelopment, EnvProduction, c.Env))
+	}
+	if c.DataFolder == "" {
+		errs = append(errs, errors.New("data-folder is required"))
+	}
+	if c.HTTPAddr == "" {
+		errs = append(errs, errors.New("http-addr is required"))
+	}
+	if c.SessionSecret == "" {
+		errs = append(errs, errors.New("session-secret is required"))
+	}
+	if c.IsProduction() {
+		if c.SessionSecret == DefaultSessionSecret {
+			errs = append(errs, errors.New("session-secret must be changed from the default in production"))
+		} else if len(c.SessionSecret) < 32 {
+			errs = append(errs, errors.New("session-secret must be at least 32 bytes in production"))
+		}
+		if c.BaseURL == "" {
+			errs = append(errs, errors.New("base-url is required in production"))
+		}
+		if c.ClearData {
+			errs = append(errs, errors.New("clear-data is not allowed in production"))
+		}
+	}
+	if c.SessionMaxAge <= 0 {
+		errs = append(errs, errors.New("session-max-age must be positive"))
+	}
+	if c.FeedPageSize < 1 || c.FeedPageSize > 100 {
+		errs = append(errs, fmt.Errorf("feed-page-size must be between 1 and 100, got %d", c.FeedPageSize))
+	}
+	if c.BackupInterval < 0 {
+		errs = append(errs, errors.New("backup-interval can't be negative"))
+	}
+	if c.BackupRetention < 1 {
+		errs = append(errs, errors.New("backup-retention must be at least 1"))
+	}
+	if c.BaseURL != "" {
+		if u, err := url.Parse(c.BaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("base-url must be an http or https URL, got %q", c.BaseURL))
+		}
+	}
+	if _, err := mail.ParseAddress(c.MailFrom); err != nil {
+		errs = append(errs, fmt.Errorf("mail-from must be an email address, got %q", c.MailFrom))
+	}
+	if c.PasswordResetExpiry <= 0 {
+		errs = append(errs, errors.New("password-reset-expiry must be positive"))
+	}
+	if c.EmailVerificationExpiry <= 0 {
+		errs = append(errs, errors.New("email-verification-expiry must be positive"))
+	}
+	if c.LoginMaxFailures < 1 {
+		errs = append(errs, errors.New("login-max-failures must be at least 1"))
+	}
+	if c.LoginIPMaxFailures < 1 {
+		errs = append(errs, errors.New("login-ip-max-failures must be at least 1"))
+	}
+	if c.LoginLockout <= 0 {
+		errs = append(errs, errors.New("login-lockout must be positive"))
+	}
+	if _, err := c.TrustedProxyPrefixes(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.UploadMaxSize <= 0 {
+		errs = append(errs, errors.New("upload-max-size must be positive"))
+	}
+	if c.ReplicaInterval <= 0 {
+		errs = append(errs, errors.New("replica-interval must be positive"))
+	}
+	if c.ReplicaSnapshotInterval <= 0 {
+		errs = append(errs, errors.New("replica-snapshot-interval must be positive"))
+	}
+	if c.ReplicaRetention < 1 {
+		errs = append(errs, errors.New("replica-retention must be at least 1"))
+	}
+	if c.JWTExpiry <= 0 {
+		errs = append(errs, errors.New("jwt-expiry must be positive"))
+	}
+	providerIDs := map[string]struct{}{}
+	for i, p := range c.OIDCProviders {
+		if !validOIDCProviderID(p.ID) {
+			errs = append(errs, fmt.Errorf("oidc-providers[%d] id must be lower case letters, digits and dashes, got %q", i, p.ID))
+		} else if _, ok := providerIDs[p.ID]; ok {
+			errs = append(errs, fmt.Errorf("oidc-providers[%d] id %q is used twice", i, p.ID))
+		}
+		providerIDs[p.ID] = struct{}{}
+		if p.Name == "" {
+			errs = append(errs, fmt.Errorf("oidc-providers[%d] name is required", i))
+		}
+		if u, err := url.Parse(p.Issuer); err != nil || u.Host == "" || (u.Scheme != "https" && (u.Scheme != "http" || c.IsProduction())) {
+			errs = append(errs, fmt.Errorf("oidc-providers[%d] issuer must be an https URL, got %q", i, p.Issuer))
+		}
+		if p.ClientID == "" {
+			errs = append(errs, fmt.Errorf("oidc-providers[%d] client-id is required", i))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	return nil
+}
+
+func validOIDCProviderID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
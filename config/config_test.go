@@ -0,0 +1,272 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "conduit.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func load(t *testing.T, args ...string) (*Config, error) {
+	t.Helper()
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(new(strings.Builder))
+	return Load(fs, args)
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := load(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, Default()) {
+		t.Errorf("got %+v, want the defaults", cfg)
+	}
+	if cfg.BackupFolder() != filepath.Join("data", "backups") {
+		t.Errorf("got backup folder %q", cfg.BackupFolder())
+	}
+	if cfg.UploadFolder() != filepath.Join("data", "uploads") {
+		t.Errorf("got upload folder %q", cfg.UploadFolder())
+	}
+	if cfg.MailFolder() != filepath.Join("data", "mail") {
+		t.Errorf("got mail folder %q", cfg.MailFolder())
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+http-addr: ":1000"
+feed-page-size: 10
+session-max-age: 2h
+robots-disallow: /file
+`)
+	t.Setenv("CONDUIT_CONFIG", path)
+	t.Setenv("CONDUIT_FEED_PAGE_SIZE", "20")
+	t.Setenv("CONDUIT_ROBOTS_DISALLOW", "/env")
+
+	cfg, err := load(t, "-robots-disallow", "/flag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Defaults, then the file, then the environment, then flags
+	if cfg.JWTExpiry != Default().JWTExpiry {
+		t.Errorf("got jwt-expiry %s from the default", cfg.JWTExpiry)
+	}
+	if cfg.HTTPAddr != ":1000" || cfg.SessionMaxAge != 2*time.Hour {
+		t.Errorf("got http-addr %q and session-max-age %s from the file", cfg.HTTPAddr, cfg.SessionMaxAge)
+	}
+	if cfg.FeedPageSize != 20 {
+		t.Errorf("got feed-page-size %d from the environment", cfg.FeedPageSize)
+	}
+	if cfg.RobotsDisallow != "/flag" {
+		t.Errorf("got robots-disallow %q from the flag", cfg.RobotsDisallow)
+	}
+}
+
+func TestLoadConfigFlag(t *testing.T) {
+	t.Setenv("CONDUIT_CONFIG", writeConfigFile(t, `http-addr: ":1000"`))
+
+	cfg, err := load(t, "-config", writeConfigFile(t, `http-addr: ":2000"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.HTTPAddr != ":2000" {
+		t.Errorf("got http-addr %q, want the one from the -config file", cfg.HTTPAddr)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		env  map[string]string
+		file string
+		args []string
+		want string
+	}{
+		"unknown file field": {
+			file: "nope: 1",
+			want: "field nope not found",
+		},
+		"missing file": {
+			args: []string{"-config", "/does/not/exist.yaml"},
+			want: "failed to open config file",
+		},
+		"bad env value": {
+			env:  map[string]string{"CONDUIT_FEED_PAGE_SIZE": "lots"},
+			want: "invalid CONDUIT_FEED_PAGE_SIZE",
+		},
+		"bad flag value": {
+			args: []string{"-session-max-age", "forever"},
+			want: "invalid value",
+		},
+		"invalid setting": {
+			args: []string{"-feed-page-size", "0"},
+			want: "feed-page-size must be between 1 and 100",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			args := tc.args
+			if tc.file != "" {
+				args = append(args, "-config", writeConfigFile(t, tc.file))
+			}
+			_, err := load(t, args...)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got error %v, want one containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadOIDCProviders(t *testing.T) {
+	cfg, err := load(t, "-config", writeConfigFile(t, `
+oidc-providers:
+  - id: example
+    name: Example
+    issuer: https://accounts.example.com
+    client-id: conduit
+    scopes: [profile, email]
+    link-by-email: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.OIDCProviders) != 1 {
+		t.Fatalf("got %d providers, want 1", len(cfg.OIDCProviders))
+	}
+	p := cfg.OIDCProviders[0]
+	if p.ID != "example" || p.Issuer != "https://accounts.example.com" || !p.LinkByEmail || len(p.Scopes) != 2 {
+		t.Errorf("got %+v", p)
+	}
+}
+
+func TestLoadKeepsCallerFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(new(strings.Builder))
+	dryRun := fs.Bool("dry-run", false, "")
+
+	// A caller's flag has no environment variable
+	t.Setenv("CONDUIT_DRY_RUN", "true")
+	if _, err := Load(fs, []string{"-http-addr", ":3000", "positional"}); err != nil {
+		t.Fatal(err)
+	}
+	if *dryRun {
+		t.Error("caller flag was set from the environment")
+	}
+	if args := fs.Args(); len(args) != 1 || args[0] != "positional" {
+		t.Errorf("got args %v", args)
+	}
+}
+
+func TestValidateProduction(t *testing.T) {
+	cfg := Default()
+	cfg.Env = EnvProduction
+	cfg.ClearData = true
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	for _, want := range []string{
+		"session-secret must be changed",
+		"base-url is required",
+		"clear-data is not allowed",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q doesn't contain %q", err, want)
+		}
+	}
+
+	cfg.ClearData = false
+	cfg.SessionSecret = strings.Repeat("s", 32)
+	cfg.BaseURL = "https://conduit.example.com"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("got error %v", err)
+	}
+
+	// Plain http issuers are only for trying providers out locally
+	cfg.OIDCProviders = []OIDCProvider{{ID: "dev", Name: "Dev", Issuer: "http://localhost:9999", ClientID: "conduit"}}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "issuer must be an https URL") {
+		t.Errorf("got error %v for an http issuer in production", err)
+	}
+	cfg.Env = EnvDevelopment
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("got error %v for an http issuer in development", err)
+	}
+}
+
+func TestValidateOIDCProviders(t *testing.T) {
+	cfg := Default()
+	cfg.OIDCProviders = []OIDCProvider{
+		{ID: "Example", Name: "Example", Issuer: "https://a.example", ClientID: "c"},
+		{ID: "dup", Name: "Dup", Issuer: "https://b.example", ClientID: "c"},
+		{ID: "dup", Issuer: "https://c.example"},
+	}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("got no error")
+	}
+	for _, want := range []string{
+		`oidc-providers[0] id must be lower case`,
+		`oidc-providers[2] id "dup" is used twice`,
+		`oidc-providers[2] name is required`,
+		`oidc-providers[2] client-id is required`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q doesn't contain %q", err, want)
+		}
+	}
+}
+
+func TestRobotsDisallowPaths(t *testing.T) {
+	cfg := &Config{RobotsDisallow: " /a, ,/b/* ,"}
+	got := cfg.RobotsDisallowPaths()
+	if len(got) != 2 || got[0] != "/a" || got[1] != "/b/*" {
+		t.Errorf("got %q", got)
+	}
+	if got := (&Config{}).RobotsDisallowPaths(); got != nil {
+		t.Errorf("got %q for nothing disallowed", got)
+	}
+}
+
+func TestTrustedProxyPrefixes(t *testing.T) {
+	cfg := Default()
+	cfg.TrustedProxies = " 10.0.0.1, ,192.168.1.7/16,::1 "
+	got, err := cfg.TrustedProxyPrefixes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0].String() != "10.0.0.1/32" || got[1].String() != "192.168.0.0/16" || got[2].String() != "::1/128" {
+		t.Errorf("got %v", got)
+	}
+
+	cfg.TrustedProxies = "10.0.0.1,proxy.example.com"
+	if _, err := cfg.TrustedProxyPrefixes(); err == nil {
+		t.Error("got no error for a host name")
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "trusted-proxies") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	if got := EnvName("login-ip-max-failures"); got != "CONDUIT_LOGIN_IP_MAX_FAILURES" {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,230 @@
+package sql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/delaneyj/toolbelt"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const (
+	backupPrefix     = "conduit-"
+	backupSuffix     = ".sqlite"
+	backupTimeLayout = "20060102T150405Z"
+)
+
+type BackupFile struct {
+	Path      string
+	CreatedAt time.Time
+	Size      int64
+}
+
+// BackupTo writes a consistent copy of the live database to filename using
+// SQLite's online backup API, so writers are only blocked while pages are
+// copied. The copy is written next to filename and renamed into place.
+func BackupTo(ctx context.Context, db *toolbelt.Database, filename string) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("failed to create backup folder: %w", err)
+	}
+
+	tmpFilename := filename + ".tmp"
+	os.Remove(tmpFilename)
+	defer os.Remove(tmpFilename)
+
+	if err := db.ReadTX(ctx, func(src *sqlite.Conn) error {
+		dst, err := sqlite.OpenConn(tmpFilename, sqlite.OpenReadWrite|sqlite.OpenCreate)
+		if err != nil {
+			return fmt.Errorf("failed to create backup file: %w", err)
+		}
+		defer dst.Close()
+
+		if err := copyDatabase(dst, src); err != nil {
+			return err
+		}
+
+		// The copy inherits WAL mode, switch it back so the backup is a
+		// single self-contained file
+		if err := sqlitex.ExecuteTransient(dst, "PRAGMA journal_mode = DELETE;", nil); err != nil {
+			return fmt.Errorf("failed to set backup journal mode: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to backup database: %w", err)
+	}
+
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return fmt.Errorf("failed to move backup into place: %w", err)
+	}
+	return nil
+}
+
+// Backup writes a timestamped backup into dir and returns its path.
+func Backup(ctx context.Context, db *toolbelt.Database, dir string) (string, error) {
+	filename := filepath.Join(dir, backupPrefix+time.Now().UTC().Format(backupTimeLayout)+backupSuffix)
+	if err := BackupTo(ctx, db, filename); err != nil {
+		return "", err
+	}
+	return filename, nil
+}
+
+// ListBackups returns the backups in dir, newest first.
+func ListBackups(dir string) ([]*BackupFile, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup folder: %w", err)
+	}
+
+	var backups []*BackupFile
+	for _, entry := range entries {
+		name := entry.Name()
+		raw, ok := strings.CutPrefix(name, backupPrefix)
+		if !ok {
+			continue
+		}
+		raw, ok = strings.CutSuffix(raw, backupSuffix)
+		if !ok {
+			continue
+		}
+		createdAt, err := time.Parse(backupTimeLayout, raw)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat backup: %w", err)
+		}
+		backups = append(backups, &BackupFile{
+			Path:      filepath.Join(dir, name),
+			CreatedAt: createdAt,
+			Size:      info.Size(),
+		})
+	}
+	slices.SortFunc(backups, func(a, b *BackupFile) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return backups, nil
+}
+
+// PruneBackups deletes all but the newest keep backups in dir.
+func PruneBackups(dir string, keep int) error {
+	backups, err := ListBackups(dir)
+	if err != nil {
+		return err
+	}
+	for _, backup := range backups[min(keep, len(backups)):] {
+		if err := os.Remove(backup.Path); err != nil {
+			return fmt.Errorf("failed to remove old backup: %w", err)
+		}
+	}
+	return nil
+}
+
+// RunPeriodicBackups backs up the database into dir every interval until ctx
+// is done, keeping the newest keep backups. Failures are logged and retried
+// on the next tick.
+func RunPeriodicBackups(ctx context.Context, db *toolbelt.Database, dir string, interval time.Duration, keep int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			filename, err := Backup(ctx, db, dir)
+			if err != nil {
+				log.Printf("Backup failed: %v", err)
+				continue
+			}
+			log.Printf("Backed up database to %s", filename)
+
+			if err := PruneBackups(dir, keep); err != nil {
+				log.Printf("Failed to prune backups: %v", err)
+			}
+		}
+	}
+}
+
+// VerifyBackup checks that filename is an intact database this binary knows
+// how to run.
+func VerifyBackup(filename string) error {
+	conn, err := sqlite.OpenConn(filename, sqlite.OpenReadOnly)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer conn.Close()
+
+	var problems []string
+	if err := sqlitex.ExecuteTransient(conn, "PRAGMA integrity_check;", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			if msg := stmt.ColumnText(0); msg != "ok" {
+				problems = append(problems, msg)
+			}
+			return nil
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to check backup integrity: %w", err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("backup is corrupt: %s", strings.Join(problems, "; "))
+	}
+
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return err
+	}
+	applied, _, err := readAppliedMigrations(conn, migrations)
+	if err != nil {
+		return err
+	}
+	if err := checkMigrationStatuses(migrationStatuses(migrations, applied)); err != nil {
+		return fmt.Errorf("backup can't be restored: %w", err)
+	}
+	return nil
+}
+
+// Restore replaces the contents of the live database with filename, which
+// should have been checked with VerifyBackup. It goes through the backup API
+// rather than swapping files so open connections see the restored data
+// instead of a deleted file.
+func Restore(ctx context.Context, db *toolbelt.Database, filename string) error {
+	return db.WriteWithoutTx(ctx, func(dst *sqlite.Conn) error {
+		src, err := sqlite.OpenConn(filename, sqlite.OpenReadOnly)
+		if err != nil {
+			return fmt.Errorf("failed to open backup: %w", err)
+		}
+		defer src.Close()
+
+		if err := copyDatabase(dst, src); err != nil {
+			return fmt.Errorf("failed to restore database: %w", err)
+		}
+		return nil
+	})
+}
+
+func copyDatabase(dst, src *sqlite.Conn) error {
+	backup, err := sqlite.NewBackup(dst, "main", src, "main")
+	if err != nil {
+		return fmt.Errorf("failed to start backup: %w", err)
+	}
+	if _, err := backup.Step(-1); err != nil {
+		backup.Close()
+		return fmt.Errorf("failed to copy pages: %w", err)
+	}
+	if err := backup.Close(); err != nil {
+		return fmt.Errorf("failed to finish backup: %w", err)
+	}
+	return nil
+}
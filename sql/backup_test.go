@@ -0,0 +1,149 @@
+package sql
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/delaneyj/toolbelt"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func newTestDB(t *testing.T) *toolbelt.Database {
+	t.Helper()
+
+	db, err := OpenDB(context.Background(), newTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func noteBodies(t *testing.T, db *toolbelt.Database) []string {
+	t.Helper()
+
+	var bodies []string
+	if err := db.ReadTX(context.Background(), func(tx *sqlite.Conn) error {
+		return sqlitex.Execute(tx, "SELECT body FROM notes ORDER BY rowid", &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				bodies = append(bodies, stmt.ColumnText(0))
+				return nil
+			},
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return bodies
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	execScript(t, db, `CREATE TABLE notes(body TEXT); INSERT INTO notes(body) VALUES ('before');`)
+
+	filename := filepath.Join(t.TempDir(), "backups", "conduit.sqlite")
+	if err := BackupTo(ctx, db, filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBackup(filename); err != nil {
+		t.Fatalf("backup doesn't verify: %v", err)
+	}
+	// A single self-contained file, nothing left behind
+	for _, suffix := range []string{"-wal", "-shm", ".tmp"} {
+		if _, err := os.Stat(filename + suffix); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s was left next to the backup", filepath.Base(filename+suffix))
+		}
+	}
+
+	execScript(t, db, `INSERT INTO notes(body) VALUES ('after');`)
+	if err := Restore(ctx, db, filename); err != nil {
+		t.Fatal(err)
+	}
+	if got := noteBodies(t, db); len(got) != 1 || got[0] != "before" {
+		t.Errorf("got %q after restoring, want only the backed up note", got)
+	}
+}
+
+func TestVerifyBackupRejects(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	garbage := filepath.Join(dir, "garbage.sqlite")
+	if err := os.WriteFile(garbage, []byte("definitely not a database, just some text padding it out"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBackup(garbage); err == nil {
+		t.Error("garbage file verified")
+	}
+	if err := VerifyBackup(filepath.Join(dir, "missing.sqlite")); err == nil {
+		t.Error("missing file verified")
+	}
+
+	// A backup taken by a newer release that added migrations
+	newer := filepath.Join(dir, "newer.sqlite")
+	db := newTestDB(t)
+	execScript(t, db, `INSERT INTO schema_migrations(version, name, checksum, applied_at) VALUES (9999, '9999.sql', 'x', 2460000.5);`)
+	if err := BackupTo(ctx, db, newer); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyBackup(newer); !errors.Is(err, ErrSchemaNewer) {
+		t.Errorf("got error %v, want %v", err, ErrSchemaNewer)
+	}
+}
+
+func TestListAndPruneBackups(t *testing.T) {
+	dir := t.TempDir()
+	if backups, err := ListBackups(filepath.Join(dir, "missing")); err != nil || backups != nil {
+		t.Errorf("got %v and error %v for a missing folder", backups, err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, name := range []string{
+		backupPrefix + now.Add(-2*time.Hour).Format(backupTimeLayout) + backupSuffix,
+		backupPrefix + now.Format(backupTimeLayout) + backupSuffix,
+		backupPrefix + now.Add(-time.Hour).Format(backupTimeLayout) + backupSuffix,
+		// Not backups
+		backupPrefix + "yesterday" + backupSuffix,
+		backupPrefix + now.Format(backupTimeLayout) + ".tmp",
+		"notes.txt",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, err := ListBackups(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 3 {
+		t.Fatalf("got %d backups, want 3", len(backups))
+	}
+	for i, backup := range backups {
+		if want := now.Add(-time.Duration(i) * time.Hour); !backup.CreatedAt.Equal(want) {
+			t.Errorf("backup %d was created at %s, want %s", i, backup.CreatedAt, want)
+		}
+	}
+
+	if err := PruneBackups(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(backups[2].Path); !errors.Is(err, os.ErrNotExist) {
+		t.Error("oldest backup wasn't pruned")
+	}
+	left, err := ListBackups(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 2 || left[0].Path != backups[0].Path {
+		t.Errorf("got %d backups left, want the newest 2", len(left))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Error("pruning removed a file that isn't a backup")
+	}
+}
@@ -0,0 +1,37 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/delaneyj/toolbelt"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func Vacuum(ctx context.Context, db *toolbelt.Database) error {
+	return db.WriteWithoutTx(ctx, func(conn *sqlite.Conn) error {
+		if err := sqlitex.ExecuteTransient(conn, "VACUUM;", nil); err != nil {
+			return fmt.Errorf("failed to vacuum database: %w", err)
+		}
+		return nil
+	})
+}
+
+// IntegrityCheck returns the problems SQLite finds with the database, none
+// means it is healthy.
+func IntegrityCheck(ctx context.Context, db *toolbelt.Database) (problems []string, err error) {
+	if err := db.ReadTX(ctx, func(tx *sqlite.Conn) error {
+		return sqlitex.ExecuteTransient(tx, "PRAGMA integrity_check;", &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				if msg := stmt.ColumnText(0); msg != "ok" {
+					problems = append(problems, msg)
+				}
+				return nil
+			},
+		})
+	}); err != nil {
+		return nil, fmt.Errorf("failed to check database integrity: %w", err)
+	}
+	return problems, nil
+}
@@ -0,0 +1,436 @@
+package sql
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/delaneyj/toolbelt"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+var (
+	ErrSchemaNewer       = errors.New("database schema is newer than this binary")
+	ErrMigrationModified = errors.New("migration was changed after it was applied")
+)
+
+// Migration is a numbered NNNN.sql file in migrations/ with an optional
+// NNNN.down.sql that undoes it.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+func (m *Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+var migrationFilenameRe = regexp.MustCompile(`^(\d+)(\.down)?\.sql$`)
+
+// LoadMigrations reads the embedded migrations, which have to be numbered
+// from 1 without gaps.
+func LoadMigrations() ([]*Migration, error) {
+	migrationsDir := "migrations"
+	entries, err := migrationsFS.ReadDir(migrationsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations directory: %w", err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := migrationFilenameRe.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", entry.Name())
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version %s: %w", entry.Name(), err)
+		}
+
+		content, err := migrationsFS.ReadFile(path.Join(migrationsDir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration file: %w", err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version}
+			byVersion[version] = m
+		}
+		if match[2] == "" {
+			m.Name = entry.Name()
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, m)
+	}
+	slices.SortFunc(migrations, func(a, b *Migration) int {
+		return a.Version - b.Version
+	})
+	for i, m := range migrations {
+		if m.Version != i+1 || m.Name == "" {
+			return nil, fmt.Errorf("missing migration %04d.sql", i+1)
+		}
+	}
+	return migrations, nil
+}
+
+type AppliedMigration struct {
+	Version   int
+	Name      string
+	Checksum  string
+	AppliedAt time.Time
+}
+
+type MigrationState string
+
+const (
+	MigrationPending  MigrationState = "pending"
+	MigrationApplied  MigrationState = "applied"
+	MigrationModified MigrationState = "modified"
+	MigrationUnknown  MigrationState = "unknown"
+)
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	State     MigrationState
+	AppliedAt time.Time
+}
+
+const createSchemaMigrations = `
+	CREATE TABLE IF NOT EXISTS schema_migrations(
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		checksum TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	)
+`
+
+// readAppliedMigrations returns what has been applied, oldest first. Databases
+// migrated before schema_migrations existed only have a user_version, their
+// migrations are assumed to match the embedded ones.
+func readAppliedMigrations(conn *sqlite.Conn, migrations []*Migration) (applied []*AppliedMigration, isLegacy bool, err error) {
+	hasTable := false
+	if err := sqlitex.Execute(conn, `
+		SELECT
+			count(*)
+		FROM
+			sqlite_master
+		WHERE
+			type = 'table' AND name = 'schema_migrations'
+	`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			hasTable = stmt.ColumnInt(0) > 0
+			return nil
+		},
+	}); err != nil {
+		return nil, false, fmt.Errorf("failed to check for schema_migrations: %w", err)
+	}
+
+	if !hasTable {
+		userVersion := 0
+		if err := sqlitex.ExecuteTransient(conn, "PRAGMA user_version;", &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				userVersion = stmt.ColumnInt(0)
+				return nil
+			},
+		}); err != nil {
+			return nil, false, fmt.Errorf("failed to read schema version: %w", err)
+		}
+		if userVersion > len(migrations) {
+			return nil, false, fmt.Errorf("%w: at version %d, only know %d", ErrSchemaNewer, userVersion, len(migrations))
+		}
+		for _, m := range migrations[:userVersion] {
+			applied = append(applied, &AppliedMigration{
+				Version:  m.Version,
+				Name:     m.Name,
+				Checksum: m.Checksum(),
+			})
+		}
+		return applied, true, nil
+	}
+
+	if err := sqlitex.Execute(conn, `
+		SELECT
+			version,
+			name,
+			checksum,
+			applied_at
+		FROM
+			schema_migrations
+		ORDER BY
+			version
+	`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			applied = append(applied, &AppliedMigration{
+				Version:   stmt.ColumnInt(0),
+				Name:      stmt.ColumnText(1),
+				Checksum:  stmt.ColumnText(2),
+				AppliedAt: toolbelt.JulianDayToTime(stmt.ColumnFloat(3)),
+			})
+			return nil
+		},
+	}); err != nil {
+		return nil, false, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	return applied, false, nil
+}
+
+func migrationStatuses(migrations []*Migration, applied []*AppliedMigration) []*MigrationStatus {
+	appliedByVersion := map[int]*AppliedMigration{}
+	for _, a := range applied {
+		appliedByVersion[a.Version] = a
+	}
+
+	var statuses []*MigrationStatus
+	for _, m := range migrations {
+		status := &MigrationStatus{
+			Version: m.Version,
+			Name:    m.Name,
+			State:   MigrationPending,
+		}
+		if a, ok := appliedByVersion[m.Version]; ok {
+			status.AppliedAt = a.AppliedAt
+			status.State = MigrationApplied
+			if a.Checksum != m.Checksum() {
+				status.State = MigrationModified
+			}
+			delete(appliedByVersion, m.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, a := range applied {
+		if _, ok := appliedByVersion[a.Version]; ok {
+			statuses = append(statuses, &MigrationStatus{
+				Version:   a.Version,
+				Name:      a.Name,
+				State:     MigrationUnknown,
+				AppliedAt: a.AppliedAt,
+			})
+		}
+	}
+	return statuses
+}
+
+// checkMigrationStatuses refuses to touch a database that has migrations this
+// binary doesn't know about or that were edited since they were applied.
+func checkMigrationStatuses(statuses []*MigrationStatus) error {
+	var errs []error
+	for _, status := range statuses {
+		switch status.State {
+		case MigrationUnknown:
+			errs = append(errs, fmt.Errorf("%w: %s", ErrSchemaNewer, status.Name))
+		case MigrationModified:
+			errs = append(errs, fmt.Errorf("%w: %s", ErrMigrationModified, status.Name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func ReadMigrationStatus(ctx context.Context, db *toolbelt.Database) (statuses []*MigrationStatus, err error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.ReadTX(ctx, func(tx *sqlite.Conn) error {
+		applied, _, err := readAppliedMigrations(tx, migrations)
+		if err != nil {
+			return err
+		}
+		statuses = migrationStatuses(migrations, applied)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+type MigrateOptions struct {
+	// DryRun writes the SQL that would run to Out instead of running it
+	DryRun bool
+	Out    io.Writer
+}
+
+// MigrateUp applies pending migrations, each in its own transaction, and
+// returns the ones that were (or for a dry run, would be) applied.
+func MigrateUp(ctx context.Context, db *toolbelt.Database, opts MigrateOptions) (pending []*Migration, err error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.WriteWithoutTx(ctx, func(conn *sqlite.Conn) error {
+		applied, isLegacy, err := readAppliedMigrations(conn, migrations)
+		if err != nil {
+			return err
+		}
+		statuses := migrationStatuses(migrations, applied)
+		if err := checkMigrationStatuses(statuses); err != nil {
+			return err
+		}
+
+		for i, status := range statuses {
+			if status.State == MigrationPending {
+				pending = append(pending, migrations[i])
+			}
+		}
+		if opts.DryRun {
+			for _, m := range pending {
+				fmt.Fprintf(opts.Out, "-- %s\n%s\n", m.Name, m.Up)
+			}
+			return nil
+		}
+
+		if err := initSchemaMigrations(conn, applied, isLegacy); err != nil {
+			return err
+		}
+		for _, m := range pending {
+			if err := applyMigration(conn, m.Version, m.Up, func() error {
+				return sqlitex.Execute(conn, `
+					INSERT INTO schema_migrations(version, name, checksum, applied_at)
+					VALUES (:version, :name, :checksum, :appliedAt)
+				`, &sqlitex.ExecOptions{
+					Named: map[string]any{
+						":version":   m.Version,
+						":name":      m.Name,
+						":checksum":  m.Checksum(),
+						":appliedAt": toolbelt.JulianNow(),
+					},
+				})
+			}); err != nil {
+				return fmt.Errorf("failed to apply %s: %w", m.Name, err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// MigrateDown reverts the last steps applied migrations using their down
+// files, newest first, and returns the ones that were (or would be) reverted.
+func MigrateDown(ctx context.Context, db *toolbelt.Database, steps int, opts MigrateOptions) (reverted []*Migration, err error) {
+	migrations, err := LoadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.WriteWithoutTx(ctx, func(conn *sqlite.Conn) error {
+		applied, isLegacy, err := readAppliedMigrations(conn, migrations)
+		if err != nil {
+			return err
+		}
+		if err := checkMigrationStatuses(migrationStatuses(migrations, applied)); err != nil {
+			return err
+		}
+
+		for i := len(applied) - 1; i >= 0 && len(reverted) < steps; i-- {
+			m := migrations[applied[i].Version-1]
+			if m.Down == "" {
+				return fmt.Errorf("%s has no down migration", m.Name)
+			}
+			reverted = append(reverted, m)
+		}
+		if opts.DryRun {
+			for _, m := range reverted {
+				fmt.Fprintf(opts.Out, "-- %s (down)\n%s\n", m.Name, m.Down)
+			}
+			return nil
+		}
+
+		if err := initSchemaMigrations(conn, applied, isLegacy); err != nil {
+			return err
+		}
+		for _, m := range reverted {
+			if err := applyMigration(conn, m.Version-1, m.Down, func() error {
+				return sqlitex.Execute(conn, `
+					DELETE FROM schema_migrations WHERE version = :version
+				`, &sqlitex.ExecOptions{
+					Named: map[string]any{":version": m.Version},
+				})
+			}); err != nil {
+				return fmt.Errorf("failed to revert %s: %w", m.Name, err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return reverted, nil
+}
+
+// initSchemaMigrations creates schema_migrations, recording what a legacy
+// database already had applied.
+func initSchemaMigrations(conn *sqlite.Conn, applied []*AppliedMigration, isLegacy bool) (err error) {
+	endFn, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer endFn(&err)
+
+	if err := sqlitex.ExecuteTransient(conn, createSchemaMigrations, nil); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	if !isLegacy {
+		return nil
+	}
+
+	now := toolbelt.JulianNow()
+	for _, a := range applied {
+		if err := sqlitex.Execute(conn, `
+			INSERT INTO schema_migrations(version, name, checksum, applied_at)
+			VALUES (:version, :name, :checksum, :appliedAt)
+		`, &sqlitex.ExecOptions{
+			Named: map[string]any{
+				":version":   a.Version,
+				":name":      a.Name,
+				":checksum":  a.Checksum,
+				":appliedAt": now,
+			},
+		}); err != nil {
+			return fmt.Errorf("failed to record applied migration: %w", err)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs script and record in one transaction, leaving
+// user_version at version so older tooling still sees the schema version.
+func applyMigration(conn *sqlite.Conn, version int, script string, record func() error) (err error) {
+	endFn, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer endFn(&err)
+
+	if err := sqlitex.ExecScript(conn, script); err != nil {
+		return err
+	}
+	if err := record(); err != nil {
+		return fmt.Errorf("failed to record migration: %w", err)
+	}
+	if err := sqlitex.ExecuteTransient(conn, fmt.Sprintf("PRAGMA user_version = %d;", version), nil); err != nil {
+		return fmt.Errorf("failed to set schema version: %w", err)
+	}
+	return nil
+}
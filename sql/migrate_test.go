@@ -0,0 +1,307 @@
+package sql
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/delaneyj/realworld-datastar/config"
+	"github.com/delaneyj/toolbelt"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func newTestConfig(t *testing.T) *config.Config {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.DataFolder = t.TempDir()
+	return cfg
+}
+
+// newUnmigratedTestDB is an empty database for tests to migrate themselves.
+func newUnmigratedTestDB(t *testing.T) *toolbelt.Database {
+	t.Helper()
+
+	db, err := OpenDBWithoutMigrating(context.Background(), newTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func execScript(t *testing.T, db *toolbelt.Database, script string) {
+	t.Helper()
+
+	if err := db.WriteWithoutTx(context.Background(), func(conn *sqlite.Conn) error {
+		return sqlitex.ExecScript(conn, script)
+	}); err != nil {
+		t.Fatalf("failed to run %q: %v", script, err)
+	}
+}
+
+func loadTestMigrations(t *testing.T) []*Migration {
+	t.Helper()
+
+	migrations, err := LoadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrations
+}
+
+func migrationStatesOf(t *testing.T, db *toolbelt.Database) map[string]MigrationState {
+	t.Helper()
+
+	statuses, err := ReadMigrationStatus(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	states := map[string]MigrationState{}
+	for _, status := range statuses {
+		states[status.Name] = status.State
+	}
+	return states
+}
+
+func userVersion(t *testing.T, db *toolbelt.Database) int {
+	t.Helper()
+
+	var version int
+	if err := db.ReadTX(context.Background(), func(tx *sqlite.Conn) error {
+		return sqlitex.ExecuteTransient(tx, "PRAGMA user_version;", &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				version = stmt.ColumnInt(0)
+				return nil
+			},
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations := loadTestMigrations(t)
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("%s has version %d, want %d", m.Name, m.Version, i+1)
+		}
+		if m.Up == "" {
+			t.Errorf("%s is empty", m.Name)
+		}
+		// Only the initial schema can't be undone
+		if m.Version > 1 && m.Down == "" {
+			t.Errorf("%s has no down migration", m.Name)
+		}
+	}
+}
+
+func TestMigrationChecksum(t *testing.T) {
+	a := &Migration{Up: "CREATE TABLE a(id INTEGER);"}
+	b := &Migration{Up: "CREATE TABLE a(id INTEGER); "}
+	if a.Checksum() == b.Checksum() {
+		t.Error("different scripts have the same checksum")
+	}
+	if a.Checksum() != (&Migration{Up: a.Up, Down: "DROP TABLE a;"}).Checksum() {
+		t.Error("down script changes the checksum")
+	}
+	if len(a.Checksum()) != 64 {
+		t.Errorf("got checksum %q, want hex SHA-256", a.Checksum())
+	}
+}
+
+func TestMigrateUp(t *testing.T) {
+	ctx := context.Background()
+	db := newUnmigratedTestDB(t)
+	migrations := loadTestMigrations(t)
+
+	applied, err := MigrateUp(ctx, db, MigrateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("applied %d migrations, want %d", len(applied), len(migrations))
+	}
+	if v := userVersion(t, db); v != len(migrations) {
+		t.Errorf("got user_version %d, want %d", v, len(migrations))
+	}
+	for name, state := range migrationStatesOf(t, db) {
+		if state != MigrationApplied {
+			t.Errorf("%s is %s", name, state)
+		}
+	}
+
+	applied, err = MigrateUp(ctx, db, MigrateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 0 {
+		t.Errorf("applied %d migrations again", len(applied))
+	}
+}
+
+func TestMigrateUpDryRun(t *testing.T) {
+	db := newUnmigratedTestDB(t)
+
+	out := &strings.Builder{}
+	pending, err := MigrateUp(context.Background(), db, MigrateOptions{DryRun: true, Out: out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "-- "+pending[0].Name) || !strings.Contains(out.String(), pending[0].Up) {
+		t.Error("dry run doesn't print the SQL")
+	}
+	for name, state := range migrationStatesOf(t, db) {
+		if state != MigrationPending {
+			t.Errorf("%s is %s after a dry run", name, state)
+		}
+	}
+}
+
+func TestMigrateRefusesModifiedMigrations(t *testing.T) {
+	ctx := context.Background()
+	db := newUnmigratedTestDB(t)
+	if _, err := MigrateUp(ctx, db, MigrateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	execScript(t, db, `UPDATE schema_migrations SET checksum = 'edited' WHERE version = 2;`)
+	if state := migrationStatesOf(t, db)["0002.sql"]; state != MigrationModified {
+		t.Errorf("got %s, want %s", state, MigrationModified)
+	}
+	if _, err := MigrateUp(ctx, db, MigrateOptions{}); !errors.Is(err, ErrMigrationModified) {
+		t.Errorf("migrating up got error %v, want %v", err, ErrMigrationModified)
+	}
+	if _, err := MigrateDown(ctx, db, 1, MigrateOptions{}); !errors.Is(err, ErrMigrationModified) {
+		t.Errorf("migrating down got error %v, want %v", err, ErrMigrationModified)
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	ctx := context.Background()
+	db := newUnmigratedTestDB(t)
+	if _, err := MigrateUp(ctx, db, MigrateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	execScript(t, db, `INSERT INTO schema_migrations(version, name, checksum, applied_at) VALUES (9999, '9999.sql', 'x', 2460000.5);`)
+	if state := migrationStatesOf(t, db)["9999.sql"]; state != MigrationUnknown {
+		t.Errorf("got %s, want %s", state, MigrationUnknown)
+	}
+	if _, err := MigrateUp(ctx, db, MigrateOptions{}); !errors.Is(err, ErrSchemaNewer) {
+		t.Errorf("got error %v, want %v", err, ErrSchemaNewer)
+	}
+}
+
+func TestMigrateLegacyUserVersion(t *testing.T) {
+	ctx := context.Background()
+	db := newUnmigratedTestDB(t)
+	migrations := loadTestMigrations(t)
+
+	// Migrated by toolbelt before schema_migrations, which only kept count
+	// in user_version
+	const legacyVersion = 3
+	for _, m := range migrations[:legacyVersion] {
+		execScript(t, db, m.Up)
+	}
+	execScript(t, db, "PRAGMA user_version = 3;")
+
+	states := migrationStatesOf(t, db)
+	for _, m := range migrations {
+		want := MigrationPending
+		if m.Version <= legacyVersion {
+			want = MigrationApplied
+		}
+		if states[m.Name] != want {
+			t.Errorf("%s is %s, want %s", m.Name, states[m.Name], want)
+		}
+	}
+
+	applied, err := MigrateUp(ctx, db, MigrateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations)-legacyVersion || applied[0].Version != legacyVersion+1 {
+		t.Errorf("applied %d migrations starting at %d", len(applied), applied[0].Version)
+	}
+
+	// What was there before is recorded with the embedded checksums
+	var recorded []string
+	if err := db.ReadTX(ctx, func(tx *sqlite.Conn) error {
+		return sqlitex.Execute(tx, `SELECT name, checksum FROM schema_migrations ORDER BY version`, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				recorded = append(recorded, stmt.ColumnText(0)+" "+stmt.ColumnText(1))
+				return nil
+			},
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != len(migrations) {
+		t.Fatalf("recorded %d migrations, want %d", len(recorded), len(migrations))
+	}
+	for i, m := range migrations {
+		if want := m.Name + " " + m.Checksum(); recorded[i] != want {
+			t.Errorf("recorded %q, want %q", recorded[i], want)
+		}
+	}
+}
+
+func TestMigrateLegacyUserVersionTooNew(t *testing.T) {
+	db := newUnmigratedTestDB(t)
+	execScript(t, db, "PRAGMA user_version = 9999;")
+
+	if _, err := MigrateUp(context.Background(), db, MigrateOptions{}); !errors.Is(err, ErrSchemaNewer) {
+		t.Errorf("got error %v, want %v", err, ErrSchemaNewer)
+	}
+}
+
+func TestMigrateDown(t *testing.T) {
+	ctx := context.Background()
+	db := newUnmigratedTestDB(t)
+	migrations := loadTestMigrations(t)
+	if _, err := MigrateUp(ctx, db, MigrateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &strings.Builder{}
+	reverted, err := MigrateDown(ctx, db, 1, MigrateOptions{DryRun: true, Out: out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := migrations[len(migrations)-1]
+	if len(reverted) != 1 || reverted[0].Name != last.Name || !strings.Contains(out.String(), last.Down) {
+		t.Error("dry run doesn't print the last down migration")
+	}
+	if state := migrationStatesOf(t, db)[last.Name]; state != MigrationApplied {
+		t.Errorf("%s is %s after a dry run", last.Name, state)
+	}
+
+	// Every down migration works, and undoes its up migration well enough
+	// for it to apply again
+	steps := len(migrations) - 1
+	reverted, err = MigrateDown(ctx, db, steps, MigrateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != steps || reverted[0].Name != last.Name {
+		t.Errorf("reverted %d migrations, want %d newest first", len(reverted), steps)
+	}
+	if v := userVersion(t, db); v != 1 {
+		t.Errorf("got user_version %d, want 1", v)
+	}
+	if _, err := MigrateDown(ctx, db, 1, MigrateOptions{}); err == nil || !strings.Contains(err.Error(), "has no down migration") {
+		t.Errorf("got error %v reverting the initial schema", err)
+	}
+
+	applied, err := MigrateUp(ctx, db, MigrateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != steps {
+		t.Errorf("applied %d migrations again, want %d", len(applied), steps)
+	}
+}
@@ -0,0 +1 @@
+ALTER TABLE articles ADD COLUMN body_html TEXT NOT NULL DEFAULT '';
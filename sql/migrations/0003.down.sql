@@ -0,0 +1,6 @@
+DROP TRIGGER articles_fts_tags_delete;
+DROP TRIGGER articles_fts_tags_insert;
+DROP TRIGGER articles_fts_delete;
+DROP TRIGGER articles_fts_update;
+DROP TRIGGER articles_fts_insert;
+DROP TABLE articles_fts;
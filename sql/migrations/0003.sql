@@ -0,0 +1,120 @@
+CREATE VIRTUAL TABLE articles_fts USING fts5(
+    title,
+    description,
+    body,
+    tags,
+    tokenize = 'porter unicode61 remove_diacritics 2'
+);
+
+INSERT INTO
+    articles_fts(rowid, title, description, body, tags)
+SELECT
+    a.id,
+    a.title,
+    a.description,
+    a.body,
+    coalesce(
+        (
+            SELECT
+                group_concat(t.name, ' ')
+            FROM
+                article_tags at
+                INNER JOIN tags t ON t.id = at.tag_id
+            WHERE
+                at.article_id = a.id
+        ),
+        ''
+    )
+FROM
+    articles a;
+
+CREATE TRIGGER articles_fts_insert
+AFTER
+INSERT
+    ON articles BEGIN
+INSERT INTO
+    articles_fts(rowid, title, description, body, tags)
+VALUES
+    (
+        new.id,
+        new.title,
+        new.description,
+        new.body,
+        ''
+    );
+
+END;
+
+CREATE TRIGGER articles_fts_update
+AFTER
+UPDATE
+    OF title,
+    description,
+    body ON articles BEGIN
+UPDATE
+    articles_fts
+SET
+    title = new.title,
+    description = new.description,
+    body = new.body
+WHERE
+    rowid = new.id;
+
+END;
+
+CREATE TRIGGER articles_fts_delete
+AFTER
+    DELETE ON articles BEGIN
+DELETE FROM
+    articles_fts
+WHERE
+    rowid = old.id;
+
+END;
+
+CREATE TRIGGER articles_fts_tags_insert
+AFTER
+INSERT
+    ON article_tags BEGIN
+UPDATE
+    articles_fts
+SET
+    tags = coalesce(
+        (
+            SELECT
+                group_concat(t.name, ' ')
+            FROM
+                article_tags at
+                INNER JOIN tags t ON t.id = at.tag_id
+            WHERE
+                at.article_id = new.article_id
+        ),
+        ''
+    )
+WHERE
+    rowid = new.article_id;
+
+END;
+
+CREATE TRIGGER articles_fts_tags_delete
+AFTER
+    DELETE ON article_tags BEGIN
+UPDATE
+    articles_fts
+SET
+    tags = coalesce(
+        (
+            SELECT
+                group_concat(t.name, ' ')
+            FROM
+                article_tags at
+                INNER JOIN tags t ON t.id = at.tag_id
+            WHERE
+                at.article_id = old.article_id
+        ),
+        ''
+    )
+WHERE
+    rowid = old.article_id;
+
+END;
@@ -0,0 +1,7 @@
+CREATE TABLE article_slugs(
+    id INTEGER PRIMARY KEY,
+    slug TEXT NOT NULL UNIQUE,
+    created_at DATETIME NOT NULL,
+    article_id INT NOT NULL,
+    FOREIGN KEY (article_id) REFERENCES articles(id) ON DELETE CASCADE
+);
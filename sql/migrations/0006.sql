@@ -0,0 +1,33 @@
+CREATE TABLE article_revisions(
+    id INTEGER PRIMARY KEY,
+    article_id INT NOT NULL,
+    editor_id INT NOT NULL,
+    title TEXT NOT NULL,
+    description TEXT NOT NULL,
+    body TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (article_id) REFERENCES articles(id) ON DELETE CASCADE,
+    FOREIGN KEY (editor_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX article_revisions_article_id ON article_revisions(article_id, created_at);
+
+-- Existing articles start their history at their current version
+INSERT INTO
+    article_revisions(
+        article_id,
+        editor_id,
+        title,
+        description,
+        body,
+        created_at
+    )
+SELECT
+    id,
+    author_id,
+    title,
+    description,
+    body,
+    updated_at
+FROM
+    articles;
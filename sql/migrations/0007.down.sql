@@ -0,0 +1,5 @@
+DROP INDEX articles_status_published_at;
+
+ALTER TABLE articles DROP COLUMN published_at;
+
+ALTER TABLE articles DROP COLUMN status;
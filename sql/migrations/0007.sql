@@ -0,0 +1,8 @@
+-- draft, scheduled or published, scheduled articles go live at published_at
+ALTER TABLE articles ADD COLUMN status TEXT NOT NULL DEFAULT 'published';
+
+ALTER TABLE articles ADD COLUMN published_at DATETIME NOT NULL DEFAULT 0;
+
+UPDATE articles SET published_at = created_at;
+
+CREATE INDEX articles_status_published_at ON articles(status, published_at);
@@ -0,0 +1,17 @@
+CREATE TABLE uploads(
+    id INTEGER PRIMARY KEY,
+    user_id INT NOT NULL,
+    -- sha256 of the uploaded file, naming the folder its variants are in
+    hash TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    ext TEXT NOT NULL,
+    width INT NOT NULL,
+    height INT NOT NULL,
+    size INT NOT NULL,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX uploads_user_id ON uploads(user_id);
+
+CREATE INDEX uploads_hash ON uploads(hash);
@@ -0,0 +1,2 @@
+UPDATE users SET image_url = 'https://i.pravatar.cc/150?u=' || id
+WHERE image_url = '/avatars/' || id || '.svg';
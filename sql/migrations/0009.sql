@@ -0,0 +1,3 @@
+-- Default avatars are generated by the app instead of fetched from pravatar.cc
+UPDATE users SET image_url = '/avatars/' || id || '.svg'
+WHERE image_url LIKE 'https://i.pravatar.cc/%';
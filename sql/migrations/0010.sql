@@ -0,0 +1,15 @@
+-- Bumped to sign a user out everywhere, sessions and API tokens carry the
+-- version they were issued for
+ALTER TABLE users ADD COLUMN session_version INT NOT NULL DEFAULT 0;
+
+CREATE TABLE password_resets(
+    id INTEGER PRIMARY KEY,
+    user_id INT NOT NULL,
+    -- sha256 of the token mailed to the user, the token itself isn't kept
+    token_hash TEXT NOT NULL UNIQUE,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX password_resets_user_id ON password_resets(user_id);
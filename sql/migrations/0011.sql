@@ -0,0 +1,19 @@
+-- Zero until the user follows a link mailed to their address
+ALTER TABLE users ADD COLUMN email_verified_at DATETIME NOT NULL DEFAULT 0;
+
+-- Accounts from before verification keep working as they did
+UPDATE users SET email_verified_at = julianday('now');
+
+CREATE TABLE email_verifications(
+    id INTEGER PRIMARY KEY,
+    user_id INT NOT NULL,
+    -- Address the link proves the user owns, a new one replaces theirs
+    email TEXT NOT NULL,
+    -- sha256 of the token mailed to the user, the token itself isn't kept
+    token_hash TEXT NOT NULL UNIQUE,
+    expires_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX email_verifications_user_id ON email_verifications(user_id);
@@ -0,0 +1,22 @@
+CREATE TABLE totp_credentials(
+    id INTEGER PRIMARY KEY,
+    user_id INT NOT NULL UNIQUE,
+    -- base32 secret shared with the user's authenticator app
+    secret TEXT NOT NULL,
+    -- Zero while setting up, until the user enters a code from the app
+    confirmed_at DATETIME NOT NULL,
+    -- Time step of the last code accepted, so each code works once
+    last_step INT NOT NULL DEFAULT 0,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE recovery_codes(
+    id INTEGER PRIMARY KEY,
+    user_id INT NOT NULL,
+    -- sha256 of the code shown to the user once, the code itself isn't kept
+    code_hash TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    UNIQUE (user_id, code_hash)
+);
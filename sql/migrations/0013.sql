@@ -0,0 +1,15 @@
+CREATE TABLE user_identities(
+    id INTEGER PRIMARY KEY,
+    user_id INT NOT NULL,
+    -- id of the OpenID Connect provider in the config
+    provider TEXT NOT NULL,
+    -- sub claim of the ID token, which the provider never reuses
+    subject TEXT NOT NULL,
+    -- As the provider knew it on the last sign in, only for display
+    email TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    last_login_at DATETIME NOT NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    UNIQUE (provider, subject),
+    UNIQUE (user_id, provider)
+);
@@ -0,0 +1,16 @@
+CREATE TABLE login_attempts(
+    id INTEGER PRIMARY KEY,
+    -- As typed, lower cased, whether or not a user has it
+    email TEXT NOT NULL,
+    ip TEXT NOT NULL,
+    -- Attempts count as failed until the password, and code with two-factor
+    -- authentication, checked out
+    succeeded BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at DATETIME NOT NULL
+);
+
+CREATE INDEX login_attempts_email_idx ON login_attempts(email, created_at);
+
+CREATE INDEX login_attempts_ip_idx ON login_attempts(ip, created_at);
+
+CREATE INDEX login_attempts_created_at_idx ON login_attempts(created_at);
@@ -21,6 +21,9 @@ SELECT
 FROM
     article_tags at
     INNER JOIN tags t ON t.id = at.tag_id
+    INNER JOIN articles a ON a.id = at.article_id
+WHERE
+    a.status = 'published'
 GROUP BY
     tag_id
 ORDER BY
@@ -31,6 +34,7 @@ LIMIT
 -- name: YourFeedArticlePreviews :many
 SELECT
     a.id AS article_id,
+    a.slug,
     u.id AS author_id,
     u.username,
     u.image_url,
@@ -42,6 +46,7 @@ FROM
     INNER JOIN users u ON u.id = a.author_id
 WHERE
     user_id = @userID
+    AND a.status = 'published'
 ORDER BY
     a.updated_at DESC,
     a.id DESC
@@ -55,11 +60,13 @@ FROM
     following f
     INNER JOIN articles a ON a.author_id = f.follows_id
 WHERE
-    user_id = @userID;
+    user_id = @userID
+    AND a.status = 'published';
 
 -- name: GlobalFeedArticlePreviews :many
 SELECT
     a.id AS article_id,
+    a.slug,
     u.id AS author_id,
     u.username,
     u.image_url,
@@ -68,6 +75,8 @@ SELECT
 FROM
     articles a
     INNER JOIN users u ON u.id = a.author_id
+WHERE
+    a.status = 'published'
 ORDER BY
     a.updated_at DESC,
     a.id DESC
@@ -78,11 +87,14 @@ LIMIT
 SELECT
     count(*)
 FROM
-    articles;
+    articles
+WHERE
+    status = 'published';
 
 -- name: ArticlePreviewsByAuthor :many
 SELECT
     a.id AS article_id,
+    a.slug,
     u.id AS author_id,
     u.username,
     u.image_url,
@@ -93,6 +105,7 @@ FROM
     INNER JOIN users u ON u.id = a.author_id
 WHERE
     a.author_id = @authorID
+    AND a.status = 'published'
 ORDER BY
     a.updated_at DESC,
     a.id DESC
@@ -105,11 +118,13 @@ SELECT
 FROM
     articles
 WHERE
-    author_id = @authorID;
+    author_id = @authorID
+    AND status = 'published';
 
 -- name: ArticlePreviewsByFavoriter :many
 SELECT
     a.id AS article_id,
+    a.slug,
     u.id AS author_id,
     u.username,
     u.image_url,
@@ -121,6 +136,7 @@ FROM
     INNER JOIN users u ON u.id = a.author_id
 WHERE
     af.user_id = @favoriterID
+    AND a.status = 'published'
 ORDER BY
     a.created_at DESC
 LIMIT
@@ -130,9 +146,11 @@ LIMIT
 SELECT
     count(*)
 FROM
-    article_favorites
+    article_favorites af
+    INNER JOIN articles a ON a.id = af.article_id
 WHERE
-    user_id = @favoriterID;
+    af.user_id = @favoriterID
+    AND a.status = 'published';
 
 -- name: TagsForArticle :many
 SELECT
@@ -215,4 +233,478 @@ DELETE FROM
     article_tags
 WHERE
     article_id = @articleID
-    AND tag_id = @tagID;
\ No newline at end of file
+    AND tag_id = @tagID;
+
+-- name: ArticleIdBySlug :one
+SELECT
+    id
+FROM
+    articles
+WHERE
+    slug = @slug;
+
+-- name: ArticlePreviewsByTag :many
+SELECT
+    a.id AS article_id,
+    a.slug,
+    u.id AS author_id,
+    u.username,
+    u.image_url,
+    a.title,
+    a.description
+FROM
+    article_tags at
+    INNER JOIN tags t ON t.id = at.tag_id
+    INNER JOIN articles a ON a.id = at.article_id
+    INNER JOIN users u ON u.id = a.author_id
+WHERE
+    t.name = @tag
+    AND a.status = 'published'
+ORDER BY
+    a.updated_at DESC,
+    a.id DESC
+LIMIT
+    @limit OFFSET @offset;
+
+-- name: ArticleCountByTag :one
+SELECT
+    count(*)
+FROM
+    article_tags at
+    INNER JOIN tags t ON t.id = at.tag_id
+    INNER JOIN articles a ON a.id = at.article_id
+WHERE
+    t.name = @tag
+    AND a.status = 'published';
+
+-- name: AllTags :many
+SELECT
+    id,
+    name
+FROM
+    tags
+ORDER BY
+    name;
+
+-- name: UpdateArticleBodyHtml :exec
+UPDATE
+    articles
+SET
+    body_html = @bodyHtml
+WHERE
+    id = @articleID;
+
+-- name: ArticleIdBySlugHistory :one
+SELECT
+    article_id
+FROM
+    article_slugs
+WHERE
+    slug = @slug;
+
+-- name: IsArticleSlugTaken :one
+SELECT
+    count(*) > 0
+FROM
+    (
+        SELECT
+            id
+        FROM
+            articles
+        WHERE
+            slug = @slug
+            AND id != @articleID
+        UNION ALL
+        SELECT
+            article_id
+        FROM
+            article_slugs
+        WHERE
+            slug = @slug
+            AND article_id != @articleID
+    );
+
+-- name: DeleteArticleSlugHistory :exec
+DELETE FROM
+    article_slugs
+WHERE
+    slug = @slug;
+
+-- name: ArticlesByAuthor :many
+SELECT
+    *
+FROM
+    articles
+WHERE
+    author_id = @authorID
+ORDER BY
+    created_at,
+    id;
+
+-- name: SitemapArticles :many
+SELECT
+    slug,
+    updated_at
+FROM
+    articles
+WHERE
+    status = 'published'
+ORDER BY
+    id
+LIMIT
+    @limit OFFSET @offset;
+
+-- name: SitemapAuthors :many
+SELECT
+    author_id,
+    CAST(max(updated_at) AS REAL) AS updated_at
+FROM
+    articles
+WHERE
+    status = 'published'
+GROUP BY
+    author_id
+ORDER BY
+    author_id
+LIMIT
+    @limit OFFSET @offset;
+
+-- name: SitemapAuthorCount :one
+SELECT
+    count(DISTINCT author_id)
+FROM
+    articles
+WHERE
+    status = 'published';
+
+-- name: SitemapTags :many
+SELECT
+    t.name,
+    CAST(max(a.updated_at) AS REAL) AS updated_at
+FROM
+    tags t
+    INNER JOIN article_tags at ON at.tag_id = t.id
+    INNER JOIN articles a ON a.id = at.article_id
+WHERE
+    a.status = 'published'
+GROUP BY
+    t.id
+ORDER BY
+    t.id
+LIMIT
+    @limit OFFSET @offset;
+
+-- name: SitemapTagCount :one
+SELECT
+    count(DISTINCT at.tag_id)
+FROM
+    article_tags at
+    INNER JOIN articles a ON a.id = at.article_id
+WHERE
+    a.status = 'published';
+
+-- name: ArticleRevisions :many
+SELECT
+    r.id,
+    r.title,
+    r.created_at,
+    u.id AS editor_id,
+    u.username AS editor_username
+FROM
+    article_revisions r
+    INNER JOIN users u ON u.id = r.editor_id
+WHERE
+    r.article_id = @articleID
+ORDER BY
+    r.created_at DESC,
+    r.id DESC;
+
+-- name: LatestArticleRevision :one
+SELECT
+    *
+FROM
+    article_revisions
+WHERE
+    article_id = @articleID
+ORDER BY
+    created_at DESC,
+    id DESC
+LIMIT
+    1;
+
+-- name: DraftArticlePreviewsByAuthor :many
+SELECT
+    a.id AS article_id,
+    a.slug,
+    u.id AS author_id,
+    u.username,
+    u.image_url,
+    a.title,
+    a.description,
+    a.status,
+    a.published_at
+FROM
+    articles a
+    INNER JOIN users u ON u.id = a.author_id
+WHERE
+    a.author_id = @authorID
+    AND a.status != 'published'
+ORDER BY
+    a.updated_at DESC,
+    a.id DESC
+LIMIT
+    @limit OFFSET @offset;
+
+-- name: DraftArticleCountByAuthor :one
+SELECT
+    count(*)
+FROM
+    articles
+WHERE
+    author_id = @authorID
+    AND status != 'published';
+
+-- name: DueScheduledArticles :many
+SELECT
+    id,
+    author_id
+FROM
+    articles
+WHERE
+    status = 'scheduled'
+    AND published_at <= @now
+ORDER BY
+    published_at;
+
+-- name: NextScheduledPublication :one
+SELECT
+    published_at
+FROM
+    articles
+WHERE
+    status = 'scheduled'
+ORDER BY
+    published_at
+LIMIT
+    1;
+
+-- name: PublishScheduledArticle :exec
+UPDATE
+    articles
+SET
+    status = 'published',
+    updated_at = @now
+WHERE
+    id = @articleID
+    AND status = 'scheduled';
+
+-- name: PasswordResetByTokenHash :one
+SELECT
+    *
+FROM
+    password_resets
+WHERE
+    token_hash = @token_hash;
+
+-- name: DeletePasswordResetsByUser :exec
+DELETE FROM
+    password_resets
+WHERE
+    user_id = @user_id;
+
+-- name: DeleteExpiredPasswordResets :exec
+DELETE FROM
+    password_resets
+WHERE
+    expires_at <= @now;
+
+-- name: EmailVerificationByTokenHash :one
+SELECT
+    *
+FROM
+    email_verifications
+WHERE
+    token_hash = @token_hash;
+
+-- name: DeleteEmailVerificationsByUser :exec
+DELETE FROM
+    email_verifications
+WHERE
+    user_id = @user_id;
+
+-- name: DeleteExpiredEmailVerifications :exec
+DELETE FROM
+    email_verifications
+WHERE
+    expires_at <= @now;
+
+-- name: PendingEmailChange :one
+SELECT
+    v.email
+FROM
+    email_verifications v
+    JOIN users u ON u.id = v.user_id
+WHERE
+    v.user_id = @user_id
+    AND v.email != u.email
+    AND v.expires_at > @now
+ORDER BY
+    v.created_at DESC
+LIMIT
+    1;
+
+-- name: TotpCredentialByUser :one
+SELECT
+    *
+FROM
+    totp_credentials
+WHERE
+    user_id = @user_id;
+
+-- name: DeleteTotpCredentialsByUser :exec
+DELETE FROM
+    totp_credentials
+WHERE
+    user_id = @user_id;
+
+-- name: RecoveryCodeByHash :one
+SELECT
+    *
+FROM
+    recovery_codes
+WHERE
+    user_id = @user_id
+    AND code_hash = @code_hash;
+
+-- name: CountRecoveryCodesByUser :one
+SELECT
+    COUNT(*)
+FROM
+    recovery_codes
+WHERE
+    user_id = @user_id;
+
+-- name: DeleteRecoveryCodesByUser :exec
+DELETE FROM
+    recovery_codes
+WHERE
+    user_id = @user_id;
+
+-- name: UserIdentityBySubject :one
+SELECT
+    *
+FROM
+    user_identities
+WHERE
+    provider = @provider
+    AND subject = @subject;
+
+-- name: UserIdentitiesByUser :many
+SELECT
+    *
+FROM
+    user_identities
+WHERE
+    user_id = @user_id
+ORDER BY
+    created_at;
+
+-- name: DeleteUserIdentityByProvider :exec
+DELETE FROM
+    user_identities
+WHERE
+    user_id = @user_id
+    AND provider = @provider;
+
+-- name: LoginAttemptsByEmail :many
+SELECT
+    succeeded,
+    created_at
+FROM
+    login_attempts
+WHERE
+    email = @email
+    AND created_at > @since
+ORDER BY
+    created_at DESC
+LIMIT
+    @limit;
+
+-- name: LoginFailuresByIP :many
+SELECT
+    succeeded,
+    created_at
+FROM
+    login_attempts
+WHERE
+    ip = @ip
+    AND NOT succeeded
+    AND created_at > @since
+ORDER BY
+    created_at DESC
+LIMIT
+    @limit;
+
+-- name: LatestLoginAttempts :many
+SELECT
+    *
+FROM
+    login_attempts
+ORDER BY
+    created_at DESC
+LIMIT
+    @limit;
+
+-- name: FailingLoginEmails :many
+SELECT
+    email,
+    count(*) AS failures
+FROM
+    login_attempts
+WHERE
+    NOT succeeded
+    AND created_at > @since
+GROUP BY
+    email
+ORDER BY
+    failures DESC
+LIMIT
+    @limit;
+
+-- name: FailingLoginIPs :many
+SELECT
+    ip,
+    count(*) AS failures
+FROM
+    login_attempts
+WHERE
+    NOT succeeded
+    AND created_at > @since
+GROUP BY
+    ip
+ORDER BY
+    failures DESC
+LIMIT
+    @limit;
+
+-- name: DeleteLoginAttemptsByEmail :exec
+DELETE FROM
+    login_attempts
+WHERE
+    email = @email;
+
+-- name: DeleteLoginAttemptsByIP :exec
+DELETE FROM
+    login_attempts
+WHERE
+    ip = @ip;
+
+-- name: DeleteAllLoginAttempts :exec
+DELETE FROM
+    login_attempts;
+
+-- name: DeleteLoginAttemptsBefore :exec
+DELETE FROM
+    login_attempts
+WHERE
+    created_at < @before;
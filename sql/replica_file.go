@@ -0,0 +1,146 @@
+package sql
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	replicaSnapshotName = "snapshot.sqlite"
+	replicaSegmentsDir  = "segments"
+	replicaSegmentExt   = ".wal"
+)
+
+// FileReplica is a ReplicaTarget in a local folder, laid out as
+//
+//	<dir>/<generation>/snapshot.sqlite
+//	<dir>/<generation>/segments/<index>-<created at unix nanos>.wal
+//
+// Files are written next to their final name and renamed into place, so
+// anything with its final name is complete.
+type FileReplica struct {
+	dir string
+}
+
+func NewFileReplica(dir string) *FileReplica {
+	return &FileReplica{dir: dir}
+}
+
+func (fr *FileReplica) WriteSnapshot(ctx context.Context, generation string, r io.Reader) error {
+	return writeFileAtomic(filepath.Join(fr.dir, generation, replicaSnapshotName), r)
+}
+
+func (fr *FileReplica) WriteSegment(ctx context.Context, generation string, segment ReplicaSegment, r io.Reader) error {
+	return writeFileAtomic(fr.segmentPath(generation, segment), r)
+}
+
+func (fr *FileReplica) Generations(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(fr.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read replica folder: %w", err)
+	}
+
+	var generations []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := GenerationTime(entry.Name()); err != nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(fr.dir, entry.Name(), replicaSnapshotName)); err != nil {
+			continue
+		}
+		generations = append(generations, entry.Name())
+	}
+	// Generations are fixed width hex timestamps so they sort by name
+	slices.Sort(generations)
+	return generations, nil
+}
+
+func (fr *FileReplica) Segments(ctx context.Context, generation string) ([]ReplicaSegment, error) {
+	entries, err := os.ReadDir(filepath.Join(fr.dir, generation, replicaSegmentsDir))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read segments folder: %w", err)
+	}
+
+	var segments []ReplicaSegment
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), replicaSegmentExt)
+		if !ok {
+			continue
+		}
+		var index, nanos int64
+		if _, err := fmt.Sscanf(name, "%016x-%016x", &index, &nanos); err != nil {
+			continue
+		}
+		segments = append(segments, ReplicaSegment{
+			Index:     index,
+			CreatedAt: time.Unix(0, nanos).UTC(),
+		})
+	}
+	slices.SortFunc(segments, func(a, b ReplicaSegment) int {
+		return cmp.Compare(a.Index, b.Index)
+	})
+	return segments, nil
+}
+
+func (fr *FileReplica) OpenSnapshot(ctx context.Context, generation string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(fr.dir, generation, replicaSnapshotName))
+}
+
+func (fr *FileReplica) OpenSegment(ctx context.Context, generation string, segment ReplicaSegment) (io.ReadCloser, error) {
+	return os.Open(fr.segmentPath(generation, segment))
+}
+
+func (fr *FileReplica) DeleteGeneration(ctx context.Context, generation string) error {
+	return os.RemoveAll(filepath.Join(fr.dir, generation))
+}
+
+func (fr *FileReplica) segmentPath(generation string, segment ReplicaSegment) string {
+	name := fmt.Sprintf("%016x-%016x%s", segment.Index, segment.CreatedAt.UnixNano(), replicaSegmentExt)
+	return filepath.Join(fr.dir, generation, replicaSegmentsDir, name)
+}
+
+func writeFileAtomic(filename string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("failed to create folder: %w", err)
+	}
+
+	tmpFilename := filename + ".tmp"
+	f, err := os.Create(tmpFilename)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(tmpFilename)
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return fmt.Errorf("failed to move file into place: %w", err)
+	}
+	return nil
+}
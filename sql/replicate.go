@@ -0,0 +1,446 @@
+package sql
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/delaneyj/toolbelt"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// ReplicaTarget stores what a Replicator ships. Replicas are made of
+// generations, each a snapshot of the database followed by WAL segments that
+// have to be applied in index order.
+type ReplicaTarget interface {
+	WriteSnapshot(ctx context.Context, generation string, r io.Reader) error
+	WriteSegment(ctx context.Context, generation string, segment ReplicaSegment, r io.Reader) error
+	// Generations returns the generations with a complete snapshot, oldest
+	// first.
+	Generations(ctx context.Context) ([]string, error)
+	// Segments returns the segments of a generation in index order.
+	Segments(ctx context.Context, generation string) ([]ReplicaSegment, error)
+	OpenSnapshot(ctx context.Context, generation string) (io.ReadCloser, error)
+	OpenSegment(ctx context.Context, generation string, segment ReplicaSegment) (io.ReadCloser, error)
+	DeleteGeneration(ctx context.Context, generation string) error
+}
+
+type ReplicaSegment struct {
+	Index     int64
+	CreatedAt time.Time
+}
+
+// GenerationTime is when the snapshot a generation starts from was taken.
+func GenerationTime(generation string) (time.Time, error) {
+	nanos, err := strconv.ParseInt(generation, 16, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid generation %q: %w", generation, err)
+	}
+	return time.Unix(0, nanos).UTC(), nil
+}
+
+func newGeneration(at time.Time) string {
+	return fmt.Sprintf("%016x", at.UnixNano())
+}
+
+var errWALDiscontinuity = errors.New("WAL was restarted before all frames were shipped")
+
+// walCheckpointPages is how many pages the WAL can grow to before the
+// replicator checkpoints it, the same as SQLite's default auto checkpoint.
+const walCheckpointPages = 1000
+
+type ReplicatorOptions struct {
+	// Interval is how often new WAL frames are shipped
+	Interval time.Duration
+	// SnapshotInterval is how often a new generation is started, which bounds
+	// how many segments a restore has to apply
+	SnapshotInterval time.Duration
+	// Retention is how many generations to keep
+	Retention int
+}
+
+// Replicator continuously copies committed WAL frames of the database into a
+// ReplicaTarget so it can be restored to within Interval of a crash.
+//
+// Frames are read straight from the -wal file while holding the database's
+// only write connection, so nothing commits half way through a read. Between
+// reads a transaction is kept open on a separate connection which stops
+// SQLite from restarting the WAL over frames that haven't been shipped. The
+// replicator checkpoints the WAL itself once everything in it is shipped.
+type Replicator struct {
+	db       *toolbelt.Database
+	filename string
+	target   ReplicaTarget
+	opts     ReplicatorOptions
+
+	reader   *sqlite.Conn
+	pageSize int64
+
+	generation   string
+	generationAt time.Time
+	segmentIndex int64
+
+	// wal is the header of the WAL being followed and offset and checksum
+	// where shipping stopped in it
+	wal      *walHeader
+	offset   int64
+	checksum [2]uint32
+}
+
+func NewReplicator(db *toolbelt.Database, filename string, target ReplicaTarget, opts ReplicatorOptions) *Replicator {
+	return &Replicator{
+		db:       db,
+		filename: filename,
+		target:   target,
+		opts:     opts,
+	}
+}
+
+// Run replicates until ctx is done, starting with a new generation since
+// whatever happened to the database while not running can't be known.
+func (r *Replicator) Run(ctx context.Context) error {
+	reader, err := sqlite.OpenConn(r.filename, sqlite.OpenReadWrite)
+	if err != nil {
+		return fmt.Errorf("failed to open replication connection: %w", err)
+	}
+	r.reader = reader
+	defer func() {
+		r.releaseRead()
+		reader.Close()
+	}()
+
+	if err := sqlitex.ExecuteTransient(reader, "PRAGMA page_size;", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			r.pageSize = stmt.ColumnInt64(0)
+			return nil
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to get page size: %w", err)
+	}
+
+	ticker := time.NewTicker(r.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.sync(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Replication failed, starting a new generation: %v", err)
+			r.generation = ""
+		}
+
+		select {
+		case <-ctx.Done():
+			// Ship whatever was committed right before shutdown
+			if err := r.sync(context.WithoutCancel(ctx)); err != nil {
+				log.Printf("Final replication failed: %v", err)
+			}
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Replicator) sync(ctx context.Context) error {
+	if r.generation == "" || time.Since(r.generationAt) >= r.opts.SnapshotInterval {
+		return r.snapshot(ctx)
+	}
+
+	var (
+		segment []byte
+		at      time.Time
+	)
+	if err := r.db.WriteWithoutTx(ctx, func(conn *sqlite.Conn) (err error) {
+		at = time.Now()
+		segment, err = r.readSegment()
+		if err != nil {
+			return err
+		}
+
+		if r.offset >= walCheckpointPages*r.pageSize {
+			r.releaseRead()
+			if err := checkpoint(conn); err != nil {
+				return err
+			}
+		}
+		return r.holdRead()
+	}); err != nil {
+		return err
+	}
+	if segment == nil {
+		return nil
+	}
+
+	r.segmentIndex++
+	if err := r.target.WriteSegment(ctx, r.generation, ReplicaSegment{
+		Index:     r.segmentIndex,
+		CreatedAt: at,
+	}, bytes.NewReader(segment)); err != nil {
+		return fmt.Errorf("failed to write WAL segment: %w", err)
+	}
+	return nil
+}
+
+// readSegment returns the WAL header followed by the frames committed since
+// the last call, or nil if there are none.
+func (r *Replicator) readSegment() ([]byte, error) {
+	f, err := os.Open(r.filename + "-wal")
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAL: %w", err)
+	}
+	defer f.Close()
+
+	h, err := readWALHeader(f)
+	if err != nil || h == nil {
+		return nil, err
+	}
+
+	if !h.sameWAL(r.wal) {
+		// After a checkpoint SQLite starts writing the WAL from the top with
+		// a new header. That's only safe if it happened exactly once since
+		// the old WAL was shipped.
+		if r.wal != nil && h.ckptSeq != r.wal.ckptSeq+1 {
+			return nil, errWALDiscontinuity
+		}
+		r.wal, r.offset, r.checksum = h, walHeaderSize, h.checksum
+	}
+
+	frames, end, checksum, err := readWALFrames(f, h, r.offset, r.checksum)
+	if err != nil || len(frames) == 0 {
+		return nil, err
+	}
+	r.offset, r.checksum = end, checksum
+
+	return append(slices.Clone(h.raw), frames...), nil
+}
+
+// snapshot starts a new generation from a copy of the database.
+func (r *Replicator) snapshot(ctx context.Context) error {
+	f, err := os.CreateTemp("", "conduit-snapshot-*.sqlite")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	var at time.Time
+	if err := r.db.WriteWithoutTx(ctx, func(conn *sqlite.Conn) error {
+		at = time.Now()
+		r.releaseRead()
+
+		before, err := readWALHeaderFile(r.filename + "-wal")
+		if err != nil {
+			return err
+		}
+		if err := checkpoint(conn); err != nil {
+			return err
+		}
+
+		dst, err := sqlite.OpenConn(f.Name(), sqlite.OpenReadWrite)
+		if err != nil {
+			return fmt.Errorf("failed to open snapshot file: %w", err)
+		}
+		defer dst.Close()
+		if err := copyDatabase(dst, conn); err != nil {
+			return err
+		}
+		if err := sqlitex.ExecuteTransient(dst, "PRAGMA journal_mode = DELETE;", nil); err != nil {
+			return fmt.Errorf("failed to set snapshot journal mode: %w", err)
+		}
+
+		// Anything left in the WAL is part of the snapshot, so shipping
+		// continues from its end
+		r.wal, r.offset, r.checksum = before, 0, [2]uint32{}
+		wal, err := os.Open(r.filename + "-wal")
+		if err == nil {
+			defer wal.Close()
+			h, err := readWALHeader(wal)
+			if err != nil {
+				return err
+			}
+			if h != nil {
+				_, end, checksum, err := readWALFrames(wal, h, walHeaderSize, h.checksum)
+				if err != nil {
+					return err
+				}
+				r.wal, r.offset, r.checksum = h, end, checksum
+			}
+		}
+
+		return r.holdRead()
+	}); err != nil {
+		return fmt.Errorf("failed to snapshot database: %w", err)
+	}
+
+	snapshot, err := os.Open(f.Name())
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer snapshot.Close()
+
+	generation := newGeneration(at)
+	if err := r.target.WriteSnapshot(ctx, generation, snapshot); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	r.generation, r.generationAt, r.segmentIndex = generation, at, 0
+	log.Printf("Started replica generation %s", generation)
+
+	generations, err := r.target.Generations(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list generations: %w", err)
+	}
+	for _, old := range generations[:max(len(generations)-r.opts.Retention, 0)] {
+		if err := r.target.DeleteGeneration(ctx, old); err != nil {
+			return fmt.Errorf("failed to delete old generation: %w", err)
+		}
+	}
+	return nil
+}
+
+// holdRead starts a read transaction so the WAL can't be restarted past the
+// frames that exist now.
+func (r *Replicator) holdRead() error {
+	r.releaseRead()
+	if err := sqlitex.ExecuteTransient(r.reader, "BEGIN;", nil); err != nil {
+		return fmt.Errorf("failed to begin read transaction: %w", err)
+	}
+	if err := sqlitex.ExecuteTransient(r.reader, "SELECT count(*) FROM sqlite_master;", nil); err != nil {
+		return fmt.Errorf("failed to start read transaction: %w", err)
+	}
+	return nil
+}
+
+func (r *Replicator) releaseRead() {
+	if !r.reader.AutocommitEnabled() {
+		sqlitex.ExecuteTransient(r.reader, "ROLLBACK;", nil)
+	}
+}
+
+// checkpoint copies the WAL into the database and truncates it. Readers in
+// the middle of a transaction can keep it from finishing, which is fine, it is
+// tried again later.
+func checkpoint(conn *sqlite.Conn) error {
+	if err := sqlitex.ExecuteTransient(conn, "PRAGMA wal_checkpoint(TRUNCATE);", nil); err != nil {
+		return fmt.Errorf("failed to checkpoint WAL: %w", err)
+	}
+	return nil
+}
+
+func readWALHeaderFile(filename string) (*walHeader, error) {
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAL: %w", err)
+	}
+	defer f.Close()
+	return readWALHeader(f)
+}
+
+// RestoreReplica rebuilds the database as it was at, or as recent as possible
+// if at is zero, into filename from the newest generation that started before
+// then. It returns the time the restored data is from.
+func RestoreReplica(ctx context.Context, target ReplicaTarget, filename string, at time.Time) (time.Time, error) {
+	generations, err := target.Generations(ctx)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to list generations: %w", err)
+	}
+
+	var (
+		generation   string
+		restoredTime time.Time
+	)
+	for _, g := range slices.Backward(generations) {
+		t, err := GenerationTime(g)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if at.IsZero() || !t.After(at) {
+			generation, restoredTime = g, t
+			break
+		}
+	}
+	if generation == "" {
+		return time.Time{}, errors.New("no replica generation to restore from")
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to create database file: %w", err)
+	}
+	lastSegmentTime, err := restoreGeneration(ctx, target, generation, at, f)
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to write database file: %w", closeErr)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !lastSegmentTime.IsZero() {
+		restoredTime = lastSegmentTime
+	}
+
+	// Pages from the WAL mark the file as being in WAL mode
+	conn, err := sqlite.OpenConn(filename, sqlite.OpenReadWrite)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to open restored database: %w", err)
+	}
+	defer conn.Close()
+	if err := sqlitex.ExecuteTransient(conn, "PRAGMA journal_mode = DELETE;", nil); err != nil {
+		return time.Time{}, fmt.Errorf("failed to set journal mode: %w", err)
+	}
+	return restoredTime, nil
+}
+
+// restoreGeneration writes the snapshot of generation into f followed by its
+// segments up to at, returning the time of the last segment applied or zero if
+// there was none.
+func restoreGeneration(ctx context.Context, target ReplicaTarget, generation string, at time.Time, f *os.File) (time.Time, error) {
+	snapshot, err := target.OpenSnapshot(ctx, generation)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	_, err = io.Copy(f, snapshot)
+	snapshot.Close()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to copy snapshot: %w", err)
+	}
+
+	segments, err := target.Segments(ctx, generation)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to list segments: %w", err)
+	}
+	var lastSegmentTime time.Time
+	for i, segment := range segments {
+		if !at.IsZero() && segment.CreatedAt.After(at) {
+			break
+		}
+		if segment.Index != int64(i+1) {
+			return time.Time{}, fmt.Errorf("generation %s is missing segment %d", generation, i+1)
+		}
+
+		rc, err := target.OpenSegment(ctx, generation, segment)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to open segment: %w", err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to read segment: %w", err)
+		}
+		if err := applyWALSegment(f, data); err != nil {
+			return time.Time{}, fmt.Errorf("failed to apply segment %d: %w", segment.Index, err)
+		}
+		lastSegmentTime = segment.CreatedAt
+	}
+	return lastSegmentTime, nil
+}
@@ -0,0 +1,166 @@
+package sql
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestGenerationTime(t *testing.T) {
+	at := time.Date(2024, 5, 6, 7, 8, 9, 10, time.UTC)
+	got, err := GenerationTime(newGeneration(at))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(at) {
+		t.Errorf("got %s, want %s", got, at)
+	}
+	if _, err := GenerationTime("snapshot"); err == nil {
+		t.Error("got no error for a folder that isn't a generation")
+	}
+}
+
+func restoredNotes(t *testing.T, filename string) []string {
+	t.Helper()
+
+	conn, err := sqlite.OpenConn(filename, sqlite.OpenReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var bodies []string
+	if err := sqlitex.Execute(conn, "SELECT body FROM notes ORDER BY rowid", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			bodies = append(bodies, stmt.ColumnText(0))
+			return nil
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return bodies
+}
+
+func TestRestoreReplica(t *testing.T) {
+	ctx := context.Background()
+	cfg := newTestConfig(t)
+	db, err := OpenDB(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	execScript(t, db, `CREATE TABLE notes(body TEXT); INSERT INTO notes(body) VALUES ('snapshot');`)
+
+	replica := NewFileReplica(filepath.Join(t.TempDir(), "replica"))
+	replicator := NewReplicator(db, DBFilename(cfg), replica, ReplicatorOptions{
+		Interval:         10 * time.Millisecond,
+		SnapshotInterval: time.Hour,
+		Retention:        2,
+	})
+	replicateCtx, stopReplicating := context.WithCancel(ctx)
+	replicating := make(chan struct{})
+	go func() {
+		defer close(replicating)
+		if err := replicator.Run(replicateCtx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	waitForSegments := func(t *testing.T, n int) {
+		t.Helper()
+
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			generations, err := replica.Generations(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(generations) == 0 {
+				continue
+			}
+			segments, err := replica.Segments(ctx, generations[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(segments) >= n {
+				return
+			}
+		}
+		t.Fatalf("%d segments weren't shipped", n)
+	}
+
+	// The generation has started once its snapshot is there
+	waitForSegments(t, 0)
+	execScript(t, db, `INSERT INTO notes(body) VALUES ('first');`)
+	waitForSegments(t, 1)
+	afterFirst := time.Now()
+	time.Sleep(20 * time.Millisecond)
+	execScript(t, db, `INSERT INTO notes(body) VALUES ('second');`)
+
+	// The last write is shipped on the way out
+	stopReplicating()
+	<-replicating
+
+	var pageSize int64
+	if err := db.ReadTX(ctx, func(tx *sqlite.Conn) error {
+		return sqlitex.ExecuteTransient(tx, "PRAGMA page_size;", &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				pageSize = stmt.ColumnInt64(0)
+				return nil
+			},
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if replicator.pageSize != pageSize {
+		t.Errorf("checkpoints with page size %d, want %d", replicator.pageSize, pageSize)
+	}
+
+	generations, err := replica.Generations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generations) != 1 {
+		t.Fatalf("got %d generations, want 1", len(generations))
+	}
+	generationAt, _ := GenerationTime(generations[0])
+
+	for name, tc := range map[string]struct {
+		at   time.Time
+		want []string
+	}{
+		"latest":        {want: []string{"snapshot", "first", "second"}},
+		"point in time": {at: afterFirst, want: []string{"snapshot", "first"}},
+		"snapshot only": {at: generationAt, want: []string{"snapshot"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "restored.sqlite")
+			restoredAt, err := RestoreReplica(ctx, replica, filename, tc.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tc.at.IsZero() && restoredAt.After(tc.at) {
+				t.Errorf("restored data from %s, after %s", restoredAt, tc.at)
+			}
+			if err := VerifyBackup(filename); err != nil {
+				t.Errorf("restored database doesn't verify: %v", err)
+			}
+			got := restoredNotes(t, filename)
+			if len(got) != len(tc.want) {
+				t.Fatalf("got notes %q, want %q", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("got notes %q, want %q", got, tc.want)
+				}
+			}
+		})
+	}
+
+	if _, err := RestoreReplica(ctx, replica, filepath.Join(t.TempDir(), "restored.sqlite"), generationAt.Add(-time.Second)); err == nil {
+		t.Error("restored from before the first generation")
+	}
+}
@@ -4,16 +4,14 @@ import (
 	"context"
 	"embed"
 	"fmt"
-	"io"
-	"io/fs"
 	"log"
 	"math/rand"
 	"os"
 	"path/filepath"
-	"slices"
 	"strings"
 	"time"
 
+	"github.com/delaneyj/realworld-datastar/config"
 	"github.com/delaneyj/realworld-datastar/sql/zz"
 	"github.com/delaneyj/toolbelt"
 	"github.com/jaswdr/faker/v2"
@@ -24,45 +22,54 @@ import (
 //go:embed migrations/*.sql
 var migrationsFS embed.FS
 
-func SetupDB(ctx context.Context, dataFolder string, shouldClear bool) (*toolbelt.Database, error) {
-	migrationsDir := "migrations"
-	migrationsFiles, err := migrationsFS.ReadDir(migrationsDir)
+func DBFilename(cfg *config.Config) string {
+	return filepath.Join(cfg.DataFolder, "database", "conduit.sqlite")
+}
+
+// OpenDB opens the database in the configured data folder, clearing it first
+// if asked to, and applies any pending migrations.
+func OpenDB(ctx context.Context, cfg *config.Config) (*toolbelt.Database, error) {
+	db, err := OpenDBWithoutMigrating(ctx, cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read migrations directory: %w", err)
+		return nil, err
 	}
-	slices.SortFunc(migrationsFiles, func(a, b fs.DirEntry) int {
-		return strings.Compare(a.Name(), b.Name())
-	})
-
-	migrations := make([]string, len(migrationsFiles))
-	for i, file := range migrationsFiles {
-		fn := filepath.Join(migrationsDir, file.Name())
-		f, err := migrationsFS.Open(fn)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open migration file: %w", err)
-		}
-		defer f.Close()
-
-		content, err := io.ReadAll(f)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read migration file: %w", err)
-		}
 
-		migrations[i] = string(content)
+	pending, err := MigrateUp(ctx, db, MigrateOptions{})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
+	for _, m := range pending {
+		log.Printf("Applied migration %s", m.Name)
+	}
+	return db, nil
+}
 
-	dbFolder := filepath.Join(dataFolder, "database")
-	if shouldClear {
+// OpenDBWithoutMigrating is OpenDB for tools that inspect or manage the schema
+// themselves.
+func OpenDBWithoutMigrating(ctx context.Context, cfg *config.Config) (*toolbelt.Database, error) {
+	dbFilename := DBFilename(cfg)
+	if cfg.ClearData {
+		dbFolder := filepath.Dir(dbFilename)
 		log.Printf("Clearing database folder: %s", dbFolder)
 		if err := os.RemoveAll(dbFolder); err != nil {
 			return nil, fmt.Errorf("failed to remove database folder: %w", err)
 		}
 	}
-	dbFilename := filepath.Join(dbFolder, "conduit.sqlite")
-	db, err := toolbelt.NewDatabase(ctx, dbFilename, migrations)
+	// Migrations are run by MigrateUp rather than toolbelt so they can be
+	// tracked in schema_migrations
+	db, err := toolbelt.NewDatabase(ctx, dbFilename, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create database: %w", err)
 	}
+	return db, nil
+}
+
+func SetupDB(ctx context.Context, cfg *config.Config) (*toolbelt.Database, error) {
+	db, err := OpenDB(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
 
 	if err := SeedDBIfEmpty(ctx, db); err != nil {
 		return nil, fmt.Errorf("failed to seed database: %w", err)
@@ -71,6 +78,20 @@ func SetupDB(ctx context.Context, dataFolder string, shouldClear bool) (*toolbel
 	return db, nil
 }
 
+type SeedOptions struct {
+	Users    int
+	Articles int
+	Seed     int64
+}
+
+func DefaultSeedOptions() SeedOptions {
+	return SeedOptions{
+		Users:    64,
+		Articles: 500,
+		Seed:     0,
+	}
+}
+
 func SeedDBIfEmpty(ctx context.Context, db *toolbelt.Database) error {
 	isEmpty := true
 	if err := db.ReadTX(ctx, func(tx *sqlite.Conn) error {
@@ -88,30 +109,45 @@ func SeedDBIfEmpty(ctx context.Context, db *toolbelt.Database) error {
 		return nil
 	}
 
+	return SeedDB(ctx, db, DefaultSeedOptions())
+}
+
+// SeedDB fills the database with fake users, tags and articles. The admin
+// user is only created if it doesn't exist yet, so it can be run more than
+// once with different seeds.
+func SeedDB(ctx context.Context, db *toolbelt.Database, opts SeedOptions) error {
 	now := time.Now()
-	randSource := rand.NewSource(0)
+	randSource := rand.NewSource(opts.Seed)
 	r := rand.New(randSource)
 	fake := faker.NewWithSeed(randSource)
 
 	if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
-		userIds := make([]int64, 64)
+		userIds := make([]int64, max(opts.Users, 1))
 		createUserStmt := zz.CreateUser(tx)
 		userIds[0] = 1
 
-		passwordHash, err := bcrypt.GenerateFromPassword([]byte("correctHorseBatteryStapler"), bcrypt.DefaultCost)
+		admin, err := zz.OnceReadByIDUser(tx, 1)
 		if err != nil {
-			return fmt.Errorf("failed to hash password: %w", err)
+			return fmt.Errorf("failed to get admin user: %w", err)
 		}
+		if admin == nil {
+			passwordHash, err := bcrypt.GenerateFromPassword([]byte("correctHorseBatteryStapler"), bcrypt.DefaultCost)
+			if err != nil {
+				return fmt.Errorf("failed to hash password: %w", err)
+			}
 
-		if err := createUserStmt.Run(&zz.UserModel{
-			Id:           1,
-			Username:     "admin",
-			Email:        "admin@example.com",
-			PasswordHash: passwordHash,
-			Bio:          "Admin user",
-			ImageUrl:     "https://i.pravatar.cc/150?u=1",
-		}); err != nil {
-			return fmt.Errorf("failed to create admin user: %w", err)
+			if err := createUserStmt.Run(&zz.UserModel{
+				Id:              1,
+				Username:        "admin",
+				Email:           "admin@example.com",
+				PasswordHash:    passwordHash,
+				Bio:             "Admin user",
+				ImageUrl:        "/avatars/1.svg",
+				IsAdmin:         true,
+				EmailVerifiedAt: now,
+			}); err != nil {
+				return fmt.Errorf("failed to create admin user: %w", err)
+			}
 		}
 
 		for i := 1; i < len(userIds); i++ {
@@ -123,12 +159,13 @@ func SeedDBIfEmpty(ctx context.Context, db *toolbelt.Database) error {
 			}
 
 			if err := createUserStmt.Run(&zz.UserModel{
-				Id:           userID,
-				Username:     fmt.Sprintf("%s%04d", fake.Internet().User(), i),
-				Email:        fake.Internet().Email(),
-				Bio:          fake.Lorem().Sentences(1)[0],
-				ImageUrl:     fmt.Sprintf("https://i.pravatar.cc/150?u=%d", userID),
-				PasswordHash: passwordHash,
+				Id:              userID,
+				Username:        fmt.Sprintf("%s%04d", fake.Internet().User(), i),
+				Email:           fake.Internet().Email(),
+				Bio:             fake.Lorem().Sentences(1)[0],
+				ImageUrl:        fmt.Sprintf("/avatars/%d.svg", userID),
+				PasswordHash:    passwordHash,
+				EmailVerifiedAt: now,
 			}); err != nil {
 				return fmt.Errorf("failed to create user: %w", err)
 			}
@@ -155,12 +192,23 @@ func SeedDBIfEmpty(ctx context.Context, db *toolbelt.Database) error {
 		}
 
 		tagIDs := make([]int64, 20)
+		tagByNameStmt := zz.TagByName(tx)
 		createTagStmt := zz.CreateTag(tx)
 		for i := range tagIDs {
+			name := fmt.Sprintf("%s%04d", fake.Lorem().Word(), i)
+			existing, err := tagByNameStmt.Run(name)
+			if err != nil {
+				return fmt.Errorf("failed to get tag by name: %w", err)
+			}
+			if existing != nil {
+				tagIDs[i] = existing.Id
+				continue
+			}
+
 			id := toolbelt.NextID()
 			if err := createTagStmt.Run(&zz.TagModel{
 				Id:   id,
-				Name: fmt.Sprintf("%s%04d", fake.Lorem().Word(), i),
+				Name: name,
 			}); err != nil {
 				return fmt.Errorf("failed to create tag: %w", err)
 			}
@@ -169,9 +217,10 @@ func SeedDBIfEmpty(ctx context.Context, db *toolbelt.Database) error {
 
 		createArticleTagStmt := zz.CreateArticleTag(tx)
 		createArticleStmt := zz.CreateArticle(tx)
-		for i := 0; i < 500; i++ {
+		createArticleRevisionStmt := zz.CreateArticleRevision(tx)
+		for i := 0; i < opts.Articles; i++ {
 			articleID := toolbelt.NextID()
-			if err := createArticleStmt.Run(&zz.ArticleModel{
+			article := &zz.ArticleModel{
 				Id:          articleID,
 				Slug:        fake.Lorem().Sentences(1)[0],
 				Title:       fake.Lorem().Sentences(1)[0],
@@ -180,9 +229,23 @@ func SeedDBIfEmpty(ctx context.Context, db *toolbelt.Database) error {
 				CreatedAt:   now,
 				UpdatedAt:   now,
 				AuthorId:    toolbelt.RandSliceItem(r, userIds),
-			}); err != nil {
+				Status:      "published",
+				PublishedAt: now,
+			}
+			if err := createArticleStmt.Run(article); err != nil {
 				return fmt.Errorf("failed to create article: %w", err)
 			}
+			if err := createArticleRevisionStmt.Run(&zz.ArticleRevisionModel{
+				Id:          toolbelt.NextID(),
+				ArticleId:   articleID,
+				EditorId:    article.AuthorId,
+				Title:       article.Title,
+				Description: article.Description,
+				Body:        article.Body,
+				CreatedAt:   now,
+			}); err != nil {
+				return fmt.Errorf("failed to create article revision: %w", err)
+			}
 
 			for i := 0; i < r.Intn(10); i++ {
 				if err := createArticleTagStmt.Run(&zz.ArticleTagModel{
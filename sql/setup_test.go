@@ -0,0 +1,80 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/delaneyj/toolbelt"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func imageURLs(t *testing.T, db *toolbelt.Database) map[int64]string {
+	t.Helper()
+
+	urls := map[int64]string{}
+	if err := db.ReadTX(context.Background(), func(tx *sqlite.Conn) error {
+		return sqlitex.Execute(tx, "SELECT id, image_url FROM users", &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				urls[stmt.ColumnInt64(0)] = stmt.ColumnText(1)
+				return nil
+			},
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return urls
+}
+
+func TestSeedDBAvatars(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	if err := SeedDB(ctx, db, SeedOptions{Users: 3, Articles: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	urls := imageURLs(t, db)
+	if len(urls) != 3 {
+		t.Fatalf("got %d users, want 3", len(urls))
+	}
+	for id, url := range urls {
+		if want := fmt.Sprintf("/avatars/%d.svg", id); url != want {
+			t.Errorf("user %d: got image %q, want %q", id, url, want)
+		}
+	}
+}
+
+func TestMigratePravatarURLs(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	if err := SeedDB(ctx, db, SeedOptions{Users: 2, Articles: 1}); err != nil {
+		t.Fatal(err)
+	}
+	execScript(t, db, `INSERT INTO users(id, username, email, password_hash, bio, image_url) VALUES (7, 'custom', 'custom@example.com', x'00', '', 'https://example.com/me.png');`)
+	before := imageURLs(t, db)
+
+	// Back to before avatars were generated, and forward again
+	migrations := loadTestMigrations(t)
+	if _, err := MigrateDown(ctx, db, len(migrations)-8, MigrateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for id, url := range imageURLs(t, db) {
+		want := fmt.Sprintf("https://i.pravatar.cc/150?u=%d", id)
+		if id == 7 {
+			want = before[id]
+		}
+		if url != want {
+			t.Errorf("user %d: got image %q, want %q", id, url, want)
+		}
+	}
+
+	if _, err := MigrateUp(ctx, db, MigrateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for id, url := range imageURLs(t, db) {
+		if url != before[id] {
+			t.Errorf("user %d: got image %q, want %q", id, url, before[id])
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package sql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The WAL file format, see https://www.sqlite.org/fileformat.html#the_write_ahead_log
+
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+	walMagicLE         = 0x377f0682
+	walMagicBE         = 0x377f0683
+)
+
+type walHeader struct {
+	raw       []byte
+	bigEndian bool
+	pageSize  int64
+	ckptSeq   uint32
+	salt1     uint32
+	salt2     uint32
+	checksum  [2]uint32
+}
+
+func (h *walHeader) frameSize() int64 {
+	return walFrameHeaderSize + h.pageSize
+}
+
+func (h *walHeader) sameWAL(other *walHeader) bool {
+	return other != nil && h.salt1 == other.salt1 && h.salt2 == other.salt2
+}
+
+// readWALHeader returns nil if the WAL is missing, empty or has no valid
+// header, which is how SQLite treats it too.
+func readWALHeader(r io.ReaderAt) (*walHeader, error) {
+	raw := make([]byte, walHeaderSize)
+	if _, err := r.ReadAt(raw, 0); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read WAL header: %w", err)
+	}
+
+	h := &walHeader{raw: raw}
+	switch binary.BigEndian.Uint32(raw[0:4]) {
+	case walMagicLE:
+	case walMagicBE:
+		h.bigEndian = true
+	default:
+		return nil, nil
+	}
+	h.pageSize = int64(binary.BigEndian.Uint32(raw[8:12]))
+	if h.pageSize == 1 {
+		h.pageSize = 65536
+	}
+	h.ckptSeq = binary.BigEndian.Uint32(raw[12:16])
+	h.salt1 = binary.BigEndian.Uint32(raw[16:20])
+	h.salt2 = binary.BigEndian.Uint32(raw[20:24])
+
+	h.checksum = walChecksum(h.bigEndian, [2]uint32{}, raw[:24])
+	if h.checksum[0] != binary.BigEndian.Uint32(raw[24:28]) || h.checksum[1] != binary.BigEndian.Uint32(raw[28:32]) {
+		return nil, nil
+	}
+	return h, nil
+}
+
+func walChecksum(bigEndian bool, s [2]uint32, b []byte) [2]uint32 {
+	order := binary.ByteOrder(binary.LittleEndian)
+	if bigEndian {
+		order = binary.BigEndian
+	}
+	for i := 0; i+8 <= len(b); i += 8 {
+		s[0] += order.Uint32(b[i:]) + s[1]
+		s[1] += order.Uint32(b[i+4:]) + s[0]
+	}
+	return s
+}
+
+// readWALFrames returns the frames of committed transactions that follow
+// offset, validating them the way SQLite does during recovery: a frame only
+// counts if its salts match the header and its checksum continues the chain
+// from checksum. It stops at the last commit so partial transactions are
+// picked up once they are complete.
+func readWALFrames(f *os.File, h *walHeader, offset int64, checksum [2]uint32) (frames []byte, end int64, endChecksum [2]uint32, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, checksum, fmt.Errorf("failed to stat WAL: %w", err)
+	}
+
+	end, endChecksum = offset, checksum
+	frame := make([]byte, h.frameSize())
+	for pos := offset; pos+h.frameSize() <= info.Size(); pos += h.frameSize() {
+		if _, err := f.ReadAt(frame, pos); err != nil {
+			return nil, 0, checksum, fmt.Errorf("failed to read WAL frame: %w", err)
+		}
+		if binary.BigEndian.Uint32(frame[8:12]) != h.salt1 || binary.BigEndian.Uint32(frame[12:16]) != h.salt2 {
+			break
+		}
+		checksum = walChecksum(h.bigEndian, checksum, frame[:8])
+		checksum = walChecksum(h.bigEndian, checksum, frame[walFrameHeaderSize:])
+		if checksum[0] != binary.BigEndian.Uint32(frame[16:20]) || checksum[1] != binary.BigEndian.Uint32(frame[20:24]) {
+			break
+		}
+
+		frames = append(frames, frame...)
+		if binary.BigEndian.Uint32(frame[4:8]) != 0 {
+			end, endChecksum = pos+h.frameSize(), checksum
+		}
+	}
+	return frames[:end-offset], end, endChecksum, nil
+}
+
+// applyWALSegment writes the pages of a shipped segment, a WAL header followed
+// by committed frames, straight into the database file the way a checkpoint
+// would.
+func applyWALSegment(db *os.File, segment []byte) error {
+	h, err := readWALHeader(bytes.NewReader(segment))
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		return errors.New("invalid WAL segment header")
+	}
+
+	frames := segment[walHeaderSize:]
+	if int64(len(frames))%h.frameSize() != 0 {
+		return errors.New("truncated WAL segment")
+	}
+	for len(frames) > 0 {
+		frame := frames[:h.frameSize()]
+		frames = frames[h.frameSize():]
+
+		pgno := int64(binary.BigEndian.Uint32(frame[0:4]))
+		if _, err := db.WriteAt(frame[walFrameHeaderSize:], (pgno-1)*h.pageSize); err != nil {
+			return fmt.Errorf("failed to write page %d: %w", pgno, err)
+		}
+		if dbSize := int64(binary.BigEndian.Uint32(frame[4:8])); dbSize != 0 {
+			if err := db.Truncate(dbSize * h.pageSize); err != nil {
+				return fmt.Errorf("failed to resize database: %w", err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package sql
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testWALPageSize = 512
+
+type testWALFrame struct {
+	pgno   uint32
+	dbSize uint32 // non-zero for the last frame of a transaction
+	fill   byte
+}
+
+// buildWAL writes a WAL the way SQLite would, with the header and every frame
+// checksummed in a chain.
+func buildWAL(bigEndian bool, salt1, salt2 uint32, frames ...testWALFrame) []byte {
+	magic := uint32(walMagicLE)
+	if bigEndian {
+		magic = walMagicBE
+	}
+	header := make([]byte, walHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], magic)
+	binary.BigEndian.PutUint32(header[4:8], 3007000)
+	binary.BigEndian.PutUint32(header[8:12], testWALPageSize)
+	binary.BigEndian.PutUint32(header[12:16], 1)
+	binary.BigEndian.PutUint32(header[16:20], salt1)
+	binary.BigEndian.PutUint32(header[20:24], salt2)
+	checksum := walChecksum(bigEndian, [2]uint32{}, header[:24])
+	binary.BigEndian.PutUint32(header[24:28], checksum[0])
+	binary.BigEndian.PutUint32(header[28:32], checksum[1])
+
+	wal := bytes.NewBuffer(header)
+	for _, f := range frames {
+		frame := make([]byte, walFrameHeaderSize+testWALPageSize)
+		binary.BigEndian.PutUint32(frame[0:4], f.pgno)
+		binary.BigEndian.PutUint32(frame[4:8], f.dbSize)
+		binary.BigEndian.PutUint32(frame[8:12], salt1)
+		binary.BigEndian.PutUint32(frame[12:16], salt2)
+		copy(frame[walFrameHeaderSize:], bytes.Repeat([]byte{f.fill}, testWALPageSize))
+		checksum = walChecksum(bigEndian, checksum, frame[:8])
+		checksum = walChecksum(bigEndian, checksum, frame[walFrameHeaderSize:])
+		binary.BigEndian.PutUint32(frame[16:20], checksum[0])
+		binary.BigEndian.PutUint32(frame[20:24], checksum[1])
+		wal.Write(frame)
+	}
+	return wal.Bytes()
+}
+
+func writeTestWAL(t *testing.T, wal []byte) *os.File {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "conduit.sqlite-wal")
+	if err := os.WriteFile(filename, wal, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestReadWALHeader(t *testing.T) {
+	for name, bigEndian := range map[string]bool{"little endian": false, "big endian": true} {
+		t.Run(name, func(t *testing.T) {
+			h, err := readWALHeader(bytes.NewReader(buildWAL(bigEndian, 11, 22)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h == nil {
+				t.Fatal("valid header was ignored")
+			}
+			if h.bigEndian != bigEndian || h.pageSize != testWALPageSize || h.ckptSeq != 1 || h.salt1 != 11 || h.salt2 != 22 {
+				t.Errorf("got %+v", h)
+			}
+			if h.frameSize() != walFrameHeaderSize+testWALPageSize {
+				t.Errorf("got frame size %d", h.frameSize())
+			}
+		})
+	}
+
+	// SQLite stores a page size of 65536 as 1
+	large := buildWAL(false, 1, 2)
+	binary.BigEndian.PutUint32(large[8:12], 1)
+	checksum := walChecksum(false, [2]uint32{}, large[:24])
+	binary.BigEndian.PutUint32(large[24:28], checksum[0])
+	binary.BigEndian.PutUint32(large[28:32], checksum[1])
+	if h, err := readWALHeader(bytes.NewReader(large)); err != nil || h == nil || h.pageSize != 65536 {
+		t.Errorf("got %+v and error %v for the largest page size", h, err)
+	}
+
+	badMagic := buildWAL(false, 1, 2)
+	badMagic[3] = 0
+	badChecksum := buildWAL(false, 1, 2)
+	badChecksum[31]++
+	for name, raw := range map[string][]byte{
+		"empty":        nil,
+		"short":        buildWAL(false, 1, 2)[:walHeaderSize-1],
+		"bad magic":    badMagic,
+		"bad checksum": badChecksum,
+	} {
+		t.Run(name, func(t *testing.T) {
+			h, err := readWALHeader(bytes.NewReader(raw))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h != nil {
+				t.Error("invalid header was read")
+			}
+		})
+	}
+}
+
+func TestSameWAL(t *testing.T) {
+	a, _ := readWALHeader(bytes.NewReader(buildWAL(false, 1, 2)))
+	b, _ := readWALHeader(bytes.NewReader(buildWAL(false, 1, 2)))
+	c, _ := readWALHeader(bytes.NewReader(buildWAL(false, 1, 3)))
+	if !a.sameWAL(b) || a.sameWAL(c) || a.sameWAL(nil) {
+		t.Error("WALs are only the same when their salts match")
+	}
+}
+
+func TestReadWALFrames(t *testing.T) {
+	frameSize := int64(walFrameHeaderSize + testWALPageSize)
+
+	for name, tc := range map[string]struct {
+		wal        []byte
+		wantFrames int
+	}{
+		"committed": {
+			wal:        buildWAL(false, 1, 2, testWALFrame{pgno: 1, fill: 'a'}, testWALFrame{pgno: 2, dbSize: 2, fill: 'b'}),
+			wantFrames: 2,
+		},
+		"big endian": {
+			wal:        buildWAL(true, 1, 2, testWALFrame{pgno: 1, dbSize: 1, fill: 'a'}),
+			wantFrames: 1,
+		},
+		// The second transaction is still being written
+		"partial transaction": {
+			wal:        buildWAL(false, 1, 2, testWALFrame{pgno: 1, dbSize: 1, fill: 'a'}, testWALFrame{pgno: 2, fill: 'b'}),
+			wantFrames: 1,
+		},
+		"partial frame": {
+			wal:        buildWAL(false, 1, 2, testWALFrame{pgno: 1, dbSize: 1, fill: 'a'}, testWALFrame{pgno: 2, dbSize: 2, fill: 'b'})[:walHeaderSize+frameSize+10],
+			wantFrames: 1,
+		},
+		"nothing committed": {
+			wal: buildWAL(false, 1, 2, testWALFrame{pgno: 1, fill: 'a'}),
+		},
+		"empty": {
+			wal: buildWAL(false, 1, 2),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := writeTestWAL(t, tc.wal)
+			h, err := readWALHeader(f)
+			if err != nil || h == nil {
+				t.Fatalf("got header %v and error %v", h, err)
+			}
+
+			frames, end, _, err := readWALFrames(f, h, walHeaderSize, h.checksum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := int64(tc.wantFrames) * frameSize; int64(len(frames)) != want {
+				t.Errorf("got %d bytes of frames, want %d", len(frames), want)
+			}
+			if want := walHeaderSize + int64(tc.wantFrames)*frameSize; end != want {
+				t.Errorf("got end %d, want %d", end, want)
+			}
+			if !bytes.Equal(frames, tc.wal[walHeaderSize:walHeaderSize+len(frames)]) {
+				t.Error("frames don't match the WAL")
+			}
+		})
+	}
+}
+
+func TestReadWALFramesStopsAtInvalidFrames(t *testing.T) {
+	frameSize := walFrameHeaderSize + testWALPageSize
+	first := testWALFrame{pgno: 1, dbSize: 1, fill: 'a'}
+	second := testWALFrame{pgno: 2, dbSize: 2, fill: 'b'}
+
+	// Left over from before the WAL was restarted with new salts
+	stale := buildWAL(false, 1, 2, first)
+	stale = append(stale, buildWAL(false, 1, 9, first, second)[walHeaderSize+frameSize:]...)
+
+	corrupt := buildWAL(false, 1, 2, first, second)
+	corrupt[walHeaderSize+frameSize+walFrameHeaderSize]++
+
+	for name, wal := range map[string][]byte{"stale salt": stale, "bad checksum": corrupt} {
+		t.Run(name, func(t *testing.T) {
+			f := writeTestWAL(t, wal)
+			h, _ := readWALHeader(f)
+			frames, end, _, err := readWALFrames(f, h, walHeaderSize, h.checksum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(frames) != frameSize || end != int64(walHeaderSize+frameSize) {
+				t.Errorf("got %d bytes of frames ending at %d, want only the first frame", len(frames), end)
+			}
+		})
+	}
+}
+
+func TestReadWALFramesContinues(t *testing.T) {
+	frameSize := int64(walFrameHeaderSize + testWALPageSize)
+	wal := buildWAL(false, 1, 2, testWALFrame{pgno: 1, dbSize: 1, fill: 'a'}, testWALFrame{pgno: 2, dbSize: 2, fill: 'b'})
+	f := writeTestWAL(t, wal)
+	h, _ := readWALHeader(f)
+
+	_, end, checksum, err := readWALFrames(f, h, walHeaderSize, h.checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing new since the last read
+	frames, again, _, err := readWALFrames(f, h, end, checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 0 || again != end {
+		t.Errorf("got %d bytes of frames ending at %d reading again", len(frames), again)
+	}
+
+	// Picking up after the first frame needs that frame's checksum
+	frames, _, _, err = readWALFrames(f, h, walHeaderSize+frameSize, h.checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 0 {
+		t.Error("frame was read without continuing the checksum chain")
+	}
+}
+
+func TestApplyWALSegment(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "conduit.sqlite")
+	if err := os.WriteFile(filename, bytes.Repeat([]byte{'x'}, 3*testWALPageSize), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	db, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Page 2 is rewritten and the database shrinks to two pages on commit
+	segment := buildWAL(false, 1, 2, testWALFrame{pgno: 2, fill: 'a'}, testWALFrame{pgno: 1, dbSize: 2, fill: 'b'})
+	if err := applyWALSegment(db, segment); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(bytes.Repeat([]byte{'b'}, testWALPageSize), bytes.Repeat([]byte{'a'}, testWALPageSize)...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %d bytes starting %q, want pages b and a", len(got), got[:1])
+	}
+
+	if err := applyWALSegment(db, segment[:len(segment)-1]); err == nil {
+		t.Error("truncated segment was applied")
+	}
+	if err := applyWALSegment(db, segment[walHeaderSize:]); err == nil {
+		t.Error("segment without a header was applied")
+	}
+}
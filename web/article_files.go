@@ -0,0 +1,343 @@
+package web
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"gopkg.in/yaml.v3"
+	"zombiezen.com/go/sqlite"
+)
+
+// maxArticleFileSize and maxArticleZipSize keep imports from using up
+// memory. A small zip can still expand to far more, so the entries in one and
+// what they decompress to are capped too.
+const (
+	maxArticleFileSize         = 4 << 20
+	maxArticleZipSize          = 64 << 20
+	maxArticleZipEntries       = 1000
+	maxArticleZipExtractedSize = 64 << 20
+)
+
+const frontMatterDelimiter = "---"
+
+type articleFrontMatter struct {
+	Title       string    `yaml:"title"`
+	Description string    `yaml:"description"`
+	Tags        []string  `yaml:"tags,omitempty"`
+	Author      string    `yaml:"author,omitempty"`
+	Created     time.Time `yaml:"created,omitempty"`
+	Updated     time.Time `yaml:"updated,omitempty"`
+	Status      string    `yaml:"status,omitempty"`
+	Published   time.Time `yaml:"published,omitempty"`
+}
+
+// ArticleFile is an article as Markdown with YAML front matter.
+type ArticleFile struct {
+	Name       string
+	Data       []byte
+	ModifiedAt time.Time
+}
+
+type ArticleImportResult struct {
+	File  string `json:"file"`
+	Slug  string `json:"slug,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// ParseArticleMarkdown reads a file written by ArticleMarkdown. The author in
+// the front matter is informational, imported articles belong to whoever
+// imports them.
+func ParseArticleMarkdown(data []byte) (*NewArticle, error) {
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.TrimPrefix(text, "\ufeff")
+
+	rest, ok := strings.CutPrefix(text, frontMatterDelimiter+"\n")
+	if !ok {
+		return nil, errors.New("missing front matter")
+	}
+	rawFrontMatter, body, ok := strings.Cut(rest, "\n"+frontMatterDelimiter+"\n")
+	if !ok {
+		rawFrontMatter, ok = strings.CutSuffix(rest, "\n"+frontMatterDelimiter)
+		if !ok {
+			return nil, errors.New("unterminated front matter")
+		}
+	}
+
+	fm := &articleFrontMatter{}
+	dec := yaml.NewDecoder(strings.NewReader(rawFrontMatter))
+	dec.KnownFields(true)
+	if err := dec.Decode(fm); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("invalid front matter: %w", err)
+	}
+
+	a := &NewArticle{
+		Title:       fm.Title,
+		Description: fm.Description,
+		Body:        body,
+		CreatedAt:   fm.Created,
+		UpdatedAt:   fm.Updated,
+		Status:      fm.Status,
+		PublishAt:   fm.Published,
+	}
+	for _, tag := range fm.Tags {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			a.TagNames = append(a.TagNames, tag)
+		}
+	}
+	return a, nil
+}
+
+// ArticleMarkdown is the export format of an article, named after its slug.
+func ArticleMarkdown(tx *sqlite.Conn, article *zz.ArticleModel) (*ArticleFile, error) {
+	author, err := zz.OnceReadByIDUser(tx, article.AuthorId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get author: %w", err)
+	}
+	tags, err := zz.OnceTagsForArticle(tx, article.Id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tags: %w", err)
+	}
+
+	fm := &articleFrontMatter{
+		Title:       article.Title,
+		Description: article.Description,
+		Created:     article.CreatedAt.UTC(),
+		Updated:     article.UpdatedAt.UTC(),
+		Status:      article.Status,
+	}
+	if article.Status != ArticleDraft {
+		fm.Published = article.PublishedAt.UTC()
+	}
+	if author != nil {
+		fm.Author = author.Username
+	}
+	for _, tag := range tags {
+		fm.Tags = append(fm.Tags, tag.Name)
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString(frontMatterDelimiter + "\n")
+	if err := yaml.NewEncoder(buf).Encode(fm); err != nil {
+		return nil, fmt.Errorf("failed to write front matter: %w", err)
+	}
+	buf.WriteString(frontMatterDelimiter + "\n\n")
+	buf.WriteString(article.Body)
+	buf.WriteString("\n")
+
+	return &ArticleFile{
+		Name:       article.Slug + ".md",
+		Data:       buf.Bytes(),
+		ModifiedAt: article.UpdatedAt,
+	}, nil
+}
+
+// ExportArticles writes every article by authorID to w as a zip of Markdown
+// files, unpublished ones only if drafts is set.
+func ExportArticles(ctx context.Context, db *toolbelt.Database, w io.Writer, authorID int64, drafts bool) error {
+	var files []*ArticleFile
+	if err := db.ReadTX(ctx, func(tx *sqlite.Conn) error {
+		articles, err := zz.OnceArticlesByAuthor(tx, authorID)
+		if err != nil {
+			return fmt.Errorf("failed to get articles: %w", err)
+		}
+		for _, res := range articles {
+			article := zz.ArticleModel(res)
+			if !drafts && article.Status != ArticlePublished {
+				continue
+			}
+			file, err := ArticleMarkdown(tx, &article)
+			if err != nil {
+				return err
+			}
+			files = append(files, file)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     file.Name,
+			Method:   zip.Deflate,
+			Modified: file.ModifiedAt,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add %s to zip: %w", file.Name, err)
+		}
+		if _, err := fw.Write(file.Data); err != nil {
+			return fmt.Errorf("failed to write %s to zip: %w", file.Name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to finish zip: %w", err)
+	}
+	return nil
+}
+
+// ImportArticles creates an article by authorID from each file the same way
+// the editor does. Every file is imported on its own, so one bad file doesn't
+// stop the rest.
+func ImportArticles(ctx context.Context, db *toolbelt.Database, authorID int64, files []*ArticleFile) []ArticleImportResult {
+	results := make([]ArticleImportResult, 0, len(files))
+	for _, file := range files {
+		result := ArticleImportResult{File: file.Name}
+
+		slug, err := importArticle(ctx, db, authorID, file)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Slug = slug
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func importArticle(ctx context.Context, db *toolbelt.Database, authorID int64, file *ArticleFile) (string, error) {
+	a, err := ParseArticleMarkdown(file.Data)
+	if err != nil {
+		return "", err
+	}
+	if validationErrors := a.validate(); len(validationErrors) > 0 {
+		return "", errors.Join(validationErrors...)
+	}
+
+	var article *zz.ArticleModel
+	if err := db.WriteTX(ctx, func(tx *sqlite.Conn) (err error) {
+		article, err = createArticle(tx, authorID, a)
+		return err
+	}); err != nil {
+		return "", err
+	}
+	return article.Slug, nil
+}
+
+// ReadArticleFiles collects the Markdown files at name, which can be a single
+// file, a folder searched recursively or a zip.
+func ReadArticleFiles(name string) ([]*ArticleFile, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		if strings.EqualFold(filepath.Ext(name), ".zip") {
+			data, err := readLimited(name, maxArticleZipSize)
+			if err != nil {
+				return nil, err
+			}
+			return ArticleFilesFromZip(name, data)
+		}
+		data, err := readLimited(name, maxArticleFileSize)
+		if err != nil {
+			return nil, err
+		}
+		return []*ArticleFile{{Name: name, Data: data}}, nil
+	}
+
+	var files []*ArticleFile
+	if err := filepath.WalkDir(name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(name, p)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isArticleFileName(rel) {
+			return nil
+		}
+		data, err := readLimited(p, maxArticleFileSize)
+		if err != nil {
+			return err
+		}
+		files = append(files, &ArticleFile{Name: p, Data: data})
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return files, nil
+}
+
+// ArticleFilesFromZip returns the Markdown files in a zip, such as one written
+// by ExportArticles, named after their path inside the zip called name.
+func ArticleFilesFromZip(name string, data []byte) ([]*ArticleFile, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zip: %w", err)
+	}
+	if len(zr.File) > maxArticleZipEntries {
+		return nil, fmt.Errorf("zip has more than %d entries", maxArticleZipEntries)
+	}
+
+	var (
+		files     []*ArticleFile
+		extracted int
+	)
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() || !isArticleFileName(zf.Name) {
+			continue
+		}
+
+		rc, err := zf.Open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s in zip: %w", zf.Name, err)
+		}
+		data, err := io.ReadAll(io.LimitReader(rc, maxArticleFileSize+1))
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s in zip: %w", zf.Name, err)
+		}
+		if len(data) > maxArticleFileSize {
+			return nil, fmt.Errorf("%s in zip is too large", zf.Name)
+		}
+		if extracted += len(data); extracted > maxArticleZipExtractedSize {
+			return nil, fmt.Errorf("zip is larger than %d MB extracted", maxArticleZipExtractedSize>>20)
+		}
+		files = append(files, &ArticleFile{Name: name + "/" + zf.Name, Data: data})
+	}
+	return files, nil
+}
+
+func readLimited(name string, limit int64) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s is too large", name)
+	}
+	return data, nil
+}
+
+// isArticleFileName skips hidden files like the __MACOSX folder zips made on
+// macOS come with.
+func isArticleFileName(name string) bool {
+	name = filepath.ToSlash(name)
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") && part != "." || part == "__MACOSX" {
+			return false
+		}
+	}
+	return strings.EqualFold(path.Ext(name), ".md")
+}
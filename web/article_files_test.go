@@ -0,0 +1,169 @@
+package web
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type testZipEntry struct {
+	name string
+	data []byte
+}
+
+func buildZip(t *testing.T, entries ...testZipEntry) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, e := range entries {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: e.name, Method: zip.Deflate})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseArticleMarkdown(t *testing.T) {
+	a, err := ParseArticleMarkdown([]byte("\ufeff---\r\ntitle: Dragons\r\ndescription: All about them\r\ntags: [dragons, ' ', fire]\r\n---\r\n\r\nThey fly.\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Title != "Dragons" || a.Description != "All about them" || a.Body != "\nThey fly.\n" {
+		t.Errorf("got %+v", a)
+	}
+	if len(a.TagNames) != 2 || a.TagNames[0] != "dragons" || a.TagNames[1] != "fire" {
+		t.Errorf("got tags %q", a.TagNames)
+	}
+
+	for name, tc := range map[string]struct {
+		data string
+		want string
+	}{
+		"no front matter": {data: "# Dragons", want: "missing front matter"},
+		"unterminated":    {data: "---\ntitle: Dragons\n", want: "unterminated front matter"},
+		"unknown field":   {data: "---\ntitle: Dragons\nsubtitle: Big ones\n---\n", want: "invalid front matter"},
+		"invalid yaml":    {data: "---\ntitle: [Dragons\n---\n", want: "invalid front matter"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseArticleMarkdown([]byte(tc.data)); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got error %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestArticleFilesFromZip(t *testing.T) {
+	data := buildZip(t,
+		testZipEntry{name: "articles/dragons.md", data: []byte("dragons")},
+		testZipEntry{name: "articles/", data: nil},
+		testZipEntry{name: "articles/notes.txt", data: []byte("notes")},
+		testZipEntry{name: "articles/.hidden.md", data: []byte("hidden")},
+		testZipEntry{name: "__MACOSX/articles/._dragons.md", data: []byte("resource fork")},
+		testZipEntry{name: "WYVERNS.MD", data: []byte("wyverns")},
+	)
+
+	files, err := ArticleFilesFromZip("export.zip", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("got %d files, want 2", len(files))
+	}
+	if files[0].Name != "export.zip/articles/dragons.md" || string(files[0].Data) != "dragons" {
+		t.Errorf("got %s: %q", files[0].Name, files[0].Data)
+	}
+	if files[1].Name != "export.zip/WYVERNS.MD" {
+		t.Errorf("got %s", files[1].Name)
+	}
+
+	if _, err := ArticleFilesFromZip("export.zip", []byte("not a zip")); err == nil {
+		t.Error("got no error for something that isn't a zip")
+	}
+}
+
+func TestArticleFilesFromZipLimits(t *testing.T) {
+	var tooMany []testZipEntry
+	for i := range maxArticleZipEntries + 1 {
+		// Even entries that would be skipped count
+		tooMany = append(tooMany, testZipEntry{name: fmt.Sprintf("%d.txt", i)})
+	}
+
+	// Each file is within the limit, together they aren't, and they compress
+	// to almost nothing
+	page := bytes.Repeat([]byte{'a'}, maxArticleFileSize)
+	var bomb []testZipEntry
+	for i := range maxArticleZipExtractedSize/maxArticleFileSize + 1 {
+		bomb = append(bomb, testZipEntry{name: fmt.Sprintf("%d.md", i), data: page})
+	}
+
+	for name, tc := range map[string]struct {
+		entries []testZipEntry
+		want    string
+	}{
+		"too many entries":    {entries: tooMany, want: "more than 1000 entries"},
+		"file too large":      {entries: []testZipEntry{{name: "large.md", data: append(page, 'a')}}, want: "large.md in zip is too large"},
+		"too large extracted": {entries: bomb, want: "larger than 64 MB extracted"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			data := buildZip(t, tc.entries...)
+			if len(data) > maxArticleZipSize {
+				t.Fatalf("zip is %d bytes, too large to get here", len(data))
+			}
+			if _, err := ArticleFilesFromZip("export.zip", data); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got error %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestExportImportArticles(t *testing.T) {
+	ts := newTestServer(t)
+	jakeID, jakeToken := ts.register(t, "jake")
+	janeID, _ := ts.register(t, "jane")
+	createAPIArticle(t, ts, jakeToken, "Dragons", "dragons", "fire")
+
+	buf := &bytes.Buffer{}
+	if err := ExportArticles(context.Background(), ts.db, buf, jakeID, false); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ArticleFilesFromZip("export.zip", buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "export.zip/dragons.md" {
+		t.Fatalf("got %d files", len(files))
+	}
+
+	files = append(files, &ArticleFile{Name: "broken.md", Data: []byte("no front matter")})
+	results := ImportArticles(context.Background(), ts.db, janeID, files)
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	// The slug is taken by the original
+	if results[0].Error != "" || results[0].Slug != "dragons-2" {
+		t.Errorf("got %+v", results[0])
+	}
+	if results[1].Error == "" {
+		t.Error("broken file was imported")
+	}
+
+	res := apiArticleResponse{}
+	if status := ts.api(t, http.MethodGet, "/api/articles/dragons-2", "", nil, &res); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if res.Article.Author.Username != "jane" || strings.Join(res.Article.TagList, ",") != "dragons,fire" {
+		t.Errorf("got %+v", res.Article)
+	}
+}
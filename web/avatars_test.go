@@ -0,0 +1,119 @@
+package web
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+type identiconSVG struct {
+	Cells struct {
+		Fill  string `xml:"fill,attr"`
+		Rects []struct {
+			X int `xml:"x,attr"`
+			Y int `xml:"y,attr"`
+		} `xml:"rect"`
+	} `xml:"g"`
+}
+
+func TestIdenticon(t *testing.T) {
+	if !bytes.Equal(identicon(42), identicon(42)) {
+		t.Error("same user got different identicons")
+	}
+	if bytes.Equal(identicon(42), identicon(43)) {
+		t.Error("different users got the same identicon")
+	}
+
+	for _, userID := range []int64{1, 42, 401599689624912915} {
+		svg := &identiconSVG{}
+		if err := xml.Unmarshal(identicon(userID), svg); err != nil {
+			t.Fatalf("user %d: invalid SVG: %v", userID, err)
+		}
+		if svg.Cells.Fill == "" {
+			t.Errorf("user %d: cells have no color", userID)
+		}
+
+		// Mirrored down the middle
+		cells := map[[2]int]bool{}
+		for _, r := range svg.Cells.Rects {
+			if r.X < 0 || r.X >= identiconSize || r.Y < 0 || r.Y >= identiconSize {
+				t.Errorf("user %d: cell %d,%d is outside the grid", userID, r.X, r.Y)
+			}
+			cells[[2]int{r.X, r.Y}] = true
+		}
+		for cell := range cells {
+			if !cells[[2]int{identiconSize - 1 - cell[0], cell[1]}] {
+				t.Errorf("user %d: cell %v isn't mirrored", userID, cell)
+			}
+		}
+	}
+}
+
+func TestAvatarURL(t *testing.T) {
+	for imageURL, want := range map[string]string{
+		"":                               "/avatars/7.svg",
+		"https://example.com/me.png":     "https://example.com/me.png",
+		"http://example.com/me.png":      "http://example.com/me.png",
+		"/uploads/abc/s256.jpg":          "/uploads/abc/s256.jpg",
+		"/avatars/8.svg":                 "/avatars/8.svg",
+		"javascript:alert(1)":            "/avatars/7.svg",
+		"data:image/svg+xml;base64,PHN2": "/avatars/7.svg",
+		"//evil.example.com/me.png":      "/avatars/7.svg",
+		"/settings":                      "/avatars/7.svg",
+		"https://i.pravatar.cc/150?u=7":  "https://i.pravatar.cc/150?u=7",
+	} {
+		if got := AvatarURL(7, imageURL); got != want {
+			t.Errorf("%q: got %q, want %q", imageURL, got, want)
+		}
+	}
+}
+
+func TestAvatarRoute(t *testing.T) {
+	ts := newTestServer(t)
+
+	res, err := http.Get(ts.URL + "/avatars/42.svg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "image/svg+xml" {
+		t.Errorf("got status %d with %q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+
+	if status, _ := ts.get(t, nil, "/avatars/jake.svg"); status != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+func TestDefaultAvatar(t *testing.T) {
+	ts := newTestServer(t)
+	userID, token := ts.register(t, "jake")
+
+	type userResponse struct {
+		User struct {
+			Image string `json:"image"`
+		} `json:"user"`
+	}
+	res := userResponse{}
+	ts.api(t, http.MethodGet, "/api/user", token, nil, &res)
+	if want := fmt.Sprintf("/avatars/%d.svg", userID); res.User.Image != want {
+		t.Errorf("new user got image %q, want %q", res.User.Image, want)
+	}
+
+	if status := ts.api(t, http.MethodPut, "/api/user", token, map[string]any{
+		"user": map[string]any{"image": "javascript:alert(1)"},
+	}, nil); status != http.StatusUnprocessableEntity {
+		t.Errorf("unsafe image: got status %d, want %d", status, http.StatusUnprocessableEntity)
+	}
+
+	// Clearing the picture falls back to the identicon
+	res = userResponse{}
+	ts.api(t, http.MethodPut, "/api/user", token, map[string]any{
+		"user": map[string]any{"image": ""},
+	}, &res)
+	if want := fmt.Sprintf("/avatars/%d.svg", userID); res.User.Image != want {
+		t.Errorf("cleared image: got %q, want %q", res.User.Image, want)
+	}
+}
@@ -0,0 +1,131 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps uploaded files. Keys are slash separated paths that are
+// never reused for different content, so a blob never changes once written.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Exists(ctx context.Context, key string) (bool, error)
+	// Open returns ErrBlobNotFound for a missing key.
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, time.Time, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// FileBlobStore keeps blobs as files in a folder.
+type FileBlobStore struct {
+	dir string
+}
+
+func NewFileBlobStore(dir string) *FileBlobStore {
+	return &FileBlobStore{dir: dir}
+}
+
+func (s *FileBlobStore) filename(key string) (string, error) {
+	if key == "" || strings.Contains(key, "\\") {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." || strings.HasPrefix(part, ".") {
+			return "", fmt.Errorf("invalid blob key %q", key)
+		}
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes through a temporary file, so readers never see half a blob.
+func (s *FileBlobStore) Put(ctx context.Context, key string, data []byte) error {
+	filename, err := s.filename(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return fmt.Errorf("failed to create blob folder: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(filename), ".blob-*")
+	if err != nil {
+		return fmt.Errorf("failed to create blob: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, bytes.NewReader(data)); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write blob: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync blob: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close blob: %w", err)
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to set blob permissions: %w", err)
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		return fmt.Errorf("failed to move blob into place: %w", err)
+	}
+	return nil
+}
+
+func (s *FileBlobStore) Exists(ctx context.Context, key string) (bool, error) {
+	filename, err := s.filename(key)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(filename); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to stat blob: %w", err)
+	}
+	return true, nil
+}
+
+func (s *FileBlobStore) Open(ctx context.Context, key string) (io.ReadSeekCloser, time.Time, error) {
+	filename, err := s.filename(key)
+	if err != nil {
+		return nil, time.Time{}, ErrBlobNotFound
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, time.Time{}, ErrBlobNotFound
+		}
+		return nil, time.Time{}, fmt.Errorf("failed to open blob: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, time.Time{}, fmt.Errorf("failed to stat blob: %w", err)
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, time.Time{}, ErrBlobNotFound
+	}
+	return f, info.ModTime(), nil
+}
+
+func (s *FileBlobStore) Delete(ctx context.Context, key string) error {
+	filename, err := s.filename(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filename); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to delete blob: %w", err)
+	}
+	return nil
+}
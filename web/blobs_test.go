@@ -0,0 +1,72 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileBlobStore(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	blobs := NewFileBlobStore(dir)
+
+	if exists, err := blobs.Exists(ctx, "abc/s64.jpg"); err != nil || exists {
+		t.Errorf("got %t and error %v before it was written", exists, err)
+	}
+	if _, _, err := blobs.Open(ctx, "abc/s64.jpg"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("got error %v, want %v", err, ErrBlobNotFound)
+	}
+
+	if err := blobs.Put(ctx, "abc/s64.jpg", []byte("pixels")); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := blobs.Exists(ctx, "abc/s64.jpg"); err != nil || !exists {
+		t.Errorf("got %t and error %v after it was written", exists, err)
+	}
+	f, _, err := blobs.Open(ctx, "abc/s64.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != "pixels" {
+		t.Errorf("got %q and error %v", data, err)
+	}
+	// Nothing left over from writing it
+	if entries, _ := os.ReadDir(filepath.Join(dir, "abc")); len(entries) != 1 {
+		t.Errorf("got %d files next to the blob", len(entries))
+	}
+
+	// A folder isn't a blob
+	if _, _, err := blobs.Open(ctx, "abc"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("got error %v opening a folder, want %v", err, ErrBlobNotFound)
+	}
+
+	if err := blobs.Delete(ctx, "abc/s64.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := blobs.Delete(ctx, "abc/s64.jpg"); err != nil {
+		t.Errorf("deleting again: %v", err)
+	}
+	if exists, _ := blobs.Exists(ctx, "abc/s64.jpg"); exists {
+		t.Error("blob is still there")
+	}
+}
+
+func TestFileBlobStoreKeys(t *testing.T) {
+	ctx := context.Background()
+	blobs := NewFileBlobStore(filepath.Join(t.TempDir(), "uploads"))
+
+	for _, key := range []string{"", "../secret", "abc/../../secret", "/abc", "abc//def", ".hidden", "abc/.blob-1", `abc\def`} {
+		if err := blobs.Put(ctx, key, []byte("x")); err == nil {
+			t.Errorf("%q was written", key)
+		}
+		if _, _, err := blobs.Open(ctx, key); !errors.Is(err, ErrBlobNotFound) {
+			t.Errorf("%q: got error %v opening, want %v", key, err, ErrBlobNotFound)
+		}
+	}
+}
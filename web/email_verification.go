@@ -0,0 +1,261 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"time"
+
+	"github.com/delaneyj/datastar"
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"github.com/go-chi/chi/v5"
+	"zombiezen.com/go/sqlite"
+)
+
+const emailVerificationMailTimeout = 30 * time.Second
+
+var (
+	errEmailUnverified          = errors.New("verify your email address before posting")
+	errEmailVerificationInvalid = errors.New("this verification link is invalid or has expired")
+	errEmailInUse               = errors.New("email is already in use")
+)
+
+// validateEmail accepts a bare address, without a name or angle brackets.
+func validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return fmt.Errorf("%q is not a valid email address", email)
+	}
+	return nil
+}
+
+// emailVerified reports whether u followed a link mailed to their address.
+func emailVerified(u *zz.UserModel) bool {
+	return u.EmailVerifiedAt.After(time.Time{})
+}
+
+// EmailVerifier mails users links that prove they own an address. Only the
+// latest link of a user works, links expire after expiry and point at
+// baseURL, or the host the request came in on without one.
+type EmailVerifier struct {
+	db      *toolbelt.Database
+	mailer  Mailer
+	baseURL string
+	expiry  time.Duration
+}
+
+func NewEmailVerifier(db *toolbelt.Database, mailer Mailer, baseURL string, expiry time.Duration) *EmailVerifier {
+	return &EmailVerifier{
+		db:      db,
+		mailer:  mailer,
+		baseURL: baseURL,
+		expiry:  expiry,
+	}
+}
+
+// Send mails u a link to verify email. For an address other than theirs,
+// following it makes it their email, the old one working until then.
+func (v *EmailVerifier) Send(r *http.Request, u *zz.UserModel, email string) error {
+	token, err := newEmailToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(v.expiry)
+	if err := v.db.WriteTX(r.Context(), func(tx *sqlite.Conn) error {
+		if err := zz.OnceDeleteExpiredEmailVerifications(tx, now); err != nil {
+			return fmt.Errorf("failed to delete expired email verifications: %w", err)
+		}
+		if err := zz.OnceDeleteEmailVerificationsByUser(tx, u.Id); err != nil {
+			return fmt.Errorf("failed to delete email verifications: %w", err)
+		}
+		if err := zz.OnceCreateEmailVerification(tx, &zz.EmailVerificationModel{
+			Id:        toolbelt.NextID(),
+			UserId:    u.Id,
+			Email:     email,
+			TokenHash: hashEmailToken(token),
+			ExpiresAt: expiresAt,
+			CreatedAt: now,
+		}); err != nil {
+			return fmt.Errorf("failed to create email verification: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/auth/verify?token=%s", linkBaseURL(v.baseURL, r), url.QueryEscape(token))
+	expires := expiresAt.Local().Format("Jan 2, 2006 15:04 MST")
+	msg := &Mail{To: email}
+	if email == u.Email {
+		msg.Subject = "Verify your Conduit email address"
+		msg.Text = fmt.Sprintf(
+			"Welcome to Conduit, %s!\n\n"+
+				"To confirm this is your email address, open this link before %s:\n\n%s\n\n"+
+				"If you didn't sign up, ignore this email.\n",
+			u.Username, expires, link,
+		)
+	} else {
+		msg.Subject = "Confirm your new Conduit email address"
+		msg.Text = fmt.Sprintf(
+			"%s asked to use this address on Conduit.\n\n"+
+				"To confirm it, open this link before %s:\n\n%s\n\n"+
+				"Until then %s keeps working. If it wasn't you, ignore this email.\n",
+			u.Username, expires, link, u.Email,
+		)
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), emailVerificationMailTimeout)
+		defer cancel()
+		if err := v.mailer.Send(ctx, msg); err != nil {
+			log.Printf("Failed to send email verification to user %d: %v", u.Id, err)
+		}
+	}()
+	return nil
+}
+
+// PendingEmail is the address userID is changing their email to, empty
+// unless they are.
+func (v *EmailVerifier) PendingEmail(ctx context.Context, userID int64) (email string, err error) {
+	if err := v.db.ReadTX(ctx, func(tx *sqlite.Conn) error {
+		email, err = zz.OncePendingEmailChange(tx, zz.PendingEmailChangeParams{
+			UserId: userID,
+			Now:    time.Now(),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get pending email change: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return "", err
+	}
+	return email, nil
+}
+
+// verifiedEmailRequired turns away users who haven't verified their email,
+// when the site requires it.
+func verifiedEmailRequired(required bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if u, _ := UserFromContext(r.Context()); required && u != nil && !emailVerified(u) {
+				if r.Header.Get("datastar-request") == "true" {
+					sse := datastar.NewSSE(w, r)
+					datastar.RenderFragmentTempl(sse, errorMessages(errEmailUnverified))
+					return
+				}
+				http.Error(w, errEmailUnverified.Error(), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func apiVerifiedEmailRequired(required bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if u, _ := UserFromContext(r.Context()); required && u != nil && !emailVerified(u) {
+				apiError(w, http.StatusForbidden, errEmailUnverified)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func setupEmailVerificationRoutes(authRouter chi.Router, db *toolbelt.Database, verifier *EmailVerifier) {
+	authRouter.Route("/verify", func(verifyRouter chi.Router) {
+		verifyRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			me, _ := UserFromContext(ctx)
+			token := r.URL.Query().Get("token")
+
+			var verified *zz.UserModel
+			err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+				if token == "" {
+					return errEmailVerificationInvalid
+				}
+				verification, err := zz.OnceEmailVerificationByTokenHash(tx, hashEmailToken(token))
+				if err != nil {
+					return fmt.Errorf("failed to get email verification: %w", err)
+				}
+				if verification == nil || !time.Now().Before(verification.ExpiresAt) {
+					return errEmailVerificationInvalid
+				}
+
+				u, err := zz.OnceReadByIDUser(tx, verification.UserId)
+				if err != nil {
+					return fmt.Errorf("failed to get user: %w", err)
+				}
+				if u == nil {
+					return errEmailVerificationInvalid
+				}
+
+				// Someone may have taken the address since it was asked for
+				if verification.Email != u.Email {
+					emailUser, err := zz.OnceUserByEmail(tx, verification.Email)
+					if err != nil {
+						return fmt.Errorf("failed to get user by email: %w", err)
+					}
+					if emailUser != nil {
+						return errEmailInUse
+					}
+					u.Email = verification.Email
+				}
+
+				u.EmailVerifiedAt = time.Now()
+				if err := zz.OnceUpdateUser(tx, u); err != nil {
+					return fmt.Errorf("failed to update user: %w", err)
+				}
+				if err := zz.OnceDeleteEmailVerificationsByUser(tx, u.Id); err != nil {
+					return fmt.Errorf("failed to delete email verifications: %w", err)
+				}
+				verified = u
+				return nil
+			})
+
+			w.Header().Set("Referrer-Policy", "no-referrer")
+			switch {
+			case errors.Is(err, errEmailVerificationInvalid):
+				PageEmailVerification(r, me, "", errEmailVerificationInvalid).Render(ctx, w)
+			case errors.Is(err, errEmailInUse):
+				PageEmailVerification(r, me, "", errEmailInUse).Render(ctx, w)
+			case err != nil:
+				http.Error(w, "failed to verify email", http.StatusInternalServerError)
+			default:
+				// The page shouldn't still ask them to verify
+				if me != nil && me.Id == verified.Id {
+					me = verified
+				}
+				PageEmailVerification(r, me, verified.Email, nil).Render(ctx, w)
+			}
+		})
+
+		verifyRouter.Post("/resend", func(w http.ResponseWriter, r *http.Request) {
+			u, _ := UserFromContext(r.Context())
+
+			if u == nil {
+				http.Error(w, "user required", http.StatusUnauthorized)
+				return
+			}
+
+			sse := datastar.NewSSE(w, r)
+			if emailVerified(u) {
+				datastar.Delete(sse, "#emailVerificationBanner")
+				return
+			}
+			if err := verifier.Send(r, u, u.Email); err != nil {
+				datastar.RenderFragmentTempl(sse, errorMessages(err))
+				return
+			}
+			datastar.RenderFragmentTempl(sse, emailVerificationBanner(u, true))
+		})
+	})
+}
@@ -0,0 +1,247 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/delaneyj/realworld-datastar/config"
+)
+
+const (
+	verifyEmailSubject  = "Verify your Conduit email address"
+	confirmEmailSubject = "Confirm your new Conduit email address"
+	verificationBanner  = "Please verify your email address"
+)
+
+// verifyEmail follows the link mailed to verify email and returns the page.
+func verifyEmail(t *testing.T, ts *testServer, client *http.Client, token string) string {
+	t.Helper()
+
+	status, page := ts.get(t, client, "/auth/verify?token="+url.QueryEscape(token))
+	if status != http.StatusOK {
+		t.Fatalf("verifying: got status %d", status)
+	}
+	return page
+}
+
+func TestValidateEmail(t *testing.T) {
+	for email, valid := range map[string]bool{
+		"jake@example.com":        true,
+		"jake+tag@example.co.uk":  true,
+		"jake":                    false,
+		"":                        false,
+		"Jake <jake@example.com>": false,
+		"<jake@example.com>":      false,
+		"jake@example.com, jane@": false,
+	} {
+		if err := validateEmail(email); (err == nil) != valid {
+			t.Errorf("%q: got error %v, want valid %t", email, err, valid)
+		}
+	}
+}
+
+func TestVerifyEmailOnRegister(t *testing.T) {
+	ts := newTestServer(t)
+
+	status, body := ts.datastar(t, ts.browser(t), http.MethodPost, "/auth/register", RegisterForm{
+		Username: "jake",
+		Email:    "not an email",
+		Password: "password1234",
+	})
+	if status != http.StatusOK || !strings.Contains(body, "is not a valid email address") {
+		t.Errorf("invalid email: got status %d: %s", status, body)
+	}
+	if status := ts.api(t, http.MethodPost, "/api/users", "", map[string]any{
+		"user": map[string]string{"username": "jake", "email": "not an email", "password": "password1234"},
+	}, nil); status != http.StatusUnprocessableEntity {
+		t.Errorf("invalid email through the API: got status %d, want %d", status, http.StatusUnprocessableEntity)
+	}
+
+	status, body = ts.datastar(t, ts.browser(t), http.MethodPost, "/auth/register", RegisterForm{
+		Username: "jake",
+		Email:    "jake@example.com",
+		Password: "password1234",
+	})
+	if status != http.StatusOK || !strings.Contains(body, "redirect /auth/login") {
+		t.Fatalf("registering: got status %d: %s", status, body)
+	}
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+	if _, page := ts.get(t, jake, "/"); !strings.Contains(page, verificationBanner) {
+		t.Error("no banner asking to verify the email")
+	}
+
+	token := mailToken(t, ts.waitForMail(t, "jake@example.com", verifyEmailSubject, 1), "/auth/verify")
+	if page := verifyEmail(t, ts, jake, token); !strings.Contains(page, "jake@example.com is verified") || strings.Contains(page, verificationBanner) {
+		t.Errorf("verifying didn't confirm the email: %s", page)
+	}
+	if _, page := ts.get(t, jake, "/"); strings.Contains(page, verificationBanner) {
+		t.Error("banner is still there after verifying")
+	}
+
+	// Links work once
+	if page := verifyEmail(t, ts, nil, token); !strings.Contains(page, errEmailVerificationInvalid.Error()) {
+		t.Error("link worked twice")
+	}
+	if page := verifyEmail(t, ts, nil, ""); !strings.Contains(page, errEmailVerificationInvalid.Error()) {
+		t.Error("empty token worked")
+	}
+}
+
+func TestRegisterWhenVerificationFails(t *testing.T) {
+	ts := newTestServer(t)
+	ts.exec(t, `CREATE TRIGGER fail_email_verifications BEFORE INSERT ON email_verifications BEGIN SELECT RAISE(ABORT, 'no verification'); END`)
+
+	// Registering still works, it's only the link that's missing
+	if _, body := ts.datastar(t, ts.browser(t), http.MethodPost, "/auth/register", RegisterForm{
+		Username: "jake",
+		Email:    "jake@example.com",
+		Password: "password1234",
+	}); !strings.Contains(body, "redirect /auth/login") {
+		t.Errorf("registering: %s", body)
+	}
+	if status := ts.api(t, http.MethodPost, "/api/users", "", map[string]any{
+		"user": map[string]string{"username": "jane", "email": "jane@example.com", "password": "password1234"},
+	}, nil); status != http.StatusCreated {
+		t.Errorf("registering through the API: got status %d, want %d", status, http.StatusCreated)
+	}
+
+	ts.exec(t, `DROP TRIGGER fail_email_verifications`)
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+	if _, body := ts.datastar(t, jake, http.MethodPost, "/auth/verify/resend", nil); !strings.Contains(body, "We sent a new link") {
+		t.Fatalf("resending: %s", body)
+	}
+	ts.waitForMail(t, "jake@example.com", verifyEmailSubject, 1)
+}
+
+func TestVerifyEmailResend(t *testing.T) {
+	ts := newTestServer(t)
+	userID, _ := ts.register(t, "jake")
+	older := mailToken(t, ts.waitForMail(t, "jake@example.com", verifyEmailSubject, 1), "/auth/verify")
+
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+	if status, body := ts.datastar(t, jake, http.MethodPost, "/auth/verify/resend", nil); status != http.StatusOK || !strings.Contains(body, "We sent a new link") {
+		t.Fatalf("resending: got status %d: %s", status, body)
+	}
+	newer := mailToken(t, ts.waitForMail(t, "jake@example.com", verifyEmailSubject, 2), "/auth/verify")
+
+	// Only the latest link works
+	if page := verifyEmail(t, ts, nil, older); !strings.Contains(page, errEmailVerificationInvalid.Error()) {
+		t.Error("older link worked")
+	}
+
+	ts.exec(t, `UPDATE email_verifications SET expires_at = julianday('now') - 1.0 / 86400 WHERE user_id = ?`, userID)
+	if page := verifyEmail(t, ts, nil, newer); !strings.Contains(page, errEmailVerificationInvalid.Error()) {
+		t.Error("expired link worked")
+	}
+	if emailVerified(readUser(t, ts, userID)) {
+		t.Error("email was verified by an invalid link")
+	}
+
+	if status, _ := ts.datastar(t, ts.browser(t), http.MethodPost, "/auth/verify/resend", nil); status != http.StatusUnauthorized {
+		t.Errorf("resending signed out: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestEmailChange(t *testing.T) {
+	ts := newTestServer(t)
+	userID, _ := ts.register(t, "jake")
+	ts.exec(t, `UPDATE users SET email_verified_at = julianday('now') WHERE id = ?`, userID)
+
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+	settings := SettingsForm{Username: "jake", Email: "jake@example.org"}
+	if _, body := ts.datastar(t, jake, http.MethodPost, "/settings", settings); !strings.Contains(body, "redirect /settings") {
+		t.Fatalf("changing the email: %s", body)
+	}
+
+	// The old address keeps working until the new one is confirmed
+	if u := readUser(t, ts, userID); u.Email != "jake@example.com" || !emailVerified(u) {
+		t.Errorf("got email %q, verified %t, before confirming", u.Email, emailVerified(u))
+	}
+	if _, page := ts.get(t, jake, "/settings"); !strings.Contains(page, "Confirm jake@example.org") {
+		t.Error("settings don't show the email waiting to be confirmed")
+	}
+	ts.signIn(t, ts.browser(t), "jake")
+
+	token := mailToken(t, ts.waitForMail(t, "jake@example.org", confirmEmailSubject, 1), "/auth/verify")
+	if page := verifyEmail(t, ts, nil, token); !strings.Contains(page, "jake@example.org is verified") {
+		t.Errorf("confirming didn't change the email: %s", page)
+	}
+	if u := readUser(t, ts, userID); u.Email != "jake@example.org" {
+		t.Errorf("got email %q after confirming", u.Email)
+	}
+}
+
+func TestEmailChangeTaken(t *testing.T) {
+	ts := newTestServer(t)
+	userID, token := ts.register(t, "jake")
+	ts.register(t, "jane")
+
+	res := struct {
+		User apiUser `json:"user"`
+	}{}
+	if status := ts.api(t, http.MethodPut, "/api/user", token, map[string]any{
+		"user": map[string]string{"email": "jane@example.com"},
+	}, nil); status != http.StatusUnprocessableEntity {
+		t.Errorf("someone else's email: got status %d, want %d", status, http.StatusUnprocessableEntity)
+	}
+	if status := ts.api(t, http.MethodPut, "/api/user", token, map[string]any{
+		"user": map[string]string{"email": "jake@example.org"},
+	}, &res); status != http.StatusOK || res.User.Email != "jake@example.com" {
+		t.Fatalf("changing the email: got status %d with email %q", status, res.User.Email)
+	}
+	link := mailToken(t, ts.waitForMail(t, "jake@example.org", confirmEmailSubject, 1), "/auth/verify")
+
+	// Someone else takes the address before it is confirmed
+	ts.register(t, "jake2")
+	ts.exec(t, `UPDATE users SET email = 'jake@example.org' WHERE username = 'jake2'`)
+	if page := verifyEmail(t, ts, nil, link); !strings.Contains(page, errEmailInUse.Error()) {
+		t.Errorf("confirming a taken email: %s", page)
+	}
+	if u := readUser(t, ts, userID); u.Email != "jake@example.com" {
+		t.Errorf("got email %q, want it unchanged", u.Email)
+	}
+}
+
+func TestRequireVerifiedEmail(t *testing.T) {
+	for name, required := range map[string]bool{"required": true, "not required": false} {
+		t.Run(name, func(t *testing.T) {
+			ts := newTestServer(t, func(cfg *config.Config) {
+				cfg.RequireVerifiedEmail = required
+			})
+			_, authorToken := ts.register(t, "jake")
+			ts.exec(t, `UPDATE users SET email_verified_at = julianday('now') WHERE username = 'jake'`)
+			article := createAPIArticle(t, ts, authorToken, "Dragons")
+			janeID, janeToken := ts.register(t, "jane")
+			jane := ts.browser(t)
+			ts.signIn(t, jane, "jane")
+
+			wantStatus := http.StatusCreated
+			if required {
+				wantStatus = http.StatusForbidden
+			}
+			if status := ts.api(t, http.MethodPost, "/api/articles", janeToken, map[string]any{
+				"article": map[string]any{"title": "Unverified", "description": "d", "body": "b"},
+			}, nil); status != wantStatus {
+				t.Errorf("posting an article: got status %d, want %d", status, wantStatus)
+			}
+			_, body := ts.datastar(t, jane, http.MethodPost, "/articles/"+article.Slug+"/comments", CommentForm{Comment: "hi"})
+			if strings.Contains(body, errEmailUnverified.Error()) != required {
+				t.Errorf("commenting: %s", body)
+			}
+
+			// Verified users can always post
+			ts.exec(t, `UPDATE users SET email_verified_at = julianday('now') WHERE id = ?`, janeID)
+			if status := ts.api(t, http.MethodPost, "/api/articles", janeToken, map[string]any{
+				"article": map[string]any{"title": "Verified", "description": "d", "body": "b"},
+			}, nil); status != http.StatusCreated {
+				t.Errorf("posting verified: got status %d, want %d", status, http.StatusCreated)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package web
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Hub is an in-process pub/sub used to tell open pages that something they
+// show has changed. Notifications carry no payload, subscribers re-read what
+// they need so every viewer gets fragments rendered for them, and a burst of
+// changes coalesces into a single pending notification per subscriber.
+type Hub struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan struct{}]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subscribers: map[string]map[chan struct{}]struct{}{},
+	}
+}
+
+func ArticleTopic(articleID int64) string {
+	return fmt.Sprintf("article:%d", articleID)
+}
+
+func UserTopic(userID int64) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// Subscribe returns a channel that receives a value whenever any of topics is
+// published, and a function to stop listening.
+func (h *Hub) Subscribe(topics ...string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, topic := range topics {
+		subs, ok := h.subscribers[topic]
+		if !ok {
+			subs = map[chan struct{}]struct{}{}
+			h.subscribers[topic] = subs
+		}
+		subs[ch] = struct{}{}
+	}
+
+	unsubscribe := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for _, topic := range topics {
+			subs := h.subscribers[topic]
+			delete(subs, ch)
+			if len(subs) == 0 {
+				delete(h.subscribers, topic)
+			}
+		}
+	}
+	return ch, unsubscribe
+}
+
+func (h *Hub) Publish(topics ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, topic := range topics {
+		for ch := range h.subscribers[topic] {
+			select {
+			case ch <- struct{}{}:
+			default:
+				// Already has a pending notification
+			}
+		}
+	}
+}
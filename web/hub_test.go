@@ -0,0 +1,144 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHub(t *testing.T) {
+	hub := NewHub()
+
+	article, unsubscribeArticle := hub.Subscribe(ArticleTopic(1), UserTopic(2))
+	user, unsubscribeUser := hub.Subscribe(UserTopic(2))
+	defer unsubscribeUser()
+
+	received := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// A burst coalesces into one notification
+	hub.Publish(ArticleTopic(1))
+	hub.Publish(ArticleTopic(1), UserTopic(2))
+	if !received(article) || received(article) {
+		t.Error("article subscriber didn't get exactly one notification")
+	}
+	if !received(user) {
+		t.Error("user subscriber didn't get notified")
+	}
+
+	hub.Publish(ArticleTopic(3))
+	if received(article) || received(user) {
+		t.Error("got notified for another topic")
+	}
+
+	unsubscribeArticle()
+	hub.Publish(ArticleTopic(1), UserTopic(2))
+	if received(article) {
+		t.Error("got notified after unsubscribing")
+	}
+	if !received(user) {
+		t.Error("other subscribers stopped getting notified")
+	}
+	if _, ok := hub.subscribers[ArticleTopic(1)]; ok {
+		t.Error("topic without subscribers wasn't removed")
+	}
+}
+
+func TestArticleUpdatesMissingArticle(t *testing.T) {
+	cfg := newTestConfig(t)
+	db := newTestDB(t, cfg)
+
+	// Deleted between being looked up by slug and subscribing
+	r := httptest.NewRequest(http.MethodGet, "/articles/gone/updates", nil)
+	r = r.WithContext(ContextWithArticleID(r.Context(), 42))
+	w := httptest.NewRecorder()
+	articleUpdates(db, NewHub())(w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// watchArticle opens the live updates of the article at slug, giving up
+// after a few seconds.
+func watchArticle(t *testing.T, ts *testServer, slug string) *bufio.Scanner {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+articlePath(slug)+"/updates", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", res.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(nil, 1<<20)
+	return scanner
+}
+
+// streamed reports whether the stream sends a line containing s.
+func streamed(scanner *bufio.Scanner, s string) bool {
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestArticleUpdatesStream(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+	ts.register(t, "jane")
+	article := createAPIArticle(t, ts, token, "Dragons")
+
+	updates := watchArticle(t, ts, article.Slug)
+	jane := ts.browser(t)
+	ts.signIn(t, jane, "jane")
+	ts.datastar(t, jane, http.MethodPost, articlePath(article.Slug)+"/comments", CommentForm{Comment: "Live dragons"})
+
+	if !streamed(updates, "Live dragons") {
+		t.Errorf("stream ended without the new comment: %v", updates.Err())
+	}
+}
+
+func TestArticleUpdatesFromAPI(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+	article := createAPIArticle(t, ts, token, "Dragons")
+
+	updates := watchArticle(t, ts, article.Slug)
+	if status := ts.api(t, http.MethodPut, "/api/articles/"+article.Slug, token, map[string]any{
+		"article": map[string]any{"body": "Live dragons"},
+	}, nil); status != http.StatusOK {
+		t.Fatalf("updating: got status %d", status)
+	}
+	if !streamed(updates, "articleMetaBanner") {
+		t.Errorf("stream ended without the update: %v", updates.Err())
+	}
+
+	if status := ts.api(t, http.MethodDelete, "/api/articles/"+article.Slug, token, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("deleting: got status %d", status)
+	}
+	if !streamed(updates, "redirect /") {
+		t.Errorf("stream ended without leaving the deleted article: %v", updates.Err())
+	}
+}
@@ -0,0 +1,291 @@
+package web
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// maxImagePixels keeps a small file that decodes into a huge image from
+// using up memory.
+const maxImagePixels = 50_000_000
+
+const jpegQuality = 85
+
+// imageContentTypes are the uploads accepted, by sniffed content type.
+var imageContentTypes = map[string]struct{}{
+	"image/jpeg": {},
+	"image/png":  {},
+	"image/gif":  {},
+	"image/webp": {},
+}
+
+// imageVariant is a size an uploaded image is stored in. Without Crop the
+// image is scaled down to fit in Width by Height, never up, a zero Height
+// leaving it unbounded. With Crop it is cut to fill exactly that box.
+type imageVariant struct {
+	Name          string
+	Width, Height int
+	Crop          bool
+}
+
+// imageKind is what an upload is for, deciding the variants it is stored in.
+// Variant names spell out their size, so the same file uploaded for
+// different kinds never stores different content under the same key. The
+// first variant is the largest and Display the one shown by default.
+type imageKind struct {
+	Variants []imageVariant
+	Display  string
+}
+
+const (
+	ImageKindAvatar  = "avatar"
+	ImageKindArticle = "article"
+)
+
+var imageKinds = map[string]*imageKind{
+	ImageKindAvatar: {
+		Variants: []imageVariant{
+			{Name: "fit1024", Width: 1024, Height: 1024},
+			{Name: "s256", Width: 256, Height: 256, Crop: true},
+			{Name: "s128", Width: 128, Height: 128, Crop: true},
+			{Name: "s64", Width: 64, Height: 64, Crop: true},
+		},
+		Display: "s256",
+	},
+	ImageKindArticle: {
+		Variants: []imageVariant{
+			{Name: "fit2560", Width: 2560, Height: 2560},
+			{Name: "w1600", Width: 1600},
+			{Name: "w800", Width: 800},
+			{Name: "w400", Width: 400},
+		},
+		Display: "w800",
+	},
+}
+
+// encodedImage is a variant ready to be stored.
+type encodedImage struct {
+	Variant       string
+	Data          []byte
+	Width, Height int
+}
+
+// decodeUploadedImage checks that data is an image we accept and decodes it
+// upright. Nothing but the pixels survives, so EXIF and other metadata are
+// dropped when it is encoded again.
+func decodeUploadedImage(data []byte) (image.Image, error) {
+	contentType := http.DetectContentType(data)
+	if _, ok := imageContentTypes[contentType]; !ok {
+		return nil, fmt.Errorf("unsupported image type %s", contentType)
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid image: %w", err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, errors.New("invalid image: empty")
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, fmt.Errorf("image is too large, %dx%d", cfg.Width, cfg.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid image: %w", err)
+	}
+	if contentType == "image/jpeg" {
+		img = orientImage(img, jpegOrientation(data))
+	}
+	return img, nil
+}
+
+// imageFormat is the extension variants of img are encoded as, PNG to keep
+// transparency and JPEG for everything else.
+func imageFormat(img image.Image) string {
+	if o, ok := img.(interface{ Opaque() bool }); ok && !o.Opaque() {
+		return "png"
+	}
+	return "jpg"
+}
+
+func encodeImageVariants(img image.Image, format string, variants []imageVariant) ([]*encodedImage, error) {
+	encoded := make([]*encodedImage, 0, len(variants))
+	for _, variant := range variants {
+		resized := resizeImage(img, variant)
+
+		buf := &bytes.Buffer{}
+		var err error
+		switch format {
+		case "png":
+			err = png.Encode(buf, resized)
+		default:
+			err = jpeg.Encode(buf, resized, &jpeg.Options{Quality: jpegQuality})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %w", variant.Name, err)
+		}
+
+		b := resized.Bounds()
+		encoded = append(encoded, &encodedImage{
+			Variant: variant.Name,
+			Data:    buf.Bytes(),
+			Width:   b.Dx(),
+			Height:  b.Dy(),
+		})
+	}
+	return encoded, nil
+}
+
+func resizeImage(img image.Image, variant imageVariant) image.Image {
+	src := img.Bounds()
+	w, h := src.Dx(), src.Dy()
+
+	var dstW, dstH int
+	if variant.Crop {
+		// Cut the middle of the image to the variant's aspect ratio first
+		if w*variant.Height > h*variant.Width {
+			cropW := h * variant.Width / variant.Height
+			src.Min.X += (w - cropW) / 2
+			src.Max.X = src.Min.X + cropW
+		} else {
+			cropH := w * variant.Height / variant.Width
+			src.Min.Y += (h - cropH) / 2
+			src.Max.Y = src.Min.Y + cropH
+		}
+		dstW, dstH = min(variant.Width, src.Dx()), min(variant.Height, src.Dy())
+	} else {
+		scale := 1.0
+		if variant.Width > 0 && w > variant.Width {
+			scale = float64(variant.Width) / float64(w)
+		}
+		if variant.Height > 0 && float64(h)*scale > float64(variant.Height) {
+			scale = float64(variant.Height) / float64(h)
+		}
+		dstW, dstH = max(int(float64(w)*scale+0.5), 1), max(int(float64(h)*scale+0.5), 1)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	if dstW == src.Dx() && dstH == src.Dy() {
+		draw.Draw(dst, dst.Bounds(), img, src.Min, draw.Src)
+	} else {
+		xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, src, xdraw.Src, nil)
+	}
+	return dst
+}
+
+// jpegOrientation reads the EXIF orientation of a JPEG, 1 meaning upright,
+// which is also assumed when there is none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xD9 || marker == 0xDA {
+			// End of image or start of the pixels, no EXIF before them
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// orientImage turns img upright for an EXIF orientation, since the tag
+// saying which way is up is dropped with the rest of the metadata.
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Orientations 5 to 8 are rotated by a quarter turn
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Flip horizontally
+				dx, dy = w-1-x, y
+			case 3: // Rotate half a turn
+				dx, dy = w-1-x, h-1-y
+			case 4: // Flip vertically
+				dx, dy = x, h-1-y
+			case 5: // Transpose
+				dx, dy = y, x
+			case 6: // Rotate clockwise
+				dx, dy = h-1-y, x
+			case 7: // Transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // Rotate counterclockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,219 @@
+package web
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+var (
+	testRed  = color.RGBA{R: 255, A: 255}
+	testBlue = color.RGBA{B: 255, A: 255}
+)
+
+// testImage is w by h, red on the left and blue on the right.
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			c := testRed
+			if x >= w/2 {
+				c = testBlue
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withEXIFOrientation adds an EXIF segment with orientation right after the
+// start of a JPEG, the way cameras write it.
+func withEXIFOrientation(data []byte, orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, 0x0112) // Orientation
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)      // SHORT
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+
+	exif := []byte{0xFF, 0xE1}
+	exif = binary.BigEndian.AppendUint16(exif, uint16(len(segment)+2))
+	exif = append(exif, segment...)
+	return append(append(append([]byte{}, data[:2]...), exif...), data[2:]...)
+}
+
+func TestDecodeUploadedImage(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"png":  encodePNG(t, testImage(4, 2)),
+		"jpeg": encodeJPEG(t, testImage(4, 2)),
+	} {
+		t.Run(name, func(t *testing.T) {
+			img, err := decodeUploadedImage(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b := img.Bounds(); b.Dx() != 4 || b.Dy() != 2 {
+				t.Errorf("got %dx%d", b.Dx(), b.Dy())
+			}
+		})
+	}
+
+	// A tiny PNG claiming to be enormous is refused before it's decoded
+	huge := encodePNG(t, testImage(1, 1))
+	binary.BigEndian.PutUint32(huge[16:], 10_000)
+	binary.BigEndian.PutUint32(huge[20:], 10_000)
+	binary.BigEndian.PutUint32(huge[29:], crc32.ChecksumIEEE(huge[12:29]))
+
+	for name, tc := range map[string]struct {
+		data []byte
+		want string
+	}{
+		"not an image": {data: []byte("<svg xmlns='http://www.w3.org/2000/svg'></svg>"), want: "unsupported image type"},
+		"truncated":    {data: encodePNG(t, testImage(4, 2))[:40], want: "invalid image"},
+		"too large":    {data: huge, want: "image is too large, 10000x10000"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := decodeUploadedImage(tc.data); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got error %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecodeUploadedImageOrientation(t *testing.T) {
+	data := withEXIFOrientation(encodeJPEG(t, testImage(40, 20)), 6)
+	if got := jpegOrientation(data); got != 6 {
+		t.Fatalf("got orientation %d, want 6", got)
+	}
+
+	img, err := decodeUploadedImage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Turned clockwise, so the left half ends up on top
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+		t.Fatalf("got %dx%d, want 20x40", b.Dx(), b.Dy())
+	}
+	if r, _, b, _ := img.At(10, 5).RGBA(); r < b {
+		t.Error("top isn't red")
+	}
+
+	// The orientation isn't kept, the pixels are already upright
+	encoded, err := encodeImageVariants(img, imageFormat(img), imageKinds[ImageKindAvatar].Variants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, variant := range encoded {
+		if bytes.Contains(variant.Data, []byte("Exif")) {
+			t.Errorf("%s still has EXIF", variant.Variant)
+		}
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	plain := encodeJPEG(t, testImage(2, 1))
+	for name, tc := range map[string]struct {
+		data []byte
+		want int
+	}{
+		"no exif":      {data: plain, want: 1},
+		"not a jpeg":   {data: encodePNG(t, testImage(2, 1)), want: 1},
+		"flipped":      {data: withEXIFOrientation(plain, 2), want: 2},
+		"out of range": {data: withEXIFOrientation(plain, 9), want: 1},
+		"truncated":    {data: withEXIFOrientation(plain, 6)[:20], want: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got := jpegOrientation(tc.data); got != tc.want {
+				t.Errorf("got %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOrientImage(t *testing.T) {
+	img := testImage(2, 1)
+	for orientation, want := range map[int][]color.RGBA{
+		// Pixels in reading order of the result
+		1: {testRed, testBlue},
+		2: {testBlue, testRed},
+		3: {testBlue, testRed},
+		6: {testRed, testBlue},
+		8: {testBlue, testRed},
+	} {
+		oriented := orientImage(img, orientation)
+		b := oriented.Bounds()
+		var got []color.RGBA
+		for y := range b.Dy() {
+			for x := range b.Dx() {
+				got = append(got, color.RGBAModel.Convert(oriented.At(x, y)).(color.RGBA))
+			}
+		}
+		if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+			t.Errorf("orientation %d: got %v, want %v", orientation, got, want)
+		}
+		if quarterTurn := orientation >= 5; quarterTurn != (b.Dx() == 1) {
+			t.Errorf("orientation %d: got %dx%d", orientation, b.Dx(), b.Dy())
+		}
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	for name, tc := range map[string]struct {
+		w, h         int
+		variant      imageVariant
+		wantW, wantH int
+	}{
+		"fit smaller":       {w: 400, h: 200, variant: imageVariant{Width: 1024, Height: 1024}, wantW: 400, wantH: 200},
+		"fit wide":          {w: 2000, h: 1000, variant: imageVariant{Width: 1024, Height: 1024}, wantW: 1024, wantH: 512},
+		"fit tall":          {w: 1000, h: 2000, variant: imageVariant{Width: 1024, Height: 1024}, wantW: 512, wantH: 1024},
+		"width only":        {w: 1600, h: 4000, variant: imageVariant{Width: 800}, wantW: 800, wantH: 2000},
+		"crop":              {w: 400, h: 200, variant: imageVariant{Width: 64, Height: 64, Crop: true}, wantW: 64, wantH: 64},
+		"crop smaller":      {w: 40, h: 20, variant: imageVariant{Width: 64, Height: 64, Crop: true}, wantW: 20, wantH: 20},
+		"never zero pixels": {w: 5000, h: 1, variant: imageVariant{Width: 400}, wantW: 400, wantH: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			b := resizeImage(testImage(tc.w, tc.h), tc.variant).Bounds()
+			if b.Dx() != tc.wantW || b.Dy() != tc.wantH {
+				t.Errorf("got %dx%d, want %dx%d", b.Dx(), b.Dy(), tc.wantW, tc.wantH)
+			}
+		})
+	}
+}
+
+func TestImageFormat(t *testing.T) {
+	if got := imageFormat(testImage(2, 2)); got != "jpg" {
+		t.Errorf("opaque image: got %s, want jpg", got)
+	}
+	transparent := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	if got := imageFormat(transparent); got != "png" {
+		t.Errorf("transparent image: got %s, want png", got)
+	}
+}
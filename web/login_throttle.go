@@ -0,0 +1,393 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"golang.org/x/crypto/bcrypt"
+	"zombiezen.com/go/sqlite"
+)
+
+const (
+	// loginBackoffBase is how long to wait after the first failure, doubling
+	// with each one after it until the lockout
+	loginBackoffBase = time.Second
+
+	// loginAttemptRetention is how long attempts are kept for admins to look
+	// into
+	loginAttemptRetention     = 30 * 24 * time.Hour
+	loginAttemptPruneInterval = time.Hour
+)
+
+// errLoginInvalid is the same whether or not a user has the email, so it
+// doesn't tell who has an account.
+var errLoginInvalid = errors.New("email or password is invalid")
+
+// LoginLockedError is returned instead of checking the password while the
+// email or the address it comes from has to wait after failed attempts.
+type LoginLockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginLockedError) Error() string {
+	return fmt.Sprintf("too many failed sign in attempts, try again in %s", max(e.RetryAfter.Round(time.Second), time.Second))
+}
+
+// LoginThrottle slows down guessing passwords and two-factor codes. Every
+// attempt is recorded, and after each failure in a row for an email the next
+// attempt has to wait twice as long, until after maxFailures it is locked out
+// for lockout. Addresses are locked out after ipMaxFailures. Unknown emails
+// are throttled like any other, so it doesn't tell who has an account either.
+type LoginThrottle struct {
+	db             *toolbelt.Database
+	maxFailures    int
+	ipMaxFailures  int
+	lockout        time.Duration
+	trustedProxies []netip.Prefix
+}
+
+func NewLoginThrottle(db *toolbelt.Database, maxFailures, ipMaxFailures int, lockout time.Duration, trustedProxies []netip.Prefix) *LoginThrottle {
+	// Otherwise the first unknown email would take longer than the rest
+	dummyPasswordHash()
+
+	return &LoginThrottle{
+		db:             db,
+		maxFailures:    maxFailures,
+		ipMaxFailures:  ipMaxFailures,
+		lockout:        lockout,
+		trustedProxies: trustedProxies,
+	}
+}
+
+func normalizeLoginEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// clientIP is the address r came from. X-Forwarded-For is only read when r
+// comes from a trusted proxy, otherwise the client could make up a new address
+// for every attempt. Each proxy appends the address it saw, so the client's is
+// the last one that isn't a trusted proxy itself.
+func (t *LoginThrottle) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !t.trustedProxy(ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			break
+		}
+		ip = hop
+		if !t.trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (t *LoginThrottle) trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range t.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// loginAttempt is an attempt as far as throttling is concerned
+type loginAttempt struct {
+	succeeded bool
+	createdAt time.Time
+}
+
+// backoff is how many attempts failed in a row, newest first in attempts,
+// and until when the next has to wait because of it. Addresses are allowed
+// more failures, shared by everyone behind them, and only back off in the
+// last few before their lockout, like an email does from the first.
+func (t *LoginThrottle) backoff(attempts []loginAttempt, maxFailures int) (failures int, until time.Time) {
+	for _, attempt := range attempts {
+		if attempt.succeeded {
+			break
+		}
+		failures++
+	}
+	if failures == 0 {
+		return 0, time.Time{}
+	}
+
+	wait := t.lockout
+	if failures < maxFailures {
+		free := max(maxFailures-t.maxFailures, 0)
+		if failures <= free {
+			return failures, time.Time{}
+		}
+		wait = min(loginBackoffBase<<(failures-free-1), t.lockout)
+	}
+	// Times are rounded down to the second going into the database and
+	// again coming out, so the failure may have been up to two seconds later
+	return failures, attempts[0].createdAt.Add(2*time.Second + wait)
+}
+
+func (t *LoginThrottle) emailBackoff(tx *sqlite.Conn, email string, now time.Time) (int, time.Time, error) {
+	res, err := zz.OnceLoginAttemptsByEmail(tx, zz.LoginAttemptsByEmailParams{
+		Email: email,
+		Since: now.Add(-t.lockout),
+		Limit: int64(t.maxFailures),
+	})
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to get login attempts by email: %w", err)
+	}
+	attempts := make([]loginAttempt, len(res))
+	for i, r := range res {
+		attempts[i] = loginAttempt{succeeded: r.Succeeded, createdAt: r.CreatedAt}
+	}
+	failures, until := t.backoff(attempts, t.maxFailures)
+	return failures, until, nil
+}
+
+func (t *LoginThrottle) ipBackoff(tx *sqlite.Conn, ip string, now time.Time) (int, time.Time, error) {
+	// Signing in to their own account doesn't let anyone off for guessing
+	// at others from the same address
+	res, err := zz.OnceLoginFailuresByIp(tx, zz.LoginFailuresByIpParams{
+		Ip:    ip,
+		Since: now.Add(-t.lockout),
+		Limit: int64(t.ipMaxFailures),
+	})
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to get login failures by ip: %w", err)
+	}
+	attempts := make([]loginAttempt, len(res))
+	for i, r := range res {
+		attempts[i] = loginAttempt{succeeded: r.Succeeded, createdAt: r.CreatedAt}
+	}
+	failures, until := t.backoff(attempts, t.ipMaxFailures)
+	return failures, until, nil
+}
+
+// Attempt records a sign in as email from r, which counts as failed until
+// Succeeded is called with the returned id. It is recorded before the
+// password is checked so guesses sent at the same time wait for each other.
+// While the email or address has to wait it returns a *LoginLockedError
+// without recording anything.
+func (t *LoginThrottle) Attempt(r *http.Request, email string) (int64, error) {
+	email = normalizeLoginEmail(email)
+	ip := t.clientIP(r)
+
+	var (
+		attemptID int64
+		locked    *LoginLockedError
+	)
+	if err := t.db.WriteTX(r.Context(), func(tx *sqlite.Conn) error {
+		now := time.Now()
+		_, emailUntil, err := t.emailBackoff(tx, email, now)
+		if err != nil {
+			return err
+		}
+		_, ipUntil, err := t.ipBackoff(tx, ip, now)
+		if err != nil {
+			return err
+		}
+		if until := maxTime(emailUntil, ipUntil); until.After(now) {
+			locked = &LoginLockedError{RetryAfter: until.Sub(now)}
+			return nil
+		}
+
+		attemptID = toolbelt.NextID()
+		if err := zz.OnceCreateLoginAttempt(tx, &zz.LoginAttemptModel{
+			Id:        attemptID,
+			Email:     email,
+			Ip:        ip,
+			CreatedAt: now,
+		}); err != nil {
+			return fmt.Errorf("failed to create login attempt: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	if locked != nil {
+		return 0, locked
+	}
+	return attemptID, nil
+}
+
+// Succeeded marks the attempt as successful, which starts counting failures
+// for its email from zero.
+func (t *LoginThrottle) Succeeded(ctx context.Context, attemptID int64) error {
+	return t.db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+		attempt, err := zz.OnceReadByIDLoginAttempt(tx, attemptID)
+		if err != nil {
+			return fmt.Errorf("failed to get login attempt: %w", err)
+		}
+		if attempt == nil {
+			return nil
+		}
+		attempt.Succeeded = true
+		if err := zz.OnceUpdateLoginAttempt(tx, attempt); err != nil {
+			return fmt.Errorf("failed to update login attempt: %w", err)
+		}
+		return nil
+	})
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// LoginFailures is an email or address with failed sign ins, for admins.
+type LoginFailures struct {
+	Email string
+	IP    string
+	// Failures are since the lockout, and in a row for emails, up to the
+	// point where it is locked out
+	Failures int
+	Until    time.Time
+}
+
+func (f LoginFailures) Locked() bool {
+	return f.Until.After(time.Now())
+}
+
+// LoginAttemptsView is what admins see of the sign in attempts.
+type LoginAttemptsView struct {
+	Emails []LoginFailures
+	IPs    []LoginFailures
+	Latest []zz.LatestLoginAttemptsRes
+}
+
+// View lists the emails and addresses failing to sign in lately, and the
+// latest attempts.
+func (t *LoginThrottle) View(ctx context.Context, limit int64) (*LoginAttemptsView, error) {
+	view := &LoginAttemptsView{}
+	if err := t.db.ReadTX(ctx, func(tx *sqlite.Conn) (err error) {
+		now := time.Now()
+
+		emails, err := zz.OnceFailingLoginEmails(tx, zz.FailingLoginEmailsParams{
+			Since: now.Add(-t.lockout),
+			Limit: limit,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get failing login emails: %w", err)
+		}
+		for _, e := range emails {
+			failures, until, err := t.emailBackoff(tx, e.Email, now)
+			if err != nil {
+				return err
+			}
+			if failures > 0 {
+				view.Emails = append(view.Emails, LoginFailures{Email: e.Email, Failures: failures, Until: until})
+			}
+		}
+
+		ips, err := zz.OnceFailingLoginIps(tx, zz.FailingLoginIpsParams{
+			Since: now.Add(-t.lockout),
+			Limit: limit,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get failing login ips: %w", err)
+		}
+		for _, ip := range ips {
+			failures, until, err := t.ipBackoff(tx, ip.Ip, now)
+			if err != nil {
+				return err
+			}
+			if failures > 0 {
+				view.IPs = append(view.IPs, LoginFailures{IP: ip.Ip, Failures: failures, Until: until})
+			}
+		}
+
+		view.Latest, err = zz.OnceLatestLoginAttempts(tx, limit)
+		if err != nil {
+			return fmt.Errorf("failed to get latest login attempts: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return view, nil
+}
+
+// ClearLoginAttempts forgets the attempts of email or ip, lifting their
+// lockout, or every attempt when both are empty.
+func ClearLoginAttempts(tx *sqlite.Conn, email, ip string) error {
+	switch {
+	case email != "":
+		if err := zz.OnceDeleteLoginAttemptsByEmail(tx, normalizeLoginEmail(email)); err != nil {
+			return fmt.Errorf("failed to delete login attempts by email: %w", err)
+		}
+	case ip != "":
+		if err := zz.OnceDeleteLoginAttemptsByIp(tx, ip); err != nil {
+			return fmt.Errorf("failed to delete login attempts by ip: %w", err)
+		}
+	default:
+		if err := zz.OnceDeleteAllLoginAttempts(tx); err != nil {
+			return fmt.Errorf("failed to delete login attempts: %w", err)
+		}
+	}
+	return nil
+}
+
+func runLoginAttemptPruner(ctx context.Context, db *toolbelt.Database) {
+	ticker := time.NewTicker(loginAttemptPruneInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+			return zz.OnceDeleteLoginAttemptsBefore(tx, time.Now().Add(-loginAttemptRetention))
+		}); err != nil {
+			log.Printf("Pruning login attempts failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dummyPasswordHash is checked against when there is no password to check,
+// so unknown emails take as long as wrong passwords.
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("not anyone's password"), bcrypt.DefaultCost)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+})
+
+// checkPassword takes as long whether or not there is a user with a
+// password, which passwordHash is empty without.
+func checkPassword(passwordHash []byte, password string) error {
+	if len(passwordHash) == 0 {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(password))
+		return errLoginInvalid
+	}
+	if err := bcrypt.CompareHashAndPassword(passwordHash, []byte(password)); err != nil {
+		return errLoginInvalid
+	}
+	return nil
+}
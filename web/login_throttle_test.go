@@ -0,0 +1,304 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/config"
+	"zombiezen.com/go/sqlite"
+)
+
+// tryLogin signs in through the login form with a new browser and returns
+// the response.
+func tryLogin(t *testing.T, ts *testServer, email, password string) string {
+	t.Helper()
+
+	_, body := ts.datastar(t, ts.browser(t), http.MethodPost, "/auth/login", map[string]string{
+		"email":    email,
+		"password": password,
+	})
+	return body
+}
+
+// waitOutBackoff moves every attempt back in time by d, as if the client had
+// waited.
+func waitOutBackoff(t *testing.T, ts *testServer, d time.Duration) {
+	t.Helper()
+
+	// Times are Julian days
+	ts.exec(t, fmt.Sprintf(`UPDATE login_attempts SET created_at = created_at - %f`, d.Hours()/24))
+}
+
+func TestLoginBackoff(t *testing.T) {
+	throttle := &LoginThrottle{maxFailures: 5, ipMaxFailures: 20, lockout: 15 * time.Minute}
+	start := time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC)
+
+	// attempts are newest first, a second apart
+	attempts := func(succeeded ...bool) []loginAttempt {
+		res := make([]loginAttempt, len(succeeded))
+		for i, s := range succeeded {
+			res[i] = loginAttempt{succeeded: s, createdAt: start.Add(-time.Duration(i) * time.Second)}
+		}
+		return res
+	}
+	failures := func(n int) []bool {
+		return make([]bool, n)
+	}
+
+	for name, tc := range map[string]struct {
+		attempts     []loginAttempt
+		maxFailures  int
+		wantFailures int
+		wantWait     time.Duration
+	}{
+		"no attempts":            {attempts: nil, maxFailures: 5},
+		"succeeded":              {attempts: attempts(true, false, false), maxFailures: 5},
+		"one failure":            {attempts: attempts(false), maxFailures: 5, wantFailures: 1, wantWait: time.Second},
+		"doubles":                {attempts: attempts(failures(3)...), maxFailures: 5, wantFailures: 3, wantWait: 4 * time.Second},
+		"since the last success": {attempts: attempts(false, false, true, false, false), maxFailures: 5, wantFailures: 2, wantWait: 2 * time.Second},
+		"locked out":             {attempts: attempts(failures(5)...), maxFailures: 5, wantFailures: 5, wantWait: 15 * time.Minute},
+		// Addresses get the difference to an email's limit for free
+		"address below the backoff": {attempts: attempts(failures(15)...), maxFailures: 20, wantFailures: 15},
+		"address backing off":       {attempts: attempts(failures(17)...), maxFailures: 20, wantFailures: 17, wantWait: 2 * time.Second},
+		"address locked out":        {attempts: attempts(failures(20)...), maxFailures: 20, wantFailures: 20, wantWait: 15 * time.Minute},
+	} {
+		t.Run(name, func(t *testing.T) {
+			gotFailures, until := throttle.backoff(tc.attempts, tc.maxFailures)
+			if gotFailures != tc.wantFailures {
+				t.Errorf("got %d failures, want %d", gotFailures, tc.wantFailures)
+			}
+			var want time.Time
+			if tc.wantWait > 0 {
+				// With two seconds for rounding to the second
+				want = start.Add(2*time.Second + tc.wantWait)
+			}
+			if !until.Equal(want) {
+				t.Errorf("got until %s, want %s", until, want)
+			}
+		})
+	}
+
+	// Doubling stops at the lockout
+	short := &LoginThrottle{maxFailures: 5, ipMaxFailures: 20, lockout: 3 * time.Second}
+	if _, until := short.backoff(attempts(failures(4)...), 5); !until.Equal(start.Add(5 * time.Second)) {
+		t.Errorf("got until %s, want the lockout", until)
+	}
+}
+
+func TestLoginClientIP(t *testing.T) {
+	proxies := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("192.168.1.1/32")}
+
+	for name, tc := range map[string]struct {
+		remoteAddr string
+		forwarded  string
+		trusted    []netip.Prefix
+		want       string
+	}{
+		"no proxies":          {remoteAddr: "10.0.0.1:1234", forwarded: "1.1.1.1", want: "10.0.0.1"},
+		"untrusted client":    {remoteAddr: "3.3.3.3:1234", forwarded: "1.1.1.1", trusted: proxies, want: "3.3.3.3"},
+		"trusted proxy":       {remoteAddr: "10.0.0.1:1234", forwarded: "1.1.1.1, 2.2.2.2", trusted: proxies, want: "2.2.2.2"},
+		"chain of proxies":    {remoteAddr: "10.0.0.1:1234", forwarded: "1.1.1.1, 2.2.2.2, 192.168.1.1", trusted: proxies, want: "2.2.2.2"},
+		"without the header":  {remoteAddr: "10.0.0.1:1234", trusted: proxies, want: "10.0.0.1"},
+		"only trusted hops":   {remoteAddr: "10.0.0.1:1234", forwarded: "10.0.0.2", trusted: proxies, want: "10.0.0.2"},
+		"IPv4 mapped proxy":   {remoteAddr: "[::ffff:10.0.0.1]:1234", forwarded: "2.2.2.2", trusted: proxies, want: "2.2.2.2"},
+		"remote without port": {remoteAddr: "10.0.0.1", forwarded: "2.2.2.2", trusted: proxies, want: "2.2.2.2"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/auth/login", nil)
+			r.RemoteAddr = tc.remoteAddr
+			if tc.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tc.forwarded)
+			}
+			if ip := (&LoginThrottle{trustedProxies: tc.trusted}).clientIP(r); ip != tc.want {
+				t.Errorf("got %s, want %s", ip, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoginIgnoresForwardedFor(t *testing.T) {
+	ts := newTestServer(t, func(cfg *config.Config) {
+		cfg.LoginMaxFailures = 3
+		cfg.LoginIPMaxFailures = 4
+	})
+
+	// Made up addresses don't get anyone more guesses
+	for i, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		body := strings.NewReader(fmt.Sprintf(`{"user":{"email":%q,"password":"password1234"}}`, email))
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/users/login", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("1.1.1.%d", i))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		want := http.StatusUnauthorized
+		if i == 2 {
+			want = http.StatusTooManyRequests
+		}
+		if res.StatusCode != want {
+			t.Errorf("guessing %s: got status %d, want %d", email, res.StatusCode, want)
+		}
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "jake")
+
+	if body := tryLogin(t, ts, "jake@example.com", "wrong-password"); !strings.Contains(body, errLoginInvalid.Error()) {
+		t.Fatalf("wrong password: %s", body)
+	}
+	// Even the right password has to wait
+	if body := tryLogin(t, ts, "jake@example.com", "password1234"); !strings.Contains(body, "too many failed sign in attempts") {
+		t.Errorf("right password while backing off: %s", body)
+	}
+	if status := ts.api(t, http.MethodPost, "/api/users/login", "", map[string]any{
+		"user": map[string]string{"email": "jake@example.com", "password": "password1234"},
+	}, nil); status != http.StatusTooManyRequests {
+		t.Errorf("API while backing off: got status %d, want %d", status, http.StatusTooManyRequests)
+	}
+	// Emails are compared the way they are typed in
+	if body := tryLogin(t, ts, " JAKE@example.com", "password1234"); !strings.Contains(body, "too many failed sign in attempts") {
+		t.Errorf("differently typed email while backing off: %s", body)
+	}
+
+	waitOutBackoff(t, ts, 10*time.Second)
+	if body := tryLogin(t, ts, " jake@example.com ", "password1234"); !strings.Contains(body, "redirect /") {
+		t.Fatalf("right password after waiting: %s", body)
+	}
+
+	// Unknown emails back off the same, so they don't tell who has an account
+	if body := tryLogin(t, ts, "nobody@example.com", "password1234"); !strings.Contains(body, errLoginInvalid.Error()) {
+		t.Errorf("unknown email: %s", body)
+	}
+	if body := tryLogin(t, ts, "nobody@example.com", "password1234"); !strings.Contains(body, "too many failed sign in attempts") {
+		t.Errorf("unknown email while backing off: %s", body)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	ts := newTestServer(t, func(cfg *config.Config) {
+		cfg.LoginMaxFailures = 3
+		cfg.LoginLockout = time.Hour
+	})
+	ts.register(t, "jake")
+
+	for range 3 {
+		if body := tryLogin(t, ts, "jake@example.com", "wrong-password"); !strings.Contains(body, errLoginInvalid.Error()) {
+			t.Fatalf("wrong password: %s", body)
+		}
+		waitOutBackoff(t, ts, 10*time.Second)
+	}
+
+	// Locked out for the lockout, not the doubling backoff
+	waitOutBackoff(t, ts, 50*time.Minute)
+	body := tryLogin(t, ts, "jake@example.com", "password1234")
+	if !strings.Contains(body, "too many failed sign in attempts, try again in 9m") && !strings.Contains(body, "try again in 10m") {
+		t.Errorf("right password while locked out: %s", body)
+	}
+
+	// Only until the lockout is over
+	waitOutBackoff(t, ts, 11*time.Minute)
+	if body := tryLogin(t, ts, "jake@example.com", "password1234"); !strings.Contains(body, "redirect /") {
+		t.Errorf("right password after the lockout: %s", body)
+	}
+}
+
+func TestLoginIPLockout(t *testing.T) {
+	// Every request comes from 127.0.0.1, which gets one failure for free
+	// and backs off after the second
+	ts := newTestServer(t, func(cfg *config.Config) {
+		cfg.LoginMaxFailures = 3
+		cfg.LoginIPMaxFailures = 4
+	})
+	ts.register(t, "jake")
+
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		if body := tryLogin(t, ts, email, "password1234"); !strings.Contains(body, errLoginInvalid.Error()) {
+			t.Fatalf("guessing %s: %s", email, body)
+		}
+	}
+	// An email never tried before still has to wait for the address
+	if body := tryLogin(t, ts, "c@example.com", "password1234"); !strings.Contains(body, "too many failed sign in attempts") {
+		t.Errorf("new email from a failing address: %s", body)
+	}
+
+	// Signing in to their own account doesn't reset the address
+	waitOutBackoff(t, ts, 10*time.Second)
+	if body := tryLogin(t, ts, "jake@example.com", "password1234"); !strings.Contains(body, "redirect /") {
+		t.Fatalf("right password after waiting: %s", body)
+	}
+	if body := tryLogin(t, ts, "d@example.com", "password1234"); !strings.Contains(body, errLoginInvalid.Error()) {
+		t.Fatalf("guessing d@example.com: %s", body)
+	}
+	if body := tryLogin(t, ts, "e@example.com", "password1234"); !strings.Contains(body, "too many failed sign in attempts") {
+		t.Errorf("after signing in to their own account: %s", body)
+	}
+}
+
+func TestLoginAttemptsView(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "jake")
+	tryLogin(t, ts, "jake@example.com", "wrong-password")
+	tryLogin(t, ts, "nobody@example.com", "wrong-password")
+
+	throttle := NewLoginThrottle(ts.db, ts.cfg.LoginMaxFailures, ts.cfg.LoginIPMaxFailures, ts.cfg.LoginLockout, nil)
+	view, err := throttle.View(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(view.Emails) != 2 || len(view.IPs) != 1 || len(view.Latest) != 2 {
+		t.Fatalf("got %d emails, %d addresses and %d attempts", len(view.Emails), len(view.IPs), len(view.Latest))
+	}
+	for _, f := range view.Emails {
+		if f.Failures != 1 || !f.Locked() {
+			t.Errorf("%s: got %d failures, locked %t", f.Email, f.Failures, f.Locked())
+		}
+	}
+	// The address gets its first failures for free
+	if ip := view.IPs[0]; ip.IP != "127.0.0.1" || ip.Failures != 2 || ip.Locked() {
+		t.Errorf("got %+v", ip)
+	}
+
+	if err := ts.db.WriteTX(context.Background(), func(tx *sqlite.Conn) error {
+		return ClearLoginAttempts(tx, "JAKE@example.com", "")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if body := tryLogin(t, ts, "jake@example.com", "password1234"); !strings.Contains(body, "redirect /") {
+		t.Errorf("right password after clearing the email: %s", body)
+	}
+	if body := tryLogin(t, ts, "nobody@example.com", "password1234"); !strings.Contains(body, "too many failed sign in attempts") {
+		t.Errorf("other email after clearing the email: %s", body)
+	}
+}
+
+func TestTwoFactorCodeThrottle(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "jake")
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+	enableTwoFactor(t, ts, jake)
+
+	// Codes are guessed at the same pace as passwords
+	client := passwordStep(t, ts, "jake")
+	ts.forgetLoginAttempts(t)
+	if _, body := ts.datastar(t, client, http.MethodPost, "/auth/two-factor", TwoFactorForm{Code: "000000"}); !strings.Contains(body, errTwoFactorCodeInvalid.Error()) {
+		t.Fatalf("wrong code: %s", body)
+	}
+	if _, body := ts.datastar(t, client, http.MethodPost, "/auth/two-factor", TwoFactorForm{Code: "000000"}); !strings.Contains(body, "too many failed sign in attempts") {
+		t.Errorf("second guess right away: %s", body)
+	}
+}
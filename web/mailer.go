@@ -0,0 +1,186 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Mail is a plain text email to a single recipient.
+type Mail struct {
+	To      string
+	Subject string
+	Text    string
+}
+
+// Mailer sends mail from the site.
+type Mailer interface {
+	Send(ctx context.Context, m *Mail) error
+}
+
+// linkBaseURL is where links in mail point, baseURL when configured and
+// otherwise the host r came in on.
+func linkBaseURL(baseURL string, r *http.Request) string {
+	if baseURL == "" {
+		baseURL = requestBaseURL(r)
+	}
+	return strings.TrimSuffix(baseURL, "/")
+}
+
+// newEmailToken is the secret in a link mailed to a user, only its hash is
+// stored.
+func newEmailToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashEmailToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// formatMail builds the RFC 5322 message for m, refusing headers that would
+// smuggle in headers of their own.
+func formatMail(from string, m *Mail) ([]byte, error) {
+	if strings.ContainsAny(m.To+m.Subject, "\r\n") {
+		return nil, errors.New("mail headers can't contain line breaks")
+	}
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address %q: %w", from, err)
+	}
+	if _, err := mail.ParseAddress(m.To); err != nil {
+		return nil, fmt.Errorf("invalid to address %q: %w", m.To, err)
+	}
+
+	messageID := make([]byte, 16)
+	if _, err := rand.Read(messageID); err != nil {
+		return nil, fmt.Errorf("failed to generate message ID: %w", err)
+	}
+	_, domain, _ := strings.Cut(fromAddr.Address, "@")
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", fromAddr.String())
+	fmt.Fprintf(buf, "To: %s\r\n", m.To)
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(messageID), domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	buf.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(buf)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(m.Text, "\n", "\r\n"))); err != nil {
+		return nil, fmt.Errorf("failed to encode mail: %w", err)
+	}
+	if err := qp.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode mail: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// SMTPMailer sends mail through an SMTP server, upgrading to TLS when the
+// server offers it.
+type SMTPMailer struct {
+	addr     string
+	auth     smtp.Auth
+	from     string
+	envelope string
+}
+
+// NewSMTPMailer authenticates with username and password unless username is
+// empty.
+func NewSMTPMailer(addr, username, password, from string) (*SMTPMailer, error) {
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address %q: %w", from, err)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP address %q: %w", addr, err)
+	}
+
+	m := &SMTPMailer{
+		addr:     addr,
+		from:     from,
+		envelope: fromAddr.Address,
+	}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m, nil
+}
+
+func (s *SMTPMailer) Send(ctx context.Context, m *Mail) error {
+	msg, err := formatMail(s.from, m)
+	if err != nil {
+		return err
+	}
+	to, _ := mail.ParseAddress(m.To)
+	if err := smtp.SendMail(s.addr, s.auth, s.envelope, []string{to.Address}, msg); err != nil {
+		return fmt.Errorf("failed to send mail: %w", err)
+	}
+	return nil
+}
+
+// MaildirMailer delivers mail into a maildir instead of sending it, so it can
+// be read with any mail client during development.
+type MaildirMailer struct {
+	dir  string
+	from string
+	seq  atomic.Int64
+}
+
+func NewMaildirMailer(dir, from string) *MaildirMailer {
+	return &MaildirMailer{dir: dir, from: from}
+}
+
+// Send writes into tmp and moves the message into new once it is complete,
+// as readers of a maildir expect.
+func (s *MaildirMailer) Send(ctx context.Context, m *Mail) error {
+	msg, err := formatMail(s.from, m)
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(s.dir, sub), 0700); err != nil {
+			return fmt.Errorf("failed to create maildir: %w", err)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	hostname = strings.NewReplacer("/", "_", ":", "_").Replace(hostname)
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), s.seq.Add(1), hostname)
+
+	tmp := filepath.Join(s.dir, "tmp", name)
+	if err := os.WriteFile(tmp, msg, 0600); err != nil {
+		return fmt.Errorf("failed to write mail: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, "new", name)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to deliver mail: %w", err)
+	}
+	return nil
+}
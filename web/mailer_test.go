@@ -0,0 +1,204 @@
+package web
+
+import (
+	"context"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readMaildirMail decodes a message the way a mail client would.
+func readMaildirMail(t *testing.T, path string) (header mail.Header, text string) {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", path, err)
+	}
+	b, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatalf("failed to decode %s: %v", path, err)
+	}
+	return msg.Header, strings.ReplaceAll(string(b), "\r\n", "\n")
+}
+
+// mails is the text of every mail to to with subject delivered so far, in
+// the order they were sent.
+func (ts *testServer) mails(t *testing.T, to, subject string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(filepath.Join(ts.cfg.MailFolder(), "new"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	// The mailer numbers what it delivers after the Q in the name
+	type delivered struct {
+		seq  int
+		text string
+	}
+	var found []delivered
+	dec := &mime.WordDecoder{}
+	for _, entry := range entries {
+		header, text := readMaildirMail(t, filepath.Join(ts.cfg.MailFolder(), "new", entry.Name()))
+		gotSubject, err := dec.DecodeHeader(header.Get("Subject"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Get("To") != to || gotSubject != subject {
+			continue
+		}
+		_, rest, _ := strings.Cut(entry.Name(), "Q")
+		seqText, _, _ := strings.Cut(rest, ".")
+		seq, err := strconv.Atoi(seqText)
+		if err != nil {
+			t.Fatalf("unexpected maildir name %q", entry.Name())
+		}
+		found = append(found, delivered{seq: seq, text: text})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].seq < found[j].seq })
+
+	texts := make([]string, len(found))
+	for i, d := range found {
+		texts[i] = d.text
+	}
+	return texts
+}
+
+// waitForMail returns the nth mail, counting from 1, to to with subject. Mail
+// is sent in the background, so it can arrive after the response.
+func (ts *testServer) waitForMail(t *testing.T, to, subject string, n int) string {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if texts := ts.mails(t, to, subject); len(texts) >= n {
+			return texts[n-1]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no mail %d to %s about %q", n, to, subject)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// mailToken is the token in the link to path in a mail.
+func mailToken(t *testing.T, text, path string) string {
+	t.Helper()
+
+	link := regexp.MustCompile(`https?://\S+` + regexp.QuoteMeta(path) + `\?\S+`).FindString(text)
+	if link == "" {
+		t.Fatalf("no link to %s in %q", path, text)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := u.Query().Get("token")
+	if token == "" {
+		t.Fatalf("no token in %s", link)
+	}
+	return token
+}
+
+func TestFormatMail(t *testing.T) {
+	msg, err := formatMail("Conduit <conduit@example.com>", &Mail{
+		To:      "jake@example.com",
+		Subject: "Héllo",
+		Text:    "line one\nline two with a long tail " + strings.Repeat("x", 100) + " = done\n",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := mail.ReadMessage(strings.NewReader(string(msg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := (&mime.WordDecoder{}).DecodeHeader(parsed.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Héllo" {
+		t.Errorf("got subject %q", subject)
+	}
+	if got := parsed.Header.Get("Message-Id"); !strings.HasSuffix(got, "@example.com>") {
+		t.Errorf("got message ID %q, want one at the sender's domain", got)
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(parsed.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "line one\r\nline two with a long tail " + strings.Repeat("x", 100) + " = done\r\n"; string(body) != want {
+		t.Errorf("got body %q, want %q", body, want)
+	}
+
+	for name, m := range map[string]*Mail{
+		"line break in to":      {To: "jake@example.com\r\nBcc: jane@example.com", Subject: "hi"},
+		"line break in subject": {To: "jake@example.com", Subject: "hi\nBcc: jane@example.com"},
+		"invalid to":            {To: "jake", Subject: "hi"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := formatMail("conduit@example.com", m); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+	if _, err := formatMail("conduit", &Mail{To: "jake@example.com"}); err == nil {
+		t.Error("got no error for an invalid from address")
+	}
+}
+
+func TestMaildirMailer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "mail")
+	mailer := NewMaildirMailer(dir, "Conduit <conduit@example.com>")
+
+	for _, subject := range []string{"first", "second"} {
+		if err := mailer.Send(context.Background(), &Mail{To: "jake@example.com", Subject: subject, Text: "hi"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only complete messages are in new
+	tmp, err := os.ReadDir(filepath.Join(dir, "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmp) != 0 {
+		t.Errorf("got %d messages left in tmp", len(tmp))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cur")); err != nil {
+		t.Errorf("maildir has no cur: %v", err)
+	}
+	delivered, err := os.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delivered) != 2 {
+		t.Fatalf("got %d messages, want 2", len(delivered))
+	}
+	header, text := readMaildirMail(t, filepath.Join(dir, "new", delivered[0].Name()))
+	if header.Get("To") != "jake@example.com" || text != "hi" {
+		t.Errorf("got mail to %q saying %q", header.Get("To"), text)
+	}
+
+	if err := mailer.Send(context.Background(), &Mail{To: "jake@example.com\nBcc: x@example.com"}); err == nil {
+		t.Error("got no error for a smuggled header")
+	}
+}
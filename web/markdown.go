@@ -0,0 +1,50 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	highlighting "github.com/yuin/goldmark-highlighting/v2"
+	"github.com/yuin/goldmark/extension"
+)
+
+var (
+	markdown = goldmark.New(
+		goldmark.WithExtensions(
+			extension.GFM,
+			highlighting.NewHighlighting(
+				highlighting.WithStyle("github"),
+			),
+		),
+	)
+
+	// markdownPolicy is applied to everything goldmark produces, raw HTML is
+	// already dropped by the renderer but authors are not trusted either way.
+	markdownPolicy = func() *bluemonday.Policy {
+		p := bluemonday.UGCPolicy()
+
+		// GFM task lists
+		p.AllowAttrs("type").Matching(regexp.MustCompile(`^checkbox$`)).OnElements("input")
+		p.AllowAttrs("checked", "disabled").OnElements("input")
+
+		// Syntax highlighting uses inline styles
+		p.AllowStyles(
+			"color", "background-color",
+			"font-weight", "font-style", "text-decoration",
+		).OnElements("pre", "span")
+
+		return p
+	}()
+)
+
+// RenderMarkdown converts an article body to sanitized HTML.
+func RenderMarkdown(source string) (string, error) {
+	buf := &bytes.Buffer{}
+	if err := markdown.Convert([]byte(source), buf); err != nil {
+		return "", fmt.Errorf("failed to render markdown: %w", err)
+	}
+	return markdownPolicy.Sanitize(buf.String()), nil
+}
@@ -0,0 +1,125 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"zombiezen.com/go/sqlite"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	for name, tc := range map[string]struct {
+		source string
+		want   []string
+	}{
+		"emphasis": {
+			source: "Some *dragons* are **big**",
+			want:   []string{"<em>dragons</em>", "<strong>big</strong>"},
+		},
+		"table": {
+			source: "| a | b |\n|---|---|\n| 1 | 2 |",
+			want:   []string{"<table>", "<th>a</th>", "<td>2</td>"},
+		},
+		"task list": {
+			source: "- [x] done\n- [ ] todo",
+			want:   []string{`<input checked="" disabled="" type="checkbox"`, `<input disabled="" type="checkbox"`},
+		},
+		"fenced code": {
+			source: "```go\nfunc main() {}\n```",
+			want:   []string{"<pre", "<span", "style=", "main"},
+		},
+		"autolink": {
+			source: "see https://example.com",
+			want:   []string{`href="https://example.com"`},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := RenderMarkdown(tc.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("%q doesn't contain %q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderMarkdownSanitizes(t *testing.T) {
+	for name, source := range map[string]string{
+		"script":          "<script>alert(1)</script>",
+		"event handler":   `<img src="x" onerror="alert(1)">`,
+		"javascript link": "[click](javascript:alert(1))",
+		"iframe":          `<iframe src="https://evil.example"></iframe>`,
+		"style":           `<p style="position:fixed">covered</p>`,
+		"form input":      `<input type="text" onfocus="alert(1)" autofocus>`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := RenderMarkdown(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lower := strings.ToLower(got)
+			for _, bad := range []string{"<script", "onerror", "onfocus", "javascript:", "<iframe", "position:fixed", `type="text"`} {
+				if strings.Contains(lower, bad) {
+					t.Errorf("%q contains %q", got, bad)
+				}
+			}
+		})
+	}
+}
+
+func TestArticleBodyHTMLCached(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+	article := createAPIArticle(t, ts, token, "Dragons")
+
+	bodyHTML := func() string {
+		t.Helper()
+
+		var html string
+		if err := ts.db.ReadTX(context.Background(), func(tx *sqlite.Conn) error {
+			id, err := zz.OnceArticleIdBySlug(tx, article.Slug)
+			if err != nil {
+				return err
+			}
+			a, err := zz.OnceReadByIDArticle(tx, id)
+			if err != nil {
+				return err
+			}
+			html = a.BodyHtml
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return html
+	}
+
+	if got := bodyHTML(); !strings.Contains(got, "All about Dragons") {
+		t.Errorf("got body HTML %q after creating", got)
+	}
+
+	status := ts.api(t, http.MethodPut, "/api/articles/"+article.Slug, token, map[string]any{
+		"article": map[string]any{"body": "Now with **bold** <script>alert(1)</script>"},
+	}, nil)
+	if status != http.StatusOK {
+		t.Fatalf("updating: got status %d", status)
+	}
+	got := bodyHTML()
+	if !strings.Contains(got, "<strong>bold</strong>") {
+		t.Errorf("got body HTML %q after updating", got)
+	}
+	if strings.Contains(got, "<script") {
+		t.Errorf("body HTML %q isn't sanitized", got)
+	}
+
+	_, page := ts.get(t, nil, "/articles/"+article.Slug)
+	if !strings.Contains(page, "<strong>bold</strong>") {
+		t.Error("article page doesn't show the rendered body")
+	}
+}
@@ -0,0 +1,601 @@
+package web
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/delaneyj/datastar"
+	"github.com/delaneyj/realworld-datastar/config"
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+	"zombiezen.com/go/sqlite"
+)
+
+const (
+	// oidcLoginTimeout is how long users have to sign in at the provider
+	oidcLoginTimeout = 10 * time.Minute
+	oidcHTTPTimeout  = 10 * time.Second
+	maxUsernameLen   = 32
+)
+
+var (
+	errOIDCFailed        = errors.New("signing in with the provider failed, please try again")
+	errOIDCNoEmail       = errors.New("the provider didn't share your email address")
+	errOIDCEmailInUse    = errors.New("an account with this email exists already, sign in to it and connect the provider from your settings")
+	errOIDCIdentityInUse = errors.New("this account at the provider is connected to another user")
+)
+
+// OIDCProvider signs users in with an OpenID Connect identity provider. Its
+// endpoints are discovered on first use, so the site starts without it.
+type OIDCProvider struct {
+	config.OIDCProvider
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+func NewOIDCProviders(cfgs []config.OIDCProvider) []*OIDCProvider {
+	providers := make([]*OIDCProvider, len(cfgs))
+	for i, cfg := range cfgs {
+		providers[i] = &OIDCProvider{OIDCProvider: cfg}
+	}
+	return providers
+}
+
+func oidcProviderByID(providers []*OIDCProvider, id string) *OIDCProvider {
+	for _, p := range providers {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// oidcContext makes the oidc and oauth2 packages give up on providers that
+// don't answer.
+func oidcContext(ctx context.Context) context.Context {
+	return oidc.ClientContext(ctx, &http.Client{Timeout: oidcHTTPTimeout})
+}
+
+func (p *OIDCProvider) discover(ctx context.Context) (*oidc.Provider, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.provider == nil {
+		provider, err := oidc.NewProvider(ctx, p.Issuer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover %s: %w", p.Issuer, err)
+		}
+		p.provider = provider
+	}
+	return p.provider, nil
+}
+
+func (p *OIDCProvider) oauth2Config(provider *oidc.Provider, redirectURL string) *oauth2.Config {
+	scopes := p.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+	}
+	if !slices.Contains(scopes, oidc.ScopeOpenID) {
+		scopes = append([]string{oidc.ScopeOpenID}, scopes...)
+	}
+	return &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  redirectURL,
+		Scopes:       scopes,
+	}
+}
+
+// oidcIdentity is who the provider says signed in.
+type oidcIdentity struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+	Name              string
+}
+
+// oidcClaims are the claims of ID tokens and userinfo Conduit uses. Some
+// providers send email_verified as a string.
+type oidcClaims struct {
+	Email             string `json:"email"`
+	EmailVerified     any    `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+}
+
+func (c *oidcClaims) emailVerified() bool {
+	return c.EmailVerified == true || c.EmailVerified == "true"
+}
+
+// oidcUsername picks a username for a new user that isn't taken, from what
+// the provider calls them.
+func oidcUsername(tx *sqlite.Conn, identity *oidcIdentity) (string, error) {
+	localPart, _, _ := strings.Cut(identity.Email, "@")
+
+	base := "user"
+	for _, candidate := range []string{identity.PreferredUsername, identity.Name, localPart} {
+		if candidate = sanitizeUsername(candidate); candidate != "" {
+			base = candidate
+			break
+		}
+	}
+
+	for i := 1; i <= 100; i++ {
+		username := base
+		if i > 1 {
+			suffix := fmt.Sprintf("%d", i)
+			username = truncateRunes(base, maxUsernameLen-len(suffix)) + suffix
+		}
+		u, err := zz.OnceUserByUsername(tx, username)
+		if err != nil {
+			return "", fmt.Errorf("failed to get user by username: %w", err)
+		}
+		if u == nil {
+			return username, nil
+		}
+	}
+	return fmt.Sprintf("%s%d", truncateRunes(base, maxUsernameLen-20), toolbelt.NextID()), nil
+}
+
+// sanitizeUsername keeps letters, digits and a few separators, so names
+// like "Jane Doe" become "Jane-Doe".
+func sanitizeUsername(name string) string {
+	name = strings.Join(strings.Fields(name), "-")
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return -1
+	}, name)
+	return truncateRunes(strings.Trim(name, "-_."), maxUsernameLen)
+}
+
+func truncateRunes(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
+
+// setupOIDCRoutes signs users in with the identity providers in the config,
+// using the authorization code flow with PKCE. Users are found by the
+// provider's subject, and a new user is created the first time unless they
+// have an account with the same email already, which they have to connect
+// from their settings. Signed in users going through it connect the
+// provider to their account instead.
+func setupOIDCRoutes(authRouter chi.Router, db *toolbelt.Database, sessionStore sessions.Store, providers []*OIDCProvider, baseURL string, verifier *EmailVerifier) {
+	redirectURL := func(r *http.Request, p *OIDCProvider) string {
+		return fmt.Sprintf("%s/auth/oidc/%s/callback", linkBaseURL(baseURL, r), p.ID)
+	}
+
+	authRouter.Route("/oidc/{provider}", func(oidcRouter chi.Router) {
+		oidcRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			ctx := oidcContext(r.Context())
+			p := oidcProviderByID(providers, chi.URLParam(r, "provider"))
+			if p == nil {
+				http.NotFound(w, r)
+				return
+			}
+			u, _ := UserFromContext(ctx)
+
+			provider, err := p.discover(ctx)
+			if err != nil {
+				log.Printf("OIDC provider %s: %v", p.ID, err)
+				PageSignInFailed(r, u, errOIDCFailed).Render(ctx, w)
+				return
+			}
+
+			state, err := newEmailToken()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			nonce, err := newEmailToken()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			codeVerifier := oauth2.GenerateVerifier()
+
+			sess, err := sessionStore.Get(r, "conduit")
+			if err != nil {
+				http.Error(w, "failed to get session", http.StatusInternalServerError)
+				return
+			}
+			sess.Values["oidcProvider"] = p.ID
+			sess.Values["oidcState"] = state
+			sess.Values["oidcNonce"] = nonce
+			sess.Values["oidcVerifier"] = codeVerifier
+			sess.Values["oidcStartedAt"] = time.Now().Unix()
+			if u != nil {
+				sess.Values["oidcLinkUserID"] = u.Id
+			} else {
+				delete(sess.Values, "oidcLinkUserID")
+			}
+			if err := sess.Save(r, w); err != nil {
+				http.Error(w, "failed to save session", http.StatusInternalServerError)
+				return
+			}
+
+			authURL := p.oauth2Config(provider, redirectURL(r, p)).AuthCodeURL(
+				state,
+				oidc.Nonce(nonce),
+				oauth2.S256ChallengeOption(codeVerifier),
+			)
+			http.Redirect(w, r, authURL, http.StatusSeeOther)
+		})
+
+		oidcRouter.Get("/callback", func(w http.ResponseWriter, r *http.Request) {
+			ctx := oidcContext(r.Context())
+			p := oidcProviderByID(providers, chi.URLParam(r, "provider"))
+			if p == nil {
+				http.NotFound(w, r)
+				return
+			}
+			u, _ := UserFromContext(ctx)
+
+			sess, err := sessionStore.Get(r, "conduit")
+			if err != nil {
+				http.Error(w, "failed to get session", http.StatusInternalServerError)
+				return
+			}
+
+			// Each attempt can only be finished once
+			sessionProvider, _ := sess.Values["oidcProvider"].(string)
+			state, _ := sess.Values["oidcState"].(string)
+			nonce, _ := sess.Values["oidcNonce"].(string)
+			codeVerifier, _ := sess.Values["oidcVerifier"].(string)
+			startedAt, _ := sess.Values["oidcStartedAt"].(int64)
+			linkUserID, linking := sess.Values["oidcLinkUserID"].(int64)
+			for _, key := range []string{"oidcProvider", "oidcState", "oidcNonce", "oidcVerifier", "oidcStartedAt", "oidcLinkUserID"} {
+				delete(sess.Values, key)
+			}
+
+			fail := func(err error, reason string, args ...any) {
+				log.Printf("OIDC sign in with %s failed: %s", p.ID, fmt.Sprintf(reason, args...))
+				if err := sess.Save(r, w); err != nil {
+					http.Error(w, "failed to save session", http.StatusInternalServerError)
+					return
+				}
+				PageSignInFailed(r, u, err).Render(ctx, w)
+			}
+
+			switch {
+			case r.URL.Query().Get("error") != "":
+				fail(errOIDCFailed, "provider returned %s: %s", r.URL.Query().Get("error"), r.URL.Query().Get("error_description"))
+				return
+			case sessionProvider != p.ID || state == "" || time.Since(time.Unix(startedAt, 0)) > oidcLoginTimeout:
+				fail(errOIDCFailed, "no sign in was started in this session")
+				return
+			case subtle.ConstantTimeCompare([]byte(state), []byte(r.URL.Query().Get("state"))) != 1:
+				fail(errOIDCFailed, "state doesn't match")
+				return
+			case linking && (u == nil || u.Id != linkUserID):
+				fail(errOIDCFailed, "user changed while connecting")
+				return
+			}
+
+			provider, err := p.discover(ctx)
+			if err != nil {
+				fail(errOIDCFailed, "%v", err)
+				return
+			}
+			oauth2Config := p.oauth2Config(provider, redirectURL(r, p))
+			token, err := oauth2Config.Exchange(ctx, r.URL.Query().Get("code"), oauth2.VerifierOption(codeVerifier))
+			if err != nil {
+				fail(errOIDCFailed, "failed to exchange code: %v", err)
+				return
+			}
+
+			// Checks the signature, issuer, audience and expiry
+			rawIDToken, _ := token.Extra("id_token").(string)
+			if rawIDToken == "" {
+				fail(errOIDCFailed, "no ID token")
+				return
+			}
+			idToken, err := provider.Verifier(&oidc.Config{ClientID: p.ClientID}).Verify(ctx, rawIDToken)
+			if err != nil {
+				fail(errOIDCFailed, "invalid ID token: %v", err)
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+				fail(errOIDCFailed, "nonce doesn't match")
+				return
+			}
+
+			claims := &oidcClaims{}
+			if err := idToken.Claims(claims); err != nil {
+				fail(errOIDCFailed, "invalid ID token claims: %v", err)
+				return
+			}
+			// Some providers only tell the email through userinfo
+			if claims.Email == "" && provider.UserInfoEndpoint() != "" {
+				userInfo, err := provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+				if err != nil {
+					fail(errOIDCFailed, "failed to get userinfo: %v", err)
+					return
+				}
+				if userInfo.Subject != idToken.Subject {
+					fail(errOIDCFailed, "userinfo is for another subject")
+					return
+				}
+				if err := userInfo.Claims(claims); err != nil {
+					fail(errOIDCFailed, "invalid userinfo claims: %v", err)
+					return
+				}
+			}
+			identity := &oidcIdentity{
+				Subject:           idToken.Subject,
+				Email:             strings.TrimSpace(claims.Email),
+				EmailVerified:     claims.emailVerified(),
+				PreferredUsername: claims.PreferredUsername,
+				Name:              claims.Name,
+			}
+
+			var (
+				user      *zz.UserModel
+				created   bool
+				needsCode bool
+			)
+			if err := db.WriteTX(ctx, func(tx *sqlite.Conn) (err error) {
+				if linking {
+					return linkOIDCIdentity(tx, p, identity, u.Id)
+				}
+				user, created, err = oidcUser(tx, p, identity)
+				if err != nil {
+					return err
+				}
+				needsCode, err = twoFactorEnabled(tx, user.Id)
+				return err
+			}); err != nil {
+				shown := errOIDCFailed
+				for _, sentinel := range []error{errOIDCNoEmail, errOIDCEmailInUse, errOIDCIdentityInUse} {
+					if errors.Is(err, sentinel) {
+						shown = sentinel
+					}
+				}
+				fail(shown, "%v", err)
+				return
+			}
+
+			if linking {
+				if err := sess.Save(r, w); err != nil {
+					http.Error(w, "failed to save session", http.StatusInternalServerError)
+					return
+				}
+				http.Redirect(w, r, "/settings", http.StatusSeeOther)
+				return
+			}
+
+			signIn(sess, user.Id, user.SessionVersion, needsCode)
+			if err := sess.Save(r, w); err != nil {
+				http.Error(w, "failed to save session", http.StatusInternalServerError)
+				return
+			}
+
+			if created && !emailVerified(user) {
+				if err := verifier.Send(r, user, user.Email); err != nil {
+					log.Printf("Failed to send email verification to user %d: %v", user.Id, err)
+				}
+			}
+			if needsCode {
+				http.Redirect(w, r, "/auth/two-factor", http.StatusSeeOther)
+				return
+			}
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+		})
+	})
+}
+
+// oidcUser is the user identity signs in as, created if it is their first
+// time.
+func oidcUser(tx *sqlite.Conn, p *OIDCProvider, identity *oidcIdentity) (user *zz.UserModel, created bool, err error) {
+	now := time.Now()
+
+	existing, err := zz.OnceUserIdentityBySubject(tx, zz.UserIdentityBySubjectParams{
+		Provider: p.ID,
+		Subject:  identity.Subject,
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get user identity: %w", err)
+	}
+	if existing != nil {
+		if err := zz.OnceUpdateUserIdentity(tx, &zz.UserIdentityModel{
+			Id:          existing.Id,
+			UserId:      existing.UserId,
+			Provider:    existing.Provider,
+			Subject:     existing.Subject,
+			Email:       identity.Email,
+			CreatedAt:   existing.CreatedAt,
+			LastLoginAt: now,
+		}); err != nil {
+			return nil, false, fmt.Errorf("failed to update user identity: %w", err)
+		}
+		user, err := zz.OnceReadByIDUser(tx, existing.UserId)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to get user: %w", err)
+		}
+		if user == nil {
+			return nil, false, errors.New("user of identity not found")
+		}
+		return user, false, nil
+	}
+
+	if identity.Email == "" || validateEmail(identity.Email) != nil {
+		return nil, false, fmt.Errorf("%w: got %q", errOIDCNoEmail, identity.Email)
+	}
+	emailUser, err := zz.OnceUserByEmail(tx, identity.Email)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get user by email: %w", err)
+	}
+	if emailUser != nil {
+		// Otherwise anyone able to claim the address at the provider could
+		// take over the account
+		if !p.LinkByEmail || !identity.EmailVerified {
+			return nil, false, fmt.Errorf("%w: user %d", errOIDCEmailInUse, emailUser.Id)
+		}
+		if err := linkOIDCIdentity(tx, p, identity, emailUser.Id); err != nil {
+			return nil, false, err
+		}
+		user, err := zz.OnceReadByIDUser(tx, emailUser.Id)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to get user: %w", err)
+		}
+		return user, false, nil
+	}
+
+	username, err := oidcUsername(tx, identity)
+	if err != nil {
+		return nil, false, err
+	}
+	userID := toolbelt.NextID()
+	user = &zz.UserModel{
+		Id:       userID,
+		Username: username,
+		Email:    identity.Email,
+		// No password until they ask for one with "Forgot password?"
+		PasswordHash: []byte{},
+		ImageUrl:     DefaultAvatarURL(userID),
+	}
+	if identity.EmailVerified {
+		user.EmailVerifiedAt = now
+	}
+	if err := zz.OnceCreateUser(tx, user); err != nil {
+		return nil, false, fmt.Errorf("failed to create user: %w", err)
+	}
+	if err := linkOIDCIdentity(tx, p, identity, userID); err != nil {
+		return nil, false, err
+	}
+	return user, true, nil
+}
+
+// linkOIDCIdentity connects identity to userID, replacing the one they had
+// at p before.
+func linkOIDCIdentity(tx *sqlite.Conn, p *OIDCProvider, identity *oidcIdentity, userID int64) error {
+	existing, err := zz.OnceUserIdentityBySubject(tx, zz.UserIdentityBySubjectParams{
+		Provider: p.ID,
+		Subject:  identity.Subject,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get user identity: %w", err)
+	}
+	if existing != nil && existing.UserId != userID {
+		return fmt.Errorf("%w: user %d", errOIDCIdentityInUse, existing.UserId)
+	}
+
+	if err := zz.OnceDeleteUserIdentityByProvider(tx, zz.DeleteUserIdentityByProviderParams{
+		UserId:   userID,
+		Provider: p.ID,
+	}); err != nil {
+		return fmt.Errorf("failed to delete user identity: %w", err)
+	}
+	now := time.Now()
+	if err := zz.OnceCreateUserIdentity(tx, &zz.UserIdentityModel{
+		Id:          toolbelt.NextID(),
+		UserId:      userID,
+		Provider:    p.ID,
+		Subject:     identity.Subject,
+		Email:       identity.Email,
+		CreatedAt:   now,
+		LastLoginAt: now,
+	}); err != nil {
+		return fmt.Errorf("failed to create user identity: %w", err)
+	}
+	return nil
+}
+
+var errOIDCLastSignIn = errors.New("choose a password with \"Forgot password?\" before disconnecting the only way you can sign in")
+
+// ConnectedIdentity is a provider in the settings, with the account the
+// user connected at it if they did.
+type ConnectedIdentity struct {
+	Provider  *OIDCProvider
+	Connected bool
+	Email     string
+}
+
+func connectedIdentities(tx *sqlite.Conn, providers []*OIDCProvider, userID int64) ([]ConnectedIdentity, error) {
+	res, err := zz.OnceUserIdentitiesByUser(tx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user identities: %w", err)
+	}
+
+	identities := make([]ConnectedIdentity, len(providers))
+	for i, p := range providers {
+		identities[i].Provider = p
+		for _, identity := range res {
+			if identity.Provider == p.ID {
+				identities[i].Connected = true
+				identities[i].Email = identity.Email
+			}
+		}
+	}
+	return identities, nil
+}
+
+// setupIdentitySettingsRoutes lets users disconnect providers, connecting
+// them goes through setupOIDCRoutes while signed in.
+func setupIdentitySettingsRoutes(settingsRouter chi.Router, db *toolbelt.Database) {
+	settingsRouter.Post("/identities/{provider}/disconnect", func(w http.ResponseWriter, r *http.Request) {
+		u, _ := UserFromContext(r.Context())
+		if u == nil {
+			http.Error(w, "user required", http.StatusUnauthorized)
+			return
+		}
+		providerID := chi.URLParam(r, "provider")
+
+		sse := datastar.NewSSE(w, r)
+		if err := db.WriteTX(r.Context(), func(tx *sqlite.Conn) error {
+			// Users created by a provider have no password until they
+			// reset it
+			if len(u.PasswordHash) == 0 {
+				res, err := zz.OnceUserIdentitiesByUser(tx, u.Id)
+				if err != nil {
+					return fmt.Errorf("failed to get user identities: %w", err)
+				}
+				others := 0
+				for _, identity := range res {
+					if identity.Provider != providerID {
+						others++
+					}
+				}
+				if others == 0 {
+					return errOIDCLastSignIn
+				}
+			}
+
+			if err := zz.OnceDeleteUserIdentityByProvider(tx, zz.DeleteUserIdentityByProviderParams{
+				UserId:   u.Id,
+				Provider: providerID,
+			}); err != nil {
+				return fmt.Errorf("failed to delete user identity: %w", err)
+			}
+			return nil
+		}); err != nil {
+			if errors.Is(err, errOIDCLastSignIn) {
+				datastar.RenderFragmentTempl(sse, errorMessages(errOIDCLastSignIn))
+				return
+			}
+			http.Error(w, "failed to disconnect provider", http.StatusInternalServerError)
+			return
+		}
+
+		datastar.Redirect(sse, "/settings")
+	})
+}
@@ -0,0 +1,558 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"html"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/config"
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+	"zombiezen.com/go/sqlite"
+)
+
+const (
+	fakeIssuerClientID     = "conduit"
+	fakeIssuerClientSecret = "conduit-secret"
+	fakeIssuerKeyID        = "fake-key"
+)
+
+// fakeIssuerTweaks make the fake issuer misbehave.
+type fakeIssuerTweaks struct {
+	// claims changes the claims of the ID token before it is signed
+	claims func(claims jwt.MapClaims)
+	// key signs the ID token instead of the published one
+	key *rsa.PrivateKey
+	// verifier replaces the PKCE verifier the token endpoint checks against
+	verifier string
+}
+
+type fakeAuthorization struct {
+	subject   string
+	nonce     string
+	challenge string
+}
+
+// fakeIssuer is an OpenID Connect provider with discovery, JWKS and token
+// endpoints. Its authorization endpoint signs in subject without asking.
+type fakeIssuer struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	mu      sync.Mutex
+	subject string
+	claims  jwt.MapClaims
+	tweaks  fakeIssuerTweaks
+	codes   map[string]fakeAuthorization
+}
+
+func newTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	t.Helper()
+
+	iss := &fakeIssuer{
+		t:     t,
+		key:   newTestRSAKey(t),
+		codes: map[string]fakeAuthorization{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", iss.discovery)
+	mux.HandleFunc("GET /jwks", iss.jwks)
+	mux.HandleFunc("GET /authorize", iss.authorize)
+	mux.HandleFunc("POST /token", iss.token)
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+// signInAs makes the next sign ins at the issuer be subject with claims.
+func (iss *fakeIssuer) signInAs(subject string, claims jwt.MapClaims) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+
+	iss.subject = subject
+	iss.claims = claims
+	iss.tweaks = fakeIssuerTweaks{}
+}
+
+func (iss *fakeIssuer) tweak(tweaks fakeIssuerTweaks) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+
+	iss.tweaks = tweaks
+}
+
+func (iss *fakeIssuer) discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                iss.URL,
+		"authorization_endpoint":                iss.URL + "/authorize",
+		"token_endpoint":                        iss.URL + "/token",
+		"jwks_uri":                              iss.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (iss *fakeIssuer) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := iss.key.PublicKey
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": fakeIssuerKeyID,
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (iss *fakeIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != fakeIssuerClientID || q.Get("response_type") != "code" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := oauth2.GenerateVerifier()
+	iss.mu.Lock()
+	iss.codes[code] = fakeAuthorization{
+		subject:   iss.subject,
+		nonce:     q.Get("nonce"),
+		challenge: q.Get("code_challenge"),
+	}
+	iss.mu.Unlock()
+
+	callback, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	callback.RawQuery = url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+	http.Redirect(w, r, callback.String(), http.StatusSeeOther)
+}
+
+// token checks the client, that the code was issued and only once, and the
+// PKCE verifier, like a real provider would.
+func (iss *fakeIssuer) token(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(code string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+
+	if err := r.ParseForm(); err != nil {
+		tokenError("invalid_request")
+		return
+	}
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != fakeIssuerClientID || clientSecret != fakeIssuerClientSecret {
+		tokenError("invalid_client")
+		return
+	}
+
+	iss.mu.Lock()
+	auth, ok := iss.codes[r.PostForm.Get("code")]
+	delete(iss.codes, r.PostForm.Get("code"))
+	claims := jwt.MapClaims{}
+	for k, v := range iss.claims {
+		claims[k] = v
+	}
+	tweaks := iss.tweaks
+	iss.mu.Unlock()
+
+	verifier := r.PostForm.Get("code_verifier")
+	if tweaks.verifier != "" {
+		verifier = tweaks.verifier
+	}
+	if !ok || oauth2.S256ChallengeFromVerifier(verifier) != auth.challenge {
+		tokenError("invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims["iss"] = iss.URL
+	claims["sub"] = auth.subject
+	claims["aud"] = fakeIssuerClientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(time.Hour).Unix()
+	claims["nonce"] = auth.nonce
+	if tweaks.claims != nil {
+		tweaks.claims(claims)
+	}
+	key := iss.key
+	if tweaks.key != nil {
+		key = tweaks.key
+	}
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	idToken.Header["kid"] = fakeIssuerKeyID
+	rawIDToken, err := idToken.SignedString(key)
+	if err != nil {
+		iss.t.Errorf("failed to sign ID token: %v", err)
+		tokenError("server_error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": oauth2.GenerateVerifier(),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     rawIDToken,
+	})
+}
+
+func newOIDCTestServer(t *testing.T, iss *fakeIssuer, linkByEmail bool) *testServer {
+	t.Helper()
+
+	return newTestServer(t, func(cfg *config.Config) {
+		cfg.OIDCProviders = []config.OIDCProvider{{
+			ID:           "fake",
+			Name:         "Fake",
+			Issuer:       iss.URL,
+			ClientID:     fakeIssuerClientID,
+			ClientSecret: fakeIssuerClientSecret,
+			LinkByEmail:  linkByEmail,
+		}}
+	})
+}
+
+// startOIDC begins signing client in with the fake provider and returns
+// where the provider sends it back to.
+func startOIDC(t *testing.T, ts *testServer, client *http.Client) *url.URL {
+	t.Helper()
+
+	res, err := client.Get(ts.URL + "/auth/oidc/fake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSeeOther {
+		t.Fatalf("starting: got status %d, want %d", res.StatusCode, http.StatusSeeOther)
+	}
+	authURL := res.Header.Get("Location")
+
+	res, err = client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSeeOther {
+		t.Fatalf("authorizing at the provider: got status %d", res.StatusCode)
+	}
+	callback, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return callback
+}
+
+// finishOIDC follows callback and returns where it redirects to, or the
+// page when it doesn't.
+func finishOIDC(t *testing.T, client *http.Client, callback *url.URL) (location, page string) {
+	t.Helper()
+
+	res, err := client.Get(callback.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Header.Get("Location"), string(b)
+}
+
+func oidcIdentityUser(t *testing.T, ts *testServer, subject string) int64 {
+	t.Helper()
+
+	var userID int64
+	if err := ts.db.ReadTX(context.Background(), func(tx *sqlite.Conn) error {
+		identity, err := zz.OnceUserIdentityBySubject(tx, zz.UserIdentityBySubjectParams{Provider: "fake", Subject: subject})
+		if identity != nil {
+			userID = identity.UserId
+		}
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return userID
+}
+
+func countUsers(t *testing.T, ts *testServer) int64 {
+	t.Helper()
+
+	var n int64
+	if err := ts.db.ReadTX(context.Background(), func(tx *sqlite.Conn) (err error) {
+		n, err = zz.OnceCountUsers(tx)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSanitizeUsername(t *testing.T) {
+	for name, want := range map[string]string{
+		"Jane Doe":                "Jane-Doe",
+		"  jane.doe_1 ":           "jane.doe_1",
+		"<script>":                "script",
+		"--jane--":                "jane",
+		"Zoë":                     "Zoë",
+		"!!!":                     "",
+		strings.Repeat("a", 40):   strings.Repeat("a", maxUsernameLen),
+		"jane@example.com (Jane)": "janeexample.com-Jane",
+	} {
+		if got := sanitizeUsername(name); got != want {
+			t.Errorf("%q: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestOIDCSignInCreatesUser(t *testing.T) {
+	iss := newFakeIssuer(t)
+	ts := newOIDCTestServer(t, iss, false)
+	iss.signInAs("jane-at-fake", jwt.MapClaims{
+		"email":              "jane@example.com",
+		"email_verified":     true,
+		"preferred_username": "Jane Doe",
+	})
+
+	jane := ts.browser(t)
+	if location, page := finishOIDC(t, jane, startOIDC(t, ts, jane)); location != "/" {
+		t.Fatalf("got redirect to %q: %s", location, page)
+	}
+	if !signedIn(t, ts, jane) {
+		t.Error("not signed in after the provider")
+	}
+
+	userID := oidcIdentityUser(t, ts, "jane-at-fake")
+	if userID == 0 {
+		t.Fatal("identity wasn't connected")
+	}
+	u := readUser(t, ts, userID)
+	if u.Username != "Jane-Doe" || u.Email != "jane@example.com" || !emailVerified(u) || len(u.PasswordHash) != 0 {
+		t.Errorf("got %+v", u)
+	}
+
+	// Found by the subject from then on, whatever the email is now
+	iss.signInAs("jane-at-fake", jwt.MapClaims{"email": "jane@example.org"})
+	again := ts.browser(t)
+	if location, page := finishOIDC(t, again, startOIDC(t, ts, again)); location != "/" {
+		t.Fatalf("signing in again: got redirect to %q: %s", location, page)
+	}
+	if n := countUsers(t, ts); n != 1 {
+		t.Errorf("got %d users after signing in again, want 1", n)
+	}
+}
+
+func TestOIDCSignInUnverifiedEmail(t *testing.T) {
+	iss := newFakeIssuer(t)
+	ts := newOIDCTestServer(t, iss, false)
+	iss.signInAs("jane-at-fake", jwt.MapClaims{"email": "jane@example.com", "email_verified": "false"})
+
+	jane := ts.browser(t)
+	finishOIDC(t, jane, startOIDC(t, ts, jane))
+	if u := readUser(t, ts, oidcIdentityUser(t, ts, "jane-at-fake")); emailVerified(u) {
+		t.Error("email the provider didn't verify is verified")
+	}
+	mailToken(t, ts.waitForMail(t, "jane@example.com", verifyEmailSubject, 1), "/auth/verify")
+}
+
+func TestOIDCSignInExistingEmail(t *testing.T) {
+	for name, tc := range map[string]struct {
+		linkByEmail   bool
+		emailVerified bool
+		wantLinked    bool
+	}{
+		"not linked by email":   {linkByEmail: false, emailVerified: true},
+		"unverified email":      {linkByEmail: true, emailVerified: false},
+		"linked by their email": {linkByEmail: true, emailVerified: true, wantLinked: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			iss := newFakeIssuer(t)
+			ts := newOIDCTestServer(t, iss, tc.linkByEmail)
+			jakeID, _ := ts.register(t, "jake")
+			iss.signInAs("jake-at-fake", jwt.MapClaims{"email": "jake@example.com", "email_verified": tc.emailVerified})
+
+			client := ts.browser(t)
+			location, page := finishOIDC(t, client, startOIDC(t, ts, client))
+			if tc.wantLinked {
+				if location != "/" || oidcIdentityUser(t, ts, "jake-at-fake") != jakeID {
+					t.Errorf("didn't sign in to the account with the email: %q %s", location, page)
+				}
+				return
+			}
+			if !strings.Contains(page, html.EscapeString(errOIDCEmailInUse.Error())) {
+				t.Errorf("page doesn't say the email is in use: %s", page)
+			}
+			if signedIn(t, ts, client) || oidcIdentityUser(t, ts, "jake-at-fake") != 0 {
+				t.Error("signed in to the account with the email")
+			}
+		})
+	}
+}
+
+func TestOIDCConnectWhileSignedIn(t *testing.T) {
+	iss := newFakeIssuer(t)
+	ts := newOIDCTestServer(t, iss, false)
+	jakeID, _ := ts.register(t, "jake")
+	// Any email, it is connected to whoever is signed in
+	iss.signInAs("jake-at-fake", jwt.MapClaims{"email": "jake@work.example.com"})
+
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+	if location, page := finishOIDC(t, jake, startOIDC(t, ts, jake)); location != "/settings" {
+		t.Fatalf("got redirect to %q: %s", location, page)
+	}
+	if userID := oidcIdentityUser(t, ts, "jake-at-fake"); userID != jakeID {
+		t.Fatalf("identity is connected to user %d, want %d", userID, jakeID)
+	}
+
+	client := ts.browser(t)
+	finishOIDC(t, client, startOIDC(t, ts, client))
+	if !signedIn(t, ts, client) {
+		t.Error("can't sign in with the connected provider")
+	}
+
+	// Nobody else can connect it
+	ts.register(t, "jane")
+	jane := ts.browser(t)
+	ts.signIn(t, jane, "jane")
+	if _, page := finishOIDC(t, jane, startOIDC(t, ts, jane)); !strings.Contains(page, html.EscapeString(errOIDCIdentityInUse.Error())) {
+		t.Errorf("page doesn't say the identity is in use: %s", page)
+	}
+}
+
+func TestOIDCSignInRejected(t *testing.T) {
+	iss := newFakeIssuer(t)
+	ts := newOIDCTestServer(t, iss, false)
+	otherKey := newTestRSAKey(t)
+
+	for name, tc := range map[string]struct {
+		tweaks   fakeIssuerTweaks
+		callback func(q url.Values)
+		want     error
+	}{
+		"state mismatch": {
+			callback: func(q url.Values) { q.Set("state", "forged") },
+		},
+		"no state": {
+			callback: func(q url.Values) { q.Del("state") },
+		},
+		"provider error": {
+			callback: func(q url.Values) { q.Set("error", "access_denied") },
+		},
+		"wrong code": {
+			callback: func(q url.Values) { q.Set("code", "forged") },
+		},
+		"wrong PKCE verifier": {
+			tweaks: fakeIssuerTweaks{verifier: oauth2.GenerateVerifier()},
+		},
+		"nonce mismatch": {
+			tweaks: fakeIssuerTweaks{claims: func(c jwt.MapClaims) { c["nonce"] = "replayed" }},
+		},
+		"bad signature": {
+			tweaks: fakeIssuerTweaks{key: otherKey},
+		},
+		"wrong audience": {
+			tweaks: fakeIssuerTweaks{claims: func(c jwt.MapClaims) { c["aud"] = "someone-else" }},
+		},
+		"wrong issuer": {
+			tweaks: fakeIssuerTweaks{claims: func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }},
+		},
+		"expired": {
+			tweaks: fakeIssuerTweaks{claims: func(c jwt.MapClaims) {
+				c["iat"] = time.Now().Add(-2 * time.Hour).Unix()
+				c["exp"] = time.Now().Add(-time.Hour).Unix()
+			}},
+		},
+		"no email": {
+			tweaks: fakeIssuerTweaks{claims: func(c jwt.MapClaims) { delete(c, "email") }},
+			want:   errOIDCNoEmail,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			iss.signInAs("jane-at-fake", jwt.MapClaims{"email": "jane@example.com", "email_verified": true})
+			iss.tweak(tc.tweaks)
+
+			client := ts.browser(t)
+			callback := startOIDC(t, ts, client)
+			if tc.callback != nil {
+				q := callback.Query()
+				tc.callback(q)
+				callback.RawQuery = q.Encode()
+			}
+
+			want := tc.want
+			if want == nil {
+				want = errOIDCFailed
+			}
+			location, page := finishOIDC(t, client, callback)
+			if location != "" || !strings.Contains(page, html.EscapeString(want.Error())) {
+				t.Errorf("got redirect to %q: %s", location, page)
+			}
+			if signedIn(t, ts, client) {
+				t.Error("signed in")
+			}
+			if oidcIdentityUser(t, ts, "jane-at-fake") != 0 {
+				t.Error("user was created")
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackOnce(t *testing.T) {
+	iss := newFakeIssuer(t)
+	ts := newOIDCTestServer(t, iss, false)
+	iss.signInAs("jane-at-fake", jwt.MapClaims{"email": "jane@example.com"})
+
+	// Another browser can't finish what this one started
+	jane := ts.browser(t)
+	callback := startOIDC(t, ts, jane)
+	if _, page := finishOIDC(t, ts.browser(t), callback); !strings.Contains(page, errOIDCFailed.Error()) {
+		t.Errorf("callback in another browser: %s", page)
+	}
+
+	if location, page := finishOIDC(t, jane, callback); location != "/" {
+		t.Fatalf("got redirect to %q: %s", location, page)
+	}
+	if location, page := finishOIDC(t, jane, callback); location != "" || !strings.Contains(page, errOIDCFailed.Error()) {
+		t.Errorf("callback used twice: got redirect to %q: %s", location, page)
+	}
+
+	if status, _ := ts.get(t, nil, "/auth/oidc/nope"); status != http.StatusNotFound {
+		t.Errorf("unknown provider: got status %d, want %d", status, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,173 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"zombiezen.com/go/sqlite"
+)
+
+// Article statuses, only published articles show up anywhere but their
+// author's drafts.
+const (
+	ArticleDraft     = "draft"
+	ArticleScheduled = "scheduled"
+	ArticlePublished = "published"
+)
+
+// ScheduleTopic is published whenever an article is scheduled, so the
+// scheduler can wake up for it.
+const ScheduleTopic = "schedule"
+
+// publishAtLayout is what a datetime-local input submits, in the server's
+// time zone.
+const publishAtLayout = "2006-01-02T15:04"
+
+// schedulerMaxSleep bounds how long the scheduler trusts its last look at
+// the schedule, in case it was changed without telling it.
+const schedulerMaxSleep = time.Minute
+
+// articleVisibleTo reports whether u may see article, drafts and scheduled
+// articles are only shown to their author.
+func articleVisibleTo(article *zz.ArticleModel, u *zz.UserModel) bool {
+	return article.Status == ArticlePublished || (u != nil && u.Id == article.AuthorId)
+}
+
+// setArticleStatus moves article to status, scheduled articles going live at
+// publishAt. Publishing keeps the original publication time of an article
+// that was already out.
+func setArticleStatus(article *zz.ArticleModel, status string, publishAt time.Time, now time.Time) error {
+	switch status {
+	case "", ArticlePublished:
+		if article.Status != ArticlePublished {
+			article.PublishedAt = now
+		}
+		article.Status = ArticlePublished
+	case ArticleScheduled:
+		if !publishAt.After(now) {
+			return errors.New("publish time must be in the future")
+		}
+		article.Status = ArticleScheduled
+		article.PublishedAt = publishAt
+	case ArticleDraft:
+		article.Status = ArticleDraft
+	default:
+		return fmt.Errorf("unknown status %q", status)
+	}
+	return nil
+}
+
+// articleStatusLabel tells an author what became of an unpublished article.
+func articleStatusLabel(status string, publishAt time.Time) string {
+	switch status {
+	case ArticleDraft:
+		return "Draft, only visible to you"
+	case ArticleScheduled:
+		return "Scheduled for " + publishAt.Local().Format("Jan 2, 2006 15:04 MST")
+	default:
+		return status
+	}
+}
+
+// publishAt is when the editor scheduled the article, zero unless it was.
+func (a *ArticleEditData) publishAt() (time.Time, error) {
+	if a.Status != ArticleScheduled {
+		return time.Time{}, nil
+	}
+	return parsePublishAt(a.PublishAt)
+}
+
+func parsePublishAt(raw string) (time.Time, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return time.Time{}, errors.New("publish time required")
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(publishAtLayout, raw, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid publish time %q", raw)
+	}
+	return t, nil
+}
+
+// runPublishScheduler publishes scheduled articles once their time comes,
+// until ctx is done. It sleeps until the next scheduled article and is woken
+// early through ScheduleTopic when the schedule changes.
+func runPublishScheduler(ctx context.Context, db *toolbelt.Database, hub *Hub) {
+	updates, unsubscribe := hub.Subscribe(ScheduleTopic)
+	defer unsubscribe()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-updates:
+		case <-timer.C:
+		}
+
+		next, err := publishDueArticles(ctx, db, hub)
+		if err != nil {
+			log.Printf("Scheduled publishing failed: %v", err)
+		}
+
+		sleep := schedulerMaxSleep
+		if !next.IsZero() {
+			sleep = min(sleep, max(time.Until(next), 0))
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(sleep)
+	}
+}
+
+// publishDueArticles publishes every scheduled article whose time has come
+// and returns when the next one is due, zero if none is.
+func publishDueArticles(ctx context.Context, db *toolbelt.Database, hub *Hub) (next time.Time, err error) {
+	var published []zz.DueScheduledArticlesRes
+	if err := db.WriteTX(ctx, func(tx *sqlite.Conn) (err error) {
+		now := time.Now()
+		published, err = zz.OnceDueScheduledArticles(tx, now)
+		if err != nil {
+			return fmt.Errorf("failed to get due articles: %w", err)
+		}
+
+		publishStmt := zz.PublishScheduledArticle(tx)
+		for _, row := range published {
+			if err := publishStmt.Run(zz.PublishScheduledArticleParams{
+				Now:       now,
+				ArticleId: row.Id,
+			}); err != nil {
+				return fmt.Errorf("failed to publish article %d: %w", row.Id, err)
+			}
+		}
+
+		next, err = zz.OnceNextScheduledPublication(tx)
+		if err != nil {
+			return fmt.Errorf("failed to get next scheduled article: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return time.Time{}, err
+	}
+
+	for _, row := range published {
+		log.Printf("Published scheduled article %d", row.Id)
+		hub.Publish(ArticleTopic(row.Id), UserTopic(row.AuthorId))
+	}
+	return next, nil
+}
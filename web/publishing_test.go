@@ -0,0 +1,133 @@
+package web
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"zombiezen.com/go/sqlite"
+)
+
+func readArticle(t *testing.T, ts *testServer, slug string) *zz.ArticleModel {
+	t.Helper()
+
+	var article *zz.ArticleModel
+	if err := ts.db.ReadTX(context.Background(), func(tx *sqlite.Conn) error {
+		id, err := zz.OnceArticleIdBySlug(tx, slug)
+		if err != nil {
+			return err
+		}
+		article, err = zz.OnceReadByIDArticle(tx, id)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return article
+}
+
+func TestSetArticleStatus(t *testing.T) {
+	now := time.Date(2024, 5, 6, 12, 0, 0, 0, time.UTC)
+	earlier, later := now.Add(-time.Hour), now.Add(time.Hour)
+
+	for name, tc := range map[string]struct {
+		article       zz.ArticleModel
+		status        string
+		publishAt     time.Time
+		wantStatus    string
+		wantPublished time.Time
+		wantErr       bool
+	}{
+		"publish draft":        {article: zz.ArticleModel{Status: ArticleDraft}, status: ArticlePublished, wantStatus: ArticlePublished, wantPublished: now},
+		"default is published": {article: zz.ArticleModel{Status: ArticleDraft}, wantStatus: ArticlePublished, wantPublished: now},
+		"keep publish time":    {article: zz.ArticleModel{Status: ArticlePublished, PublishedAt: earlier}, status: ArticlePublished, wantStatus: ArticlePublished, wantPublished: earlier},
+		"schedule":             {article: zz.ArticleModel{Status: ArticleDraft}, status: ArticleScheduled, publishAt: later, wantStatus: ArticleScheduled, wantPublished: later},
+		"schedule in the past": {article: zz.ArticleModel{Status: ArticleDraft}, status: ArticleScheduled, publishAt: earlier, wantErr: true},
+		"unpublish":            {article: zz.ArticleModel{Status: ArticlePublished, PublishedAt: earlier}, status: ArticleDraft, wantStatus: ArticleDraft, wantPublished: earlier},
+		"unknown":              {article: zz.ArticleModel{Status: ArticleDraft}, status: "hidden", wantErr: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			article := tc.article
+			err := setArticleStatus(&article, tc.status, tc.publishAt, now)
+			if tc.wantErr {
+				if err == nil {
+					t.Error("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if article.Status != tc.wantStatus || !article.PublishedAt.Equal(tc.wantPublished) {
+				t.Errorf("got %s at %s, want %s at %s", article.Status, article.PublishedAt, tc.wantStatus, tc.wantPublished)
+			}
+		})
+	}
+}
+
+func TestParsePublishAt(t *testing.T) {
+	for raw, want := range map[string]time.Time{
+		"2024-05-06T12:30:00Z": time.Date(2024, 5, 6, 12, 30, 0, 0, time.UTC),
+		" 2024-05-06T12:30 ":   time.Date(2024, 5, 6, 12, 30, 0, 0, time.Local),
+	} {
+		got, err := parsePublishAt(raw)
+		if err != nil {
+			t.Errorf("%q: %v", raw, err)
+		} else if !got.Equal(want) {
+			t.Errorf("%q: got %s, want %s", raw, got, want)
+		}
+	}
+	for _, raw := range []string{"", "tomorrow", "2024-05-06"} {
+		if _, err := parsePublishAt(raw); err == nil {
+			t.Errorf("%q: got no error", raw)
+		}
+	}
+}
+
+func TestPublishDueArticles(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+	due := createAPIArticle(t, ts, token, "Dragons")
+	future := createAPIArticle(t, ts, token, "Wyverns")
+
+	// Written a day ago, due an hour ago and the other in an hour
+	ts.exec(t, "UPDATE articles SET status = 'scheduled', created_at = julianday('now', '-1 day'), updated_at = julianday('now', '-1 day'), published_at = julianday('now', '-1 hour') WHERE slug = ?", due.Slug)
+	ts.exec(t, "UPDATE articles SET status = 'scheduled', published_at = julianday('now', '+1 hour') WHERE slug = ?", future.Slug)
+	scheduledAt := readArticle(t, ts, due.Slug).PublishedAt
+	nextAt := readArticle(t, ts, future.Slug).PublishedAt
+
+	hub := NewHub()
+	updates, unsubscribe := hub.Subscribe(ArticleTopic(readArticle(t, ts, due.Slug).Id))
+	defer unsubscribe()
+
+	// Times are stored to the second
+	before := time.Now().Add(-time.Minute)
+	next, err := publishDueArticles(context.Background(), ts.db, hub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !next.Equal(nextAt) {
+		t.Errorf("got next publication at %s, want %s", next, nextAt)
+	}
+
+	published := readArticle(t, ts, due.Slug)
+	if published.Status != ArticlePublished {
+		t.Fatalf("got status %s", published.Status)
+	}
+	// Publishing is an update now, the publication time stays as scheduled
+	if published.UpdatedAt.Before(before) {
+		t.Errorf("got updated at %s, want when it was published", published.UpdatedAt)
+	}
+	if !published.PublishedAt.Equal(scheduledAt) {
+		t.Errorf("got published at %s, want %s", published.PublishedAt, scheduledAt)
+	}
+	if status := readArticle(t, ts, future.Slug).Status; status != ArticleScheduled {
+		t.Errorf("future article is %s", status)
+	}
+
+	select {
+	case <-updates:
+	default:
+		t.Error("article page wasn't told it was published")
+	}
+}
@@ -0,0 +1,165 @@
+package web
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"zombiezen.com/go/sqlite"
+)
+
+// saveArticleRevision records the current content of article as edited by
+// editorID, unless it is the same as the latest revision.
+func saveArticleRevision(tx *sqlite.Conn, article *zz.ArticleModel, editorID int64) error {
+	latest, err := zz.OnceLatestArticleRevision(tx, article.Id)
+	if err != nil {
+		return fmt.Errorf("failed to get latest revision: %w", err)
+	}
+	if latest != nil &&
+		latest.Title == article.Title &&
+		latest.Description == article.Description &&
+		latest.Body == article.Body {
+		return nil
+	}
+
+	if err := zz.OnceCreateArticleRevision(tx, &zz.ArticleRevisionModel{
+		Id:          toolbelt.NextID(),
+		ArticleId:   article.Id,
+		EditorId:    editorID,
+		Title:       article.Title,
+		Description: article.Description,
+		Body:        article.Body,
+		CreatedAt:   article.UpdatedAt,
+	}); err != nil {
+		return fmt.Errorf("failed to create revision: %w", err)
+	}
+	return nil
+}
+
+type DiffOp string
+
+const (
+	DiffEqual  DiffOp = "equal"
+	DiffInsert DiffOp = "insert"
+	DiffDelete DiffOp = "delete"
+)
+
+// DiffLine is a line of a unified diff, OldLine and NewLine are its line
+// numbers on either side or 0 if it isn't on that side.
+type DiffLine struct {
+	Op      DiffOp
+	Text    string
+	OldLine int
+	NewLine int
+}
+
+// DiffRow is a line of a side by side diff, either side can be nil.
+type DiffRow struct {
+	Old, New *DiffLine
+}
+
+type FieldDiff struct {
+	Field   string
+	Changed bool
+	Lines   []*DiffLine
+}
+
+// Rows pairs up deleted and inserted lines so changes line up side by side.
+func (d *FieldDiff) Rows() []DiffRow {
+	var (
+		rows              []DiffRow
+		deleted, inserted []*DiffLine
+	)
+	flush := func() {
+		for i := 0; i < max(len(deleted), len(inserted)); i++ {
+			row := DiffRow{}
+			if i < len(deleted) {
+				row.Old = deleted[i]
+			}
+			if i < len(inserted) {
+				row.New = inserted[i]
+			}
+			rows = append(rows, row)
+		}
+		deleted, inserted = nil, nil
+	}
+
+	for _, line := range d.Lines {
+		switch line.Op {
+		case DiffDelete:
+			deleted = append(deleted, line)
+		case DiffInsert:
+			inserted = append(inserted, line)
+		default:
+			flush()
+			rows = append(rows, DiffRow{Old: line, New: line})
+		}
+	}
+	flush()
+	return rows
+}
+
+func diffRevisions(from, to *zz.ArticleRevisionModel) []*FieldDiff {
+	return []*FieldDiff{
+		diffField("Title", from.Title, to.Title),
+		diffField("Description", from.Description, to.Description),
+		diffField("Body", from.Body, to.Body),
+	}
+}
+
+// diffField diffs whole lines, which reads better than characters for prose
+// and Markdown.
+func diffField(field, from, to string) *FieldDiff {
+	// A missing newline at the end would make the last lines differ
+	from = strings.TrimSuffix(from, "\n") + "\n"
+	to = strings.TrimSuffix(to, "\n") + "\n"
+
+	dmp := diffmatchpatch.New()
+	fromChars, toChars, lines := dmp.DiffLinesToChars(from, to)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(fromChars, toChars, false), lines)
+
+	d := &FieldDiff{Field: field}
+	oldLine, newLine := 0, 0
+	for _, diff := range diffs {
+		for _, text := range strings.Split(strings.TrimSuffix(diff.Text, "\n"), "\n") {
+			line := &DiffLine{Text: text}
+			switch diff.Type {
+			case diffmatchpatch.DiffEqual:
+				oldLine++
+				newLine++
+				line.Op, line.OldLine, line.NewLine = DiffEqual, oldLine, newLine
+			case diffmatchpatch.DiffDelete:
+				oldLine++
+				line.Op, line.OldLine = DiffDelete, oldLine
+				d.Changed = true
+			case diffmatchpatch.DiffInsert:
+				newLine++
+				line.Op, line.NewLine = DiffInsert, newLine
+				d.Changed = true
+			}
+			d.Lines = append(d.Lines, line)
+		}
+	}
+	return d
+}
+
+func diffLineNumber(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.Itoa(n)
+}
+
+func diffPrefix(op DiffOp) string {
+	switch op {
+	case DiffInsert:
+		return "+ "
+	case DiffDelete:
+		return "- "
+	default:
+		return "  "
+	}
+}
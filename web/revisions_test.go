@@ -0,0 +1,205 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"zombiezen.com/go/sqlite"
+)
+
+func TestDiffField(t *testing.T) {
+	d := diffField("Body", "a\nb\nc", "a\nB\nc\nd\n")
+	if !d.Changed {
+		t.Error("diff isn't changed")
+	}
+	want := []DiffLine{
+		{Op: DiffEqual, Text: "a", OldLine: 1, NewLine: 1},
+		{Op: DiffDelete, Text: "b", OldLine: 2},
+		{Op: DiffInsert, Text: "B", NewLine: 2},
+		{Op: DiffEqual, Text: "c", OldLine: 3, NewLine: 3},
+		{Op: DiffInsert, Text: "d", NewLine: 4},
+	}
+	if len(d.Lines) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(d.Lines), len(want))
+	}
+	for i, line := range d.Lines {
+		if *line != want[i] {
+			t.Errorf("line %d: got %+v, want %+v", i, *line, want[i])
+		}
+	}
+
+	// Only a trailing newline is different
+	if d := diffField("Title", "Dragons", "Dragons\n"); d.Changed || len(d.Lines) != 1 {
+		t.Errorf("got %d lines, changed %t", len(d.Lines), d.Changed)
+	}
+}
+
+func TestFieldDiffRows(t *testing.T) {
+	rows := diffField("Body", "a\nb\nc\nd", "a\nB\nC\nD\nE\nd").Rows()
+
+	got := make([]string, len(rows))
+	for i, row := range rows {
+		side := func(line *DiffLine) string {
+			if line == nil {
+				return "_"
+			}
+			return line.Text
+		}
+		got[i] = side(row.Old) + side(row.New)
+	}
+	// Deleted lines line up with what replaced them
+	if want := "aa bB cC _D _E dd"; strings.Join(got, " ") != want {
+		t.Errorf("got %q, want %q", strings.Join(got, " "), want)
+	}
+}
+
+// articleRevisions are the revisions of the article at slug, newest first.
+func articleRevisions(t *testing.T, ts *testServer, slug string) []zz.ArticleRevisionModel {
+	t.Helper()
+
+	var revisions []zz.ArticleRevisionModel
+	if err := ts.db.ReadTX(context.Background(), func(tx *sqlite.Conn) error {
+		articleID, err := zz.OnceArticleIdBySlug(tx, slug)
+		if err != nil {
+			return err
+		}
+		res, err := zz.OnceArticleRevisions(tx, articleID)
+		if err != nil {
+			return err
+		}
+		for _, row := range res {
+			revision, err := zz.OnceReadByIDArticleRevision(tx, row.Id)
+			if err != nil {
+				return err
+			}
+			revisions = append(revisions, *revision)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return revisions
+}
+
+func updateAPIArticle(t *testing.T, ts *testServer, token, slug string, fields map[string]any) apiArticle {
+	t.Helper()
+
+	res := apiArticleResponse{}
+	if status := ts.api(t, http.MethodPut, "/api/articles/"+slug, token, map[string]any{"article": fields}, &res); status != http.StatusOK {
+		t.Fatalf("updating %s: got status %d", slug, status)
+	}
+	return res.Article
+}
+
+func TestArticleRevisions(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+	article := createAPIArticle(t, ts, token, "Dragons")
+
+	updateAPIArticle(t, ts, token, article.Slug, map[string]any{"body": "Dragons fly"})
+	// Saving without changes isn't a revision
+	updateAPIArticle(t, ts, token, article.Slug, map[string]any{"body": "Dragons fly"})
+
+	revisions := articleRevisions(t, ts, article.Slug)
+	if len(revisions) != 2 {
+		t.Fatalf("got %d revisions, want 2", len(revisions))
+	}
+	if revisions[0].Body != "Dragons fly" || revisions[1].Body != "All about Dragons" {
+		t.Errorf("got bodies %q and %q", revisions[0].Body, revisions[1].Body)
+	}
+}
+
+func TestArticleHistoryPages(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+	_, janeToken := ts.register(t, "jane")
+	article := createAPIArticle(t, ts, token, "Dragons")
+	updateAPIArticle(t, ts, token, article.Slug, map[string]any{"body": "Dragons fly"})
+	other := createAPIArticle(t, ts, janeToken, "Wyverns")
+	revisions := articleRevisions(t, ts, article.Slug)
+	otherRevision := articleRevisions(t, ts, other.Slug)[0]
+
+	jake, jane := ts.browser(t), ts.browser(t)
+	ts.signIn(t, jake, "jake")
+	ts.signIn(t, jane, "jane")
+	historyPath := articlePath(article.Slug) + "/history"
+
+	status, body := ts.get(t, jake, historyPath)
+	if status != http.StatusOK {
+		t.Fatalf("history: got status %d", status)
+	}
+	if strings.Count(body, "Restore</button>") != 1 || !strings.Contains(body, "Current") {
+		t.Error("history doesn't list the revisions")
+	}
+
+	for _, path := range []string{historyPath + "/diff", historyPath + "/diff?view=split"} {
+		status, body := ts.get(t, jake, path)
+		if status != http.StatusOK {
+			t.Fatalf("%s: got status %d", path, status)
+		}
+		if !strings.Contains(body, "Dragons fly") || !strings.Contains(body, "All about Dragons") || !strings.Contains(body, "diff-insert") {
+			t.Errorf("%s doesn't show the last change", path)
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		client *http.Client
+		path   string
+		want   int
+	}{
+		"other user's history": {client: jane, path: historyPath, want: http.StatusSeeOther},
+		"other user's diff":    {client: jane, path: historyPath + "/diff", want: http.StatusSeeOther},
+		"signed out":           {path: historyPath, want: http.StatusSeeOther},
+		"invalid revision":     {client: jake, path: historyPath + "/diff?to=latest", want: http.StatusBadRequest},
+		"another article's":    {client: jake, path: fmt.Sprintf("%s/diff?from=%d&to=%d", historyPath, otherRevision.Id, revisions[0].Id), want: http.StatusNotFound},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if status, _ := ts.get(t, tc.client, tc.path); status != tc.want {
+				t.Errorf("got status %d, want %d", status, tc.want)
+			}
+		})
+	}
+}
+
+func TestRestoreArticleRevision(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+	ts.register(t, "jane")
+	article := createAPIArticle(t, ts, token, "Dragons")
+	updated := updateAPIArticle(t, ts, token, article.Slug, map[string]any{"title": "Wyverns", "body": "Wyverns fly"})
+	original := articleRevisions(t, ts, updated.Slug)[1]
+
+	jake, jane := ts.browser(t), ts.browser(t)
+	ts.signIn(t, jake, "jake")
+	ts.signIn(t, jane, "jane")
+	restorePath := fmt.Sprintf("%s/history/%d/restore", articlePath(updated.Slug), original.Id)
+
+	_, body := ts.datastar(t, jane, http.MethodPost, restorePath, nil)
+	if !strings.Contains(body, "user is not author") {
+		t.Errorf("someone else restored a revision: %s", body)
+	}
+
+	_, body = ts.datastar(t, jake, http.MethodPost, restorePath, nil)
+	if !strings.Contains(body, "redirect "+articlePath(article.Slug)) {
+		t.Errorf("restoring doesn't go to the article under its old title: %s", body)
+	}
+	res := apiArticleResponse{}
+	ts.api(t, http.MethodGet, "/api/articles/"+article.Slug, "", nil, &res)
+	if res.Article.Title != "Dragons" || res.Article.Body != "All about Dragons" {
+		t.Errorf("got %q: %q", res.Article.Title, res.Article.Body)
+	}
+
+	// Restoring is itself a revision
+	revisions := articleRevisions(t, ts, article.Slug)
+	if len(revisions) != 3 || revisions[0].Id == original.Id || revisions[0].Body != original.Body {
+		t.Errorf("got %d revisions, want the restored one on top", len(revisions))
+	}
+
+	if _, body := ts.datastar(t, jake, http.MethodPost, fmt.Sprintf("%s/history/1/restore", articlePath(article.Slug)), nil); !strings.Contains(body, "revision not found") {
+		t.Errorf("restored a missing revision: %s", body)
+	}
+}
@@ -0,0 +1,140 @@
+package web
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/delaneyj/datastar"
+	"github.com/delaneyj/realworld-datastar/sql"
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"github.com/go-chi/chi/v5"
+	"zombiezen.com/go/sqlite"
+)
+
+func setupAdminRoutes(r chi.Router, db *toolbelt.Database, throttle *LoginThrottle) {
+	r.Route("/admin", func(adminRouter chi.Router) {
+		adminRouter.Use(adminRequired)
+
+		adminRouter.Get("/backup", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+
+			f, err := os.CreateTemp("", "conduit-backup-*.sqlite")
+			if err != nil {
+				http.Error(w, "failed to create backup", http.StatusInternalServerError)
+				return
+			}
+			f.Close()
+			defer os.Remove(f.Name())
+
+			if err := sql.BackupTo(ctx, db, f.Name()); err != nil {
+				log.Printf("Backup download failed: %v", err)
+				http.Error(w, "failed to create backup", http.StatusInternalServerError)
+				return
+			}
+
+			backup, err := os.Open(f.Name())
+			if err != nil {
+				http.Error(w, "failed to open backup", http.StatusInternalServerError)
+				return
+			}
+			defer backup.Close()
+
+			now := time.Now().UTC()
+			filename := fmt.Sprintf("conduit-%s.sqlite", now.Format("20060102T150405Z"))
+			w.Header().Set("Content-Type", "application/vnd.sqlite3")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+			http.ServeContent(w, r, filename, now, backup)
+		})
+
+		// For users who lost their authenticator app and recovery codes,
+		// once whoever runs the site is satisfied they are who they say
+		adminRouter.Post("/users/{userID}/two-factor/reset", func(w http.ResponseWriter, r *http.Request) {
+			userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+			if err != nil {
+				http.Error(w, "invalid user id", http.StatusBadRequest)
+				return
+			}
+
+			var (
+				u       *zz.UserModel
+				enabled bool
+			)
+			if err := db.WriteTX(r.Context(), func(tx *sqlite.Conn) (err error) {
+				u, err = zz.OnceReadByIDUser(tx, userID)
+				if err != nil {
+					return fmt.Errorf("failed to get user: %w", err)
+				}
+				if u == nil {
+					return nil
+				}
+				enabled, err = ResetTwoFactor(tx, userID)
+				return err
+			}); err != nil {
+				http.Error(w, "failed to reset two-factor authentication", http.StatusInternalServerError)
+				return
+			}
+			if u == nil {
+				http.Error(w, "user not found", http.StatusNotFound)
+				return
+			}
+			log.Printf("Admin reset two-factor authentication of user %d", userID)
+
+			status := "Two-factor authentication turned off"
+			if !enabled {
+				status = "Two-factor authentication wasn't on"
+			}
+			sse := datastar.NewSSE(w, r)
+			datastar.RenderFragmentTempl(sse, adminTwoFactorReset(u, status))
+		})
+
+		adminRouter.Route("/login-attempts", func(attemptsRouter chi.Router) {
+			attemptsRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				ctx := r.Context()
+				u, _ := UserFromContext(ctx)
+
+				view, err := throttle.View(ctx, 100)
+				if err != nil {
+					http.Error(w, "failed to get login attempts", http.StatusInternalServerError)
+					return
+				}
+
+				PageLoginAttempts(r, u, view).Render(ctx, w)
+			})
+
+			// Lifts the lockout of ?email= or ?ip=, or all of them
+			attemptsRouter.Post("/clear", func(w http.ResponseWriter, r *http.Request) {
+				email, ip := r.URL.Query().Get("email"), r.URL.Query().Get("ip")
+				if err := db.WriteTX(r.Context(), func(tx *sqlite.Conn) error {
+					return ClearLoginAttempts(tx, email, ip)
+				}); err != nil {
+					http.Error(w, "failed to clear login attempts", http.StatusInternalServerError)
+					return
+				}
+				log.Printf("Admin cleared login attempts of email %q ip %q", email, ip)
+
+				sse := datastar.NewSSE(w, r)
+				datastar.Redirect(sse, "/admin/login-attempts")
+			})
+		})
+	})
+}
+
+func adminRequired(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, _ := UserFromContext(r.Context())
+		if u == nil {
+			http.Error(w, "user required", http.StatusUnauthorized)
+			return
+		}
+		if !u.IsAdmin {
+			http.Error(w, "admin required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,225 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"github.com/go-chi/chi/v5"
+	"zombiezen.com/go/sqlite"
+)
+
+// RealWorld spec payloads, see https://realworld-docs.netlify.app/specifications/backend/api-response-format/
+
+type apiUser struct {
+	Email    string `json:"email"`
+	Token    string `json:"token"`
+	Username string `json:"username"`
+	Bio      string `json:"bio"`
+	Image    string `json:"image"`
+}
+
+type apiProfile struct {
+	Username  string `json:"username"`
+	Bio       string `json:"bio"`
+	Image     string `json:"image"`
+	Following bool   `json:"following"`
+}
+
+type apiArticle struct {
+	Slug           string     `json:"slug"`
+	Title          string     `json:"title"`
+	Description    string     `json:"description"`
+	Body           string     `json:"body"`
+	TagList        []string   `json:"tagList"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	UpdatedAt      time.Time  `json:"updatedAt"`
+	Favorited      bool       `json:"favorited"`
+	FavoritesCount int64      `json:"favoritesCount"`
+	Author         apiProfile `json:"author"`
+}
+
+type apiComment struct {
+	Id        int64      `json:"id"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	Body      string     `json:"body"`
+	Author    apiProfile `json:"author"`
+}
+
+var (
+	errAPIUnauthorized = errors.New("unauthorized")
+	errAPIForbidden    = errors.New("forbidden")
+	errAPIInternal     = errors.New("internal server error")
+)
+
+func setupAPIRoutes(r chi.Router, db *toolbelt.Database, tokens *TokenAuthority, hub *Hub, verifier *EmailVerifier, throttle *LoginThrottle, requireVerifiedEmail bool) {
+	r.Route("/api", func(apiRouter chi.Router) {
+		setupAPIUsersRoutes(apiRouter, db, tokens, verifier, throttle)
+		setupAPIProfilesRoutes(apiRouter, db, hub)
+		setupAPIArticlesRoutes(apiRouter, db, hub, requireVerifiedEmail)
+
+		apiRouter.Get("/tags", func(w http.ResponseWriter, r *http.Request) {
+			tags := []string{}
+			if err := db.ReadTX(r.Context(), func(tx *sqlite.Conn) error {
+				res, err := zz.OnceAllTags(tx)
+				if err != nil {
+					return fmt.Errorf("failed to get tags: %w", err)
+				}
+				for _, row := range res {
+					tags = append(tags, row.Name)
+				}
+				return nil
+			}); err != nil {
+				apiInternalError(w, r, err)
+				return
+			}
+
+			apiJSON(w, http.StatusOK, map[string]any{"tags": tags})
+		})
+	})
+}
+
+func apiUserRequired(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, ok := UserFromContext(r.Context()); !ok || u == nil {
+			apiError(w, http.StatusUnauthorized, errAPIUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func apiDecode(r *http.Request, envelope string, v any) error {
+	body := map[string]json.RawMessage{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return fmt.Errorf("failed to parse request body: %w", err)
+	}
+
+	raw, ok := body[envelope]
+	if !ok {
+		return fmt.Errorf("%s is required", envelope)
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", envelope, err)
+	}
+
+	return nil
+}
+
+func apiJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// apiInternalError logs err and responds without it, so clients never see
+// what went wrong inside, like the database's own messages.
+func apiInternalError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("%s %s failed: %v", r.Method, r.URL.Path, err)
+	apiError(w, http.StatusInternalServerError, errAPIInternal)
+}
+
+func apiError(w http.ResponseWriter, status int, errs ...error) {
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+
+	apiJSON(w, status, map[string]any{
+		"errors": map[string][]string{
+			"body": messages,
+		},
+	})
+}
+
+func apiUserByUsername(tx *sqlite.Conn, username string) (*zz.UserModel, error) {
+	res, err := zz.OnceUserByUsername(tx, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user by username: %w", err)
+	}
+	if res == nil {
+		return nil, nil
+	}
+
+	u, err := zz.OnceReadByIDUser(tx, res.Id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user by ID: %w", err)
+	}
+	return u, nil
+}
+
+func apiProfileFor(tx *sqlite.Conn, me, u *zz.UserModel) (apiProfile, error) {
+	p := apiProfile{
+		Username: u.Username,
+		Bio:      u.Bio,
+		Image:    AvatarURL(u.Id, u.ImageUrl),
+	}
+
+	if me != nil {
+		isFollowing, err := zz.OnceIsUserFollowing(tx, zz.IsUserFollowingParams{
+			UserId:    me.Id,
+			FollowsId: u.Id,
+		})
+		if err != nil {
+			return p, fmt.Errorf("failed to check if user is following: %w", err)
+		}
+		p.Following = isFollowing
+	}
+
+	return p, nil
+}
+
+func apiArticleFor(tx *sqlite.Conn, me *zz.UserModel, article *zz.ArticleModel) (*apiArticle, error) {
+	a := &apiArticle{
+		Slug:        article.Slug,
+		Title:       article.Title,
+		Description: article.Description,
+		Body:        article.Body,
+		TagList:     []string{},
+		CreatedAt:   article.CreatedAt,
+		UpdatedAt:   article.UpdatedAt,
+	}
+
+	author, err := zz.OnceReadByIDUser(tx, article.AuthorId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get author: %w", err)
+	}
+	if author == nil {
+		return nil, fmt.Errorf("author %d not found", article.AuthorId)
+	}
+	a.Author, err = apiProfileFor(tx, me, author)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := zz.OnceTagsForArticle(tx, article.Id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tags for article: %w", err)
+	}
+	for _, tag := range tags {
+		a.TagList = append(a.TagList, tag.Name)
+	}
+
+	a.FavoritesCount, err = zz.OnceArticleFavoriteCount(tx, article.Id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get favorite count: %w", err)
+	}
+
+	if me != nil {
+		a.Favorited, err = zz.OnceHasUserFavorited(tx, zz.HasUserFavoritedParams{
+			UserId:    me.Id,
+			ArticleId: article.Id,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to check if article is favorited: %w", err)
+		}
+	}
+
+	return a, nil
+}
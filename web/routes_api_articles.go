@@ -0,0 +1,794 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"github.com/go-chi/chi/v5"
+	"zombiezen.com/go/sqlite"
+)
+
+type apiArticleForm struct {
+	Title       *string   `json:"title"`
+	Description *string   `json:"description"`
+	Body        *string   `json:"body"`
+	TagList     *[]string `json:"tagList"`
+}
+
+func apiLimitOffset(r *http.Request) (limit, offset int64, err error) {
+	limit, offset = 20, 0
+
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		limit, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || limit < 1 {
+			return 0, 0, errors.New("invalid limit")
+		}
+	}
+
+	if raw := r.URL.Query().Get("offset"); raw != "" {
+		offset, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("invalid offset")
+		}
+	}
+
+	return limit, offset, nil
+}
+
+func apiArticlesFor(tx *sqlite.Conn, me *zz.UserModel, articleIDs ...int64) ([]*apiArticle, error) {
+	articles := make([]*apiArticle, 0, len(articleIDs))
+	readArticleStmt := zz.ReadByIDArticle(tx)
+	for _, articleID := range articleIDs {
+		article, err := readArticleStmt.Run(articleID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get article: %w", err)
+		}
+		if article == nil {
+			continue
+		}
+
+		a, err := apiArticleFor(tx, me, article)
+		if err != nil {
+			return nil, err
+		}
+		articles = append(articles, a)
+	}
+	return articles, nil
+}
+
+func setupAPIArticlesRoutes(r chi.Router, db *toolbelt.Database, hub *Hub, requireVerifiedEmail bool) {
+	verifiedRequired := apiVerifiedEmailRequired(requireVerifiedEmail)
+
+	errArticleNotFound := errors.New("article not found")
+	errCommentNotFound := errors.New("comment not found")
+
+	r.Route("/articles", func(articlesRouter chi.Router) {
+		articlesRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			me, _ := UserFromContext(ctx)
+
+			limit, offset, err := apiLimitOffset(r)
+			if err != nil {
+				apiError(w, http.StatusUnprocessableEntity, err)
+				return
+			}
+
+			q := r.URL.Query()
+			tag, author, favorited := q.Get("tag"), q.Get("author"), q.Get("favorited")
+
+			var (
+				articles      = []*apiArticle{}
+				articlesCount int64
+			)
+			if err := db.ReadTX(ctx, func(tx *sqlite.Conn) error {
+				var articleIDs []int64
+
+				switch {
+				case tag != "":
+					res, err := zz.OnceArticlePreviewsByTag(tx, zz.ArticlePreviewsByTagParams{
+						Tag:    tag,
+						Limit:  limit,
+						Offset: offset,
+					})
+					if err != nil {
+						return fmt.Errorf("failed to get articles by tag: %w", err)
+					}
+					for _, row := range res {
+						articleIDs = append(articleIDs, row.ArticleId)
+					}
+
+					articlesCount, err = zz.OnceArticleCountByTag(tx, tag)
+					if err != nil {
+						return fmt.Errorf("failed to get article count by tag: %w", err)
+					}
+
+				case author != "":
+					u, err := apiUserByUsername(tx, author)
+					if err != nil {
+						return err
+					}
+					if u == nil {
+						return nil
+					}
+
+					res, err := zz.OnceArticlePreviewsByAuthor(tx, zz.ArticlePreviewsByAuthorParams{
+						AuthorId: u.Id,
+						Limit:    limit,
+						Offset:   offset,
+					})
+					if err != nil {
+						return fmt.Errorf("failed to get articles by author: %w", err)
+					}
+					for _, row := range res {
+						articleIDs = append(articleIDs, row.ArticleId)
+					}
+
+					articlesCount, err = zz.OnceArticleCountByAuthor(tx, u.Id)
+					if err != nil {
+						return fmt.Errorf("failed to get article count by author: %w", err)
+					}
+
+				case favorited != "":
+					u, err := apiUserByUsername(tx, favorited)
+					if err != nil {
+						return err
+					}
+					if u == nil {
+						return nil
+					}
+
+					res, err := zz.OnceArticlePreviewsByFavoriter(tx, zz.ArticlePreviewsByFavoriterParams{
+						FavoriterId: u.Id,
+						Limit:       limit,
+						Offset:      offset,
+					})
+					if err != nil {
+						return fmt.Errorf("failed to get articles by favoriter: %w", err)
+					}
+					for _, row := range res {
+						articleIDs = append(articleIDs, row.ArticleId)
+					}
+
+					articlesCount, err = zz.OnceArticleCountByFavoriter(tx, u.Id)
+					if err != nil {
+						return fmt.Errorf("failed to get article count by favoriter: %w", err)
+					}
+
+				default:
+					res, err := zz.OnceGlobalFeedArticlePreviews(tx, zz.GlobalFeedArticlePreviewsParams{
+						Limit:  limit,
+						Offset: offset,
+					})
+					if err != nil {
+						return fmt.Errorf("failed to get global feed: %w", err)
+					}
+					for _, row := range res {
+						articleIDs = append(articleIDs, row.ArticleId)
+					}
+
+					articlesCount, err = zz.OnceGlobalFeedArticleCount(tx)
+					if err != nil {
+						return fmt.Errorf("failed to get global feed count: %w", err)
+					}
+				}
+
+				res, err := apiArticlesFor(tx, me, articleIDs...)
+				if err != nil {
+					return err
+				}
+				articles = append(articles, res...)
+
+				return nil
+			}); err != nil {
+				apiInternalError(w, r, err)
+				return
+			}
+
+			apiJSON(w, http.StatusOK, map[string]any{
+				"articles":      articles,
+				"articlesCount": articlesCount,
+			})
+		})
+
+		articlesRouter.With(apiUserRequired).Get("/feed", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			me, _ := UserFromContext(ctx)
+
+			limit, offset, err := apiLimitOffset(r)
+			if err != nil {
+				apiError(w, http.StatusUnprocessableEntity, err)
+				return
+			}
+
+			var (
+				articles      = []*apiArticle{}
+				articlesCount int64
+			)
+			if err := db.ReadTX(ctx, func(tx *sqlite.Conn) error {
+				res, err := zz.OnceYourFeedArticlePreviews(tx, zz.YourFeedArticlePreviewsParams{
+					UserId: me.Id,
+					Limit:  limit,
+					Offset: offset,
+				})
+				if err != nil {
+					return fmt.Errorf("failed to get your feed: %w", err)
+				}
+
+				articleIDs := make([]int64, len(res))
+				for i, row := range res {
+					articleIDs[i] = row.ArticleId
+				}
+
+				feed, err := apiArticlesFor(tx, me, articleIDs...)
+				if err != nil {
+					return err
+				}
+				articles = append(articles, feed...)
+
+				articlesCount, err = zz.OnceYourFeedArticleCount(tx, me.Id)
+				if err != nil {
+					return fmt.Errorf("failed to get your feed count: %w", err)
+				}
+
+				return nil
+			}); err != nil {
+				apiInternalError(w, r, err)
+				return
+			}
+
+			apiJSON(w, http.StatusOK, map[string]any{
+				"articles":      articles,
+				"articlesCount": articlesCount,
+			})
+		})
+
+		articlesRouter.With(apiUserRequired, verifiedRequired).Post("/", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			me, _ := UserFromContext(ctx)
+
+			form := &apiArticleForm{}
+			if err := apiDecode(r, "article", form); err != nil {
+				apiError(w, http.StatusUnprocessableEntity, err)
+				return
+			}
+
+			newArticle := &NewArticle{}
+			if form.Title != nil {
+				newArticle.Title = *form.Title
+			}
+			if form.Description != nil {
+				newArticle.Description = *form.Description
+			}
+			if form.Body != nil {
+				newArticle.Body = *form.Body
+			}
+			if form.TagList != nil {
+				newArticle.TagNames = *form.TagList
+			}
+			if validationErrors := newArticle.validate(); len(validationErrors) > 0 {
+				apiError(w, http.StatusUnprocessableEntity, validationErrors...)
+				return
+			}
+
+			var article *apiArticle
+			if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+				a, err := createArticle(tx, me.Id, newArticle)
+				if err != nil {
+					return err
+				}
+
+				article, err = apiArticleFor(tx, me, a)
+				return err
+			}); err != nil {
+				apiInternalError(w, r, err)
+				return
+			}
+
+			apiJSON(w, http.StatusCreated, map[string]any{"article": article})
+		})
+
+		articlesRouter.Route("/{slug}", func(articleRouter chi.Router) {
+			articleRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				ctx := r.Context()
+				me, _ := UserFromContext(ctx)
+
+				var article *apiArticle
+				if err := db.ReadTX(ctx, func(tx *sqlite.Conn) error {
+					a, err := articleBySlug(tx, me, pathParam(r, "slug"))
+					if err != nil {
+						return err
+					}
+					if a == nil {
+						return nil
+					}
+
+					article, err = apiArticleFor(tx, me, a)
+					return err
+				}); err != nil {
+					apiInternalError(w, r, err)
+					return
+				}
+
+				if article == nil {
+					apiError(w, http.StatusNotFound, errArticleNotFound)
+					return
+				}
+
+				apiJSON(w, http.StatusOK, map[string]any{"article": article})
+			})
+
+			articleRouter.With(apiUserRequired, verifiedRequired).Put("/", func(w http.ResponseWriter, r *http.Request) {
+				ctx := r.Context()
+				me, _ := UserFromContext(ctx)
+
+				form := &apiArticleForm{}
+				if err := apiDecode(r, "article", form); err != nil {
+					apiError(w, http.StatusUnprocessableEntity, err)
+					return
+				}
+
+				var (
+					article          *apiArticle
+					articleID        int64
+					status           int
+					validationErrors []error
+				)
+				if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+					a, err := articleBySlug(tx, me, pathParam(r, "slug"))
+					if err != nil {
+						return err
+					}
+					if a == nil {
+						status = http.StatusNotFound
+						return nil
+					}
+					if a.AuthorId != me.Id {
+						status = http.StatusForbidden
+						return nil
+					}
+
+					articleID = a.Id
+
+					// Fields left out keep their current values
+					edited := &NewArticle{
+						Title:       a.Title,
+						Description: a.Description,
+						Body:        a.Body,
+					}
+					if form.Title != nil {
+						edited.Title = *form.Title
+					}
+					if form.Description != nil {
+						edited.Description = *form.Description
+					}
+					if form.Body != nil {
+						edited.Body = *form.Body
+					}
+					if validationErrors = edited.validate(); len(validationErrors) > 0 {
+						status = http.StatusUnprocessableEntity
+						return nil
+					}
+
+					if edited.Title != a.Title {
+						if err := setArticleSlug(tx, a, edited.Title); err != nil {
+							return err
+						}
+					}
+					if edited.Body != a.Body {
+						if a.BodyHtml, err = RenderMarkdown(edited.Body); err != nil {
+							return err
+						}
+					}
+					a.Title = edited.Title
+					a.Description = edited.Description
+					a.Body = edited.Body
+					a.UpdatedAt = time.Now()
+
+					if err := zz.UpdateArticle(tx).Run(a); err != nil {
+						return fmt.Errorf("failed to update article: %w", err)
+					}
+					if err := saveArticleRevision(tx, a, me.Id); err != nil {
+						return err
+					}
+
+					if form.TagList != nil {
+						tags, err := findOrCreateTags(tx, *form.TagList...)
+						if err != nil {
+							return err
+						}
+						wanted := make(map[int64]struct{}, len(tags))
+						for _, tag := range tags {
+							wanted[tag.Id] = struct{}{}
+						}
+
+						existing, err := zz.OnceTagsForArticle(tx, a.Id)
+						if err != nil {
+							return fmt.Errorf("failed to get tags for article: %w", err)
+						}
+						for _, tag := range existing {
+							if _, ok := wanted[tag.Id]; ok {
+								delete(wanted, tag.Id)
+								continue
+							}
+							if err := zz.OnceDeleteTagFromArticle(tx, zz.DeleteTagFromArticleParams{
+								ArticleId: a.Id,
+								TagId:     tag.Id,
+							}); err != nil {
+								return fmt.Errorf("failed to delete tag: %w", err)
+							}
+						}
+
+						createArticleTagStmt := zz.CreateArticleTag(tx)
+						for tagID := range wanted {
+							if err := createArticleTagStmt.Run(&zz.ArticleTagModel{
+								Id:        toolbelt.NextID(),
+								ArticleId: a.Id,
+								TagId:     tagID,
+							}); err != nil {
+								return fmt.Errorf("failed to create article tag: %w", err)
+							}
+						}
+					}
+
+					article, err = apiArticleFor(tx, me, a)
+					return err
+				}); err != nil {
+					apiInternalError(w, r, err)
+					return
+				}
+
+				switch status {
+				case http.StatusNotFound:
+					apiError(w, status, errArticleNotFound)
+				case http.StatusForbidden:
+					apiError(w, status, errAPIForbidden)
+				case http.StatusUnprocessableEntity:
+					apiError(w, status, validationErrors...)
+				default:
+					hub.Publish(ArticleTopic(articleID))
+					apiJSON(w, http.StatusOK, map[string]any{"article": article})
+				}
+			})
+
+			articleRouter.With(apiUserRequired).Delete("/", func(w http.ResponseWriter, r *http.Request) {
+				ctx := r.Context()
+				me, _ := UserFromContext(ctx)
+
+				var (
+					articleID int64
+					status    = http.StatusNoContent
+				)
+				if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+					a, err := articleBySlug(tx, me, pathParam(r, "slug"))
+					if err != nil {
+						return err
+					}
+					if a == nil {
+						status = http.StatusNotFound
+						return nil
+					}
+					if a.AuthorId != me.Id {
+						status = http.StatusForbidden
+						return nil
+					}
+
+					articleID = a.Id
+
+					if err := zz.OnceDeleteArticle(tx, a.Id); err != nil {
+						return fmt.Errorf("failed to delete article: %w", err)
+					}
+					return nil
+				}); err != nil {
+					apiInternalError(w, r, err)
+					return
+				}
+
+				switch status {
+				case http.StatusNotFound:
+					apiError(w, status, errArticleNotFound)
+				case http.StatusForbidden:
+					apiError(w, status, errAPIForbidden)
+				default:
+					hub.Publish(ArticleTopic(articleID))
+					w.WriteHeader(status)
+				}
+			})
+
+			articleRouter.Route("/favorite", func(favoriteRouter chi.Router) {
+				favoriteRouter.Use(apiUserRequired)
+
+				toggleFavorite := func(w http.ResponseWriter, r *http.Request, shouldFavorite bool) {
+					ctx := r.Context()
+					me, _ := UserFromContext(ctx)
+
+					var (
+						article   *apiArticle
+						articleID int64
+					)
+					if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+						a, err := articleBySlug(tx, me, pathParam(r, "slug"))
+						if err != nil {
+							return err
+						}
+						if a == nil {
+							return nil
+						}
+						articleID = a.Id
+
+						alreadyFavorited, err := zz.OnceHasUserFavorited(tx, zz.HasUserFavoritedParams{
+							UserId:    me.Id,
+							ArticleId: a.Id,
+						})
+						if err != nil {
+							return fmt.Errorf("failed to check if article is already favorited: %w", err)
+						}
+
+						switch {
+						case shouldFavorite && !alreadyFavorited:
+							if err := zz.OnceCreateArticleFavorite(tx, &zz.ArticleFavoriteModel{
+								Id:        toolbelt.NextID(),
+								UserId:    me.Id,
+								ArticleId: a.Id,
+							}); err != nil {
+								return fmt.Errorf("failed to favorite article: %w", err)
+							}
+						case !shouldFavorite && alreadyFavorited:
+							if err := zz.OnceDeleteFavoritedArticle(tx, zz.DeleteFavoritedArticleParams{
+								UserId:    me.Id,
+								ArticleId: a.Id,
+							}); err != nil {
+								return fmt.Errorf("failed to unfavorite article: %w", err)
+							}
+						}
+
+						article, err = apiArticleFor(tx, me, a)
+						return err
+					}); err != nil {
+						apiInternalError(w, r, err)
+						return
+					}
+
+					if article == nil {
+						apiError(w, http.StatusNotFound, errArticleNotFound)
+						return
+					}
+					hub.Publish(ArticleTopic(articleID))
+
+					apiJSON(w, http.StatusOK, map[string]any{"article": article})
+				}
+
+				favoriteRouter.Post("/", func(w http.ResponseWriter, r *http.Request) {
+					toggleFavorite(w, r, true)
+				})
+
+				favoriteRouter.Delete("/", func(w http.ResponseWriter, r *http.Request) {
+					toggleFavorite(w, r, false)
+				})
+			})
+
+			articleRouter.Route("/comments", func(commentsRouter chi.Router) {
+				commentsRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
+					ctx := r.Context()
+					me, _ := UserFromContext(ctx)
+
+					var (
+						found    bool
+						comments = []*apiComment{}
+					)
+					if err := db.ReadTX(ctx, func(tx *sqlite.Conn) error {
+						a, err := articleBySlug(tx, me, pathParam(r, "slug"))
+						if err != nil {
+							return err
+						}
+						if a == nil {
+							return nil
+						}
+						found = true
+
+						res, err := zz.OnceArticleComments(tx, a.Id)
+						if err != nil {
+							return fmt.Errorf("failed to get comments: %w", err)
+						}
+
+						readCommentStmt := zz.ReadByIDComment(tx)
+						readUserStmt := zz.ReadByIDUser(tx)
+						for _, row := range res {
+							comment, err := readCommentStmt.Run(row.CommentId)
+							if err != nil {
+								return fmt.Errorf("failed to get comment: %w", err)
+							}
+							commenter, err := readUserStmt.Run(row.CommenterId)
+							if err != nil {
+								return fmt.Errorf("failed to get commenter: %w", err)
+							}
+
+							c, err := apiCommentFor(tx, me, comment, commenter)
+							if err != nil {
+								return err
+							}
+							comments = append(comments, c)
+						}
+
+						return nil
+					}); err != nil {
+						apiInternalError(w, r, err)
+						return
+					}
+
+					if !found {
+						apiError(w, http.StatusNotFound, errArticleNotFound)
+						return
+					}
+
+					apiJSON(w, http.StatusOK, map[string]any{"comments": comments})
+				})
+
+				commentsRouter.With(apiUserRequired, verifiedRequired).Post("/", func(w http.ResponseWriter, r *http.Request) {
+					ctx := r.Context()
+					me, _ := UserFromContext(ctx)
+
+					type Form struct {
+						Body string `json:"body"`
+					}
+					form := &Form{}
+					if err := apiDecode(r, "comment", form); err != nil {
+						apiError(w, http.StatusUnprocessableEntity, err)
+						return
+					}
+
+					form.Body = strings.TrimSpace(form.Body)
+					if form.Body == "" {
+						apiError(w, http.StatusUnprocessableEntity, errors.New("body required"))
+						return
+					}
+
+					var (
+						comment   *apiComment
+						articleID int64
+					)
+					if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+						a, err := articleBySlug(tx, me, pathParam(r, "slug"))
+						if err != nil {
+							return err
+						}
+						if a == nil {
+							return nil
+						}
+						articleID = a.Id
+
+						now := time.Now()
+						c := &zz.CommentModel{
+							Id:        toolbelt.NextID(),
+							Body:      form.Body,
+							CreatedAt: now,
+							UpdatedAt: now,
+							AuthorId:  me.Id,
+							ArticleId: a.Id,
+						}
+						if err := zz.OnceCreateComment(tx, c); err != nil {
+							return fmt.Errorf("failed to create comment: %w", err)
+						}
+
+						comment, err = apiCommentFor(tx, me, c, me)
+						return err
+					}); err != nil {
+						apiInternalError(w, r, err)
+						return
+					}
+
+					if comment == nil {
+						apiError(w, http.StatusNotFound, errArticleNotFound)
+						return
+					}
+					hub.Publish(ArticleTopic(articleID))
+
+					apiJSON(w, http.StatusOK, map[string]any{"comment": comment})
+				})
+
+				commentsRouter.With(apiUserRequired).Delete("/{commentId}", func(w http.ResponseWriter, r *http.Request) {
+					ctx := r.Context()
+					me, _ := UserFromContext(ctx)
+
+					commentID, err := strconv.ParseInt(chi.URLParam(r, "commentId"), 10, 64)
+					if err != nil {
+						apiError(w, http.StatusUnprocessableEntity, errors.New("invalid comment ID"))
+						return
+					}
+
+					status := http.StatusNoContent
+					var articleID int64
+					if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+						a, err := articleBySlug(tx, me, pathParam(r, "slug"))
+						if err != nil {
+							return err
+						}
+						if a == nil {
+							status = http.StatusNotFound
+							return nil
+						}
+						articleID = a.Id
+
+						c, err := zz.OnceReadByIDComment(tx, commentID)
+						if err != nil {
+							return fmt.Errorf("failed to get comment: %w", err)
+						}
+						if c == nil || c.ArticleId != a.Id {
+							status = http.StatusNotFound
+							return nil
+						}
+						if c.AuthorId != me.Id {
+							status = http.StatusForbidden
+							return nil
+						}
+
+						if err := zz.OnceDeleteComment(tx, c.Id); err != nil {
+							return fmt.Errorf("failed to delete comment: %w", err)
+						}
+						return nil
+					}); err != nil {
+						apiInternalError(w, r, err)
+						return
+					}
+
+					switch status {
+					case http.StatusNotFound:
+						apiError(w, status, errCommentNotFound)
+					case http.StatusForbidden:
+						apiError(w, status, errAPIForbidden)
+					default:
+						hub.Publish(ArticleTopic(articleID))
+						w.WriteHeader(status)
+					}
+				})
+			})
+		})
+	})
+}
+
+func apiCommentFor(tx *sqlite.Conn, me *zz.UserModel, comment *zz.CommentModel, commenter *zz.UserModel) (*apiComment, error) {
+	author, err := apiProfileFor(tx, me, commenter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &apiComment{
+		Id:        comment.Id,
+		CreatedAt: comment.CreatedAt,
+		UpdatedAt: comment.UpdatedAt,
+		Body:      comment.Body,
+		Author:    author,
+	}, nil
+}
+
+// articleBySlug finds the article at a current or previous slug, returning
+// nil if there is none or it is an unpublished article me didn't write.
+func articleBySlug(tx *sqlite.Conn, me *zz.UserModel, slug string) (*zz.ArticleModel, error) {
+	articleID, err := zz.OnceArticleIdBySlug(tx, slug)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get article by slug: %w", err)
+	}
+	if articleID == 0 {
+		articleID, err = zz.OnceArticleIdBySlugHistory(tx, slug)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get article by previous slug: %w", err)
+		}
+	}
+	if articleID == 0 {
+		return nil, nil
+	}
+
+	article, err := zz.OnceReadByIDArticle(tx, articleID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get article: %w", err)
+	}
+	if article == nil || !articleVisibleTo(article, me) {
+		return nil, nil
+	}
+	return article, nil
+}
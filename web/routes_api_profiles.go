@@ -0,0 +1,152 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"github.com/go-chi/chi/v5"
+	"zombiezen.com/go/sqlite"
+)
+
+func setupAPIProfilesRoutes(r chi.Router, db *toolbelt.Database, hub *Hub) {
+	errProfileNotFound := errors.New("profile not found")
+
+	r.Route("/profiles/{username}", func(profileRouter chi.Router) {
+		profileRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			me, _ := UserFromContext(ctx)
+
+			var profile *apiProfile
+			if err := db.ReadTX(ctx, func(tx *sqlite.Conn) error {
+				u, err := apiUserByUsername(tx, chi.URLParam(r, "username"))
+				if err != nil {
+					return err
+				}
+				if u == nil {
+					return nil
+				}
+
+				p, err := apiProfileFor(tx, me, u)
+				if err != nil {
+					return err
+				}
+				profile = &p
+				return nil
+			}); err != nil {
+				apiInternalError(w, r, err)
+				return
+			}
+
+			if profile == nil {
+				apiError(w, http.StatusNotFound, errProfileNotFound)
+				return
+			}
+
+			apiJSON(w, http.StatusOK, map[string]any{"profile": profile})
+		})
+
+		profileRouter.With(apiUserRequired).Post("/follow", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			me, _ := UserFromContext(ctx)
+
+			var (
+				profile *apiProfile
+				userID  int64
+			)
+			if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+				u, err := apiUserByUsername(tx, chi.URLParam(r, "username"))
+				if err != nil {
+					return err
+				}
+				if u == nil {
+					return nil
+				}
+				userID = u.Id
+
+				isFollowing, err := zz.OnceIsUserFollowing(tx, zz.IsUserFollowingParams{
+					UserId:    me.Id,
+					FollowsId: u.Id,
+				})
+				if err != nil {
+					return fmt.Errorf("failed to check if user is following: %w", err)
+				}
+
+				if !isFollowing && u.Id != me.Id {
+					if err := zz.OnceCreateFollowing(tx, &zz.FollowingModel{
+						Id:        toolbelt.NextID(),
+						UserId:    me.Id,
+						FollowsId: u.Id,
+					}); err != nil {
+						return fmt.Errorf("failed to follow user: %w", err)
+					}
+				}
+
+				p, err := apiProfileFor(tx, me, u)
+				if err != nil {
+					return err
+				}
+				profile = &p
+				return nil
+			}); err != nil {
+				apiInternalError(w, r, err)
+				return
+			}
+
+			if profile == nil {
+				apiError(w, http.StatusNotFound, errProfileNotFound)
+				return
+			}
+			hub.Publish(UserTopic(userID))
+
+			apiJSON(w, http.StatusOK, map[string]any{"profile": profile})
+		})
+
+		profileRouter.With(apiUserRequired).Delete("/follow", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			me, _ := UserFromContext(ctx)
+
+			var (
+				profile *apiProfile
+				userID  int64
+			)
+			if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+				u, err := apiUserByUsername(tx, chi.URLParam(r, "username"))
+				if err != nil {
+					return err
+				}
+				if u == nil {
+					return nil
+				}
+				userID = u.Id
+
+				if err := zz.OnceDeleteFollow(tx, zz.DeleteFollowParams{
+					UserId:    me.Id,
+					FollowsId: u.Id,
+				}); err != nil {
+					return fmt.Errorf("failed to unfollow user: %w", err)
+				}
+
+				p, err := apiProfileFor(tx, me, u)
+				if err != nil {
+					return err
+				}
+				profile = &p
+				return nil
+			}); err != nil {
+				apiInternalError(w, r, err)
+				return
+			}
+
+			if profile == nil {
+				apiError(w, http.StatusNotFound, errProfileNotFound)
+				return
+			}
+			hub.Publish(UserTopic(userID))
+
+			apiJSON(w, http.StatusOK, map[string]any{"profile": profile})
+		})
+	})
+}
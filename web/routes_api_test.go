@@ -0,0 +1,177 @@
+package web
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type apiArticleResponse struct {
+	Article apiArticle `json:"article"`
+}
+
+type apiArticlesResponse struct {
+	Articles      []apiArticle `json:"articles"`
+	ArticlesCount int64        `json:"articlesCount"`
+}
+
+func createAPIArticle(t *testing.T, ts *testServer, token, title string, tags ...string) apiArticle {
+	t.Helper()
+
+	res := apiArticleResponse{}
+	status := ts.api(t, http.MethodPost, "/api/articles", token, map[string]any{
+		"article": map[string]any{
+			"title":       title,
+			"description": "About " + title,
+			"body":        "All about " + title,
+			"tagList":     tags,
+		},
+	}, &res)
+	if status != http.StatusCreated {
+		t.Fatalf("creating %q: got status %d", title, status)
+	}
+	return res.Article
+}
+
+func TestAPICreateArticle(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+
+	article := createAPIArticle(t, ts, token, "How to train your dragon", "dragons", "training")
+	if article.Slug == "" {
+		t.Error("got no slug")
+	}
+	if article.Author.Username != "jake" {
+		t.Errorf("got author %q, want jake", article.Author.Username)
+	}
+	if !slices.Equal(article.TagList, []string{"dragons", "training"}) {
+		t.Errorf("got tags %v", article.TagList)
+	}
+
+	res := apiArticleResponse{}
+	if status := ts.api(t, http.MethodGet, "/api/articles/"+article.Slug, "", nil, &res); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if res.Article.Title != "How to train your dragon" {
+		t.Errorf("got title %q", res.Article.Title)
+	}
+}
+
+func TestAPICreateArticleRequiresUser(t *testing.T) {
+	ts := newTestServer(t)
+
+	status := ts.api(t, http.MethodPost, "/api/articles", "", map[string]any{
+		"article": map[string]any{"title": "t", "description": "d", "body": "b"},
+	}, nil)
+	if status != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", status, http.StatusUnauthorized)
+	}
+}
+
+func TestAPICreateArticleValidation(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+
+	for name, body := range map[string]any{
+		"missing envelope": map[string]any{},
+		"missing fields":   map[string]any{"article": map[string]any{"title": "  "}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			res := apiErrorsResponse{}
+			if status := ts.api(t, http.MethodPost, "/api/articles", token, body, &res); status != http.StatusUnprocessableEntity {
+				t.Errorf("got status %d, want %d", status, http.StatusUnprocessableEntity)
+			}
+			if len(res.Errors.Body) == 0 {
+				t.Error("got no errors")
+			}
+		})
+	}
+}
+
+func TestAPICreateArticleInternalError(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+
+	// Anything going wrong past validation is the server's fault
+	ts.exec(t, `CREATE TRIGGER fail_articles BEFORE INSERT ON articles BEGIN SELECT RAISE(ABORT, 'secret sqlite detail'); END`)
+
+	res := apiErrorsResponse{}
+	status := ts.api(t, http.MethodPost, "/api/articles", token, map[string]any{
+		"article": map[string]any{"title": "t", "description": "d", "body": "b"},
+	}, &res)
+	if status != http.StatusInternalServerError {
+		t.Errorf("got status %d, want %d", status, http.StatusInternalServerError)
+	}
+	if !slices.Equal(res.Errors.Body, []string{errAPIInternal.Error()}) {
+		t.Errorf("got errors %v", res.Errors.Body)
+	}
+	for _, msg := range res.Errors.Body {
+		if strings.Contains(msg, "sqlite") {
+			t.Errorf("error leaks %q", msg)
+		}
+	}
+}
+
+func TestAPIUpdateArticle(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+	article := createAPIArticle(t, ts, token, "Dragons", "dragons")
+
+	// Fields left out stay, tags are trimmed and repeats dropped
+	res := apiArticleResponse{}
+	if status := ts.api(t, http.MethodPut, "/api/articles/"+article.Slug, token, map[string]any{
+		"article": map[string]any{"body": " Bigger dragons ", "tagList": []string{"training", " dragons", "", "training"}},
+	}, &res); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if res.Article.Title != "Dragons" || res.Article.Description != "About Dragons" || res.Article.Body != "Bigger dragons" {
+		t.Errorf("got %q, %q, %q", res.Article.Title, res.Article.Description, res.Article.Body)
+	}
+	if !slices.Equal(res.Article.TagList, []string{"dragons", "training"}) {
+		t.Errorf("got tags %v", res.Article.TagList)
+	}
+
+	errs := apiErrorsResponse{}
+	if status := ts.api(t, http.MethodPut, "/api/articles/"+article.Slug, token, map[string]any{
+		"article": map[string]any{"title": "  ", "body": ""},
+	}, &errs); status != http.StatusUnprocessableEntity {
+		t.Errorf("blank fields: got status %d, want %d", status, http.StatusUnprocessableEntity)
+	}
+	if !slices.Equal(errs.Errors.Body, []string{"title required", "body required"}) {
+		t.Errorf("got errors %v", errs.Errors.Body)
+	}
+}
+
+func TestAPIArticlesByTag(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+
+	createAPIArticle(t, ts, token, "Dragons", "dragons")
+	createAPIArticle(t, ts, token, "Training", "training")
+	createAPIArticle(t, ts, token, "Training dragons", "dragons", "training")
+
+	res := apiArticlesResponse{}
+	if status := ts.api(t, http.MethodGet, "/api/articles?tag=dragons", "", nil, &res); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if res.ArticlesCount != 2 || len(res.Articles) != 2 {
+		t.Fatalf("got %d of %d articles, want 2", len(res.Articles), res.ArticlesCount)
+	}
+	for _, a := range res.Articles {
+		if !slices.Contains(a.TagList, "dragons") {
+			t.Errorf("%q isn't tagged dragons", a.Title)
+		}
+	}
+
+	tags := struct {
+		Tags []string `json:"tags"`
+	}{}
+	if status := ts.api(t, http.MethodGet, "/api/tags", "", nil, &tags); status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	slices.Sort(tags.Tags)
+	if !slices.Equal(tags.Tags, []string{"dragons", "training"}) {
+		t.Errorf("got tags %v", tags.Tags)
+	}
+}
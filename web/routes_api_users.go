@@ -0,0 +1,332 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
+	"zombiezen.com/go/sqlite"
+)
+
+func apiUserFor(u *zz.UserModel, token string) apiUser {
+	return apiUser{
+		Email:    u.Email,
+		Token:    token,
+		Username: u.Username,
+		Bio:      u.Bio,
+		Image:    AvatarURL(u.Id, u.ImageUrl),
+	}
+}
+
+func setupAPIUsersRoutes(r chi.Router, db *toolbelt.Database, tokens *TokenAuthority, verifier *EmailVerifier, throttle *LoginThrottle) {
+	respondWithUser := func(w http.ResponseWriter, r *http.Request, status int, u *zz.UserModel) {
+		token, err := tokens.Issue(u.Id, u.SessionVersion)
+		if err != nil {
+			apiInternalError(w, r, err)
+			return
+		}
+		apiJSON(w, status, map[string]any{"user": apiUserFor(u, token)})
+	}
+
+	r.Route("/users", func(usersRouter chi.Router) {
+		usersRouter.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			form := &RegisterForm{}
+			if err := apiDecode(r, "user", form); err != nil {
+				apiError(w, http.StatusUnprocessableEntity, err)
+				return
+			}
+
+			form.Username = strings.TrimSpace(form.Username)
+			form.Email = strings.TrimSpace(form.Email)
+
+			var validationErrors []error
+			if form.Username == "" {
+				validationErrors = append(validationErrors, errors.New("username is required"))
+			}
+			if form.Email == "" {
+				validationErrors = append(validationErrors, errors.New("email is required"))
+			} else if err := validateEmail(form.Email); err != nil {
+				validationErrors = append(validationErrors, err)
+			}
+			if len(form.Password) < 8 {
+				validationErrors = append(validationErrors, errors.New("password must be at least 8 characters"))
+			}
+			if len(validationErrors) > 0 {
+				apiError(w, http.StatusUnprocessableEntity, validationErrors...)
+				return
+			}
+
+			var user *zz.UserModel
+			if err := db.WriteTX(r.Context(), func(tx *sqlite.Conn) error {
+				emailUser, err := zz.OnceUserByEmail(tx, form.Email)
+				if err != nil {
+					return fmt.Errorf("failed to get user by email: %w", err)
+				}
+				if emailUser != nil {
+					validationErrors = append(validationErrors, errors.New("email is already in use"))
+				}
+
+				usernameUser, err := zz.OnceUserByUsername(tx, form.Username)
+				if err != nil {
+					return fmt.Errorf("failed to get user by username: %w", err)
+				}
+				if usernameUser != nil {
+					validationErrors = append(validationErrors, errors.New("username is already in use"))
+				}
+
+				if len(validationErrors) > 0 {
+					return nil
+				}
+
+				passwordHash, err := bcrypt.GenerateFromPassword([]byte(form.Password), bcrypt.DefaultCost)
+				if err != nil {
+					return fmt.Errorf("failed to hash password: %w", err)
+				}
+
+				userID := toolbelt.NextID()
+				user = &zz.UserModel{
+					Id:           userID,
+					Username:     form.Username,
+					Email:        form.Email,
+					PasswordHash: passwordHash,
+					ImageUrl:     DefaultAvatarURL(userID),
+				}
+
+				if err := zz.OnceCreateUser(tx, user); err != nil {
+					return fmt.Errorf("failed to create user: %w", err)
+				}
+
+				return nil
+			}); err != nil {
+				apiInternalError(w, r, err)
+				return
+			}
+
+			if len(validationErrors) > 0 {
+				apiError(w, http.StatusUnprocessableEntity, validationErrors...)
+				return
+			}
+
+			if err := verifier.Send(r, user, user.Email); err != nil {
+				log.Printf("Failed to send email verification to user %d: %v", user.Id, err)
+			}
+
+			respondWithUser(w, r, http.StatusCreated, user)
+		})
+
+		usersRouter.Post("/login", func(w http.ResponseWriter, r *http.Request) {
+			// Code is only needed with two-factor authentication, from the
+			// authenticator app or a recovery code
+			type Form struct {
+				Email    string `json:"email"`
+				Password string `json:"password"`
+				Code     string `json:"code"`
+			}
+
+			form := &Form{}
+			if err := apiDecode(r, "user", form); err != nil {
+				apiError(w, http.StatusUnprocessableEntity, err)
+				return
+			}
+			form.Email = strings.TrimSpace(form.Email)
+
+			var locked *LoginLockedError
+			attemptID, err := throttle.Attempt(r, form.Email)
+			if errors.As(err, &locked) {
+				w.Header().Set("Retry-After", strconv.FormatInt(int64((locked.RetryAfter+time.Second-1)/time.Second), 10))
+				apiError(w, http.StatusTooManyRequests, locked)
+				return
+			}
+			if err != nil {
+				apiInternalError(w, r, err)
+				return
+			}
+
+			var res *zz.UserByEmailRes
+			if err := db.ReadTX(r.Context(), func(tx *sqlite.Conn) (err error) {
+				res, err = zz.OnceUserByEmail(tx, form.Email)
+				if err != nil {
+					return fmt.Errorf("failed to get user by email: %w", err)
+				}
+				return nil
+			}); err != nil {
+				apiInternalError(w, r, err)
+				return
+			}
+
+			var passwordHash []byte
+			if res != nil {
+				passwordHash = res.PasswordHash
+			}
+			if err := checkPassword(passwordHash, form.Password); err != nil {
+				apiError(w, http.StatusUnauthorized, err)
+				return
+			}
+
+			if err := db.WriteTX(r.Context(), func(tx *sqlite.Conn) error {
+				needsCode, err := twoFactorEnabled(tx, res.Id)
+				if err != nil || !needsCode {
+					return err
+				}
+				if strings.TrimSpace(form.Code) == "" {
+					return errTwoFactorCodeRequired
+				}
+				return checkSecondFactor(tx, res.Id, strings.TrimSpace(form.Code))
+			}); err != nil {
+				switch {
+				case errors.Is(err, errTwoFactorCodeRequired):
+					apiError(w, http.StatusUnauthorized, errTwoFactorCodeRequired)
+				case errors.Is(err, errTwoFactorCodeInvalid):
+					apiError(w, http.StatusUnauthorized, errTwoFactorCodeInvalid)
+				default:
+					apiInternalError(w, r, err)
+				}
+				return
+			}
+
+			if err := throttle.Succeeded(r.Context(), attemptID); err != nil {
+				apiInternalError(w, r, err)
+				return
+			}
+
+			respondWithUser(w, r, http.StatusOK, &zz.UserModel{
+				Id:             res.Id,
+				Username:       res.Username,
+				Email:          res.Email,
+				Bio:            res.Bio,
+				ImageUrl:       res.ImageUrl,
+				SessionVersion: res.SessionVersion,
+			})
+		})
+	})
+
+	r.Route("/user", func(userRouter chi.Router) {
+		userRouter.Use(apiUserRequired)
+
+		userRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			u, _ := UserFromContext(r.Context())
+			respondWithUser(w, r, http.StatusOK, u)
+		})
+
+		userRouter.Put("/", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			u, _ := UserFromContext(ctx)
+
+			type Form struct {
+				Email    *string `json:"email"`
+				Username *string `json:"username"`
+				Password *string `json:"password"`
+				Image    *string `json:"image"`
+				Bio      *string `json:"bio"`
+			}
+
+			form := &Form{}
+			if err := apiDecode(r, "user", form); err != nil {
+				apiError(w, http.StatusUnprocessableEntity, err)
+				return
+			}
+
+			var validationErrors []error
+			newEmail := ""
+			if form.Username != nil {
+				username := strings.TrimSpace(*form.Username)
+				if username == "" {
+					validationErrors = append(validationErrors, errors.New("username is required"))
+				}
+				u.Username = username
+			}
+			if form.Email != nil {
+				// A new email only replaces the old one once it is confirmed
+				email := strings.TrimSpace(*form.Email)
+				if email == "" {
+					validationErrors = append(validationErrors, errors.New("email is required"))
+				} else if email != u.Email {
+					if err := validateEmail(email); err != nil {
+						validationErrors = append(validationErrors, err)
+					}
+					newEmail = email
+				}
+			}
+			if form.Password != nil {
+				if len(*form.Password) < 8 {
+					validationErrors = append(validationErrors, errors.New("password must be at least 8 characters"))
+				} else {
+					passwordHash, err := bcrypt.GenerateFromPassword([]byte(*form.Password), bcrypt.DefaultCost)
+					if err != nil {
+						apiInternalError(w, r, err)
+						return
+					}
+					u.PasswordHash = passwordHash
+				}
+			}
+			if form.Image != nil {
+				if err := validateImageURL(*form.Image); err != nil {
+					validationErrors = append(validationErrors, err)
+				} else {
+					u.ImageUrl = *form.Image
+				}
+			}
+			if form.Bio != nil {
+				u.Bio = *form.Bio
+			}
+			if len(validationErrors) > 0 {
+				apiError(w, http.StatusUnprocessableEntity, validationErrors...)
+				return
+			}
+
+			if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+				if newEmail != "" {
+					emailUser, err := zz.OnceUserByEmail(tx, newEmail)
+					if err != nil {
+						return fmt.Errorf("failed to get user by email: %w", err)
+					}
+					if emailUser != nil {
+						validationErrors = append(validationErrors, errEmailInUse)
+					}
+				}
+
+				usernameUser, err := zz.OnceUserByUsername(tx, u.Username)
+				if err != nil {
+					return fmt.Errorf("failed to get user by username: %w", err)
+				}
+				if usernameUser != nil && usernameUser.Id != u.Id {
+					validationErrors = append(validationErrors, errors.New("username is already in use"))
+				}
+
+				if len(validationErrors) > 0 {
+					return nil
+				}
+
+				if err := zz.OnceUpdateUser(tx, u); err != nil {
+					return fmt.Errorf("failed to update user: %w", err)
+				}
+				return nil
+			}); err != nil {
+				apiInternalError(w, r, err)
+				return
+			}
+
+			if len(validationErrors) > 0 {
+				apiError(w, http.StatusUnprocessableEntity, validationErrors...)
+				return
+			}
+
+			if newEmail != "" {
+				if err := verifier.Send(r, u, newEmail); err != nil {
+					apiInternalError(w, r, err)
+					return
+				}
+			}
+
+			respondWithUser(w, r, http.StatusOK, u)
+		})
+	})
+}
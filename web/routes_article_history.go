@@ -0,0 +1,203 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/delaneyj/datastar"
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"github.com/go-chi/chi/v5"
+	"zombiezen.com/go/sqlite"
+)
+
+// setupArticleHistoryRoutes adds the revision history of the article resolved
+// by articleRouter. Only the author can see it, earlier revisions may hold
+// things they meant to take down.
+func setupArticleHistoryRoutes(articleRouter chi.Router, db *toolbelt.Database, hub *Hub) {
+	articleRouter.Route("/history", func(historyRouter chi.Router) {
+		historyRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			u, _ := UserFromContext(ctx)
+
+			articleID, _ := ArticleIDFromContext(ctx)
+
+			data := &ArticleHistoryData{}
+			if err := db.ReadTX(ctx, func(tx *sqlite.Conn) (err error) {
+				data.Article, err = zz.OnceReadByIDArticle(tx, articleID)
+				if err != nil {
+					return fmt.Errorf("failed to get article: %w", err)
+				}
+				data.Revisions, err = zz.OnceArticleRevisions(tx, articleID)
+				if err != nil {
+					return fmt.Errorf("failed to get revisions: %w", err)
+				}
+				return nil
+			}); err != nil {
+				http.Error(w, "failed to get article history", http.StatusInternalServerError)
+				return
+			}
+
+			if u == nil || data.Article.AuthorId != u.Id {
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+
+			PageArticleHistory(r, u, data).Render(ctx, w)
+		})
+
+		historyRouter.Get("/diff", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			u, _ := UserFromContext(ctx)
+
+			articleID, _ := ArticleIDFromContext(ctx)
+
+			var fromID, toID int64
+			for name, id := range map[string]*int64{"from": &fromID, "to": &toID} {
+				raw := r.URL.Query().Get(name)
+				if raw == "" {
+					continue
+				}
+				var err error
+				if *id, err = strconv.ParseInt(raw, 10, 64); err != nil {
+					http.Error(w, "invalid revision ID", http.StatusBadRequest)
+					return
+				}
+			}
+
+			data := &ArticleDiffData{
+				Split: r.URL.Query().Get("view") == "split",
+			}
+			if err := db.ReadTX(ctx, func(tx *sqlite.Conn) (err error) {
+				data.Article, err = zz.OnceReadByIDArticle(tx, articleID)
+				if err != nil {
+					return fmt.Errorf("failed to get article: %w", err)
+				}
+				data.Revisions, err = zz.OnceArticleRevisions(tx, articleID)
+				if err != nil {
+					return fmt.Errorf("failed to get revisions: %w", err)
+				}
+				if len(data.Revisions) == 0 {
+					return nil
+				}
+
+				// Without revisions given, show the last change
+				if toID == 0 {
+					toID = data.Revisions[0].Id
+				}
+				if fromID == 0 {
+					fromID = toID
+					for i, revision := range data.Revisions {
+						if revision.Id == toID && i+1 < len(data.Revisions) {
+							fromID = data.Revisions[i+1].Id
+						}
+					}
+				}
+
+				if data.From, err = articleRevision(tx, articleID, fromID); err != nil {
+					return err
+				}
+				data.To, err = articleRevision(tx, articleID, toID)
+				return err
+			}); err != nil {
+				http.Error(w, "failed to get article history", http.StatusInternalServerError)
+				return
+			}
+
+			if u == nil || data.Article.AuthorId != u.Id {
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+			if data.From == nil || data.To == nil {
+				http.Error(w, "revision not found", http.StatusNotFound)
+				return
+			}
+
+			data.Fields = diffRevisions(data.From, data.To)
+			PageArticleDiff(r, u, data).Render(ctx, w)
+		})
+
+		// Restoring saves the old content as a new revision, so it can be
+		// undone like any other edit
+		historyRouter.Post("/{revisionID}/restore", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			u, _ := UserFromContext(ctx)
+
+			if u == nil {
+				http.Error(w, "user required", http.StatusUnauthorized)
+				return
+			}
+
+			articleID, _ := ArticleIDFromContext(ctx)
+			revisionID, err := strconv.ParseInt(chi.URLParam(r, "revisionID"), 10, 64)
+			if err != nil {
+				http.Error(w, "invalid revision ID", http.StatusBadRequest)
+				return
+			}
+
+			sse := datastar.NewSSE(w, r)
+
+			var slug string
+			if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+				article, err := zz.OnceReadByIDArticle(tx, articleID)
+				if err != nil {
+					return fmt.Errorf("failed to get article: %w", err)
+				}
+				if article.AuthorId != u.Id {
+					return errors.New("user is not author")
+				}
+
+				revision, err := articleRevision(tx, articleID, revisionID)
+				if err != nil {
+					return err
+				}
+				if revision == nil {
+					return errors.New("revision not found")
+				}
+
+				bodyHTML, err := RenderMarkdown(revision.Body)
+				if err != nil {
+					return err
+				}
+				if err := setArticleSlug(tx, article, revision.Title); err != nil {
+					return err
+				}
+				slug = article.Slug
+
+				article.Title = revision.Title
+				article.Description = revision.Description
+				article.Body = revision.Body
+				article.BodyHtml = bodyHTML
+				article.UpdatedAt = time.Now()
+
+				if err := zz.UpdateArticle(tx).Run(article); err != nil {
+					return fmt.Errorf("failed to update article: %w", err)
+				}
+				return saveArticleRevision(tx, article, u.Id)
+			}); err != nil {
+				datastar.RenderFragmentTempl(sse, errorMessages(
+					fmt.Errorf("failed to restore revision: %w", err),
+				))
+				return
+			}
+
+			hub.Publish(ArticleTopic(articleID))
+			datastar.Redirect(sse, articlePath(slug))
+		})
+	})
+}
+
+// articleRevision returns nil unless revisionID is a revision of articleID.
+func articleRevision(tx *sqlite.Conn, articleID, revisionID int64) (*zz.ArticleRevisionModel, error) {
+	revision, err := zz.OnceReadByIDArticleRevision(tx, revisionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get revision: %w", err)
+	}
+	if revision == nil || revision.ArticleId != articleID {
+		return nil, nil
+	}
+	return revision, nil
+}
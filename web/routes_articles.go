@@ -1,8 +1,12 @@
 package web
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"path"
 	"slices"
 	"strconv"
 	"strings"
@@ -24,7 +28,22 @@ type CommentData struct {
 	CommenterImageURL string
 }
 
-func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
+type ArticleData struct {
+	Article       *zz.ArticleModel
+	Author        *zz.UserModel
+	FavoriteCount int64
+	IsFollowing   bool
+	IsFavorited   bool
+	Comments      []CommentData
+}
+
+func (d *ArticleData) IsAuthor(u *zz.UserModel) bool {
+	return u != nil && u.Id == d.Article.AuthorId
+}
+
+func setupArticlesRoutes(r chi.Router, db *toolbelt.Database, hub *Hub, requireVerifiedEmail bool) {
+	verifiedRequired := verifiedEmailRequired(requireVerifiedEmail)
+
 	r.Route("/articles", func(articlesRouter chi.Router) {
 
 		articlesRouter.Route("/new", func(editorRouter chi.Router) {
@@ -32,11 +51,11 @@ func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
 				ctx := r.Context()
 				u, _ := UserFromContext(ctx)
 
-				a := &ArticleEditData{}
+				a := &ArticleEditData{Status: ArticlePublished}
 				PageArticleUpsert(r, u, a).Render(r.Context(), w)
 			})
 
-			editorRouter.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			editorRouter.With(verifiedRequired).Post("/", func(w http.ResponseWriter, r *http.Request) {
 				a := &ArticleEditData{}
 				if err := datastar.BodyUnmarshal(r, a); err != nil {
 					http.Error(w, "failed to parse request body", http.StatusBadRequest)
@@ -53,69 +72,29 @@ func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
 
 				sse := datastar.NewSSE(w, r)
 
-				a.Title = strings.TrimSpace(a.Title)
-				a.Description = strings.TrimSpace(a.Description)
-				a.Body = strings.TrimSpace(a.Body)
-
-				var validationErrors []error
-				if a.Title == "" {
-					validationErrors = append(validationErrors, fmt.Errorf("title required"))
-				}
-
-				if a.Description == "" {
-					validationErrors = append(validationErrors, fmt.Errorf("description required"))
-				}
-
-				if a.Body == "" {
-					validationErrors = append(validationErrors, fmt.Errorf("body required"))
+				newArticle := &NewArticle{
+					Title:       a.Title,
+					Description: a.Description,
+					Body:        a.Body,
+					Status:      a.Status,
 				}
+				validationErrors := newArticle.validate()
 
-				tagParts := strings.Split(a.NewTags, " ")
-				possibleTagNames := make(map[string]struct{}, len(tagParts))
-				for _, part := range tagParts {
-					possibleTagName := strings.TrimSpace(part)
-					if possibleTagName == "" {
-						continue
-					}
-					possibleTagNames[possibleTagName] = struct{}{}
+				publishAt, err := a.publishAt()
+				if err != nil {
+					validationErrors = append(validationErrors, err)
 				}
-				tags := make([]*zz.TagModel, 0, len(possibleTagNames))
-
-				if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
-					tagByNameStmt := zz.TagByName(tx)
-
-					for possibleTagName := range possibleTagNames {
-						res, err := tagByNameStmt.Run(possibleTagName)
-						if err != nil {
-							return fmt.Errorf("failed to get tag by name: %w", err)
-						}
-
-						tag := &zz.TagModel{}
-						if res != nil {
-							tag.Id = res.Id
-							tag.Name = res.Name
-						} else {
-							tag.Id = toolbelt.NextID()
-							tag.Name = possibleTagName
-
-							if err := zz.CreateTag(tx).Run(tag); err != nil {
-								return fmt.Errorf("failed to create tag: %w", err)
-							}
-						}
-
-						tags = append(tags, tag)
-					}
+				newArticle.PublishAt = publishAt
 
-					return nil
+				var tags []*zz.TagModel
+				if err := db.WriteTX(ctx, func(tx *sqlite.Conn) (err error) {
+					tags, err = findOrCreateTags(tx, strings.Fields(a.NewTags)...)
+					return err
 				}); err != nil {
 					http.Error(w, "failed to create tags", http.StatusInternalServerError)
 					return
 				}
 				if len(tags) > 0 {
-					slices.SortFunc(tags, func(a, b *zz.TagModel) int {
-						return strings.Compare(a.Name, b.Name)
-					})
-
 					a.NewTags = ""
 					datastar.RenderFragmentTempl(sse, articleEditor(r, a, tags...))
 				}
@@ -125,128 +104,152 @@ func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
 					return
 				}
 
-				// Create article
-				articleID := toolbelt.NextID()
-				if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
-					if err := zz.CreateArticle(tx).Run(&zz.ArticleModel{
-						Id:          articleID,
-						AuthorId:    u.Id,
-						Title:       a.Title,
-						Slug:        toolbelt.Kebab(a.Title),
-						Description: a.Description,
-						Body:        a.Body,
-					}); err != nil {
-						return fmt.Errorf("failed to create article: %w", err)
-					}
-
-					for _, tag := range tags {
-						if err := zz.CreateArticleTag(tx).Run(&zz.ArticleTagModel{
-							Id:        toolbelt.NextID(),
-							ArticleId: articleID,
-							TagId:     tag.Id,
-						}); err != nil {
-							return fmt.Errorf("failed to create article tag: %w", err)
-						}
-					}
+				for _, tag := range tags {
+					newArticle.TagNames = append(newArticle.TagNames, tag.Name)
+				}
 
-					return nil
+				var article *zz.ArticleModel
+				if err := db.WriteTX(ctx, func(tx *sqlite.Conn) (err error) {
+					article, err = createArticle(tx, u.Id, newArticle)
+					return err
 				}); err != nil {
 					datastar.RenderFragmentTempl(sse, errorMessages(
 						fmt.Errorf("failed to create article %w", err),
 					))
 				} else {
-					datastar.Redirect(sse, fmt.Sprintf("/articles/%d", articleID))
+					if article.Status == ArticleScheduled {
+						hub.Publish(ScheduleTopic)
+					}
+					datastar.Redirect(sse, articlePath(article.Slug))
 				}
 			})
 		})
 
-		articlesRouter.Route("/{articleId}", func(articleRouter chi.Router) {
-			articleRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
-				ctx := r.Context()
-				u, _ := UserFromContext(ctx)
-
-				articleIDRaw := chi.URLParam(r, "articleId")
-				articleID, err := strconv.ParseInt(articleIDRaw, 10, 64)
+		// Markdown files with front matter or zips of them as written by the
+		// exports, uploaded as multipart "files"
+		articlesRouter.With(verifiedRequired).Post("/import", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			u, _ := UserFromContext(ctx)
+
+			if u == nil {
+				http.Error(w, "user required", http.StatusUnauthorized)
+				return
+			}
+
+			r.Body = http.MaxBytesReader(w, r.Body, maxArticleZipSize)
+			if err := r.ParseMultipartForm(maxArticleFileSize); err != nil {
+				http.Error(w, "failed to parse upload", http.StatusBadRequest)
+				return
+			}
+			defer r.MultipartForm.RemoveAll()
+
+			var (
+				files   []*ArticleFile
+				results []ArticleImportResult
+			)
+			for _, header := range r.MultipartForm.File["files"] {
+				data, err := readUpload(header)
 				if err != nil {
-					http.Error(w, "invalid article ID", http.StatusBadRequest)
-					return
+					results = append(results, ArticleImportResult{File: header.Filename, Error: err.Error()})
+					continue
 				}
 
-				var (
-					author                   *zz.UserModel
-					article                  *zz.ArticleModel
-					favoriteCount            int64
-					comments                 []CommentData
-					isFollowing, isFavorited bool
-				)
-				if err := db.ReadTX(ctx, func(tx *sqlite.Conn) error {
-					article, err = zz.OnceReadByIDArticle(tx, articleID)
-					if err != nil {
-						return fmt.Errorf("failed to get article: %w", err)
-					}
+				if !strings.EqualFold(path.Ext(header.Filename), ".zip") {
+					files = append(files, &ArticleFile{Name: header.Filename, Data: data})
+					continue
+				}
+				zipped, err := ArticleFilesFromZip(header.Filename, data)
+				if err != nil {
+					results = append(results, ArticleImportResult{File: header.Filename, Error: err.Error()})
+					continue
+				}
+				files = append(files, zipped...)
+			}
+			if len(files) == 0 && len(results) == 0 {
+				http.Error(w, "no files uploaded", http.StatusBadRequest)
+				return
+			}
+
+			results = append(results, ImportArticles(ctx, db, u.Id, files)...)
+			apiJSON(w, http.StatusOK, map[string]any{"results": results})
+		})
 
-					author, err = zz.OnceReadByIDUser(tx, article.AuthorId)
-					if err != nil {
-						return fmt.Errorf("failed to get author: %w", err)
-					}
+		articlesRouter.With(articleResolver(db)).Get("/{articleSlug}.md", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			articleID, _ := ArticleIDFromContext(ctx)
 
-					favoriteCount, err = zz.OnceArticleFavoriteCount(tx, articleID)
-					if err != nil {
-						return fmt.Errorf("failed to get favorite count: %w", err)
-					}
+			var file *ArticleFile
+			if err := db.ReadTX(ctx, func(tx *sqlite.Conn) error {
+				article, err := zz.OnceReadByIDArticle(tx, articleID)
+				if err != nil {
+					return fmt.Errorf("failed to get article: %w", err)
+				}
+				file, err = ArticleMarkdown(tx, article)
+				return err
+			}); err != nil {
+				http.Error(w, "failed to export article", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file.Name))
+			w.Write(file.Data)
+		})
 
-					commentsRaw, err := zz.OnceArticleComments(tx, articleID)
-					if err != nil {
-						return fmt.Errorf("failed to get comments: %w", err)
-					}
-
-					comments = make([]CommentData, len(commentsRaw))
-					for i, c := range commentsRaw {
-						comments[i] = CommentData{
-							ID:                c.CommentId,
-							Body:              c.Body,
-							At:                c.CreatedAt,
-							CommenterId:       c.CommenterId,
-							CommenterUsername: c.CommenterName,
-							CommenterImageURL: c.CommenterImage,
-						}
-					}
+		articlesRouter.Route("/{articleSlug}", func(articleRouter chi.Router) {
+			articleRouter.Use(articleResolver(db))
+			setupArticleHistoryRoutes(articleRouter, db, hub)
 
-					if u != nil {
-						isFollowing, err = zz.OnceIsUserFollowing(tx, zz.IsUserFollowingParams{
-							UserId:    u.Id,
-							FollowsId: author.Id,
-						})
-						if err != nil {
-							return fmt.Errorf("failed to check if user is following: %w", err)
-						}
+			articleRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				ctx := r.Context()
+				u, _ := UserFromContext(ctx)
 
-						isFavorited, err = zz.OnceHasUserFavorited(tx, zz.HasUserFavoritedParams{
-							UserId:    u.Id,
-							ArticleId: articleID,
-						})
-						if err != nil {
-							return fmt.Errorf("failed to check if article is favorited: %w", err)
-						}
-					}
+				articleID, _ := ArticleIDFromContext(r.Context())
 
-					return nil
+				var data *ArticleData
+				if err := db.ReadTX(ctx, func(tx *sqlite.Conn) (err error) {
+					data, err = readArticleData(tx, u, articleID)
+					return err
 				}); err != nil {
 					http.Error(w, "failed to get article", http.StatusInternalServerError)
 					return
 				}
 
-				if article == nil {
+				if data == nil {
 					http.Error(w, "article not found", http.StatusNotFound)
 					return
 				}
+				article := data.Article
+
+				// Articles written before bodies were rendered have no cached
+				// HTML yet, fill it in the first time they are viewed.
+				if article.BodyHtml == "" && article.Body != "" {
+					bodyHTML, err := RenderMarkdown(article.Body)
+					if err != nil {
+						http.Error(w, "failed to render article", http.StatusInternalServerError)
+						return
+					}
+					article.BodyHtml = bodyHTML
+
+					if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+						if err := zz.OnceUpdateArticleBodyHtml(tx, zz.UpdateArticleBodyHtmlParams{
+							BodyHtml:  article.BodyHtml,
+							ArticleId: article.Id,
+						}); err != nil {
+							return fmt.Errorf("failed to update article body: %w", err)
+						}
+						return nil
+					}); err != nil {
+						http.Error(w, "failed to update article", http.StatusInternalServerError)
+						return
+					}
+				}
 
-				PageArticle(
-					r, u, author, article, favoriteCount,
-					isFollowing, isFavorited, comments...,
-				).Render(r.Context(), w)
+				PageArticle(r, u, data).Render(r.Context(), w)
 			})
 
+			articleRouter.Get("/updates", articleUpdates(db, hub))
+
 			articleRouter.Delete("/", func(w http.ResponseWriter, r *http.Request) {
 				ctx := r.Context()
 				u, _ := UserFromContext(ctx)
@@ -256,12 +259,7 @@ func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
 					return
 				}
 
-				articleIDRaw := chi.URLParam(r, "articleId")
-				articleID, err := strconv.ParseInt(articleIDRaw, 10, 64)
-				if err != nil {
-					http.Error(w, "invalid article ID", http.StatusBadRequest)
-					return
-				}
+				articleID, _ := ArticleIDFromContext(r.Context())
 
 				if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
 					article, err := zz.OnceReadByIDArticle(tx, articleID)
@@ -292,12 +290,7 @@ func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
 					ctx := r.Context()
 					u, _ := UserFromContext(ctx)
 
-					articleIDRaw := chi.URLParam(r, "articleId")
-					articleID, err := strconv.ParseInt(articleIDRaw, 10, 64)
-					if err != nil {
-						http.Error(w, "invalid article ID", http.StatusBadRequest)
-						return
-					}
+					articleID, _ := ArticleIDFromContext(r.Context())
 
 					var (
 						article *zz.ArticleModel
@@ -306,7 +299,7 @@ func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
 					articleEditData := &ArticleEditData{}
 
 					isUserAuthor := false
-					if err := db.ReadTX(ctx, func(tx *sqlite.Conn) error {
+					if err := db.ReadTX(ctx, func(tx *sqlite.Conn) (err error) {
 						article, err = zz.OnceReadByIDArticle(tx, articleID)
 						if err != nil {
 							return fmt.Errorf("failed to get article: %w", err)
@@ -321,6 +314,10 @@ func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
 						articleEditData.Title = article.Title
 						articleEditData.Description = article.Description
 						articleEditData.Body = article.Body
+						articleEditData.Status = article.Status
+						if article.Status == ArticleScheduled {
+							articleEditData.PublishAt = article.PublishedAt.Local().Format(publishAtLayout)
+						}
 
 						res, err := zz.OnceTagsForArticle(tx, articleID)
 						if err != nil {
@@ -347,7 +344,7 @@ func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
 					PageArticleUpsert(r, u, articleEditData, tags...).Render(r.Context(), w)
 				})
 
-				editRouter.Post("/", func(w http.ResponseWriter, r *http.Request) {
+				editRouter.With(verifiedRequired).Post("/", func(w http.ResponseWriter, r *http.Request) {
 					a := &ArticleEditData{}
 					if err := datastar.BodyUnmarshal(r, a); err != nil {
 						http.Error(w, "failed to parse request body", http.StatusBadRequest)
@@ -364,82 +361,45 @@ func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
 
 					sse := datastar.NewSSE(w, r)
 
-					a.Title = strings.TrimSpace(a.Title)
-					a.Description = strings.TrimSpace(a.Description)
-					a.Body = strings.TrimSpace(a.Body)
-
-					var validationErrors []error
-					if a.Title == "" {
-						validationErrors = append(validationErrors, fmt.Errorf("title required"))
-					}
-
-					if a.Description == "" {
-						validationErrors = append(validationErrors, fmt.Errorf("description required"))
-					}
-
-					if a.Body == "" {
-						validationErrors = append(validationErrors, fmt.Errorf("body required"))
+					edited := &NewArticle{
+						Title:       a.Title,
+						Description: a.Description,
+						Body:        a.Body,
 					}
+					validationErrors := edited.validate()
+					a.Title, a.Description, a.Body = edited.Title, edited.Description, edited.Body
 
-					tagParts := strings.Split(a.NewTags, " ")
-					possibleTagNames := make(map[string]struct{}, len(tagParts))
-					for _, part := range tagParts {
-						possibleTagName := strings.TrimSpace(part)
-						if possibleTagName == "" {
-							continue
-						}
-						possibleTagNames[possibleTagName] = struct{}{}
+					publishAt, err := a.publishAt()
+					if err != nil {
+						validationErrors = append(validationErrors, err)
 					}
-					tags := make([]*zz.TagModel, 0, len(possibleTagNames))
 
-					if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
-						tagByNameStmt := zz.TagByName(tx)
-
-						for possibleTagName := range possibleTagNames {
-							res, err := tagByNameStmt.Run(possibleTagName)
-							if err != nil {
-								return fmt.Errorf("failed to get tag by name: %w", err)
-							}
-
-							tag := &zz.TagModel{}
-							if res != nil {
-								tag.Id = res.Id
-								tag.Name = res.Name
-							} else {
-								tag.Id = toolbelt.NextID()
-								tag.Name = possibleTagName
-
-								if err := zz.CreateTag(tx).Run(tag); err != nil {
-									return fmt.Errorf("failed to create tag: %w", err)
-								}
-							}
-
-							tags = append(tags, tag)
-						}
-
-						return nil
+					var tags []*zz.TagModel
+					if err := db.WriteTX(ctx, func(tx *sqlite.Conn) (err error) {
+						tags, err = findOrCreateTags(tx, strings.Fields(a.NewTags)...)
+						return err
 					}); err != nil {
 						http.Error(w, "failed to create tags", http.StatusInternalServerError)
 						return
 					}
-					if len(tags) > 0 {
-						slices.SortFunc(tags, func(a, b *zz.TagModel) int {
-							return strings.Compare(a.Name, b.Name)
-						})
-					}
 
 					if len(validationErrors) > 0 {
 						datastar.RenderFragmentTempl(sse, errorMessages(validationErrors...))
 						return
 					}
 
-					articleIDRaw := chi.URLParam(r, "articleId")
-					articleID, err := strconv.ParseInt(articleIDRaw, 10, 64)
+					articleID, _ := ArticleIDFromContext(r.Context())
+
+					bodyHTML, err := RenderMarkdown(a.Body)
 					if err != nil {
-						http.Error(w, "invalid article ID", http.StatusBadRequest)
+						datastar.RenderFragmentTempl(sse, errorMessages(err))
 						return
 					}
 
+					var (
+						slug      string
+						scheduled bool
+					)
 					if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
 						article, err := zz.OnceReadByIDArticle(tx, articleID)
 						if err != nil {
@@ -450,14 +410,32 @@ func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
 							return fmt.Errorf("user is not author")
 						}
 
+						// Links keep working unless the title changes
+						if a.Title != article.Title {
+							if err := setArticleSlug(tx, article, a.Title); err != nil {
+								return err
+							}
+						}
+						slug = article.Slug
+
+						now := time.Now()
+						if err := setArticleStatus(article, a.Status, publishAt, now); err != nil {
+							return err
+						}
+						scheduled = article.Status == ArticleScheduled
+
 						article.Title = a.Title
-						article.Slug = toolbelt.Kebab(a.Title)
 						article.Description = a.Description
 						article.Body = a.Body
+						article.BodyHtml = bodyHTML
+						article.UpdatedAt = now
 
 						if err := zz.UpdateArticle(tx).Run(article); err != nil {
 							return fmt.Errorf("failed to update article: %w", err)
 						}
+						if err := saveArticleRevision(tx, article, u.Id); err != nil {
+							return err
+						}
 
 						for _, tag := range tags {
 							if err := zz.CreateArticleTag(tx).Run(&zz.ArticleTagModel{
@@ -476,7 +454,10 @@ func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
 							fmt.Errorf("failed to update article %w", err),
 						))
 					} else {
-						datastar.Redirect(sse, fmt.Sprintf("/articles/%d", articleID))
+						if scheduled {
+							hub.Publish(ScheduleTopic)
+						}
+						datastar.Redirect(sse, articlePath(slug))
 					}
 				})
 
@@ -489,12 +470,7 @@ func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
 						return
 					}
 
-					articleIDRaw := chi.URLParam(r, "articleId")
-					articleID, err := strconv.ParseInt(articleIDRaw, 10, 64)
-					if err != nil {
-						http.Error(w, "invalid article ID", http.StatusBadRequest)
-						return
-					}
+					articleID, _ := ArticleIDFromContext(r.Context())
 
 					tagIDRaw := chi.URLParam(r, "tagId")
 					tagID, err := strconv.ParseInt(tagIDRaw, 10, 64)
@@ -505,11 +481,13 @@ func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
 
 					sse := datastar.NewSSE(w, r)
 
+					var slug string
 					if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
 						article, err := zz.OnceReadByIDArticle(tx, articleID)
 						if err != nil {
 							return fmt.Errorf("failed to get article: %w", err)
 						}
+						slug = article.Slug
 
 						if article.AuthorId != u.Id {
 							return fmt.Errorf("user is not author")
@@ -529,7 +507,158 @@ func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
 						))
 					}
 
-					datastar.Redirect(sse, fmt.Sprintf("/articles/%d/edit", articleID))
+					datastar.Redirect(sse, articlePath(slug)+"/edit")
+				})
+			})
+
+			articleRouter.Route("/comments", func(commentsRouter chi.Router) {
+				commentsRouter.With(verifiedRequired).Post("/", func(w http.ResponseWriter, r *http.Request) {
+					ctx := r.Context()
+					u, _ := UserFromContext(ctx)
+
+					if u == nil {
+						http.Error(w, "user required", http.StatusUnauthorized)
+						return
+					}
+
+					articleID, _ := ArticleIDFromContext(r.Context())
+
+					form := &CommentForm{}
+					if err := datastar.BodyUnmarshal(r, form); err != nil {
+						http.Error(w, "failed to parse request body", http.StatusBadRequest)
+						return
+					}
+
+					sse := datastar.NewSSE(w, r)
+
+					form.Comment = strings.TrimSpace(form.Comment)
+					if form.Comment == "" {
+						datastar.RenderFragmentTempl(sse, errorMessages(fmt.Errorf("comment required")))
+						return
+					}
+
+					var (
+						comment     *zz.CommentModel
+						articleSlug string
+					)
+					if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+						article, err := zz.OnceReadByIDArticle(tx, articleID)
+						if err != nil {
+							return fmt.Errorf("failed to get article: %w", err)
+						}
+						if article == nil {
+							return fmt.Errorf("article not found")
+						}
+						articleSlug = article.Slug
+
+						now := time.Now()
+						comment = &zz.CommentModel{
+							Id:        toolbelt.NextID(),
+							Body:      form.Comment,
+							CreatedAt: now,
+							UpdatedAt: now,
+							AuthorId:  u.Id,
+							ArticleId: articleID,
+						}
+						if err := zz.OnceCreateComment(tx, comment); err != nil {
+							return fmt.Errorf("failed to create comment: %w", err)
+						}
+
+						return nil
+					}); err != nil {
+						datastar.RenderFragmentTempl(sse, errorMessages(
+							fmt.Errorf("failed to post comment %w", err),
+						))
+						return
+					}
+
+					hub.Publish(ArticleTopic(articleID))
+
+					datastar.RenderFragmentTempl(sse, errorMessages())
+					datastar.PatchStore(sse, &CommentForm{})
+					datastar.RenderFragmentTempl(
+						sse,
+						articleComment(articleSlug, CommentData{
+							ID:                comment.Id,
+							Body:              comment.Body,
+							At:                comment.CreatedAt,
+							CommenterId:       u.Id,
+							CommenterUsername: u.Username,
+							CommenterImageURL: u.ImageUrl,
+						}, true),
+						datastar.WithQuerySelectorID("comments"),
+						datastar.WithMergePrependElement(),
+					)
+				})
+
+				commentsRouter.Delete("/{commentId}", func(w http.ResponseWriter, r *http.Request) {
+					ctx := r.Context()
+					u, _ := UserFromContext(ctx)
+
+					if u == nil {
+						http.Error(w, "user required", http.StatusUnauthorized)
+						return
+					}
+
+					articleID, _ := ArticleIDFromContext(r.Context())
+
+					commentIDRaw := chi.URLParam(r, "commentId")
+					commentID, err := strconv.ParseInt(commentIDRaw, 10, 64)
+					if err != nil {
+						http.Error(w, "invalid comment ID", http.StatusBadRequest)
+						return
+					}
+
+					var (
+						found      bool
+						authorized bool
+					)
+					if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+						comment, err := zz.OnceReadByIDComment(tx, commentID)
+						if err != nil {
+							return fmt.Errorf("failed to get comment: %w", err)
+						}
+						if comment == nil || comment.ArticleId != articleID {
+							return nil
+						}
+						found = true
+
+						// Comments can be removed by whoever wrote them or by the
+						// author of the article they were left on.
+						authorized = comment.AuthorId == u.Id
+						if !authorized {
+							article, err := zz.OnceReadByIDArticle(tx, articleID)
+							if err != nil {
+								return fmt.Errorf("failed to get article: %w", err)
+							}
+							authorized = article != nil && article.AuthorId == u.Id
+						}
+						if !authorized {
+							return nil
+						}
+
+						if err := zz.OnceDeleteComment(tx, commentID); err != nil {
+							return fmt.Errorf("failed to delete comment: %w", err)
+						}
+						return nil
+					}); err != nil {
+						http.Error(w, "failed to delete comment", http.StatusInternalServerError)
+						return
+					}
+
+					if !found {
+						http.Error(w, "comment not found", http.StatusNotFound)
+						return
+					}
+					if !authorized {
+						http.Error(w, "user is not allowed to delete comment", http.StatusForbidden)
+						return
+					}
+
+					hub.Publish(ArticleTopic(articleID))
+
+					sse := datastar.NewSSE(w, r)
+					datastar.Delete(sse, fmt.Sprintf("#comment-%d", commentID))
 				})
 			})
 
@@ -543,12 +672,7 @@ func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
 						return
 					}
 
-					articleIDRaw := chi.URLParam(r, "articleId")
-					articleID, err := strconv.ParseInt(articleIDRaw, 10, 64)
-					if err != nil {
-						http.Error(w, "invalid article ID", http.StatusBadRequest)
-						return
-					}
+					articleID, _ := ArticleIDFromContext(r.Context())
 
 					if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
 						alreadyFavorited, err := zz.OnceHasUserFavorited(tx, zz.HasUserFavoritedParams{
@@ -576,11 +700,11 @@ func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
 						return
 					}
 
-					sse := datastar.NewSSE(w, r)
+					hub.Publish(ArticleTopic(articleID))
 
-					from := r.URL.Query().Get("from")
-					if from != "" {
-						datastar.Redirect(sse, from)
+					sse := datastar.NewSSE(w, r)
+					if err := renderArticleUpdates(ctx, db, sse, me, articleID); err != nil {
+						datastar.RenderFragmentTempl(sse, errorMessages(err))
 					}
 				})
 
@@ -593,12 +717,7 @@ func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
 						return
 					}
 
-					articleIDRaw := chi.URLParam(r, "articleId")
-					articleID, err := strconv.ParseInt(articleIDRaw, 10, 64)
-					if err != nil {
-						http.Error(w, "invalid article ID", http.StatusBadRequest)
-						return
-					}
+					articleID, _ := ArticleIDFromContext(r.Context())
 
 					if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
 						if err := zz.OnceDeleteFavoritedArticle(tx, zz.DeleteFavoritedArticleParams{
@@ -613,14 +732,303 @@ func setupArticlesRoutes(r chi.Router, db *toolbelt.Database) {
 						return
 					}
 
-					sse := datastar.NewSSE(w, r)
+					hub.Publish(ArticleTopic(articleID))
 
-					from := r.URL.Query().Get("from")
-					if from != "" {
-						datastar.Redirect(sse, from)
+					sse := datastar.NewSSE(w, r)
+					if err := renderArticleUpdates(ctx, db, sse, me, articleID); err != nil {
+						datastar.RenderFragmentTempl(sse, errorMessages(err))
 					}
 				})
 			})
 		})
 	})
 }
+
+// NewArticle is an article about to be created from the editor, the API or an
+// imported Markdown file.
+type NewArticle struct {
+	Title       string
+	Description string
+	Body        string
+	TagNames    []string
+
+	// CreatedAt and UpdatedAt default to now, imports keep their original
+	// times
+	CreatedAt time.Time
+	UpdatedAt time.Time
+
+	// Status defaults to published, PublishAt is when a scheduled article
+	// goes live or when an imported one first did
+	Status    string
+	PublishAt time.Time
+}
+
+func (a *NewArticle) validate() []error {
+	a.Title = strings.TrimSpace(a.Title)
+	a.Description = strings.TrimSpace(a.Description)
+	a.Body = strings.TrimSpace(a.Body)
+
+	var validationErrors []error
+	if a.Title == "" {
+		validationErrors = append(validationErrors, fmt.Errorf("title required"))
+	}
+	if a.Description == "" {
+		validationErrors = append(validationErrors, fmt.Errorf("description required"))
+	}
+	if a.Body == "" {
+		validationErrors = append(validationErrors, fmt.Errorf("body required"))
+	}
+	return validationErrors
+}
+
+// createArticle renders and saves a validated article for authorID, creating
+// any of its tags that don't exist yet.
+func createArticle(tx *sqlite.Conn, authorID int64, a *NewArticle) (*zz.ArticleModel, error) {
+	bodyHTML, err := RenderMarkdown(a.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := findOrCreateTags(tx, a.TagNames...)
+	if err != nil {
+		return nil, err
+	}
+
+	articleID := toolbelt.NextID()
+	slug, err := uniqueArticleSlug(tx, articleID, a.Title)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	article := &zz.ArticleModel{
+		Id:          articleID,
+		AuthorId:    authorID,
+		Title:       a.Title,
+		Slug:        slug,
+		Description: a.Description,
+		Body:        a.Body,
+		BodyHtml:    bodyHTML,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if !a.CreatedAt.IsZero() {
+		article.CreatedAt = a.CreatedAt
+	}
+	if !a.UpdatedAt.IsZero() {
+		article.UpdatedAt = a.UpdatedAt
+	}
+	if err := setArticleStatus(article, a.Status, a.PublishAt, now); err != nil {
+		return nil, err
+	}
+	if article.Status == ArticlePublished {
+		article.PublishedAt = article.CreatedAt
+		if !a.PublishAt.IsZero() {
+			article.PublishedAt = a.PublishAt
+		}
+	}
+	if err := zz.CreateArticle(tx).Run(article); err != nil {
+		return nil, fmt.Errorf("failed to create article: %w", err)
+	}
+	if err := saveArticleRevision(tx, article, authorID); err != nil {
+		return nil, err
+	}
+
+	createArticleTagStmt := zz.CreateArticleTag(tx)
+	for _, tag := range tags {
+		if err := createArticleTagStmt.Run(&zz.ArticleTagModel{
+			Id:        toolbelt.NextID(),
+			ArticleId: article.Id,
+			TagId:     tag.Id,
+		}); err != nil {
+			return nil, fmt.Errorf("failed to create article tag: %w", err)
+		}
+	}
+
+	return article, nil
+}
+
+// findOrCreateTags returns the tags named, sorted by name, creating the ones
+// that don't exist yet. Names are trimmed and blank or repeated ones skipped.
+func findOrCreateTags(tx *sqlite.Conn, names ...string) ([]*zz.TagModel, error) {
+	tagByNameStmt := zz.TagByName(tx)
+	createTagStmt := zz.CreateTag(tx)
+
+	tags := make([]*zz.TagModel, 0, len(names))
+	seen := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+
+		res, err := tagByNameStmt.Run(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get tag by name: %w", err)
+		}
+
+		tag := &zz.TagModel{}
+		if res != nil {
+			tag.Id = res.Id
+			tag.Name = res.Name
+		} else {
+			tag.Id = toolbelt.NextID()
+			tag.Name = name
+
+			if err := createTagStmt.Run(tag); err != nil {
+				return nil, fmt.Errorf("failed to create tag: %w", err)
+			}
+		}
+
+		tags = append(tags, tag)
+	}
+
+	slices.SortFunc(tags, func(a, b *zz.TagModel) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return tags, nil
+}
+
+// readArticleData loads everything the article page shows for viewer u,
+// returning nil if the article doesn't exist.
+func readArticleData(tx *sqlite.Conn, u *zz.UserModel, articleID int64) (*ArticleData, error) {
+	article, err := zz.OnceReadByIDArticle(tx, articleID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get article: %w", err)
+	}
+	if article == nil {
+		return nil, nil
+	}
+	data := &ArticleData{Article: article}
+
+	data.Author, err = zz.OnceReadByIDUser(tx, article.AuthorId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get author: %w", err)
+	}
+
+	data.FavoriteCount, err = zz.OnceArticleFavoriteCount(tx, articleID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get favorite count: %w", err)
+	}
+
+	commentsRaw, err := zz.OnceArticleComments(tx, articleID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get comments: %w", err)
+	}
+
+	data.Comments = make([]CommentData, len(commentsRaw))
+	for i, c := range commentsRaw {
+		data.Comments[i] = CommentData{
+			ID:                c.CommentId,
+			Body:              c.Body,
+			At:                c.CreatedAt,
+			CommenterId:       c.CommenterId,
+			CommenterUsername: c.CommenterName,
+			CommenterImageURL: c.CommenterImage,
+		}
+	}
+
+	if u != nil {
+		data.IsFollowing, err = zz.OnceIsUserFollowing(tx, zz.IsUserFollowingParams{
+			UserId:    u.Id,
+			FollowsId: article.AuthorId,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to check if user is following: %w", err)
+		}
+
+		data.IsFavorited, err = zz.OnceHasUserFavorited(tx, zz.HasUserFavoritedParams{
+			UserId:    u.Id,
+			ArticleId: articleID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to check if article is favorited: %w", err)
+		}
+	}
+
+	return data, nil
+}
+
+// articleUpdates streams fresh fragments of the article in the context to
+// its page whenever it, its comments or its author change.
+func articleUpdates(db *toolbelt.Database, hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		u, _ := UserFromContext(ctx)
+
+		articleID, _ := ArticleIDFromContext(r.Context())
+
+		var article *zz.ArticleModel
+		if err := db.ReadTX(ctx, func(tx *sqlite.Conn) (err error) {
+			article, err = zz.OnceReadByIDArticle(tx, articleID)
+			if err != nil {
+				return fmt.Errorf("failed to get article: %w", err)
+			}
+			return nil
+		}); err != nil {
+			http.Error(w, "failed to get article", http.StatusInternalServerError)
+			return
+		}
+		// Deleted since it was looked up by slug
+		if article == nil {
+			http.Error(w, "article not found", http.StatusNotFound)
+			return
+		}
+
+		updates, unsubscribe := hub.Subscribe(ArticleTopic(articleID), UserTopic(article.AuthorId))
+		defer unsubscribe()
+
+		sse := datastar.NewSSE(w, r)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-updates:
+				if err := renderArticleUpdates(ctx, db, sse, u, articleID); err != nil {
+					datastar.RenderFragmentTempl(sse, errorMessages(err))
+					return
+				}
+			}
+		}
+	}
+}
+
+// renderArticleUpdates merges the live parts of the article page, as seen by
+// u, into an open page.
+func renderArticleUpdates(ctx context.Context, db *toolbelt.Database, sse *datastar.ServerSentEventsHandler, u *zz.UserModel, articleID int64) error {
+	var data *ArticleData
+	if err := db.ReadTX(ctx, func(tx *sqlite.Conn) (err error) {
+		data, err = readArticleData(tx, u, articleID)
+		return err
+	}); err != nil {
+		return err
+	}
+	if data == nil {
+		datastar.Redirect(sse, "/")
+		return nil
+	}
+
+	datastar.RenderFragmentTempl(sse, articleMetadata("articleMetaBanner", u, data))
+	datastar.RenderFragmentTempl(sse, articleMetadata("articleMetaActions", u, data))
+	datastar.RenderFragmentTempl(sse, articleComments(u, data))
+	return nil
+}
+
+func readUpload(header *multipart.FileHeader) ([]byte, error) {
+	f, err := header.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload: %w", err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload: %w", err)
+	}
+	return data, nil
+}
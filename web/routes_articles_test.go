@@ -0,0 +1,161 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type apiCommentsResponse struct {
+	Comments []apiComment `json:"comments"`
+}
+
+func apiArticleComments(t *testing.T, ts *testServer, slug string) []apiComment {
+	t.Helper()
+
+	res := apiCommentsResponse{}
+	if status := ts.api(t, http.MethodGet, "/api/articles/"+slug+"/comments", "", nil, &res); status != http.StatusOK {
+		t.Fatalf("listing comments: got status %d", status)
+	}
+	return res.Comments
+}
+
+func TestEditorTags(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "jake")
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+
+	_, body := ts.datastar(t, jake, http.MethodPost, "/articles/new", ArticleEditData{
+		Title:       "Dragons",
+		Description: "About dragons",
+		Body:        "All about dragons",
+		NewTags:     " training  dragons training ",
+		Status:      ArticlePublished,
+	})
+	if !strings.Contains(body, "redirect "+articlePath("dragons")) {
+		t.Fatalf("creating: %s", body)
+	}
+	res := apiArticleResponse{}
+	ts.api(t, http.MethodGet, "/api/articles/dragons", "", nil, &res)
+	if !slices.Equal(res.Article.TagList, []string{"dragons", "training"}) {
+		t.Errorf("got tags %v", res.Article.TagList)
+	}
+
+	// Tags are added to the ones the article has
+	_, body = ts.datastar(t, jake, http.MethodPost, articlePath("dragons")+"/edit", ArticleEditData{
+		Title:       "Dragons",
+		Description: "About dragons",
+		Body:        "All about dragons",
+		NewTags:     "flying dragons",
+		Status:      ArticlePublished,
+	})
+	if !strings.Contains(body, "redirect "+articlePath("dragons")) {
+		t.Fatalf("editing: %s", body)
+	}
+	ts.api(t, http.MethodGet, "/api/articles/dragons", "", nil, &res)
+	if !slices.Equal(res.Article.TagList, []string{"dragons", "flying", "training"}) {
+		t.Errorf("got tags %v after editing", res.Article.TagList)
+	}
+}
+
+func TestPostComment(t *testing.T) {
+	ts := newTestServer(t)
+	_, authorToken := ts.register(t, "jake")
+	ts.register(t, "jane")
+	article := createAPIArticle(t, ts, authorToken, "Dragons")
+
+	jane := ts.browser(t)
+	ts.signIn(t, jane, "jane")
+
+	status, body := ts.datastar(t, jane, http.MethodPost, "/articles/"+article.Slug+"/comments", CommentForm{Comment: "  Nice dragons  "})
+	if status != http.StatusOK {
+		t.Fatalf("got status %d: %s", status, body)
+	}
+	comments := apiArticleComments(t, ts, article.Slug)
+	if len(comments) != 1 {
+		t.Fatalf("got %d comments, want 1", len(comments))
+	}
+	if comments[0].Body != "Nice dragons" || comments[0].Author.Username != "jane" {
+		t.Errorf("got %q by %s", comments[0].Body, comments[0].Author.Username)
+	}
+	if !strings.Contains(body, fmt.Sprintf("comment-%d", comments[0].Id)) {
+		t.Errorf("response doesn't add the comment: %s", body)
+	}
+}
+
+func TestPostCommentValidation(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+	article := createAPIArticle(t, ts, token, "Dragons")
+
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+
+	_, body := ts.datastar(t, jake, http.MethodPost, "/articles/"+article.Slug+"/comments", CommentForm{Comment: " "})
+	if !strings.Contains(body, "comment required") {
+		t.Errorf("response doesn't say the comment is required: %s", body)
+	}
+	if comments := apiArticleComments(t, ts, article.Slug); len(comments) != 0 {
+		t.Errorf("got %d comments, want none", len(comments))
+	}
+
+	anonymous := ts.browser(t)
+	if status, _ := ts.datastar(t, anonymous, http.MethodPost, "/articles/"+article.Slug+"/comments", CommentForm{Comment: "hi"}); status != http.StatusUnauthorized {
+		t.Errorf("got status %d signed out, want %d", status, http.StatusUnauthorized)
+	}
+	if status, _ := ts.datastar(t, jake, http.MethodPost, "/articles/nope/comments", CommentForm{Comment: "hi"}); status != http.StatusNotFound {
+		t.Errorf("got status %d for a missing article, want %d", status, http.StatusNotFound)
+	}
+}
+
+func TestDeleteComment(t *testing.T) {
+	ts := newTestServer(t)
+	_, authorToken := ts.register(t, "jake")
+	ts.register(t, "jane")
+	ts.register(t, "joe")
+	article := createAPIArticle(t, ts, authorToken, "Dragons")
+
+	jake, jane, joe := ts.browser(t), ts.browser(t), ts.browser(t)
+	ts.signIn(t, jake, "jake")
+	ts.signIn(t, jane, "jane")
+	ts.signIn(t, joe, "joe")
+
+	commentsPath := "/articles/" + article.Slug + "/comments"
+	ts.datastar(t, jane, http.MethodPost, commentsPath, CommentForm{Comment: "first"})
+	ts.datastar(t, jane, http.MethodPost, commentsPath, CommentForm{Comment: "second"})
+	comments := apiArticleComments(t, ts, article.Slug)
+	if len(comments) != 2 {
+		t.Fatalf("got %d comments, want 2", len(comments))
+	}
+	commentPath := func(c apiComment) string {
+		return fmt.Sprintf("%s/%d", commentsPath, c.Id)
+	}
+
+	if status, _ := ts.datastar(t, ts.browser(t), http.MethodDelete, commentPath(comments[0]), nil); status != http.StatusUnauthorized {
+		t.Errorf("signed out: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+	// Neither the commenter nor the article's author
+	if status, _ := ts.datastar(t, joe, http.MethodDelete, commentPath(comments[0]), nil); status != http.StatusForbidden {
+		t.Errorf("someone else: got status %d, want %d", status, http.StatusForbidden)
+	}
+	if status, _ := ts.datastar(t, jane, http.MethodDelete, commentsPath+"/1", nil); status != http.StatusNotFound {
+		t.Errorf("missing comment: got status %d, want %d", status, http.StatusNotFound)
+	}
+
+	status, body := ts.datastar(t, jane, http.MethodDelete, commentPath(comments[0]), nil)
+	if status != http.StatusOK {
+		t.Fatalf("commenter: got status %d: %s", status, body)
+	}
+	if !strings.Contains(body, fmt.Sprintf("#comment-%d", comments[0].Id)) {
+		t.Errorf("response doesn't remove the comment: %s", body)
+	}
+	if status, _ := ts.datastar(t, jake, http.MethodDelete, commentPath(comments[1]), nil); status != http.StatusOK {
+		t.Errorf("article author: got status %d, want %d", status, http.StatusOK)
+	}
+	if comments := apiArticleComments(t, ts, article.Slug); len(comments) != 0 {
+		t.Errorf("got %d comments left, want none", len(comments))
+	}
+}
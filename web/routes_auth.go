@@ -3,8 +3,10 @@ package web
 import (
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/delaneyj/datastar"
 	"github.com/delaneyj/realworld-datastar/sql/zz"
@@ -15,9 +17,14 @@ import (
 	"zombiezen.com/go/sqlite"
 )
 
-func setupAuthRoutes(r chi.Router, db *toolbelt.Database, sessionStore sessions.Store) {
+func setupAuthRoutes(r chi.Router, db *toolbelt.Database, sessionStore sessions.Store, mailer Mailer, baseURL string, resetExpiry time.Duration, verifier *EmailVerifier, providers []*OIDCProvider, throttle *LoginThrottle) {
 
 	r.Route("/auth", func(authRouter chi.Router) {
+		setupPasswordResetRoutes(authRouter, db, mailer, baseURL, resetExpiry)
+		setupEmailVerificationRoutes(authRouter, db, verifier)
+		setupTwoFactorLoginRoutes(authRouter, db, sessionStore, throttle)
+		setupOIDCRoutes(authRouter, db, sessionStore, providers, baseURL, verifier)
+
 		authRouter.Post("/logout", func(w http.ResponseWriter, r *http.Request) {
 			sess, err := sessionStore.Get(r, "conduit")
 			if err != nil {
@@ -26,6 +33,8 @@ func setupAuthRoutes(r chi.Router, db *toolbelt.Database, sessionStore sessions.
 			}
 
 			delete(sess.Values, "userID")
+			delete(sess.Values, "sessionVersion")
+			delete(sess.Values, "twoFactorUserID")
 			if err := sess.Save(r, w); err != nil {
 				http.Error(w, "failed to save session", http.StatusInternalServerError)
 				return
@@ -42,7 +51,7 @@ func setupAuthRoutes(r chi.Router, db *toolbelt.Database, sessionStore sessions.
 					return
 				}
 
-				PageAuthenticationLogin(r, nil).Render(r.Context(), w)
+				PageAuthenticationLogin(r, nil, providers).Render(r.Context(), w)
 			})
 
 			loginRouter.Post("/", func(w http.ResponseWriter, r *http.Request) {
@@ -56,34 +65,62 @@ func setupAuthRoutes(r chi.Router, db *toolbelt.Database, sessionStore sessions.
 					http.Error(w, "failed to parse request body", http.StatusBadRequest)
 					return
 				}
+				form.Email = strings.TrimSpace(form.Email)
 
-				var res *zz.UserByEmailRes
-				err := db.ReadTX(r.Context(), func(tx *sqlite.Conn) (err error) {
+				var locked *LoginLockedError
+				attemptID, err := throttle.Attempt(r, form.Email)
+				if errors.As(err, &locked) {
+					sse := datastar.NewSSE(w, r)
+					datastar.RenderFragmentTempl(sse, errorMessages(locked))
+					return
+				}
+				if err != nil {
+					http.Error(w, "failed to record login attempt", http.StatusInternalServerError)
+					return
+				}
+
+				var (
+					res       *zz.UserByEmailRes
+					needsCode bool
+				)
+				err = db.ReadTX(r.Context(), func(tx *sqlite.Conn) (err error) {
 					res, err = zz.OnceUserByEmail(tx, form.Email)
 					if err != nil {
 						return fmt.Errorf("failed to get user by email: %w", err)
 					}
-					return nil
+					if res != nil {
+						needsCode, err = twoFactorEnabled(tx, res.Id)
+					}
+					return err
 				})
 				if err != nil {
 					http.Error(w, "failed to get user by email", http.StatusInternalServerError)
 					return
 				}
 
-				if res == nil {
-					err = errors.New("user with email not found")
-				} else {
-					err = bcrypt.CompareHashAndPassword(res.PasswordHash, []byte(form.Password))
+				var passwordHash []byte
+				if res != nil {
+					passwordHash = res.PasswordHash
 				}
+				err = checkPassword(passwordHash, form.Password)
 
 				if err == nil {
+					// With two-factor authentication the attempt only
+					// succeeds with the code
+					if !needsCode {
+						if err := throttle.Succeeded(r.Context(), attemptID); err != nil {
+							http.Error(w, "failed to record login attempt", http.StatusInternalServerError)
+							return
+						}
+					}
+
 					sess, err := sessionStore.Get(r, "conduit")
 					if err != nil {
 						http.Error(w, "failed to get session", http.StatusInternalServerError)
 						return
 					}
 
-					sess.Values["userID"] = res.Id
+					signIn(sess, res.Id, res.SessionVersion, needsCode)
 					if err := sess.Save(r, w); err != nil {
 						http.Error(w, "failed to save session", http.StatusInternalServerError)
 						return
@@ -96,6 +133,10 @@ func setupAuthRoutes(r chi.Router, db *toolbelt.Database, sessionStore sessions.
 					return
 				}
 
+				if needsCode {
+					datastar.Redirect(sse, "/auth/two-factor")
+					return
+				}
 				datastar.Redirect(sse, "/")
 			})
 		})
@@ -110,7 +151,7 @@ func setupAuthRoutes(r chi.Router, db *toolbelt.Database, sessionStore sessions.
 
 				ctx := r.Context()
 				form := &RegisterForm{}
-				PageAuthenticationRegister(r, nil, form).Render(ctx, w)
+				PageAuthenticationRegister(r, nil, form, providers).Render(ctx, w)
 			})
 
 			registerRouter.Post("/", func(w http.ResponseWriter, r *http.Request) {
@@ -142,12 +183,14 @@ func setupAuthRoutes(r chi.Router, db *toolbelt.Database, sessionStore sessions.
 				}
 				if form.Email == "" {
 					appendAndSendValidationErrors(errors.New("email is required"))
+				} else if err := validateEmail(form.Email); err != nil {
+					appendAndSendValidationErrors(err)
 				}
 				if len(form.Password) < 8 {
 					appendAndSendValidationErrors(errors.New("password must be at least 8 characters"))
 				}
 
-				var userID int64
+				var user *zz.UserModel
 				if len(validationErrors) == 0 {
 					if err := db.WriteTX(r.Context(), func(tx *sqlite.Conn) error {
 						emailUser, err := zz.OnceUserByEmail(tx, form.Email)
@@ -175,13 +218,13 @@ func setupAuthRoutes(r chi.Router, db *toolbelt.Database, sessionStore sessions.
 							return fmt.Errorf("failed to hash password: %w", err)
 						}
 
-						userID = toolbelt.NextID()
-						user := &zz.UserModel{
+						userID := toolbelt.NextID()
+						user = &zz.UserModel{
 							Id:           userID,
 							Username:     form.Username,
 							Email:        form.Email,
 							PasswordHash: passwordHash,
-							ImageUrl:     fmt.Sprintf("https://i.pravatar.cc/150?u=%d", userID),
+							ImageUrl:     DefaultAvatarURL(userID),
 						}
 
 						if err := zz.OnceCreateUser(tx, user); err != nil {
@@ -199,8 +242,27 @@ func setupAuthRoutes(r chi.Router, db *toolbelt.Database, sessionStore sessions.
 					return
 				}
 
+				// The user is already created, they can ask for another link
+				// once signed in
+				if err := verifier.Send(r, user, user.Email); err != nil {
+					log.Printf("Failed to send email verification to user %d: %v", user.Id, err)
+				}
+
 				datastar.Redirect(sse, "/auth/login")
 			})
 		})
 	})
 }
+
+// signIn makes sess the user's, or with two-factor authentication leaves it
+// waiting for the code from their app.
+func signIn(sess *sessions.Session, userID, sessionVersion int64, needsCode bool) {
+	if needsCode {
+		sess.Values["twoFactorUserID"] = userID
+		sess.Values["twoFactorSessionVersion"] = sessionVersion
+		sess.Values["twoFactorStartedAt"] = time.Now().Unix()
+		return
+	}
+	sess.Values["userID"] = userID
+	sess.Values["sessionVersion"] = sessionVersion
+}
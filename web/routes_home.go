@@ -3,9 +3,12 @@ package web
 import (
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/a-h/templ"
 	"github.com/delaneyj/realworld-datastar/sql/zz"
 	"github.com/delaneyj/toolbelt"
 	"github.com/go-chi/chi/v5"
@@ -15,6 +18,7 @@ import (
 type FeedData struct {
 	Names         []string
 	Current       string
+	Tag           string
 	Limit, Offset int64
 	Articles      []*ArticlePreview
 	TotalArticles int64
@@ -24,6 +28,7 @@ type FeedData struct {
 type ArticlePreview struct {
 	AuthorID      int64
 	ArticleId     int64
+	Slug          string
 	Username      string
 	ImageUrl      string
 	Title         string
@@ -31,15 +36,20 @@ type ArticlePreview struct {
 	CreatedAt     time.Time
 	Tags          []*zz.TagModel
 	FavoriteCount int64
+	Snippet       string
+
+	// Status and PublishAt are only set in the author's drafts
+	Status    string
+	PublishAt time.Time
 }
 
-func setupHomeRoutes(r chi.Router, db *toolbelt.Database) {
+func setupHomeRoutes(r chi.Router, db *toolbelt.Database, pageSize int64) {
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		u, _ := UserFromContext(ctx)
 
 		feedData := &FeedData{
-			Limit:  3,
+			Limit:  pageSize,
 			Offset: 0,
 		}
 		if u != nil {
@@ -48,6 +58,11 @@ func setupHomeRoutes(r chi.Router, db *toolbelt.Database) {
 		feedData.Names = append(feedData.Names, "global")
 
 		feed := r.URL.Query().Get("feed")
+		if tag := strings.TrimSpace(r.URL.Query().Get("tag")); tag != "" {
+			feedData.Tag = tag
+			feed = tagFeedName(tag)
+			feedData.Names = append(feedData.Names, feed)
+		}
 		if feed == "" {
 			if u != nil {
 				feed = "your"
@@ -96,6 +111,7 @@ func setupHomeRoutes(r chi.Router, db *toolbelt.Database) {
 				for _, row := range res {
 					preview := &ArticlePreview{
 						ArticleId:   row.ArticleId,
+						Slug:        row.Slug,
 						AuthorID:    row.AuthorId,
 						Username:    row.Username,
 						ImageUrl:    row.ImageUrl,
@@ -122,6 +138,7 @@ func setupHomeRoutes(r chi.Router, db *toolbelt.Database) {
 				for _, row := range res {
 					preview := &ArticlePreview{
 						ArticleId:   row.ArticleId,
+						Slug:        row.Slug,
 						AuthorID:    row.AuthorId,
 						Username:    row.Username,
 						ImageUrl:    row.ImageUrl,
@@ -135,6 +152,34 @@ func setupHomeRoutes(r chi.Router, db *toolbelt.Database) {
 				if err != nil {
 					return fmt.Errorf("failed to get global feed count: %w", err)
 				}
+
+			case tagFeedName(feedData.Tag):
+				res, err := zz.OnceArticlePreviewsByTag(tx, zz.ArticlePreviewsByTagParams{
+					Tag:    feedData.Tag,
+					Offset: feedData.Offset,
+					Limit:  feedData.Limit,
+				})
+				if err != nil {
+					return fmt.Errorf("failed to get tag feed: %w", err)
+				}
+
+				for _, row := range res {
+					preview := &ArticlePreview{
+						ArticleId:   row.ArticleId,
+						Slug:        row.Slug,
+						AuthorID:    row.AuthorId,
+						Username:    row.Username,
+						ImageUrl:    row.ImageUrl,
+						Title:       row.Title,
+						Description: row.Description,
+					}
+					feedData.Articles = append(feedData.Articles, preview)
+				}
+
+				feedData.TotalArticles, err = zz.OnceArticleCountByTag(tx, feedData.Tag)
+				if err != nil {
+					return fmt.Errorf("failed to get tag feed count: %w", err)
+				}
 			}
 
 			for _, preview := range feedData.Articles {
@@ -172,3 +217,29 @@ func setupHomeRoutes(r chi.Router, db *toolbelt.Database) {
 		PageHome(r, u, feedData).Render(r.Context(), w)
 	})
 }
+
+// tagFeedName is the feed name shown for articles with the given tag, feeds
+// named this way are linked with ?tag= rather than ?feed=.
+func tagFeedName(tag string) string {
+	return "#" + tag
+}
+
+func feedURL(urlPrefix, feed string, offset, limit int64) templ.SafeURL {
+	values := url.Values{}
+	if tag, ok := strings.CutPrefix(feed, "#"); ok {
+		values.Set("tag", tag)
+	} else {
+		values.Set("feed", feed)
+	}
+	if limit > 0 {
+		values.Set("offset", strconv.FormatInt(offset, 10))
+		values.Set("limit", strconv.FormatInt(limit, 10))
+	}
+	return templ.SafeURL(urlPrefix + "?" + values.Encode())
+}
+
+func feedPageURL(urlPrefix, feed string, limit int64) func(offset int64) templ.SafeURL {
+	return func(offset int64) templ.SafeURL {
+		return feedURL(urlPrefix, feed, offset, limit)
+	}
+}
@@ -0,0 +1,61 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/delaneyj/realworld-datastar/config"
+)
+
+func TestFeedURL(t *testing.T) {
+	for feed, want := range map[string]string{
+		"global": "/?feed=global&limit=3&offset=6",
+		"#go":    "/?limit=3&offset=6&tag=go",
+		"#c++":   "/?limit=3&offset=6&tag=c%2B%2B",
+	} {
+		if got := string(feedURL("/", feed, 6, 3)); got != want {
+			t.Errorf("feedURL(%q) = %q, want %q", feed, got, want)
+		}
+	}
+	if got := string(feedURL("/", "#go", 0, 0)); got != "/?tag=go" {
+		t.Errorf("without a limit got %q", got)
+	}
+}
+
+func TestTagFeed(t *testing.T) {
+	ts := newTestServer(t, func(cfg *config.Config) {
+		cfg.FeedPageSize = 2
+	})
+	_, token := ts.register(t, "jake")
+
+	for i := range 3 {
+		createAPIArticle(t, ts, token, fmt.Sprintf("Dragon %d", i), "dragons")
+	}
+	createAPIArticle(t, ts, token, "Training", "training")
+
+	status, body := ts.get(t, nil, "/?tag=dragons")
+	if status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if !strings.Contains(body, "#dragons") {
+		t.Error("page has no tab for the tag")
+	}
+	if strings.Contains(body, "<h1>Training</h1>") {
+		t.Error("page lists an article without the tag")
+	}
+	if n := strings.Count(body, "<h1>Dragon "); n != 2 {
+		t.Errorf("first page lists %d articles, want 2", n)
+	}
+
+	_, body = ts.get(t, nil, "/?tag=dragons&offset=2")
+	if n := strings.Count(body, "<h1>Dragon "); n != 1 {
+		t.Errorf("second page lists %d articles, want 1", n)
+	}
+
+	_, body = ts.get(t, nil, "/?tag=nothing")
+	if strings.Contains(body, "<h1>Dragon ") {
+		t.Error("unused tag lists articles")
+	}
+}
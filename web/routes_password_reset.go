@@ -0,0 +1,229 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/delaneyj/datastar"
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
+	"zombiezen.com/go/sqlite"
+)
+
+const passwordResetMailTimeout = 30 * time.Second
+
+var errPasswordResetInvalid = errors.New("this reset link is invalid or has expired")
+
+// setupPasswordResetRoutes mails users who forgot their password a link to
+// choose a new one. Links hold a random token of which only the hash is
+// stored, work once and expire after expiry. Links point at baseURL, or the
+// host the request came in on without one.
+func setupPasswordResetRoutes(authRouter chi.Router, db *toolbelt.Database, mailer Mailer, baseURL string, expiry time.Duration) {
+	authRouter.Route("/forgot", func(forgotRouter chi.Router) {
+		forgotRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := UserFromContext(r.Context()); ok {
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+				return
+			}
+
+			PageAuthenticationForgot(r, nil).Render(r.Context(), w)
+		})
+
+		// Answers the same whether or not the email has an account, so it
+		// can't be used to find out who does
+		forgotRouter.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			type Form struct {
+				Email string `json:"email"`
+			}
+
+			form := &Form{}
+			if err := datastar.BodyUnmarshal(r, form); err != nil {
+				http.Error(w, "failed to parse request body", http.StatusBadRequest)
+				return
+			}
+			sse := datastar.NewSSE(w, r)
+
+			form.Email = strings.TrimSpace(form.Email)
+			if form.Email == "" {
+				datastar.RenderFragmentTempl(sse, errorMessages(errors.New("email is required")))
+				return
+			}
+
+			token, err := newEmailToken()
+			if err != nil {
+				http.Error(w, "failed to create reset token", http.StatusInternalServerError)
+				return
+			}
+
+			now := time.Now()
+			expiresAt := now.Add(expiry)
+			var user *zz.UserByEmailRes
+			if err := db.WriteTX(r.Context(), func(tx *sqlite.Conn) (err error) {
+				if err := zz.OnceDeleteExpiredPasswordResets(tx, now); err != nil {
+					return fmt.Errorf("failed to delete expired password resets: %w", err)
+				}
+
+				user, err = zz.OnceUserByEmail(tx, form.Email)
+				if err != nil {
+					return fmt.Errorf("failed to get user by email: %w", err)
+				}
+				if user == nil {
+					return nil
+				}
+
+				// Only the latest link works
+				if err := zz.OnceDeletePasswordResetsByUser(tx, user.Id); err != nil {
+					return fmt.Errorf("failed to delete password resets: %w", err)
+				}
+				if err := zz.OnceCreatePasswordReset(tx, &zz.PasswordResetModel{
+					Id:        toolbelt.NextID(),
+					UserId:    user.Id,
+					TokenHash: hashEmailToken(token),
+					ExpiresAt: expiresAt,
+					CreatedAt: now,
+				}); err != nil {
+					return fmt.Errorf("failed to create password reset: %w", err)
+				}
+				return nil
+			}); err != nil {
+				http.Error(w, "failed to create password reset", http.StatusInternalServerError)
+				return
+			}
+
+			if user != nil {
+				link := fmt.Sprintf("%s/auth/reset?token=%s", linkBaseURL(baseURL, r), url.QueryEscape(token))
+				msg := &Mail{
+					To:      user.Email,
+					Subject: "Reset your Conduit password",
+					Text: fmt.Sprintf(
+						"Someone asked to reset the password of %s on Conduit.\n\n"+
+							"To choose a new one, open this link before %s:\n\n%s\n\n"+
+							"If it wasn't you, ignore this email and your password stays the same.\n",
+						user.Username, expiresAt.Local().Format("Jan 2, 2006 15:04 MST"), link,
+					),
+				}
+
+				// Sent in the background so the answer takes as long for
+				// emails without an account
+				go func() {
+					ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), passwordResetMailTimeout)
+					defer cancel()
+					if err := mailer.Send(ctx, msg); err != nil {
+						log.Printf("Failed to send password reset to user %d: %v", user.Id, err)
+					}
+				}()
+			}
+
+			datastar.RenderFragmentTempl(sse, errorMessages())
+			datastar.RenderFragmentTempl(sse, passwordResetSent(form.Email))
+		})
+	})
+
+	authRouter.Route("/reset", func(resetRouter chi.Router) {
+		resetRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			token := r.URL.Query().Get("token")
+
+			var valid bool
+			if err := db.ReadTX(ctx, func(tx *sqlite.Conn) (err error) {
+				reset, err := passwordResetByToken(tx, token)
+				valid = reset != nil
+				return err
+			}); err != nil {
+				http.Error(w, "failed to get password reset", http.StatusInternalServerError)
+				return
+			}
+
+			// Keep the token out of requests for anything on the page
+			w.Header().Set("Referrer-Policy", "no-referrer")
+			u, _ := UserFromContext(ctx)
+			PageAuthenticationReset(r, u, &PasswordResetForm{Token: token}, valid).Render(ctx, w)
+		})
+
+		// Choosing a new password signs the user out everywhere, whoever
+		// knew the old one included
+		resetRouter.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			form := &PasswordResetForm{}
+			if err := datastar.BodyUnmarshal(r, form); err != nil {
+				http.Error(w, "failed to parse request body", http.StatusBadRequest)
+				return
+			}
+			sse := datastar.NewSSE(w, r)
+
+			if len(form.Password) < 8 {
+				datastar.RenderFragmentTempl(sse, errorMessages(errors.New("password must be at least 8 characters")))
+				return
+			}
+			passwordHash, err := bcrypt.GenerateFromPassword([]byte(form.Password), bcrypt.DefaultCost)
+			if err != nil {
+				http.Error(w, "failed to hash password", http.StatusInternalServerError)
+				return
+			}
+
+			if err := db.WriteTX(r.Context(), func(tx *sqlite.Conn) error {
+				reset, err := passwordResetByToken(tx, form.Token)
+				if err != nil {
+					return err
+				}
+				if reset == nil {
+					return errPasswordResetInvalid
+				}
+
+				u, err := zz.OnceReadByIDUser(tx, reset.UserId)
+				if err != nil {
+					return fmt.Errorf("failed to get user: %w", err)
+				}
+				if u == nil {
+					return errPasswordResetInvalid
+				}
+
+				u.PasswordHash = passwordHash
+				u.SessionVersion++
+				// The link was mailed to them, so the address is theirs
+				if !emailVerified(u) {
+					u.EmailVerifiedAt = time.Now()
+				}
+				if err := zz.OnceUpdateUser(tx, u); err != nil {
+					return fmt.Errorf("failed to update user: %w", err)
+				}
+				if err := zz.OnceDeletePasswordResetsByUser(tx, u.Id); err != nil {
+					return fmt.Errorf("failed to delete password resets: %w", err)
+				}
+				return nil
+			}); err != nil {
+				if errors.Is(err, errPasswordResetInvalid) {
+					datastar.RenderFragmentTempl(sse, errorMessages(errPasswordResetInvalid))
+					return
+				}
+				http.Error(w, "failed to reset password", http.StatusInternalServerError)
+				return
+			}
+
+			datastar.Redirect(sse, "/auth/login")
+		})
+	})
+}
+
+// passwordResetByToken returns nil unless token is a reset that hasn't
+// expired.
+func passwordResetByToken(tx *sqlite.Conn, token string) (*zz.PasswordResetByTokenHashRes, error) {
+	if token == "" {
+		return nil, nil
+	}
+	reset, err := zz.OncePasswordResetByTokenHash(tx, hashEmailToken(token))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get password reset: %w", err)
+	}
+	if reset == nil || !time.Now().Before(reset.ExpiresAt) {
+		return nil, nil
+	}
+	return reset, nil
+}
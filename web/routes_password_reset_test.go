@@ -0,0 +1,188 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/config"
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"zombiezen.com/go/sqlite"
+)
+
+const passwordResetSubject = "Reset your Conduit password"
+
+// requestPasswordReset asks for the nth reset link of username and returns
+// the token mailed to them.
+func requestPasswordReset(t *testing.T, ts *testServer, username string, n int) string {
+	t.Helper()
+
+	email := username + "@example.com"
+	status, body := ts.datastar(t, ts.browser(t), http.MethodPost, "/auth/forgot", map[string]string{"email": email})
+	if status != http.StatusOK {
+		t.Fatalf("requesting a reset link: got status %d: %s", status, body)
+	}
+	return mailToken(t, ts.waitForMail(t, email, passwordResetSubject, n), "/auth/reset")
+}
+
+func resetPassword(t *testing.T, ts *testServer, token, password string) string {
+	t.Helper()
+
+	status, body := ts.datastar(t, ts.browser(t), http.MethodPost, "/auth/reset", PasswordResetForm{Token: token, Password: password})
+	if status != http.StatusOK {
+		t.Fatalf("resetting the password: got status %d: %s", status, body)
+	}
+	return body
+}
+
+func readUser(t *testing.T, ts *testServer, userID int64) *zz.UserModel {
+	t.Helper()
+
+	var u *zz.UserModel
+	if err := ts.db.ReadTX(context.Background(), func(tx *sqlite.Conn) (err error) {
+		u, err = zz.OnceReadByIDUser(tx, userID)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// signedIn reports whether the page header offers client to sign in.
+func signedIn(t *testing.T, ts *testServer, client *http.Client) bool {
+	t.Helper()
+
+	_, body := ts.get(t, client, "/")
+	return !strings.Contains(body, `href="/auth/login"`)
+}
+
+func TestPasswordReset(t *testing.T) {
+	ts := newTestServer(t)
+	userID, apiToken := ts.register(t, "jake")
+	before := readUser(t, ts, userID)
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+
+	token := requestPasswordReset(t, ts, "jake", 1)
+	_, page := ts.get(t, nil, "/auth/reset?token="+url.QueryEscape(token))
+	if strings.Contains(page, "invalid or has expired") {
+		t.Error("reset page says a fresh link is invalid")
+	}
+
+	if body := resetPassword(t, ts, token, "short"); !strings.Contains(body, "at least 8 characters") {
+		t.Errorf("short password wasn't refused: %s", body)
+	}
+	if body := resetPassword(t, ts, token, "new-password"); !strings.Contains(body, "redirect /auth/login") {
+		t.Fatalf("reset didn't send to the login page: %s", body)
+	}
+
+	after := readUser(t, ts, userID)
+	if string(after.PasswordHash) == string(before.PasswordHash) {
+		t.Error("password wasn't changed")
+	}
+	if after.SessionVersion != before.SessionVersion+1 {
+		t.Errorf("got session version %d, want %d", after.SessionVersion, before.SessionVersion+1)
+	}
+	if !emailVerified(after) {
+		t.Error("following the mailed link didn't verify the email")
+	}
+
+	// Signed out everywhere, in browsers and through the API
+	if signedIn(t, ts, jake) {
+		t.Error("browser session still works")
+	}
+	if status := ts.api(t, http.MethodGet, "/api/user", apiToken, nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("old API token: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+	status, body := ts.datastar(t, ts.browser(t), http.MethodPost, "/auth/login", map[string]string{
+		"email":    "jake@example.com",
+		"password": "new-password",
+	})
+	if status != http.StatusOK || !strings.Contains(body, "redirect /") {
+		t.Errorf("signing in with the new password: got status %d: %s", status, body)
+	}
+
+	// Links work once
+	if body := resetPassword(t, ts, token, "another-password"); !strings.Contains(body, errPasswordResetInvalid.Error()) {
+		t.Errorf("link worked twice: %s", body)
+	}
+	if _, page := ts.get(t, nil, "/auth/reset?token="+url.QueryEscape(token)); !strings.Contains(page, "invalid or has expired") {
+		t.Error("reset page doesn't say a used link is invalid")
+	}
+}
+
+func TestPasswordResetExpires(t *testing.T) {
+	ts := newTestServer(t, func(cfg *config.Config) {
+		cfg.PasswordResetExpiry = 2 * time.Hour
+	})
+	userID, _ := ts.register(t, "jake")
+
+	requested := time.Now()
+	token := requestPasswordReset(t, ts, "jake", 1)
+	var expiresAt time.Time
+	if err := ts.db.ReadTX(context.Background(), func(tx *sqlite.Conn) error {
+		reset, err := zz.OncePasswordResetByTokenHash(tx, hashEmailToken(token))
+		if err != nil || reset == nil {
+			t.Fatalf("got reset %v, error %v", reset, err)
+		}
+		expiresAt = reset.ExpiresAt
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := requested.Add(2 * time.Hour); expiresAt.Sub(want).Abs() > time.Minute {
+		t.Errorf("expires at %s, want about %s", expiresAt, want)
+	}
+
+	ts.exec(t, `UPDATE password_resets SET expires_at = julianday('now') - 1.0 / 86400 WHERE user_id = ?`, userID)
+	if _, page := ts.get(t, nil, "/auth/reset?token="+url.QueryEscape(token)); !strings.Contains(page, "invalid or has expired") {
+		t.Error("reset page doesn't say an expired link is invalid")
+	}
+	if body := resetPassword(t, ts, token, "new-password"); !strings.Contains(body, errPasswordResetInvalid.Error()) {
+		t.Errorf("expired link worked: %s", body)
+	}
+	if readUser(t, ts, userID).SessionVersion != 0 {
+		t.Error("expired link signed the user out")
+	}
+}
+
+func TestPasswordResetNewerLink(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "jake")
+
+	older := requestPasswordReset(t, ts, "jake", 1)
+	newer := requestPasswordReset(t, ts, "jake", 2)
+	if older == newer {
+		t.Fatal("both links have the same token")
+	}
+
+	if body := resetPassword(t, ts, older, "new-password"); !strings.Contains(body, errPasswordResetInvalid.Error()) {
+		t.Errorf("older link worked: %s", body)
+	}
+	if body := resetPassword(t, ts, newer, "new-password"); !strings.Contains(body, "redirect /auth/login") {
+		t.Errorf("newer link didn't work: %s", body)
+	}
+}
+
+func TestPasswordResetUnknownEmail(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "jake")
+
+	// Nobody can tell from the answer whether the email has an account
+	_, known := ts.datastar(t, ts.browser(t), http.MethodPost, "/auth/forgot", map[string]string{"email": "jake@example.com"})
+	_, unknown := ts.datastar(t, ts.browser(t), http.MethodPost, "/auth/forgot", map[string]string{"email": "nobody@example.com"})
+	if strings.ReplaceAll(known, "jake@example.com", "") != strings.ReplaceAll(unknown, "nobody@example.com", "") {
+		t.Errorf("answers differ:\n%s\n%s", known, unknown)
+	}
+	ts.waitForMail(t, "jake@example.com", passwordResetSubject, 1)
+	if mails := ts.mails(t, "nobody@example.com", passwordResetSubject); len(mails) != 0 {
+		t.Errorf("got %d mails to an email without an account", len(mails))
+	}
+
+	if body := resetPassword(t, ts, "", "new-password"); !strings.Contains(body, errPasswordResetInvalid.Error()) {
+		t.Errorf("empty token worked: %s", body)
+	}
+}
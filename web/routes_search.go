@@ -0,0 +1,209 @@
+package web
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/a-h/templ"
+	"github.com/delaneyj/datastar"
+	"github.com/delaneyj/toolbelt"
+	"github.com/go-chi/chi/v5"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+type SearchData struct {
+	Query         string
+	Limit, Offset int64
+	Articles      []*ArticlePreview
+	TotalArticles int64
+}
+
+func (s *SearchData) PageURL(offset int64) templ.SafeURL {
+	values := url.Values{}
+	values.Set("q", s.Query)
+	values.Set("offset", strconv.FormatInt(offset, 10))
+	return templ.SafeURL("/search?" + values.Encode())
+}
+
+type SearchForm struct {
+	Search string `json:"search"`
+}
+
+func setupSearchRoutes(r chi.Router, db *toolbelt.Database) {
+	r.Route("/search", func(searchRouter chi.Router) {
+		searchRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			u, _ := UserFromContext(ctx)
+
+			data := &SearchData{
+				Query: strings.TrimSpace(r.URL.Query().Get("q")),
+				Limit: 10,
+			}
+
+			offsetRaw := r.URL.Query().Get("offset")
+			if offsetRaw != "" {
+				offset, err := strconv.ParseInt(offsetRaw, 10, 64)
+				if err != nil || offset < 0 {
+					http.Error(w, "invalid offset", http.StatusBadRequest)
+					return
+				}
+				data.Offset = offset
+			}
+
+			if match := ftsMatchQuery(data.Query); match != "" {
+				if err := db.ReadTX(ctx, func(tx *sqlite.Conn) (err error) {
+					data.Articles, err = searchArticles(tx, match, data.Limit, data.Offset)
+					if err != nil {
+						return err
+					}
+					data.TotalArticles, err = searchArticleCount(tx, match)
+					if err != nil {
+						return err
+					}
+					return nil
+				}); err != nil {
+					http.Error(w, "failed to search articles", http.StatusInternalServerError)
+					return
+				}
+			}
+
+			PageSearch(r, u, data).Render(ctx, w)
+		})
+
+		searchRouter.Get("/suggest", func(w http.ResponseWriter, r *http.Request) {
+			form := &SearchForm{}
+			if err := datastar.QueryStringUnmarshal(r, form); err != nil {
+				http.Error(w, "failed to parse request", http.StatusBadRequest)
+				return
+			}
+
+			data := &SearchData{
+				Query: strings.TrimSpace(form.Search),
+				Limit: 5,
+			}
+			if match := ftsMatchQuery(data.Query); match != "" {
+				if err := db.ReadTX(r.Context(), func(tx *sqlite.Conn) (err error) {
+					data.Articles, err = searchArticles(tx, match, data.Limit, 0)
+					return err
+				}); err != nil {
+					http.Error(w, "failed to search articles", http.StatusInternalServerError)
+					return
+				}
+			}
+
+			sse := datastar.NewSSE(w, r)
+			datastar.RenderFragmentTempl(sse, searchSuggestions(data))
+		})
+	})
+}
+
+// ftsMatchQuery turns free text into an FTS5 query where every word must
+// match, the last one as a prefix so results show up while typing. Words are
+// quoted so FTS5 operators in user input are treated as plain text.
+func ftsMatchQuery(q string) string {
+	words := strings.Fields(q)
+	for i, word := range words {
+		words[i] = `"` + strings.ReplaceAll(word, `"`, `""`) + `"`
+	}
+	if len(words) > 0 {
+		words[len(words)-1] += "*"
+	}
+	return strings.Join(words, " ")
+}
+
+const (
+	snippetStart = "\x02"
+	snippetEnd   = "\x03"
+)
+
+// The FTS5 auxiliary functions can't be typed by sqlc, so these queries live
+// here instead of queries.sql.
+
+func searchArticles(tx *sqlite.Conn, match string, limit, offset int64) ([]*ArticlePreview, error) {
+	var previews []*ArticlePreview
+	if err := sqlitex.Execute(tx, `
+		SELECT
+			a.id,
+			a.slug,
+			u.id,
+			u.username,
+			u.image_url,
+			a.title,
+			a.description,
+			a.created_at,
+			snippet(articles_fts, -1, :start, :end, '…', 24)
+		FROM
+			articles_fts f
+			INNER JOIN articles a ON a.id = f.rowid
+			INNER JOIN users u ON u.id = a.author_id
+		WHERE
+			articles_fts MATCH :match
+			AND a.status = 'published'
+		ORDER BY
+			bm25(articles_fts, 10.0, 5.0, 1.0, 3.0),
+			a.id DESC
+		LIMIT
+			:limit OFFSET :offset
+	`, &sqlitex.ExecOptions{
+		Named: map[string]any{
+			":start":  snippetStart,
+			":end":    snippetEnd,
+			":match":  match,
+			":limit":  limit,
+			":offset": offset,
+		},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			previews = append(previews, &ArticlePreview{
+				ArticleId:   stmt.ColumnInt64(0),
+				Slug:        stmt.ColumnText(1),
+				AuthorID:    stmt.ColumnInt64(2),
+				Username:    stmt.ColumnText(3),
+				ImageUrl:    stmt.ColumnText(4),
+				Title:       stmt.ColumnText(5),
+				Description: stmt.ColumnText(6),
+				CreatedAt:   toolbelt.JulianDayToTime(stmt.ColumnFloat(7)),
+				Snippet:     highlightSnippet(stmt.ColumnText(8)),
+			})
+			return nil
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to search articles: %w", err)
+	}
+	return previews, nil
+}
+
+func searchArticleCount(tx *sqlite.Conn, match string) (count int64, err error) {
+	if err := sqlitex.Execute(tx, `
+		SELECT
+			count(*)
+		FROM
+			articles_fts f
+			INNER JOIN articles a ON a.id = f.rowid
+		WHERE
+			articles_fts MATCH :match
+			AND a.status = 'published'
+	`, &sqlitex.ExecOptions{
+		Named: map[string]any{":match": match},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			count = stmt.ColumnInt64(0)
+			return nil
+		},
+	}); err != nil {
+		return 0, fmt.Errorf("failed to count search results: %w", err)
+	}
+	return count, nil
+}
+
+// highlightSnippet escapes the raw article text FTS5 returns and only then
+// swaps the match markers for <mark> tags.
+func highlightSnippet(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.ReplaceAll(snippet, snippetStart, "<mark>")
+	snippet = strings.ReplaceAll(snippet, snippetEnd, "</mark>")
+	return snippet
+}
@@ -0,0 +1,122 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+)
+
+func TestFTSMatchQuery(t *testing.T) {
+	for q, want := range map[string]string{
+		"":                  "",
+		"   ":               "",
+		"dragon":            `"dragon"*`,
+		"train  dragons":    `"train" "dragons"*`,
+		`say "hi"`:          `"say" """hi"""*`,
+		"a OR b NOT c":      `"a" "OR" "b" "NOT" "c"*`,
+		"NEAR(a b) title:x": `"NEAR(a" "b)" "title:x"*`,
+	} {
+		if got := ftsMatchQuery(q); got != want {
+			t.Errorf("ftsMatchQuery(%q) = %q, want %q", q, got, want)
+		}
+	}
+}
+
+func TestHighlightSnippet(t *testing.T) {
+	got := highlightSnippet("<b>" + snippetStart + "dragons" + snippetEnd + " & more")
+	want := "&lt;b&gt;<mark>dragons</mark> &amp; more"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSearchArticles(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+
+	createAPIArticle(t, ts, token, "Gardening")
+	inBody := createAPIArticle(t, ts, token, "Flying")
+	ts.api(t, http.MethodPut, "/api/articles/"+inBody.Slug, token, map[string]any{
+		"article": map[string]any{"body": "Riding dragons is the fastest way to fly"},
+	}, nil)
+	inTitle := createAPIArticle(t, ts, token, "Dragons")
+
+	search := func(t *testing.T, q string) ([]*ArticlePreview, int64) {
+		t.Helper()
+
+		var (
+			previews []*ArticlePreview
+			count    int64
+		)
+		if err := ts.db.ReadTX(context.Background(), func(tx *sqlite.Conn) (err error) {
+			match := ftsMatchQuery(q)
+			if previews, err = searchArticles(tx, match, 10, 0); err != nil {
+				return err
+			}
+			count, err = searchArticleCount(tx, match)
+			return err
+		}); err != nil {
+			t.Fatalf("searching %q: %v", q, err)
+		}
+		return previews, count
+	}
+
+	previews, count := search(t, "dragons")
+	if count != 2 || len(previews) != 2 {
+		t.Fatalf("got %d of %d results, want 2", len(previews), count)
+	}
+	// Titles weigh more than bodies
+	if previews[0].Slug != inTitle.Slug || previews[1].Slug != inBody.Slug {
+		t.Errorf("got %s then %s", previews[0].Slug, previews[1].Slug)
+	}
+	if !strings.Contains(previews[1].Snippet, "<mark>dragons</mark>") {
+		t.Errorf("got snippet %q", previews[1].Snippet)
+	}
+
+	if _, count := search(t, "drag"); count != 2 {
+		t.Errorf("prefix matched %d articles, want 2", count)
+	}
+	if _, count := search(t, "riding gardening"); count != 0 {
+		t.Errorf("matched %d articles without every word, want none", count)
+	}
+	for _, q := range []string{`"`, "dragons OR", "NEAR(", "title:dragons", "*", "-dragons"} {
+		search(t, q)
+	}
+
+	// The index follows deletes
+	if status := ts.api(t, http.MethodDelete, "/api/articles/"+inTitle.Slug, token, nil, nil); status != http.StatusOK && status != http.StatusNoContent {
+		t.Fatalf("deleting: got status %d", status)
+	}
+	if _, count := search(t, "dragons"); count != 1 {
+		t.Errorf("matched %d articles after deleting one, want 1", count)
+	}
+}
+
+func TestSearchPages(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+	createAPIArticle(t, ts, token, "Dragons")
+
+	status, body := ts.get(t, nil, "/search?q=dragon")
+	if status != http.StatusOK {
+		t.Fatalf("got status %d", status)
+	}
+	if !strings.Contains(body, "Dragons</h1>") {
+		t.Error("results don't list the article")
+	}
+	if status, _ := ts.get(t, nil, "/search?q=dragon&offset=-1"); status != http.StatusBadRequest {
+		t.Errorf("negative offset: got status %d, want %d", status, http.StatusBadRequest)
+	}
+
+	status, body = ts.get(t, nil, "/search/suggest?datastar="+url.QueryEscape(`{"search":"drag"}`))
+	if status != http.StatusOK {
+		t.Fatalf("suggest: got status %d", status)
+	}
+	if !strings.Contains(body, "Dragons") {
+		t.Errorf("suggestions don't list the article: %s", body)
+	}
+}
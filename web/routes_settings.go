@@ -20,10 +20,20 @@ type SettingsForm struct {
 	ImageUrl string `json:"imageURL"`
 	Bio      string `json:"bio"`
 	Password string `json:"password"`
+
+	// PendingEmail is waiting to be confirmed before it replaces Email
+	PendingEmail      string `json:"-"`
+	TwoFactorEnabled  bool   `json:"-"`
+	RecoveryCodesLeft int64  `json:"-"`
+
+	Identities []ConnectedIdentity `json:"-"`
 }
 
-func setupSettingsRoutes(r chi.Router, db *toolbelt.Database) {
+func setupSettingsRoutes(r chi.Router, db *toolbelt.Database, hub *Hub, blobs BlobStore, maxUploadSize int64, verifier *EmailVerifier, providers []*OIDCProvider) {
 	r.Route("/settings", func(settingsRouter chi.Router) {
+		setupTwoFactorSettingsRoutes(settingsRouter, db)
+		setupIdentitySettingsRoutes(settingsRouter, db)
+
 		settingsRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
 			u, _ := UserFromContext(ctx)
@@ -34,6 +44,29 @@ func setupSettingsRoutes(r chi.Router, db *toolbelt.Database) {
 				Bio:      u.Bio,
 				Password: "",
 			}
+
+			pendingEmail, err := verifier.PendingEmail(ctx, u.Id)
+			if err != nil {
+				http.Error(w, "failed to get pending email", http.StatusInternalServerError)
+				return
+			}
+			settings.PendingEmail = pendingEmail
+
+			if err := db.ReadTX(ctx, func(tx *sqlite.Conn) (err error) {
+				if settings.TwoFactorEnabled, err = twoFactorEnabled(tx, u.Id); err != nil {
+					return err
+				}
+				settings.RecoveryCodesLeft, err = zz.OnceCountRecoveryCodesByUser(tx, u.Id)
+				if err != nil {
+					return fmt.Errorf("failed to count recovery codes: %w", err)
+				}
+				settings.Identities, err = connectedIdentities(tx, providers, u.Id)
+				return err
+			}); err != nil {
+				http.Error(w, "failed to get sign in settings", http.StatusInternalServerError)
+				return
+			}
+
 			PageSettings(r, u, settings).Render(ctx, w)
 		})
 
@@ -55,29 +88,109 @@ func setupSettingsRoutes(r chi.Router, db *toolbelt.Database) {
 				return
 			}
 
-			passwordHash, err := bcrypt.GenerateFromPassword([]byte(form.Password), bcrypt.DefaultCost)
-			if err != nil {
-				http.Error(w, "failed to hash password", http.StatusInternalServerError)
+			form.ImageUrl = strings.TrimSpace(form.ImageUrl)
+			if err := validateImageURL(form.ImageUrl); err != nil {
+				datastar.RenderFragmentTempl(sse, errorMessages(err))
 				return
 			}
 
+			// A new email only replaces the old one once it is confirmed
+			form.Email = strings.TrimSpace(form.Email)
+			newEmail := ""
+			if form.Email != u.Email {
+				if err := validateEmail(form.Email); err != nil {
+					datastar.RenderFragmentTempl(sse, errorMessages(err))
+					return
+				}
+				newEmail = form.Email
+			}
+
+			// Left empty it keeps the password, users signing in with a
+			// provider may not have one
+			if form.Password != "" {
+				passwordHash, err := bcrypt.GenerateFromPassword([]byte(form.Password), bcrypt.DefaultCost)
+				if err != nil {
+					http.Error(w, "failed to hash password", http.StatusInternalServerError)
+					return
+				}
+				u.PasswordHash = passwordHash
+			}
+
 			u.Username = form.Username
-			u.Email = form.Email
-			u.PasswordHash = passwordHash
 			u.ImageUrl = form.ImageUrl
 			u.Bio = form.Bio
 
 			if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+				if newEmail != "" {
+					emailUser, err := zz.OnceUserByEmail(tx, newEmail)
+					if err != nil {
+						return fmt.Errorf("failed to get user by email: %w", err)
+					}
+					if emailUser != nil {
+						return errEmailInUse
+					}
+				}
 				if err := zz.OnceUpdateUser(tx, u); err != nil {
 					return fmt.Errorf("failed to update user: %w", err)
 				}
 				return nil
 			}); err != nil {
+				if errors.Is(err, errEmailInUse) {
+					datastar.RenderFragmentTempl(sse, errorMessages(errEmailInUse))
+					return
+				}
 				http.Error(w, "failed to update user", http.StatusInternalServerError)
 				return
 			}
 
+			if newEmail != "" {
+				if err := verifier.Send(r, u, newEmail); err != nil {
+					datastar.RenderFragmentTempl(sse, errorMessages(err))
+					return
+				}
+				datastar.Redirect(sse, "/settings")
+				return
+			}
+
 			datastar.Redirect(sse, "/")
 		})
+
+		// A plain multipart form, the profile picture is replaced by the
+		// uploaded image
+		settingsRouter.Post("/avatar", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			u, _ := UserFromContext(ctx)
+
+			if u == nil {
+				http.Error(w, "user required", http.StatusUnauthorized)
+				return
+			}
+
+			data, _, err := readImageUpload(w, r, "avatar", maxUploadSize)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+
+			img, err := saveUploadedImage(ctx, db, blobs, u.Id, ImageKindAvatar, data)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+
+			u.ImageUrl = img.DisplayURL()
+			if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+				if err := zz.OnceUpdateUser(tx, u); err != nil {
+					return fmt.Errorf("failed to update user: %w", err)
+				}
+				return nil
+			}); err != nil {
+				http.Error(w, "failed to update user", http.StatusInternalServerError)
+				return
+			}
+
+			hub.Publish(UserTopic(u.Id))
+			http.Redirect(w, r, "/settings", http.StatusSeeOther)
+		})
 	})
 }
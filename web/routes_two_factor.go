@@ -0,0 +1,359 @@
+package web
+
+import (
+	"errors"
+	"fmt"
+	"image/png"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/delaneyj/datastar"
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/sessions"
+	"zombiezen.com/go/sqlite"
+)
+
+type TwoFactorForm struct {
+	Code string `json:"twoFactorCode"`
+}
+
+// setupTwoFactorLoginRoutes is the second step of signing in for users with
+// two-factor authentication. The password step leaves who is signing in in
+// the session, only once the code checks out is "userID" set.
+func setupTwoFactorLoginRoutes(authRouter chi.Router, db *toolbelt.Database, sessionStore sessions.Store, throttle *LoginThrottle) {
+	// pendingLogin is who passed the password step of this session, if it
+	// wasn't too long ago
+	pendingLogin := func(sess *sessions.Session) (userID, sessionVersion int64, ok bool) {
+		userID, ok = sess.Values["twoFactorUserID"].(int64)
+		if !ok {
+			return 0, 0, false
+		}
+		sessionVersion, _ = sess.Values["twoFactorSessionVersion"].(int64)
+		startedAt, _ := sess.Values["twoFactorStartedAt"].(int64)
+		if time.Since(time.Unix(startedAt, 0)) > twoFactorLoginTimeout {
+			return 0, 0, false
+		}
+		return userID, sessionVersion, true
+	}
+
+	authRouter.Route("/two-factor", func(twoFactorRouter chi.Router) {
+		twoFactorRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			sess, err := sessionStore.Get(r, "conduit")
+			if err != nil {
+				http.Error(w, "failed to get session", http.StatusInternalServerError)
+				return
+			}
+			if _, _, ok := pendingLogin(sess); !ok {
+				http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+				return
+			}
+
+			PageAuthenticationTwoFactor(r).Render(r.Context(), w)
+		})
+
+		twoFactorRouter.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			form := &TwoFactorForm{}
+			if err := datastar.BodyUnmarshal(r, form); err != nil {
+				http.Error(w, "failed to parse request body", http.StatusBadRequest)
+				return
+			}
+
+			sess, err := sessionStore.Get(r, "conduit")
+			if err != nil {
+				http.Error(w, "failed to get session", http.StatusInternalServerError)
+				return
+			}
+
+			var u *zz.UserModel
+			userID, sessionVersion, ok := pendingLogin(sess)
+			if ok {
+				if err := db.ReadTX(r.Context(), func(tx *sqlite.Conn) (err error) {
+					u, err = zz.OnceReadByIDUser(tx, userID)
+					if err != nil {
+						return fmt.Errorf("failed to get user: %w", err)
+					}
+					return nil
+				}); err != nil {
+					http.Error(w, "failed to get user", http.StatusInternalServerError)
+					return
+				}
+			}
+
+			// Codes are guessed at the same pace as passwords
+			var attemptID int64
+			switch {
+			// Their password was reset since they entered it
+			case !ok, u == nil, u.SessionVersion != sessionVersion:
+				err = errTwoFactorLoginExpired
+			default:
+				attemptID, err = throttle.Attempt(r, u.Email)
+			}
+			if err == nil {
+				err = db.WriteTX(r.Context(), func(tx *sqlite.Conn) error {
+					return checkSecondFactor(tx, userID, form.Code)
+				})
+			}
+			if err == nil {
+				if err := throttle.Succeeded(r.Context(), attemptID); err != nil {
+					http.Error(w, "failed to record login attempt", http.StatusInternalServerError)
+					return
+				}
+			}
+
+			// The session has to be saved before the events start
+			if err == nil {
+				delete(sess.Values, "twoFactorUserID")
+				delete(sess.Values, "twoFactorSessionVersion")
+				delete(sess.Values, "twoFactorStartedAt")
+				sess.Values["userID"] = userID
+				sess.Values["sessionVersion"] = sessionVersion
+				if err := sess.Save(r, w); err != nil {
+					http.Error(w, "failed to save session", http.StatusInternalServerError)
+					return
+				}
+			}
+
+			var locked *LoginLockedError
+			sse := datastar.NewSSE(w, r)
+			switch {
+			case errors.As(err, &locked):
+				datastar.RenderFragmentTempl(sse, errorMessages(locked))
+				return
+			case errors.Is(err, errTwoFactorLoginExpired):
+				datastar.RenderFragmentTempl(sse, errorMessages(errTwoFactorLoginExpired))
+				return
+			case errors.Is(err, errTwoFactorCodeInvalid):
+				datastar.RenderFragmentTempl(sse, errorMessages(errTwoFactorCodeInvalid))
+				return
+			case err != nil:
+				datastar.RenderFragmentTempl(sse, errorMessages(errors.New("failed to check two-factor code")))
+				return
+			}
+
+			datastar.Redirect(sse, "/")
+		})
+	})
+}
+
+// setupTwoFactorSettingsRoutes lets users set up an authenticator app, which
+// only takes effect once they enter a code from it, and turn it off again.
+func setupTwoFactorSettingsRoutes(settingsRouter chi.Router, db *toolbelt.Database) {
+	settingsRouter.Route("/two-factor", func(twoFactorRouter chi.Router) {
+		// Starts over with a new secret every time, unless it is set up
+		// already
+		twoFactorRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			u, _ := UserFromContext(ctx)
+
+			if u == nil {
+				http.Redirect(w, r, "/auth/login", http.StatusSeeOther)
+				return
+			}
+
+			secret, err := newTOTPSecret(u)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			var enabled bool
+			if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+				cred, err := totpCredential(tx, u.Id)
+				if err != nil {
+					return err
+				}
+				if enabled = totpConfirmed(cred); enabled {
+					return nil
+				}
+				if err := zz.OnceDeleteTotpCredentialsByUser(tx, u.Id); err != nil {
+					return fmt.Errorf("failed to delete totp credentials: %w", err)
+				}
+				if err := zz.OnceCreateTotpCredential(tx, &zz.TotpCredentialModel{
+					Id:        toolbelt.NextID(),
+					UserId:    u.Id,
+					Secret:    secret,
+					CreatedAt: time.Now(),
+				}); err != nil {
+					return fmt.Errorf("failed to create totp credential: %w", err)
+				}
+				return nil
+			}); err != nil {
+				http.Error(w, "failed to start two-factor setup", http.StatusInternalServerError)
+				return
+			}
+			if enabled {
+				http.Redirect(w, r, "/settings", http.StatusSeeOther)
+				return
+			}
+
+			// The secret must not linger in caches or history
+			w.Header().Set("Cache-Control", "no-store")
+			PageTwoFactorSetup(r, u, secret).Render(ctx, w)
+		})
+
+		// Drawn here rather than by a third party, who would learn the secret
+		twoFactorRouter.Get("/qr.png", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			u, _ := UserFromContext(ctx)
+
+			if u == nil {
+				http.Error(w, "user required", http.StatusUnauthorized)
+				return
+			}
+
+			var cred *zz.TotpCredentialModel
+			if err := db.ReadTX(ctx, func(tx *sqlite.Conn) (err error) {
+				cred, err = totpCredential(tx, u.Id)
+				return err
+			}); err != nil {
+				http.Error(w, "failed to get totp credential", http.StatusInternalServerError)
+				return
+			}
+			if cred == nil || totpConfirmed(cred) {
+				http.Error(w, "two-factor setup not started", http.StatusNotFound)
+				return
+			}
+
+			key, err := totpKey(u, cred.Secret)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			img, err := key.Image(256, 256)
+			if err != nil {
+				http.Error(w, "failed to draw QR code", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("Cache-Control", "no-store")
+			png.Encode(w, img)
+		})
+
+		twoFactorRouter.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			u, _ := UserFromContext(ctx)
+
+			if u == nil {
+				http.Error(w, "user required", http.StatusUnauthorized)
+				return
+			}
+
+			form := &TwoFactorForm{}
+			if err := datastar.BodyUnmarshal(r, form); err != nil {
+				http.Error(w, "failed to parse request body", http.StatusBadRequest)
+				return
+			}
+			sse := datastar.NewSSE(w, r)
+
+			var codes []string
+			if err := db.WriteTX(ctx, func(tx *sqlite.Conn) (err error) {
+				cred, err := totpCredential(tx, u.Id)
+				if err != nil {
+					return err
+				}
+				if cred == nil || totpConfirmed(cred) {
+					return errTwoFactorSetupExpired
+				}
+
+				now := time.Now()
+				step := checkTOTP(cred, form.Code, now)
+				if step == 0 {
+					return errTwoFactorCodeInvalid
+				}
+				cred.ConfirmedAt = now
+				cred.LastStep = step
+				if err := zz.OnceUpdateTotpCredential(tx, cred); err != nil {
+					return fmt.Errorf("failed to update totp credential: %w", err)
+				}
+
+				codes, err = replaceRecoveryCodes(tx, u.Id)
+				return err
+			}); err != nil {
+				switch {
+				case errors.Is(err, errTwoFactorSetupExpired):
+					datastar.RenderFragmentTempl(sse, errorMessages(errTwoFactorSetupExpired))
+				case errors.Is(err, errTwoFactorCodeInvalid):
+					datastar.RenderFragmentTempl(sse, errorMessages(errTwoFactorCodeInvalid))
+				default:
+					http.Error(w, "failed to turn on two-factor authentication", http.StatusInternalServerError)
+				}
+				return
+			}
+
+			datastar.RenderFragmentTempl(sse, errorMessages())
+			datastar.RenderFragmentTempl(sse, twoFactorRecoveryCodes(codes))
+		})
+
+		// Both need a code, so a session left signed in can't be used to
+		// take the second factor away
+		twoFactorRouter.Post("/recovery-codes", func(w http.ResponseWriter, r *http.Request) {
+			u, sse, form, ok := twoFactorSettingsRequest(w, r)
+			if !ok {
+				return
+			}
+
+			var codes []string
+			if err := db.WriteTX(r.Context(), func(tx *sqlite.Conn) (err error) {
+				if err := checkSecondFactor(tx, u.Id, form.Code); err != nil {
+					return err
+				}
+				codes, err = replaceRecoveryCodes(tx, u.Id)
+				return err
+			}); err != nil {
+				if errors.Is(err, errTwoFactorCodeInvalid) {
+					datastar.RenderFragmentTempl(sse, errorMessages(errTwoFactorCodeInvalid))
+					return
+				}
+				http.Error(w, "failed to replace recovery codes", http.StatusInternalServerError)
+				return
+			}
+
+			datastar.RenderFragmentTempl(sse, errorMessages())
+			datastar.RenderFragmentTempl(sse, twoFactorRecoveryCodes(codes))
+		})
+
+		twoFactorRouter.Post("/disable", func(w http.ResponseWriter, r *http.Request) {
+			u, sse, form, ok := twoFactorSettingsRequest(w, r)
+			if !ok {
+				return
+			}
+
+			if err := db.WriteTX(r.Context(), func(tx *sqlite.Conn) error {
+				if err := checkSecondFactor(tx, u.Id, form.Code); err != nil {
+					return err
+				}
+				_, err := ResetTwoFactor(tx, u.Id)
+				return err
+			}); err != nil {
+				if errors.Is(err, errTwoFactorCodeInvalid) {
+					datastar.RenderFragmentTempl(sse, errorMessages(errTwoFactorCodeInvalid))
+					return
+				}
+				http.Error(w, "failed to turn off two-factor authentication", http.StatusInternalServerError)
+				return
+			}
+
+			datastar.Redirect(sse, "/settings")
+		})
+	})
+}
+
+func twoFactorSettingsRequest(w http.ResponseWriter, r *http.Request) (*zz.UserModel, *datastar.ServerSentEventsHandler, *TwoFactorForm, bool) {
+	u, _ := UserFromContext(r.Context())
+	if u == nil {
+		http.Error(w, "user required", http.StatusUnauthorized)
+		return nil, nil, nil, false
+	}
+
+	form := &TwoFactorForm{}
+	if err := datastar.BodyUnmarshal(r, form); err != nil {
+		http.Error(w, "failed to parse request body", http.StatusBadRequest)
+		return nil, nil, nil, false
+	}
+	form.Code = strings.TrimSpace(form.Code)
+	return u, datastar.NewSSE(w, r), form, true
+}
@@ -0,0 +1,208 @@
+package web
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"github.com/dustin/go-humanize"
+	"github.com/go-chi/chi/v5"
+	"zombiezen.com/go/sqlite"
+)
+
+var (
+	uploadHashRegexp = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	uploadFileRegexp = regexp.MustCompile(`^[a-z0-9]+\.(jpg|png)$`)
+)
+
+var uploadContentTypes = map[string]string{
+	"jpg": "image/jpeg",
+	"png": "image/png",
+}
+
+// UploadedImage is an image stored in every variant of its kind.
+type UploadedImage struct {
+	Kind          string
+	Hash          string
+	Ext           string
+	Width, Height int
+}
+
+// URL of a variant, which never changes content so it can be cached forever.
+func (img *UploadedImage) URL(variant string) string {
+	return fmt.Sprintf("/uploads/%s/%s.%s", img.Hash, variant, img.Ext)
+}
+
+func (img *UploadedImage) DisplayURL() string {
+	return img.URL(imageKinds[img.Kind].Display)
+}
+
+func (img *UploadedImage) FullURL() string {
+	return img.URL(imageKinds[img.Kind].Variants[0].Name)
+}
+
+func setupUploadRoutes(r chi.Router, db *toolbelt.Database, blobs BlobStore, maxSize int64, requireVerifiedEmail bool) {
+	r.Route("/uploads", func(uploadsRouter chi.Router) {
+		// Images for the article editor, uploaded as multipart "image"
+		uploadsRouter.With(verifiedEmailRequired(requireVerifiedEmail)).Post("/", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			u, _ := UserFromContext(ctx)
+
+			if u == nil {
+				http.Error(w, "user required", http.StatusUnauthorized)
+				return
+			}
+
+			data, filename, err := readImageUpload(w, r, "image", maxSize)
+			if err != nil {
+				apiError(w, http.StatusUnprocessableEntity, err)
+				return
+			}
+
+			img, err := saveUploadedImage(ctx, db, blobs, u.Id, ImageKindArticle, data)
+			if err != nil {
+				apiError(w, http.StatusUnprocessableEntity, err)
+				return
+			}
+
+			// Brackets would end the alt text early
+			alt := strings.TrimSuffix(path.Base(filename), path.Ext(filename))
+			alt = strings.NewReplacer("[", "", "]", "", "\n", " ").Replace(alt)
+
+			apiJSON(w, http.StatusCreated, map[string]any{
+				"url":      img.DisplayURL(),
+				"full":     img.FullURL(),
+				"width":    img.Width,
+				"height":   img.Height,
+				"markdown": fmt.Sprintf("[![%s](%s)](%s)", alt, img.DisplayURL(), img.FullURL()),
+			})
+		})
+
+		uploadsRouter.Get("/{hash}/{file}", func(w http.ResponseWriter, r *http.Request) {
+			hash, file := chi.URLParam(r, "hash"), chi.URLParam(r, "file")
+			if !uploadHashRegexp.MatchString(hash) || !uploadFileRegexp.MatchString(file) {
+				http.Error(w, "upload not found", http.StatusNotFound)
+				return
+			}
+
+			f, modTime, err := blobs.Open(r.Context(), hash+"/"+file)
+			if err != nil {
+				if errors.Is(err, ErrBlobNotFound) {
+					http.Error(w, "upload not found", http.StatusNotFound)
+					return
+				}
+				http.Error(w, "failed to open upload", http.StatusInternalServerError)
+				return
+			}
+			defer f.Close()
+
+			w.Header().Set("Content-Type", uploadContentTypes[path.Ext(file)[1:]])
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+			w.Header().Set("ETag", fmt.Sprintf(`"%s/%s"`, hash, file))
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			http.ServeContent(w, r, "", modTime, f)
+		})
+	})
+}
+
+// readImageUpload reads the file in the multipart field of r, refusing
+// anything over maxSize.
+func readImageUpload(w http.ResponseWriter, r *http.Request, field string, maxSize int64) ([]byte, string, error) {
+	// Leave room for the rest of the multipart body
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1<<20)
+	if err := r.ParseMultipartForm(maxSize); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return nil, "", fmt.Errorf("image is larger than %s", humanize.IBytes(uint64(maxSize)))
+		}
+		return nil, "", errors.New("failed to parse upload")
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	headers := r.MultipartForm.File[field]
+	if len(headers) == 0 {
+		return nil, "", errors.New("no image uploaded")
+	}
+	header := headers[0]
+	if header.Size > maxSize {
+		return nil, "", fmt.Errorf("image is larger than %s", humanize.IBytes(uint64(maxSize)))
+	}
+
+	data, err := readUpload(header)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, header.Filename, nil
+}
+
+// saveUploadedImage stores every variant of kind for an image userID
+// uploaded. Variants live under the hash of the uploaded file, so uploading
+// the same file again reuses what is already stored.
+func saveUploadedImage(ctx context.Context, db *toolbelt.Database, blobs BlobStore, userID int64, kind string, data []byte) (*UploadedImage, error) {
+	k, ok := imageKinds[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown image kind %q", kind)
+	}
+
+	decoded, err := decodeUploadedImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	img := &UploadedImage{
+		Kind: kind,
+		Hash: hex.EncodeToString(sum[:]),
+		Ext:  imageFormat(decoded),
+	}
+
+	encoded, err := encodeImageVariants(decoded, img.Ext, k.Variants)
+	if err != nil {
+		return nil, err
+	}
+	img.Width, img.Height = encoded[0].Width, encoded[0].Height
+
+	for _, variant := range encoded {
+		key := fmt.Sprintf("%s/%s.%s", img.Hash, variant.Variant, img.Ext)
+		exists, err := blobs.Exists(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+		if err := blobs.Put(ctx, key, variant.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := db.WriteTX(ctx, func(tx *sqlite.Conn) error {
+		if err := zz.OnceCreateUpload(tx, &zz.UploadModel{
+			Id:        toolbelt.NextID(),
+			UserId:    userID,
+			Hash:      img.Hash,
+			Kind:      kind,
+			Ext:       img.Ext,
+			Width:     int64(img.Width),
+			Height:    int64(img.Height),
+			Size:      int64(len(data)),
+			CreatedAt: time.Now(),
+		}); err != nil {
+			return fmt.Errorf("failed to record upload: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
@@ -0,0 +1,173 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/delaneyj/realworld-datastar/config"
+)
+
+type uploadResponse struct {
+	URL      string `json:"url"`
+	Full     string `json:"full"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Markdown string `json:"markdown"`
+}
+
+// upload posts data as the multipart file field, the way the browser does.
+func (ts *testServer) upload(t *testing.T, client *http.Client, path, field, filename string, data []byte) (int, []byte) {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, err := mw.CreateFormFile(field, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := client.Post(ts.URL+path, mw.FormDataContentType(), body)
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", path, err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, b
+}
+
+func TestArticleImageUpload(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "jake")
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+
+	data := encodeJPEG(t, testImage(1000, 500))
+	status, body := ts.upload(t, jake, "/uploads", "image", "my [dragon].jpg", data)
+	if status != http.StatusCreated {
+		t.Fatalf("got status %d: %s", status, body)
+	}
+	res := uploadResponse{}
+	if err := json.Unmarshal(body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(res.URL, "/w800.jpg") || !strings.HasSuffix(res.Full, "/fit2560.jpg") {
+		t.Errorf("got %s and %s", res.URL, res.Full)
+	}
+	if res.Width != 1000 || res.Height != 500 {
+		t.Errorf("got %dx%d, want the original size", res.Width, res.Height)
+	}
+	if want := "[![my dragon](" + res.URL + ")](" + res.Full + ")"; res.Markdown != want {
+		t.Errorf("got %q, want %q", res.Markdown, want)
+	}
+
+	for _, variant := range imageKinds[ImageKindArticle].Variants {
+		url := strings.Replace(res.URL, "w800", variant.Name, 1)
+		r, err := http.Get(ts.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		if r.StatusCode != http.StatusOK {
+			t.Errorf("%s: got status %d", url, r.StatusCode)
+			continue
+		}
+		if r.Header.Get("Content-Type") != "image/jpeg" || !strings.Contains(r.Header.Get("Cache-Control"), "immutable") {
+			t.Errorf("%s: got %q cached %q", url, r.Header.Get("Content-Type"), r.Header.Get("Cache-Control"))
+		}
+	}
+
+	// The same file is stored once, under the same URLs
+	_, body = ts.upload(t, jake, "/uploads", "image", "again.jpg", data)
+	again := uploadResponse{}
+	json.Unmarshal(body, &again)
+	if again.URL != res.URL {
+		t.Errorf("got %s uploading again, want %s", again.URL, res.URL)
+	}
+}
+
+func TestArticleImageUploadRejected(t *testing.T) {
+	ts := newTestServer(t, func(cfg *config.Config) {
+		cfg.UploadMaxSize = 1 << 10
+	})
+	ts.register(t, "jake")
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+
+	if status, _ := ts.upload(t, ts.browser(t), "/uploads", "image", "a.png", encodePNG(t, testImage(2, 2))); status != http.StatusUnauthorized {
+		t.Errorf("signed out: got status %d, want %d", status, http.StatusUnauthorized)
+	}
+
+	for name, tc := range map[string]struct {
+		field string
+		data  []byte
+		want  string
+	}{
+		"too large":    {field: "image", data: bytes.Repeat([]byte{0}, 2<<10), want: "image is larger than 1.0 KiB"},
+		"not an image": {field: "image", data: []byte("<html><script>alert(1)</script></html>"), want: "unsupported image type"},
+		"wrong field":  {field: "file", data: encodePNG(t, testImage(2, 2)), want: "no image uploaded"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			status, body := ts.upload(t, jake, "/uploads", tc.field, "a.png", tc.data)
+			if status != http.StatusUnprocessableEntity || !strings.Contains(string(body), tc.want) {
+				t.Errorf("got status %d: %s, want %q", status, body, tc.want)
+			}
+		})
+	}
+}
+
+func TestServeUploadNotFound(t *testing.T) {
+	ts := newTestServer(t)
+	hash := strings.Repeat("a", 64)
+
+	for _, path := range []string{
+		"/uploads/" + hash + "/w800.jpg",
+		"/uploads/" + hash + "/w800.svg",
+		"/uploads/nothex/w800.jpg",
+		"/uploads/" + hash + "/..%2f..%2fdatabase.jpg",
+	} {
+		if status, _ := ts.get(t, nil, path); status != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", path, status, http.StatusNotFound)
+		}
+	}
+}
+
+func TestAvatarUpload(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+
+	status, body := ts.upload(t, jake, "/settings/avatar", "avatar", "me.png", encodePNG(t, testImage(300, 200)))
+	if status != http.StatusSeeOther {
+		t.Fatalf("got status %d: %s", status, body)
+	}
+
+	res := struct {
+		User struct {
+			Image string `json:"image"`
+		} `json:"user"`
+	}{}
+	ts.api(t, http.MethodGet, "/api/user", token, nil, &res)
+	if !strings.HasPrefix(res.User.Image, "/uploads/") || !strings.HasSuffix(res.User.Image, "/s256.jpg") {
+		t.Fatalf("got image %q", res.User.Image)
+	}
+	if status, _ := ts.get(t, nil, res.User.Image); status != http.StatusOK {
+		t.Errorf("avatar: got status %d", status)
+	}
+
+	if status, _ := ts.upload(t, jake, "/settings/avatar", "avatar", "me.txt", []byte("hello")); status != http.StatusUnprocessableEntity {
+		t.Errorf("not an image: got status %d, want %d", status, http.StatusUnprocessableEntity)
+	}
+}
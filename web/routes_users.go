@@ -1,9 +1,13 @@
 package web
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 
 	"github.com/delaneyj/datastar"
 	"github.com/delaneyj/realworld-datastar/sql/zz"
@@ -12,7 +16,7 @@ import (
 	"zombiezen.com/go/sqlite"
 )
 
-func setupUsersRoutes(r chi.Router, db *toolbelt.Database) {
+func setupUsersRoutes(r chi.Router, db *toolbelt.Database, hub *Hub, pageSize int64) {
 	r.Route("/users/{userID}", func(userRouter chi.Router) {
 		userRouter.Get("/", func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
@@ -47,9 +51,12 @@ func setupUsersRoutes(r chi.Router, db *toolbelt.Database) {
 			feedData := &FeedData{
 				Names:   []string{"my", "favorited"},
 				Current: feed,
-				Limit:   3,
+				Limit:   pageSize,
 				Offset:  offset,
 			}
+			if me != nil && me.Id == userID {
+				feedData.Names = append(feedData.Names, "drafts")
+			}
 
 			validFeedName := false
 			for _, name := range feedData.Names {
@@ -100,6 +107,7 @@ func setupUsersRoutes(r chi.Router, db *toolbelt.Database) {
 					for _, row := range res {
 						preview := &ArticlePreview{
 							ArticleId:   row.ArticleId,
+							Slug:        row.Slug,
 							AuthorID:    row.AuthorId,
 							Username:    row.Username,
 							ImageUrl:    row.ImageUrl,
@@ -127,6 +135,7 @@ func setupUsersRoutes(r chi.Router, db *toolbelt.Database) {
 					for _, row := range res {
 						preview := &ArticlePreview{
 							ArticleId:   row.ArticleId,
+							Slug:        row.Slug,
 							AuthorID:    row.AuthorId,
 							Username:    row.Username,
 							ImageUrl:    row.ImageUrl,
@@ -140,6 +149,36 @@ func setupUsersRoutes(r chi.Router, db *toolbelt.Database) {
 					if err != nil {
 						return fmt.Errorf("failed to get total articles by favoriter: %w", err)
 					}
+
+				case "drafts":
+					res, err := zz.OnceDraftArticlePreviewsByAuthor(tx, zz.DraftArticlePreviewsByAuthorParams{
+						AuthorId: userID,
+						Limit:    feedData.Limit,
+						Offset:   feedData.Offset,
+					})
+					if err != nil {
+						return fmt.Errorf("failed to get drafts by author: %w", err)
+					}
+
+					for _, row := range res {
+						preview := &ArticlePreview{
+							ArticleId:   row.ArticleId,
+							Slug:        row.Slug,
+							AuthorID:    row.AuthorId,
+							Username:    row.Username,
+							ImageUrl:    row.ImageUrl,
+							Title:       row.Title,
+							Description: row.Description,
+							Status:      row.Status,
+							PublishAt:   row.PublishedAt,
+						}
+						feedData.Articles = append(feedData.Articles, preview)
+					}
+
+					feedData.TotalArticles, err = zz.OnceDraftArticleCountByAuthor(tx, userID)
+					if err != nil {
+						return fmt.Errorf("failed to get total drafts by author: %w", err)
+					}
 				}
 
 				for _, preview := range feedData.Articles {
@@ -170,6 +209,74 @@ func setupUsersRoutes(r chi.Router, db *toolbelt.Database) {
 			PageUser(r, me, u, isFollowing, feedData).Render(r.Context(), w)
 		})
 
+		userRouter.Get("/feed.{format}", syndicationHandler(db, authorSyndication(db)))
+
+		userRouter.Get("/articles.zip", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+
+			userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+			if err != nil {
+				http.Error(w, "invalid user ID", http.StatusBadRequest)
+				return
+			}
+
+			var user *zz.UserModel
+			if err := db.ReadTX(ctx, func(tx *sqlite.Conn) (err error) {
+				user, err = zz.OnceReadByIDUser(tx, userID)
+				if err != nil {
+					return fmt.Errorf("failed to get user: %w", err)
+				}
+				return nil
+			}); err != nil {
+				http.Error(w, "failed to get user", http.StatusInternalServerError)
+				return
+			}
+			if user == nil {
+				http.Error(w, "user not found", http.StatusNotFound)
+				return
+			}
+
+			// Written to a buffer first so a failure can still be reported
+			buf := &bytes.Buffer{}
+			me, _ := UserFromContext(ctx)
+			if err := ExportArticles(ctx, db, buf, userID, me != nil && me.Id == userID); err != nil {
+				http.Error(w, "failed to export articles", http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/zip")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", user.Username+"-articles.zip"))
+			w.Write(buf.Bytes())
+		})
+
+		userRouter.Get("/updates", func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			me, _ := UserFromContext(ctx)
+
+			userIDRaw := chi.URLParam(r, "userID")
+			userID, err := strconv.ParseInt(userIDRaw, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid user ID", http.StatusBadRequest)
+				return
+			}
+
+			updates, unsubscribe := hub.Subscribe(UserTopic(userID))
+			defer unsubscribe()
+
+			sse := datastar.NewSSE(w, r)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-updates:
+					if err := renderProfileUpdates(ctx, db, sse, me, userID); err != nil {
+						datastar.RenderFragmentTempl(sse, errorMessages(err))
+						return
+					}
+				}
+			}
+		})
+
 		userRouter.Route("/follow", func(followRouter chi.Router) {
 			followRouter.Post("/", func(w http.ResponseWriter, r *http.Request) {
 				ctx := r.Context()
@@ -206,11 +313,11 @@ func setupUsersRoutes(r chi.Router, db *toolbelt.Database) {
 					return
 				}
 
-				sse := datastar.NewSSE(w, r)
+				hub.Publish(UserTopic(userID))
 
-				from := r.URL.Query().Get("from")
-				if from != "" {
-					datastar.Redirect(sse, from)
+				sse := datastar.NewSSE(w, r)
+				if err := renderFollowUpdates(ctx, db, sse, me, userID, r.URL.Query().Get("from")); err != nil {
+					datastar.RenderFragmentTempl(sse, errorMessages(err))
 				}
 			})
 
@@ -243,13 +350,77 @@ func setupUsersRoutes(r chi.Router, db *toolbelt.Database) {
 					return
 				}
 
-				sse := datastar.NewSSE(w, r)
+				hub.Publish(UserTopic(userID))
 
-				from := r.URL.Query().Get("from")
-				if from != "" {
-					datastar.Redirect(sse, from)
+				sse := datastar.NewSSE(w, r)
+				if err := renderFollowUpdates(ctx, db, sse, me, userID, r.URL.Query().Get("from")); err != nil {
+					datastar.RenderFragmentTempl(sse, errorMessages(err))
 				}
 			})
 		})
 	})
 }
+
+// renderProfileUpdates merges the live parts of a profile page, as seen by
+// me, into an open page.
+func renderProfileUpdates(ctx context.Context, db *toolbelt.Database, sse *datastar.ServerSentEventsHandler, me *zz.UserModel, userID int64) error {
+	var (
+		u           *zz.UserModel
+		isFollowing bool
+	)
+	if err := db.ReadTX(ctx, func(tx *sqlite.Conn) (err error) {
+		u, err = zz.OnceReadByIDUser(tx, userID)
+		if err != nil {
+			return fmt.Errorf("failed to get user by ID: %w", err)
+		}
+
+		if me != nil {
+			isFollowing, err = zz.OnceIsUserFollowing(tx, zz.IsUserFollowingParams{
+				UserId:    me.Id,
+				FollowsId: userID,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to check if user is following: %w", err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if u == nil {
+		return nil
+	}
+
+	datastar.RenderFragmentTempl(sse, profileFollowButton(me, u, isFollowing))
+	return nil
+}
+
+// renderFollowUpdates refreshes the page a follow button was clicked on, from
+// is the path of that page.
+func renderFollowUpdates(ctx context.Context, db *toolbelt.Database, sse *datastar.ServerSentEventsHandler, me *zz.UserModel, userID int64, from string) error {
+	if from == fmt.Sprintf("/users/%d", userID) {
+		return renderProfileUpdates(ctx, db, sse, me, userID)
+	}
+
+	if escapedSlug, ok := strings.CutPrefix(from, "/articles/"); ok {
+		slug, _ := url.PathUnescape(escapedSlug)
+		var articleID int64
+		if err := db.ReadTX(ctx, func(tx *sqlite.Conn) (err error) {
+			articleID, err = zz.OnceArticleIdBySlug(tx, slug)
+			if err != nil {
+				return fmt.Errorf("failed to get article by slug: %w", err)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if articleID != 0 {
+			return renderArticleUpdates(ctx, db, sse, me, articleID)
+		}
+	}
+
+	if from != "" {
+		datastar.Redirect(sse, from)
+	}
+	return nil
+}
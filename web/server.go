@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/a-h/templ"
+	"github.com/delaneyj/realworld-datastar/config"
 	"github.com/delaneyj/realworld-datastar/sql/zz"
 	"github.com/delaneyj/toolbelt"
 	"github.com/go-chi/chi/v5"
@@ -19,7 +21,8 @@ import (
 type CtxKey string
 
 const (
-	CtxKeyUser CtxKey = "user"
+	CtxKeyUser      CtxKey = "user"
+	CtxKeyArticleID CtxKey = "articleID"
 )
 
 func UserFromContext(ctx context.Context) (*zz.UserModel, bool) {
@@ -31,9 +34,31 @@ func ContextWithUser(ctx context.Context, user *zz.UserModel) context.Context {
 	return context.WithValue(ctx, CtxKeyUser, user)
 }
 
-func RunHTTPServer(setupCtx context.Context, db *toolbelt.Database) error {
-	sessionStore := sessions.NewCookieStore([]byte("conduit"))
-	sessionStore.MaxAge(int(24 * time.Hour / time.Second))
+func RunHTTPServer(setupCtx context.Context, cfg *config.Config, db *toolbelt.Database, tokens *TokenAuthority) error {
+	router, err := NewRouter(setupCtx, cfg, db, tokens)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Addr:    cfg.HTTPAddr,
+		Handler: router,
+	}
+
+	log.Printf("Stashing server on http://localhost%s", srv.Addr)
+
+	go func() {
+		<-setupCtx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	return srv.ListenAndServe()
+}
+
+// NewRouter sets up every route, and runs the background jobs they rely on
+// until setupCtx is done.
+func NewRouter(setupCtx context.Context, cfg *config.Config, db *toolbelt.Database, tokens *TokenAuthority) (http.Handler, error) {
+	sessionStore := sessions.NewCookieStore([]byte(cfg.SessionSecret))
+	sessionStore.MaxAge(int(cfg.SessionMaxAge / time.Second))
 
 	router := chi.NewRouter()
 	router.Use(
@@ -41,21 +66,45 @@ func RunHTTPServer(setupCtx context.Context, db *toolbelt.Database) error {
 		middleware.Recoverer,
 		func(next http.Handler) http.Handler {
 			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				session, err := sessionStore.Get(r, "conduit")
-				if err != nil {
-					http.Error(w, "failed to get session", http.StatusInternalServerError)
-					return
-				}
+				var userID, sessionVersion int64
+
+				authHeader := r.Header.Get("Authorization")
+				if authHeader != "" {
+					// User from API token
+					rawToken, ok := strings.CutPrefix(authHeader, "Token ")
+					if !ok {
+						rawToken, ok = strings.CutPrefix(authHeader, "Bearer ")
+					}
+					if !ok {
+						apiError(w, http.StatusUnauthorized, errAPIUnauthorized)
+						return
+					}
 
-				// User from session
-				userID, ok := session.Values["userID"].(int64)
-				if !ok {
-					next.ServeHTTP(w, r)
-					return
+					var err error
+					userID, sessionVersion, err = tokens.Verify(rawToken)
+					if err != nil {
+						apiError(w, http.StatusUnauthorized, errAPIUnauthorized)
+						return
+					}
+				} else {
+					session, err := sessionStore.Get(r, "conduit")
+					if err != nil {
+						http.Error(w, "failed to get session", http.StatusInternalServerError)
+						return
+					}
+
+					// User from session
+					sessionUserID, ok := session.Values["userID"].(int64)
+					if !ok {
+						next.ServeHTTP(w, r)
+						return
+					}
+					userID = sessionUserID
+					sessionVersion, _ = session.Values["sessionVersion"].(int64)
 				}
 
 				var user *zz.UserModel
-				if err := db.ReadTX(r.Context(), func(tx *sqlite.Conn) error {
+				if err := db.ReadTX(r.Context(), func(tx *sqlite.Conn) (err error) {
 					user, err = zz.OnceReadByIDUser(tx, userID)
 					if err != nil {
 						return fmt.Errorf("failed to get user by ID: %w", err)
@@ -66,30 +115,59 @@ func RunHTTPServer(setupCtx context.Context, db *toolbelt.Database) error {
 					return
 				}
 
+				// Signed out everywhere since this session or token was issued
+				if user != nil && user.SessionVersion != sessionVersion {
+					if authHeader != "" {
+						apiError(w, http.StatusUnauthorized, errAPIUnauthorized)
+						return
+					}
+					next.ServeHTTP(w, r)
+					return
+				}
+
 				ctx := ContextWithUser(r.Context(), user)
 				next.ServeHTTP(w, r.WithContext(ctx))
 			})
 		},
 	)
 
-	setupHomeRoutes(router, db)
-	setupAuthRoutes(router, db, sessionStore)
-	setupSettingsRoutes(router, db)
-	setupUsersRoutes(router, db)
-	setupArticlesRoutes(router, db)
+	hub := NewHub()
+	go runPublishScheduler(setupCtx, db, hub)
+	go runLoginAttemptPruner(setupCtx, db)
 
-	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: router,
-	}
+	blobs := NewFileBlobStore(cfg.UploadFolder())
 
-	log.Printf("Stashing server on http://localhost%s", srv.Addr)
+	var mailer Mailer = NewMaildirMailer(cfg.MailFolder(), cfg.MailFrom)
+	if cfg.SMTPAddr != "" {
+		smtpMailer, err := NewSMTPMailer(cfg.SMTPAddr, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom)
+		if err != nil {
+			return nil, err
+		}
+		mailer = smtpMailer
+	}
 
-	go func() {
-		<-setupCtx.Done()
-		srv.Shutdown(context.Background())
-	}()
-	return srv.ListenAndServe()
+	verifier := NewEmailVerifier(db, mailer, cfg.BaseURL, cfg.EmailVerificationExpiry)
+	providers := NewOIDCProviders(cfg.OIDCProviders)
+	trustedProxies, err := cfg.TrustedProxyPrefixes()
+	if err != nil {
+		return nil, err
+	}
+	throttle := NewLoginThrottle(db, cfg.LoginMaxFailures, cfg.LoginIPMaxFailures, cfg.LoginLockout, trustedProxies)
+
+	setupHomeRoutes(router, db, cfg.FeedPageSize)
+	setupAuthRoutes(router, db, sessionStore, mailer, cfg.BaseURL, cfg.PasswordResetExpiry, verifier, providers, throttle)
+	setupSettingsRoutes(router, db, hub, blobs, cfg.UploadMaxSize, verifier, providers)
+	setupUsersRoutes(router, db, hub, cfg.FeedPageSize)
+	setupArticlesRoutes(router, db, hub, cfg.RequireVerifiedEmail)
+	setupSearchRoutes(router, db)
+	setupSyndicationRoutes(router, db)
+	setupUploadRoutes(router, db, blobs, cfg.UploadMaxSize, cfg.RequireVerifiedEmail)
+	setupAvatarRoutes(router)
+	setupSitemapRoutes(router, db, cfg.RobotsDisallowPaths())
+	setupAdminRoutes(router, db, throttle)
+	setupAPIRoutes(router, db, tokens, hub, verifier, throttle, cfg.RequireVerifiedEmail)
+
+	return router, nil
 }
 
 // func userRequiredMiddleware(next http.Handler) http.Handler {
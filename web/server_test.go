@@ -0,0 +1,263 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/config"
+	"github.com/delaneyj/realworld-datastar/sql"
+	"github.com/delaneyj/toolbelt"
+	"zombiezen.com/go/sqlite"
+)
+
+// testServer is the whole app over a fresh database in a temporary data
+// folder.
+type testServer struct {
+	*httptest.Server
+	cfg    *config.Config
+	db     *toolbelt.Database
+	tokens *TokenAuthority
+}
+
+func newTestConfig(t *testing.T) *config.Config {
+	t.Helper()
+
+	cfg := config.Default()
+	cfg.DataFolder = t.TempDir()
+	return cfg
+}
+
+func newTestDB(t *testing.T, cfg *config.Config) *toolbelt.Database {
+	t.Helper()
+
+	db, err := sql.OpenDB(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func newTestServer(t *testing.T, configure ...func(cfg *config.Config)) *testServer {
+	t.Helper()
+
+	cfg := newTestConfig(t)
+	for _, fn := range configure {
+		fn(cfg)
+	}
+	db := newTestDB(t, cfg)
+
+	tokens, err := NewEphemeralTokenAuthority(cfg.JWTExpiry)
+	if err != nil {
+		t.Fatalf("failed to create token authority: %v", err)
+	}
+
+	// Links in emails need the address before the routes are set up
+	srv := httptest.NewUnstartedServer(nil)
+	cfg.BaseURL = "http://" + srv.Listener.Addr().String()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	router, err := NewRouter(ctx, cfg, db, tokens)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	srv.Config.Handler = router
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	return &testServer{
+		Server: srv,
+		cfg:    cfg,
+		db:     db,
+		tokens: tokens,
+	}
+}
+
+// browser is a client that keeps the session cookie between requests and
+// doesn't follow redirects, so they can be checked.
+func (ts *testServer) browser(t *testing.T) *http.Client {
+	t.Helper()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("failed to create cookie jar: %v", err)
+	}
+	return &http.Client{
+		Jar:     jar,
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// api sends body as JSON with token, if any, and decodes the response into
+// out, if any.
+func (ts *testServer) api(t *testing.T, method, path, token string, body, out any) int {
+	t.Helper()
+
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("failed to marshal body: %v", err)
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, reqBody)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Token "+token)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer res.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			t.Fatalf("failed to decode %s %s response: %v", method, path, err)
+		}
+	}
+	return res.StatusCode
+}
+
+type apiErrorsResponse struct {
+	Errors struct {
+		Body []string `json:"body"`
+	} `json:"errors"`
+}
+
+// register signs up username through the API and returns its id and token.
+func (ts *testServer) register(t *testing.T, username string) (int64, string) {
+	t.Helper()
+
+	res := struct {
+		User apiUser `json:"user"`
+	}{}
+	status := ts.api(t, http.MethodPost, "/api/users", "", map[string]any{
+		"user": map[string]string{
+			"username": username,
+			"email":    username + "@example.com",
+			"password": "password1234",
+		},
+	}, &res)
+	if status != http.StatusCreated {
+		t.Fatalf("registering %s: got status %d", username, status)
+	}
+
+	userID, _, err := ts.tokens.Verify(res.User.Token)
+	if err != nil {
+		t.Fatalf("failed to verify token: %v", err)
+	}
+	return userID, res.User.Token
+}
+
+// exec runs statements against the database, for setting up what the app
+// can't be asked to.
+func (ts *testServer) exec(t *testing.T, query string, args ...any) {
+	t.Helper()
+
+	if err := ts.db.WriteTX(context.Background(), func(tx *sqlite.Conn) error {
+		stmt, _, err := tx.PrepareTransient(query)
+		if err != nil {
+			return err
+		}
+		defer stmt.Finalize()
+		for i, arg := range args {
+			switch v := arg.(type) {
+			case int64:
+				stmt.BindInt64(i+1, v)
+			case string:
+				stmt.BindText(i+1, v)
+			default:
+				return fmt.Errorf("unsupported argument %T", arg)
+			}
+		}
+		_, err = stmt.Step()
+		return err
+	}); err != nil {
+		t.Fatalf("failed to exec %q: %v", query, err)
+	}
+}
+
+// signIn signs client in through the login form, as a browser would.
+func (ts *testServer) signIn(t *testing.T, client *http.Client, username string) {
+	t.Helper()
+
+	status, body := ts.datastar(t, client, http.MethodPost, "/auth/login", map[string]string{
+		"email":    username + "@example.com",
+		"password": "password1234",
+	})
+	if status != http.StatusOK || !strings.Contains(body, "redirect /") {
+		t.Fatalf("signing in %s: got status %d: %s", username, status, body)
+	}
+}
+
+// datastar sends signals the way Datastar does and returns the raw response,
+// which is the server sent events for most of these routes.
+func (ts *testServer) datastar(t *testing.T, client *http.Client, method, path string, signals any) (int, string) {
+	t.Helper()
+
+	var reqBody io.Reader
+	if signals != nil {
+		b, err := json.Marshal(signals)
+		if err != nil {
+			t.Fatalf("failed to marshal signals: %v", err)
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, reqBody)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Datastar-Request", "true")
+
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("failed to read %s %s response: %v", method, path, err)
+	}
+	return res.StatusCode, string(b)
+}
+
+// get fetches a page as client, or signed out without one.
+func (ts *testServer) get(t *testing.T, client *http.Client, path string) (int, string) {
+	t.Helper()
+
+	if client == nil {
+		client = ts.browser(t)
+	}
+	res, err := client.Get(ts.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", path, err)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("failed to read GET %s response: %v", path, err)
+	}
+	return res.StatusCode, string(b)
+}
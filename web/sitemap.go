@@ -0,0 +1,225 @@
+package web
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"github.com/go-chi/chi/v5"
+	"zombiezen.com/go/sqlite"
+)
+
+// sitemapMaxURLs is the most URLs a single sitemap may list, bigger sites are
+// split into pages listed by a sitemap index.
+const sitemapMaxURLs = 50_000
+
+const sitemapNamespace = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"sitemapindex"`
+	Xmlns    string       `xml:"xmlns,attr"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// sitemapSection is one kind of public page, listed in pages of at most
+// sitemapMaxURLs.
+type sitemapSection struct {
+	name  string
+	count func(tx *sqlite.Conn) (int64, error)
+	urls  func(tx *sqlite.Conn, baseURL string, limit, offset int64) ([]sitemapURL, error)
+}
+
+var sitemapSections = []sitemapSection{
+	{
+		name: "articles",
+		count: func(tx *sqlite.Conn) (int64, error) {
+			return zz.OnceGlobalFeedArticleCount(tx)
+		},
+		urls: func(tx *sqlite.Conn, baseURL string, limit, offset int64) ([]sitemapURL, error) {
+			res, err := zz.OnceSitemapArticles(tx, zz.SitemapArticlesParams{Limit: limit, Offset: offset})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get articles: %w", err)
+			}
+			urls := make([]sitemapURL, len(res))
+			for i, row := range res {
+				urls[i] = sitemapURL{
+					Loc:     baseURL + articlePath(row.Slug),
+					LastMod: sitemapTime(row.UpdatedAt),
+				}
+			}
+			return urls, nil
+		},
+	},
+	{
+		name: "profiles",
+		count: func(tx *sqlite.Conn) (int64, error) {
+			return zz.OnceSitemapAuthorCount(tx)
+		},
+		urls: func(tx *sqlite.Conn, baseURL string, limit, offset int64) ([]sitemapURL, error) {
+			res, err := zz.OnceSitemapAuthors(tx, zz.SitemapAuthorsParams{Limit: limit, Offset: offset})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get authors: %w", err)
+			}
+			urls := make([]sitemapURL, len(res))
+			for i, row := range res {
+				urls[i] = sitemapURL{
+					Loc:     fmt.Sprintf("%s/users/%d", baseURL, row.AuthorId),
+					LastMod: sitemapTime(row.UpdatedAt),
+				}
+			}
+			return urls, nil
+		},
+	},
+	{
+		name: "tags",
+		count: func(tx *sqlite.Conn) (int64, error) {
+			return zz.OnceSitemapTagCount(tx)
+		},
+		urls: func(tx *sqlite.Conn, baseURL string, limit, offset int64) ([]sitemapURL, error) {
+			res, err := zz.OnceSitemapTags(tx, zz.SitemapTagsParams{Limit: limit, Offset: offset})
+			if err != nil {
+				return nil, fmt.Errorf("failed to get tags: %w", err)
+			}
+			urls := make([]sitemapURL, len(res))
+			for i, row := range res {
+				urls[i] = sitemapURL{
+					Loc:     baseURL + string(feedURL("/", tagFeedName(row.Name), 0, 0)),
+					LastMod: sitemapTime(row.UpdatedAt),
+				}
+			}
+			return urls, nil
+		},
+	},
+}
+
+// setupSitemapRoutes serves /sitemap.xml, only profiles of users who wrote
+// something are listed, and /robots.txt keeping crawlers out of disallowed.
+func setupSitemapRoutes(r chi.Router, db *toolbelt.Database, disallowed []string) {
+	r.Get("/sitemap.xml", func(w http.ResponseWriter, r *http.Request) {
+		baseURL := requestBaseURL(r)
+
+		var v any
+		if err := db.ReadTX(r.Context(), func(tx *sqlite.Conn) error {
+			counts := make([]int64, len(sitemapSections))
+			var total int64
+			for i, section := range sitemapSections {
+				count, err := section.count(tx)
+				if err != nil {
+					return fmt.Errorf("failed to count %s: %w", section.name, err)
+				}
+				counts[i] = count
+				total += count
+			}
+
+			// Small sites get everything in one sitemap
+			if total+1 <= sitemapMaxURLs {
+				urlSet := &sitemapURLSet{
+					Xmlns: sitemapNamespace,
+					URLs:  []sitemapURL{{Loc: baseURL + "/"}},
+				}
+				for _, section := range sitemapSections {
+					urls, err := section.urls(tx, baseURL, sitemapMaxURLs, 0)
+					if err != nil {
+						return err
+					}
+					urlSet.URLs = append(urlSet.URLs, urls...)
+				}
+				v = urlSet
+				return nil
+			}
+
+			index := &sitemapIndex{Xmlns: sitemapNamespace}
+			for i, section := range sitemapSections {
+				pages := (counts[i] + sitemapMaxURLs - 1) / sitemapMaxURLs
+				for page := int64(1); page <= pages; page++ {
+					index.Sitemaps = append(index.Sitemaps, sitemapURL{
+						Loc: fmt.Sprintf("%s/sitemaps/%s/%d.xml", baseURL, section.name, page),
+					})
+				}
+			}
+			v = index
+			return nil
+		}); err != nil {
+			http.Error(w, "failed to build sitemap", http.StatusInternalServerError)
+			return
+		}
+
+		writeSitemap(w, v)
+	})
+
+	r.Get("/sitemaps/{section}/{page}.xml", func(w http.ResponseWriter, r *http.Request) {
+		var section *sitemapSection
+		for i, s := range sitemapSections {
+			if s.name == chi.URLParam(r, "section") {
+				section = &sitemapSections[i]
+			}
+		}
+		page, err := strconv.ParseInt(chi.URLParam(r, "page"), 10, 64)
+		if section == nil || err != nil || page < 1 {
+			http.Error(w, "sitemap not found", http.StatusNotFound)
+			return
+		}
+
+		urlSet := &sitemapURLSet{Xmlns: sitemapNamespace}
+		if err := db.ReadTX(r.Context(), func(tx *sqlite.Conn) (err error) {
+			urlSet.URLs, err = section.urls(tx, requestBaseURL(r), sitemapMaxURLs, (page-1)*sitemapMaxURLs)
+			return err
+		}); err != nil {
+			http.Error(w, "failed to build sitemap", http.StatusInternalServerError)
+			return
+		}
+		if len(urlSet.URLs) == 0 {
+			http.Error(w, "sitemap not found", http.StatusNotFound)
+			return
+		}
+
+		writeSitemap(w, urlSet)
+	})
+
+	r.Get("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		buf := &strings.Builder{}
+		buf.WriteString("User-agent: *\n")
+		for _, path := range disallowed {
+			fmt.Fprintf(buf, "Disallow: %s\n", path)
+		}
+		fmt.Fprintf(buf, "\nSitemap: %s/sitemap.xml\n", requestBaseURL(r))
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(buf.String()))
+	})
+}
+
+func writeSitemap(w http.ResponseWriter, v any) {
+	buf := &bytes.Buffer{}
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		http.Error(w, "failed to write sitemap", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func sitemapTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
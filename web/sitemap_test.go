@@ -0,0 +1,140 @@
+package web
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/delaneyj/realworld-datastar/config"
+)
+
+func getSitemap(t *testing.T, ts *testServer, path string, v any) {
+	t.Helper()
+
+	status, body := ts.get(t, nil, path)
+	if status != http.StatusOK {
+		t.Fatalf("%s: got status %d", path, status)
+	}
+	if err := xml.Unmarshal([]byte(body), v); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+}
+
+func sitemapLocs(urls []sitemapURL) []string {
+	locs := make([]string, len(urls))
+	for i, u := range urls {
+		locs[i] = u.Loc
+	}
+	return locs
+}
+
+func TestSitemap(t *testing.T) {
+	ts := newTestServer(t)
+	jakeID, jakeToken := ts.register(t, "jake")
+	janeID, janeToken := ts.register(t, "jane")
+	joeID, _ := ts.register(t, "joe")
+	article := createAPIArticle(t, ts, jakeToken, "C++? 50% off/on #sale", "c#")
+	draft := createAPIArticle(t, ts, janeToken, "Draft", "secret")
+	ts.exec(t, "UPDATE articles SET status = 'draft' WHERE slug = ?", draft.Slug)
+	// Noon on 2024-05-06 as a Julian day
+	ts.exec(t, "UPDATE articles SET updated_at = 2460437.0 WHERE slug = ?", article.Slug)
+
+	urlSet := &sitemapURLSet{}
+	getSitemap(t, ts, "/sitemap.xml", urlSet)
+	want := []string{
+		ts.URL + "/",
+		ts.URL + articlePath(article.Slug),
+		fmt.Sprintf("%s/users/%d", ts.URL, jakeID),
+		ts.URL + string(feedURL("/", tagFeedName("c#"), 0, 0)),
+	}
+	if got := sitemapLocs(urlSet.URLs); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Nothing that isn't public, and no profiles without articles
+	for _, u := range urlSet.URLs {
+		for _, hidden := range []string{draft.Slug, "secret", fmt.Sprint(janeID), fmt.Sprint(joeID)} {
+			if strings.Contains(u.Loc, hidden) {
+				t.Errorf("%s is listed", u.Loc)
+			}
+		}
+	}
+
+	for _, u := range urlSet.URLs[1:] {
+		if u.LastMod != "2024-05-06T12:00:00Z" {
+			t.Errorf("%s: got lastmod %q, want the article's updated_at", u.Loc, u.LastMod)
+		}
+	}
+}
+
+func TestSitemapIndex(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+	createAPIArticle(t, ts, token, "Dragons")
+
+	// One more tag than fits in a sitemap, all on the one article. Search
+	// reindexes its tags on every insert, which is far too slow for that many.
+	ts.exec(t, "DROP TRIGGER articles_fts_tags_insert")
+	ts.exec(t, fmt.Sprintf(`
+		INSERT INTO tags(name)
+		WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < %d)
+		SELECT 'tag-' || i FROM n
+	`, sitemapMaxURLs+1))
+	ts.exec(t, `INSERT INTO article_tags(article_id, tag_id) SELECT a.id, t.id FROM articles a, tags t`)
+
+	index := &sitemapIndex{}
+	getSitemap(t, ts, "/sitemap.xml", index)
+	want := []string{
+		ts.URL + "/sitemaps/articles/1.xml",
+		ts.URL + "/sitemaps/profiles/1.xml",
+		ts.URL + "/sitemaps/tags/1.xml",
+		ts.URL + "/sitemaps/tags/2.xml",
+	}
+	if got := sitemapLocs(index.Sitemaps); !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	for path, wantURLs := range map[string]int{
+		"/sitemaps/articles/1.xml": 1,
+		"/sitemaps/tags/1.xml":     sitemapMaxURLs,
+		"/sitemaps/tags/2.xml":     1,
+	} {
+		urlSet := &sitemapURLSet{}
+		getSitemap(t, ts, path, urlSet)
+		if len(urlSet.URLs) != wantURLs {
+			t.Errorf("%s: got %d URLs, want %d", path, len(urlSet.URLs), wantURLs)
+		}
+	}
+
+	for _, path := range []string{"/sitemaps/tags/3.xml", "/sitemaps/tags/0.xml", "/sitemaps/nope/1.xml"} {
+		if status, _ := ts.get(t, nil, path); status != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", path, status, http.StatusNotFound)
+		}
+	}
+}
+
+func TestRobots(t *testing.T) {
+	for name, tc := range map[string]struct {
+		disallow string
+		want     string
+	}{
+		"default":  {disallow: config.Default().RobotsDisallow, want: "Disallow: /settings\nDisallow: /auth\nDisallow: /articles/new\nDisallow: /articles/*/edit\nDisallow: /articles/import\nDisallow: /admin\nDisallow: /api\n"},
+		"custom":   {disallow: " /private, /drafts/*", want: "Disallow: /private\nDisallow: /drafts/*\n"},
+		"everyone": {disallow: ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ts := newTestServer(t, func(cfg *config.Config) {
+				cfg.RobotsDisallow = tc.disallow
+			})
+			status, body := ts.get(t, nil, "/robots.txt")
+			if status != http.StatusOK {
+				t.Fatalf("got status %d", status)
+			}
+			if want := "User-agent: *\n" + tc.want + "\nSitemap: " + ts.URL + "/sitemap.xml\n"; body != want {
+				t.Errorf("got %q, want %q", body, want)
+			}
+		})
+	}
+}
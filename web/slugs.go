@@ -0,0 +1,179 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"github.com/go-chi/chi/v5"
+	"zombiezen.com/go/sqlite"
+)
+
+// reservedArticleSlugs would be shadowed by static routes under /articles.
+var reservedArticleSlugs = map[string]struct{}{
+	"new":    {},
+	"import": {},
+}
+
+// articlePath is where the article with slug lives, every link to an article
+// is built from it so slugs are escaped the same way everywhere.
+func articlePath(slug string) string {
+	return "/articles/" + url.PathEscape(slug)
+}
+
+// pathParam is the URL param key unescaped, as chi leaves it escaped when it
+// routes on the raw path.
+func pathParam(r *http.Request, key string) string {
+	param := chi.URLParam(r, key)
+	if r.URL.RawPath == "" {
+		return param
+	}
+	if unescaped, err := url.PathUnescape(param); err == nil {
+		return unescaped
+	}
+	return param
+}
+
+func ArticleIDFromContext(ctx context.Context) (int64, bool) {
+	articleID, ok := ctx.Value(CtxKeyArticleID).(int64)
+	return articleID, ok
+}
+
+func ContextWithArticleID(ctx context.Context, articleID int64) context.Context {
+	return context.WithValue(ctx, CtxKeyArticleID, articleID)
+}
+
+// articleResolver looks up the article named by the {articleSlug} URL param.
+// Current slugs are used as is, while old slugs and numeric IDs are
+// permanently redirected to the current slug for page views. Unpublished
+// articles are only found for their author.
+func articleResolver(db *toolbelt.Database) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+
+			// chi routes on the raw path when it has escapes that differ
+			// from the default, like a slash in a slug
+			path := r.URL.Path
+			if r.URL.RawPath != "" {
+				path = r.URL.RawPath
+			}
+			rawRef := chi.URLParam(r, "articleSlug")
+			ref := pathParam(r, "articleSlug")
+
+			var article *zz.ArticleModel
+			if err := db.ReadTX(ctx, func(tx *sqlite.Conn) error {
+				id, err := zz.OnceArticleIdBySlug(tx, ref)
+				if err != nil {
+					return fmt.Errorf("failed to get article by slug: %w", err)
+				}
+				if id == 0 {
+					id, err = zz.OnceArticleIdBySlugHistory(tx, ref)
+					if err != nil {
+						return fmt.Errorf("failed to get article by previous slug: %w", err)
+					}
+				}
+				if id == 0 {
+					if id, err = strconv.ParseInt(ref, 10, 64); err != nil {
+						return nil
+					}
+				}
+
+				article, err = zz.OnceReadByIDArticle(tx, id)
+				if err != nil {
+					return fmt.Errorf("failed to get article: %w", err)
+				}
+				return nil
+			}); err != nil {
+				http.Error(w, "failed to get article", http.StatusInternalServerError)
+				return
+			}
+
+			// Drafts don't exist as far as anyone but their author knows
+			u, _ := UserFromContext(ctx)
+			if article == nil || !articleVisibleTo(article, u) {
+				http.Error(w, "article not found", http.StatusNotFound)
+				return
+			}
+
+			if article.Slug != ref && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+				target := articlePath(article.Slug) + strings.TrimPrefix(path, "/articles/"+rawRef)
+				if r.URL.RawQuery != "" {
+					target += "?" + r.URL.RawQuery
+				}
+				http.Redirect(w, r, target, http.StatusMovedPermanently)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(ContextWithArticleID(ctx, article.Id)))
+		})
+	}
+}
+
+// uniqueArticleSlug derives a slug from title that isn't used, now or in the
+// past, by any other article, adding a numeric suffix on collision.
+func uniqueArticleSlug(tx *sqlite.Conn, articleID int64, title string) (string, error) {
+	base := toolbelt.Kebab(title)
+	if base == "" {
+		base = "article"
+	}
+
+	isTakenStmt := zz.IsArticleSlugTaken(tx)
+	for i := 1; ; i++ {
+		slug := base
+		if i > 1 {
+			slug = fmt.Sprintf("%s-%d", base, i)
+		}
+		if _, ok := reservedArticleSlugs[slug]; ok {
+			continue
+		}
+
+		isTaken, err := isTakenStmt.Run(zz.IsArticleSlugTakenParams{
+			Slug:      slug,
+			ArticleId: articleID,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to check if slug is taken: %w", err)
+		}
+		if !isTaken {
+			return slug, nil
+		}
+	}
+}
+
+// setArticleSlug updates article.Slug for a new title, remembering the old
+// slug so links to it keep working. The caller still has to save the article.
+func setArticleSlug(tx *sqlite.Conn, article *zz.ArticleModel, title string) error {
+	slug, err := uniqueArticleSlug(tx, article.Id, title)
+	if err != nil {
+		return err
+	}
+	if slug == article.Slug {
+		return nil
+	}
+
+	// Moving back to a slug this article used before
+	if err := zz.OnceDeleteArticleSlugHistory(tx, slug); err != nil {
+		return fmt.Errorf("failed to delete slug history: %w", err)
+	}
+
+	if article.Slug != "" {
+		if err := zz.OnceCreateArticleSlug(tx, &zz.ArticleSlugModel{
+			Id:        toolbelt.NextID(),
+			Slug:      article.Slug,
+			CreatedAt: time.Now(),
+			ArticleId: article.Id,
+		}); err != nil {
+			return fmt.Errorf("failed to save previous slug: %w", err)
+		}
+	}
+
+	article.Slug = slug
+	return nil
+}
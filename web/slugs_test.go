@@ -0,0 +1,174 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"zombiezen.com/go/sqlite"
+)
+
+func TestArticlePath(t *testing.T) {
+	for slug, want := range map[string]string{
+		"how-to-train-your-dragon": "/articles/how-to-train-your-dragon",
+		"dragons & co":             "/articles/dragons%20&%20co",
+		"a/b?c#d":                  "/articles/a%2Fb%3Fc%23d",
+		"100%":                     "/articles/100%25",
+		"drachenzähmen":            "/articles/drachenz%C3%A4hmen",
+	} {
+		if got := articlePath(slug); got != want {
+			t.Errorf("articlePath(%q) = %q, want %q", slug, got, want)
+		}
+	}
+}
+
+func TestUniqueArticleSlug(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+
+	first := createAPIArticle(t, ts, token, "How to train your dragon")
+	second := createAPIArticle(t, ts, token, "How to train your dragon")
+	if first.Slug != "how-to-train-your-dragon" || second.Slug != "how-to-train-your-dragon-2" {
+		t.Errorf("got slugs %q and %q", first.Slug, second.Slug)
+	}
+
+	for title, want := range map[string]string{
+		"New":    "new-2",
+		"Import": "import-2",
+	} {
+		if got := createAPIArticle(t, ts, token, title).Slug; got != want {
+			t.Errorf("%q got slug %q, want %q", title, got, want)
+		}
+	}
+
+	// Slugs articles had before stay theirs
+	ts.api(t, http.MethodPut, "/api/articles/"+first.Slug, token, map[string]any{
+		"article": map[string]any{"title": "Dragons"},
+	}, nil)
+	if got := createAPIArticle(t, ts, token, "How to train your dragon").Slug; got != "how-to-train-your-dragon-3" {
+		t.Errorf("got slug %q, want how-to-train-your-dragon-3", got)
+	}
+}
+
+func TestArticleSlugRedirects(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+	article := createAPIArticle(t, ts, token, "How to train your dragon")
+
+	res := apiArticleResponse{}
+	ts.api(t, http.MethodPut, "/api/articles/"+article.Slug, token, map[string]any{
+		"article": map[string]any{"title": "Dragons"},
+	}, &res)
+	if res.Article.Slug != "dragons" {
+		t.Fatalf("got slug %q after renaming", res.Article.Slug)
+	}
+
+	var articleID int64
+	if err := ts.db.ReadTX(context.Background(), func(tx *sqlite.Conn) (err error) {
+		articleID, err = zz.OnceArticleIdBySlug(tx, "dragons")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	client := ts.browser(t)
+	for path, want := range map[string]string{
+		"/articles/how-to-train-your-dragon":             "/articles/dragons",
+		"/articles/how-to-train-your-dragon/history?x=1": "/articles/dragons/history?x=1",
+		"/articles/" + strconv.FormatInt(articleID, 10):  "/articles/dragons",
+	} {
+		res, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusMovedPermanently {
+			t.Errorf("%s: got status %d, want %d", path, res.StatusCode, http.StatusMovedPermanently)
+		}
+		if got := res.Header.Get("Location"); got != want {
+			t.Errorf("%s: redirected to %q, want %q", path, got, want)
+		}
+	}
+
+	if status, _ := ts.get(t, nil, "/articles/dragons"); status != http.StatusOK {
+		t.Errorf("got status %d for the current slug", status)
+	}
+	if status, _ := ts.get(t, nil, "/articles/nope"); status != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown slug", status)
+	}
+}
+
+func TestEditKeepsSlug(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+	first := createAPIArticle(t, ts, token, "Dragons")
+	second := createAPIArticle(t, ts, token, "Dragons")
+	if status := ts.api(t, http.MethodDelete, "/api/articles/"+first.Slug, token, nil, nil); status != http.StatusNoContent {
+		t.Fatalf("deleting: got status %d", status)
+	}
+
+	// The base slug is free again, but only a new title moves the article
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+	edit := func(title string) string {
+		_, body := ts.datastar(t, jake, http.MethodPost, articlePath(second.Slug)+"/edit", ArticleEditData{
+			Title:       title,
+			Description: second.Description,
+			Body:        "Edited " + title,
+			Status:      ArticlePublished,
+		})
+		return body
+	}
+	if body := edit("Dragons"); !strings.Contains(body, "redirect "+articlePath("dragons-2")) {
+		t.Errorf("editing the body: %s", body)
+	}
+	if body := edit("Dragons again"); !strings.Contains(body, "redirect "+articlePath("dragons-again")) {
+		t.Errorf("editing the title: %s", body)
+	}
+}
+
+func TestArticleSlugWithPunctuation(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+
+	// Kebab case keeps punctuation, which has to be escaped in links
+	article := createAPIArticle(t, ts, token, "C++? 50% off/on #sale")
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+	for _, path := range []string{articlePath(article.Slug), articlePath(article.Slug) + "/history", articlePath(article.Slug) + ".md"} {
+		if status, _ := ts.get(t, jake, path); status != http.StatusOK {
+			t.Errorf("%s: got status %d", path, status)
+		}
+	}
+	if status := ts.api(t, http.MethodGet, "/api/articles/"+url.PathEscape(article.Slug), "", nil, nil); status != http.StatusOK {
+		t.Errorf("got API status %d", status)
+	}
+}
+
+func TestArticleLinksEscapeSlugs(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+	createAPIArticle(t, ts, token, "Dragons")
+
+	// Slugs are kebab case when made here, but not necessarily when imported
+	ts.exec(t, `UPDATE articles SET slug = ? WHERE slug = 'dragons'`, "dragons & co/2")
+
+	_, body := ts.get(t, nil, "/?feed=global")
+	if !strings.Contains(body, `href="/articles/dragons%20&amp;%20co%2F2"`) {
+		t.Error("home page doesn't link to the escaped slug")
+	}
+	status, body := ts.get(t, nil, "/articles/dragons%20&%20co%2F2")
+	if status != http.StatusOK {
+		t.Fatalf("got status %d for the escaped slug", status)
+	}
+	if !strings.Contains(body, `/articles/dragons%20&amp;%20co%2F2/updates`) {
+		t.Error("article page doesn't escape its own slug")
+	}
+	if status := ts.api(t, http.MethodGet, "/api/articles/dragons%20&%20co%2F2", "", nil, nil); status != http.StatusOK {
+		t.Errorf("got API status %d for the escaped slug", status)
+	}
+}
@@ -0,0 +1,294 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/feeds"
+	"zombiezen.com/go/sqlite"
+)
+
+// syndicationSize is how many of the newest articles a feed has.
+const syndicationSize = 20
+
+type syndicationFormat struct {
+	Ext, ContentType, Name string
+}
+
+var syndicationFormats = []syndicationFormat{
+	{Ext: "atom", ContentType: "application/atom+xml", Name: "Atom"},
+	{Ext: "rss", ContentType: "application/rss+xml", Name: "RSS"},
+	{Ext: "json", ContentType: "application/feed+json", Name: "JSON Feed"},
+}
+
+// syndication is a feed of articles, path is the page showing the same
+// articles and articleIDs returns the newest of them.
+type syndication struct {
+	title       string
+	description string
+	path        string
+	articleIDs  func(tx *sqlite.Conn) ([]int64, error)
+}
+
+// FeedLink is a feed advertised in the head of a page.
+type FeedLink struct {
+	Title, Href, ContentType string
+}
+
+func setupSyndicationRoutes(r chi.Router, db *toolbelt.Database) {
+	r.Get("/feed.{format}", syndicationHandler(db, func(r *http.Request) (*syndication, error) {
+		return &syndication{
+			title:       "Conduit",
+			description: "The newest articles on Conduit",
+			path:        "/",
+			articleIDs: func(tx *sqlite.Conn) ([]int64, error) {
+				res, err := zz.OnceGlobalFeedArticlePreviews(tx, zz.GlobalFeedArticlePreviewsParams{
+					Limit: syndicationSize,
+				})
+				if err != nil {
+					return nil, fmt.Errorf("failed to get global feed: %w", err)
+				}
+				ids := make([]int64, len(res))
+				for i, row := range res {
+					ids[i] = row.ArticleId
+				}
+				return ids, nil
+			},
+		}, nil
+	}))
+
+	r.Get("/tags/{tag}/feed.{format}", syndicationHandler(db, func(r *http.Request) (*syndication, error) {
+		tag := chi.URLParam(r, "tag")
+		return &syndication{
+			title:       "Conduit: #" + tag,
+			description: "The newest articles tagged " + tag + " on Conduit",
+			path:        string(feedURL("/", tagFeedName(tag), 0, 0)),
+			articleIDs: func(tx *sqlite.Conn) ([]int64, error) {
+				res, err := zz.OnceArticlePreviewsByTag(tx, zz.ArticlePreviewsByTagParams{
+					Tag:   tag,
+					Limit: syndicationSize,
+				})
+				if err != nil {
+					return nil, fmt.Errorf("failed to get tag feed: %w", err)
+				}
+				ids := make([]int64, len(res))
+				for i, row := range res {
+					ids[i] = row.ArticleId
+				}
+				return ids, nil
+			},
+		}, nil
+	}))
+}
+
+// authorSyndication is the feed of /users/{userID}.
+func authorSyndication(db *toolbelt.Database) func(r *http.Request) (*syndication, error) {
+	return func(r *http.Request) (*syndication, error) {
+		userID, err := strconv.ParseInt(chi.URLParam(r, "userID"), 10, 64)
+		if err != nil {
+			return nil, nil
+		}
+
+		var author *zz.UserModel
+		if err := db.ReadTX(r.Context(), func(tx *sqlite.Conn) (err error) {
+			author, err = zz.OnceReadByIDUser(tx, userID)
+			if err != nil {
+				return fmt.Errorf("failed to get user: %w", err)
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		if author == nil {
+			return nil, nil
+		}
+
+		return &syndication{
+			title:       "Conduit: " + author.Username,
+			description: "The newest articles by " + author.Username + " on Conduit",
+			path:        fmt.Sprintf("/users/%d", author.Id),
+			articleIDs: func(tx *sqlite.Conn) ([]int64, error) {
+				res, err := zz.OnceArticlePreviewsByAuthor(tx, zz.ArticlePreviewsByAuthorParams{
+					AuthorId: author.Id,
+					Limit:    syndicationSize,
+				})
+				if err != nil {
+					return nil, fmt.Errorf("failed to get author feed: %w", err)
+				}
+				ids := make([]int64, len(res))
+				for i, row := range res {
+					ids[i] = row.ArticleId
+				}
+				return ids, nil
+			},
+		}, nil
+	}
+}
+
+// syndicationHandler serves the feed from newSyndication, nil meaning not
+// found, in the format named by the {format} URL param. Responses carry an
+// ETag and Last-Modified so readers polling an unchanged feed get a 304.
+func syndicationHandler(db *toolbelt.Database, newSyndication func(r *http.Request) (*syndication, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		var format *syndicationFormat
+		for i, f := range syndicationFormats {
+			if f.Ext == chi.URLParam(r, "format") {
+				format = &syndicationFormats[i]
+			}
+		}
+		if format == nil {
+			http.Error(w, "unknown feed format", http.StatusNotFound)
+			return
+		}
+
+		s, err := newSyndication(r)
+		if err != nil {
+			http.Error(w, "failed to get feed", http.StatusInternalServerError)
+			return
+		}
+		if s == nil {
+			http.Error(w, "feed not found", http.StatusNotFound)
+			return
+		}
+
+		baseURL := requestBaseURL(r)
+		feed := &feeds.Feed{
+			Id:          baseURL + s.path,
+			Title:       s.title,
+			Description: s.description,
+			Link:        &feeds.Link{Href: baseURL + s.path},
+		}
+		if err := db.ReadTX(ctx, func(tx *sqlite.Conn) error {
+			articleIDs, err := s.articleIDs(tx)
+			if err != nil {
+				return err
+			}
+			for _, articleID := range articleIDs {
+				item, err := syndicationItem(tx, baseURL, articleID)
+				if err != nil {
+					return err
+				}
+				if item.Updated.After(feed.Updated) {
+					feed.Updated = item.Updated
+				}
+				feed.Add(item)
+			}
+			return nil
+		}); err != nil {
+			http.Error(w, "failed to get feed", http.StatusInternalServerError)
+			return
+		}
+		if feed.Updated.IsZero() {
+			feed.Updated = time.Unix(0, 0).UTC()
+		}
+		feed.Created = feed.Updated
+
+		buf := &bytes.Buffer{}
+		switch format.Ext {
+		case "atom":
+			err = feed.WriteAtom(buf)
+		case "rss":
+			err = feed.WriteRss(buf)
+		case "json":
+			err = feed.WriteJSON(buf)
+		}
+		if err != nil {
+			http.Error(w, "failed to write feed", http.StatusInternalServerError)
+			return
+		}
+
+		sum := sha256.Sum256(buf.Bytes())
+		w.Header().Set("Content-Type", format.ContentType+"; charset=utf-8")
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		http.ServeContent(w, r, "", feed.Updated, bytes.NewReader(buf.Bytes()))
+	}
+}
+
+// syndicationItem is an article with its full rendered body.
+func syndicationItem(tx *sqlite.Conn, baseURL string, articleID int64) (*feeds.Item, error) {
+	article, err := zz.OnceReadByIDArticle(tx, articleID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get article: %w", err)
+	}
+	author, err := zz.OnceReadByIDUser(tx, article.AuthorId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get author: %w", err)
+	}
+
+	// Articles that were never viewed since bodies started being rendered
+	// have no cached HTML yet
+	content := article.BodyHtml
+	if content == "" && article.Body != "" {
+		if content, err = RenderMarkdown(article.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	link := baseURL + articlePath(article.Slug)
+	item := &feeds.Item{
+		Id:          fmt.Sprintf("%s/articles/%d", baseURL, article.Id),
+		Title:       article.Title,
+		Link:        &feeds.Link{Href: link},
+		Description: article.Description,
+		Content:     content,
+		Created:     article.CreatedAt.UTC(),
+		Updated:     article.UpdatedAt.UTC(),
+	}
+	if author != nil {
+		item.Author = &feeds.Author{Name: author.Username}
+	}
+	return item, nil
+}
+
+// feedLinks are the feeds with the same articles as the page at r.
+func feedLinks(r *http.Request) []FeedLink {
+	var title, prefix string
+	switch {
+	case r.URL.Path == "/" && r.URL.Query().Get("tag") != "":
+		tag := r.URL.Query().Get("tag")
+		title, prefix = "#"+tag, "/tags/"+url.PathEscape(tag)
+	case r.URL.Path == "/":
+		title, prefix = "Conduit", ""
+	case strings.HasPrefix(r.URL.Path, "/users/"):
+		userID, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/users/"), "/")
+		if _, err := strconv.ParseInt(userID, 10, 64); err != nil {
+			return nil
+		}
+		title, prefix = "Articles by this author", "/users/"+userID
+	default:
+		return nil
+	}
+
+	links := make([]FeedLink, len(syndicationFormats))
+	for i, format := range syndicationFormats {
+		links[i] = FeedLink{
+			Title:       title + " (" + format.Name + ")",
+			Href:        prefix + "/feed." + format.Ext,
+			ContentType: format.ContentType,
+		}
+	}
+	return links
+}
+
+// requestBaseURL is the scheme and host the client used to reach us, taking
+// a TLS terminating proxy in front into account.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
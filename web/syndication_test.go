@@ -0,0 +1,192 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type jsonFeed struct {
+	HomePageURL string `json:"home_page_url"`
+	Items       []struct {
+		ID          string `json:"id"`
+		URL         string `json:"url"`
+		Title       string `json:"title"`
+		ContentHTML string `json:"content_html"`
+	} `json:"items"`
+}
+
+func getFeed(t *testing.T, ts *testServer, path string, header http.Header) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func readJSONFeed(t *testing.T, ts *testServer, path string) *jsonFeed {
+	t.Helper()
+
+	res := getFeed(t, ts, path, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("%s: got status %d", path, res.StatusCode)
+	}
+	feed := &jsonFeed{}
+	if err := json.NewDecoder(res.Body).Decode(feed); err != nil {
+		t.Fatal(err)
+	}
+	return feed
+}
+
+func feedTitles(feed *jsonFeed) string {
+	titles := make([]string, len(feed.Items))
+	for i, item := range feed.Items {
+		titles[i] = item.Title
+	}
+	return strings.Join(titles, ", ")
+}
+
+func TestSyndicationFormats(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+	createAPIArticle(t, ts, token, "Dragons")
+
+	for _, format := range syndicationFormats {
+		t.Run(format.Name, func(t *testing.T) {
+			res := getFeed(t, ts, "/feed."+format.Ext, nil)
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d", res.StatusCode)
+			}
+			if got := res.Header.Get("Content-Type"); got != format.ContentType+"; charset=utf-8" {
+				t.Errorf("got content type %q", got)
+			}
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(body), "All about Dragons") {
+				t.Errorf("feed doesn't have the article: %s", body)
+			}
+		})
+	}
+
+	if res := getFeed(t, ts, "/feed.xml", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown format: got status %d, want %d", res.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestSyndicationItems(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+	article := createAPIArticle(t, ts, token, "C++? 50% off/on #sale")
+	// Written before bodies were rendered
+	ts.exec(t, "UPDATE articles SET body = '# Dragons', body_html = '' WHERE slug = ?", article.Slug)
+
+	feed := readJSONFeed(t, ts, "/feed.json")
+	if feed.HomePageURL != ts.URL+"/" {
+		t.Errorf("got home page %q", feed.HomePageURL)
+	}
+	if len(feed.Items) != 1 {
+		t.Fatalf("got %d items, want 1", len(feed.Items))
+	}
+	item := feed.Items[0]
+	if want := ts.URL + articlePath(article.Slug); item.URL != want {
+		t.Errorf("got link %q, want %q", item.URL, want)
+	}
+	// Stable even if the slug changes
+	if id, ok := strings.CutPrefix(item.ID, ts.URL+"/articles/"); !ok || strings.Trim(id, "0123456789") != "" {
+		t.Errorf("got id %q, want the article's ID URL", item.ID)
+	}
+	if !strings.Contains(item.ContentHTML, "<h1") || !strings.Contains(item.ContentHTML, "Dragons</h1>") {
+		t.Errorf("got content %q, want the rendered body", item.ContentHTML)
+	}
+}
+
+func TestSyndicationFeeds(t *testing.T) {
+	ts := newTestServer(t)
+	jakeID, jakeToken := ts.register(t, "jake")
+	_, janeToken := ts.register(t, "jane")
+	createAPIArticle(t, ts, jakeToken, "Dragons", "dragons")
+	createAPIArticle(t, ts, janeToken, "Wyverns", "dragons", "c#")
+	createAPIArticle(t, ts, janeToken, "Griffins")
+
+	for path, want := range map[string]string{
+		"/feed.json":                               "Griffins, Wyverns, Dragons",
+		"/tags/dragons/feed.json":                  "Wyverns, Dragons",
+		"/tags/c%23/feed.json":                     "Wyverns",
+		"/tags/nope/feed.json":                     "",
+		fmt.Sprintf("/users/%d/feed.json", jakeID): "Dragons",
+	} {
+		if got := feedTitles(readJSONFeed(t, ts, path)); got != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+
+	for _, path := range []string{"/users/9999/feed.json", "/users/jake/feed.json"} {
+		if res := getFeed(t, ts, path, nil); res.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", path, res.StatusCode, http.StatusNotFound)
+		}
+	}
+}
+
+func TestSyndicationConditionalGet(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+	article := createAPIArticle(t, ts, token, "Dragons")
+
+	res := getFeed(t, ts, "/feed.atom", nil)
+	etag, lastModified := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("got ETag %q and Last-Modified %q", etag, lastModified)
+	}
+
+	for name, header := range map[string]http.Header{
+		"If-None-Match":     {"If-None-Match": {etag}},
+		"If-Modified-Since": {"If-Modified-Since": {lastModified}},
+	} {
+		if res := getFeed(t, ts, "/feed.atom", header); res.StatusCode != http.StatusNotModified {
+			t.Errorf("%s: got status %d, want %d", name, res.StatusCode, http.StatusNotModified)
+		}
+	}
+
+	ts.api(t, http.MethodPut, "/api/articles/"+article.Slug, token, map[string]any{
+		"article": map[string]any{"body": "Dragons changed"},
+	}, nil)
+	if res := getFeed(t, ts, "/feed.atom", http.Header{"If-None-Match": {etag}}); res.StatusCode != http.StatusOK {
+		t.Errorf("changed feed: got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+}
+
+func TestFeedLinks(t *testing.T) {
+	ts := newTestServer(t)
+	jakeID, _ := ts.register(t, "jake")
+
+	for path, want := range map[string]string{
+		"/":                                      `href="/feed.atom"`,
+		"/?tag=c%23":                             `href="/tags/c%23/feed.atom"`,
+		fmt.Sprintf("/users/%d?feed=my", jakeID): fmt.Sprintf(`href="/users/%d/feed.atom"`, jakeID),
+	} {
+		_, body := ts.get(t, nil, path)
+		if !strings.Contains(body, `rel="alternate"`) || !strings.Contains(body, want) {
+			t.Errorf("%s doesn't link to its feed with %s", path, want)
+		}
+	}
+
+	_, body := ts.get(t, nil, "/login")
+	if strings.Contains(body, `rel="alternate"`) {
+		t.Error("sign in page links to a feed")
+	}
+}
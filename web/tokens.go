@@ -0,0 +1,136 @@
+package web
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type TokenKey struct {
+	ID     string
+	Secret []byte
+}
+
+// TokenAuthority issues and verifies the HS256 JWTs used by API clients.
+// Tokens are always signed with the current signing key, but any key in the
+// keyring is accepted for verification so keys can be rotated without
+// logging everyone out.
+type TokenAuthority struct {
+	signingKey TokenKey
+	keys       map[string][]byte
+	expiry     time.Duration
+}
+
+func NewTokenAuthority(signingKeyID string, expiry time.Duration, keys ...TokenKey) (*TokenAuthority, error) {
+	if expiry <= 0 {
+		return nil, errors.New("token expiry must be positive")
+	}
+
+	ta := &TokenAuthority{
+		keys:   make(map[string][]byte, len(keys)),
+		expiry: expiry,
+	}
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, errors.New("token key ID is required")
+		}
+		if len(key.Secret) < 32 {
+			return nil, fmt.Errorf("token key %q must be at least 32 bytes", key.ID)
+		}
+		if _, ok := ta.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate token key %q", key.ID)
+		}
+		ta.keys[key.ID] = key.Secret
+	}
+
+	secret, ok := ta.keys[signingKeyID]
+	if !ok {
+		return nil, fmt.Errorf("signing key %q not found", signingKeyID)
+	}
+	ta.signingKey = TokenKey{ID: signingKeyID, Secret: secret}
+
+	return ta, nil
+}
+
+// NewEphemeralTokenAuthority creates an authority with a random key, tokens
+// it issues will not survive a restart.
+func NewEphemeralTokenAuthority(expiry time.Duration) (*TokenAuthority, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate token key: %w", err)
+	}
+	return NewTokenAuthority("ephemeral", expiry, TokenKey{ID: "ephemeral", Secret: secret})
+}
+
+// ParseTokenKeys parses a comma separated list of kid:secret pairs.
+func ParseTokenKeys(raw string) ([]TokenKey, error) {
+	var keys []TokenKey
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		id, secret, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid token key %q, expected kid:secret", pair)
+		}
+		keys = append(keys, TokenKey{ID: id, Secret: []byte(secret)})
+	}
+	return keys, nil
+}
+
+// tokenClaims carry the session version of the user, so tokens issued before
+// they were signed out everywhere stop working.
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	SessionVersion int64 `json:"ver,omitempty"`
+}
+
+func (ta *TokenAuthority) Issue(userID, sessionVersion int64) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, tokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatInt(userID, 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ta.expiry)),
+		},
+		SessionVersion: sessionVersion,
+	})
+	token.Header["kid"] = ta.signingKey.ID
+
+	signed, err := token.SignedString(ta.signingKey.Secret)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %w", err)
+	}
+	return signed, nil
+}
+
+func (ta *TokenAuthority) Verify(raw string) (userID, sessionVersion int64, err error) {
+	claims := &tokenClaims{}
+	if _, err := jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		secret, ok := ta.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown token key %q", kid)
+		}
+		return secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	); err != nil {
+		return 0, 0, fmt.Errorf("invalid token: %w", err)
+	}
+
+	userID, err = strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid token subject: %w", err)
+	}
+	return userID, claims.SessionVersion, nil
+}
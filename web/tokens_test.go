@@ -0,0 +1,199 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	oldTokenKey = TokenKey{ID: "2023", Secret: []byte(strings.Repeat("o", 32))}
+	newTokenKey = TokenKey{ID: "2024", Secret: []byte(strings.Repeat("n", 32))}
+)
+
+func newTestTokenAuthority(t *testing.T, signingKeyID string, keys ...TokenKey) *TokenAuthority {
+	t.Helper()
+
+	ta, err := NewTokenAuthority(signingKeyID, time.Hour, keys...)
+	if err != nil {
+		t.Fatalf("failed to create token authority: %v", err)
+	}
+	return ta
+}
+
+func TestTokenRoundTrip(t *testing.T) {
+	ta := newTestTokenAuthority(t, newTokenKey.ID, newTokenKey)
+
+	raw, err := ta.Issue(42, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, sessionVersion, err := ta.Verify(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID != 42 || sessionVersion != 7 {
+		t.Errorf("got user %d version %d, want 42 and 7", userID, sessionVersion)
+	}
+}
+
+func TestTokenKeyRotation(t *testing.T) {
+	before := newTestTokenAuthority(t, oldTokenKey.ID, oldTokenKey)
+	oldToken, err := before.Issue(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new key signs, the old one is still accepted until it's dropped
+	during := newTestTokenAuthority(t, newTokenKey.ID, oldTokenKey, newTokenKey)
+	if _, _, err := during.Verify(oldToken); err != nil {
+		t.Errorf("token signed with the old key was rejected: %v", err)
+	}
+	newToken, err := during.Issue(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, _, err := jwt.NewParser().ParseUnverified(newToken, &tokenClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kid := parsed.Header["kid"]; kid != newTokenKey.ID {
+		t.Errorf("got kid %v, want %s", kid, newTokenKey.ID)
+	}
+
+	after := newTestTokenAuthority(t, newTokenKey.ID, newTokenKey)
+	if _, _, err := after.Verify(oldToken); err == nil {
+		t.Error("token signed with a dropped key was accepted")
+	}
+	if _, _, err := after.Verify(newToken); err != nil {
+		t.Errorf("token signed with the new key was rejected: %v", err)
+	}
+}
+
+func TestTokenRejected(t *testing.T) {
+	ta := newTestTokenAuthority(t, newTokenKey.ID, newTokenKey)
+
+	sign := func(t *testing.T, method jwt.SigningMethod, key any, kid string, claims jwt.Claims) string {
+		t.Helper()
+
+		token := jwt.NewWithClaims(method, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		raw, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	now := time.Now()
+	valid := tokenClaims{RegisteredClaims: jwt.RegisteredClaims{
+		Subject:   "1",
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+	}}
+
+	for name, raw := range map[string]string{
+		"unknown kid": sign(t, jwt.SigningMethodHS256, newTokenKey.Secret, "nope", valid),
+		"no kid":      sign(t, jwt.SigningMethodHS256, newTokenKey.Secret, "", valid),
+		"wrong key":   sign(t, jwt.SigningMethodHS256, oldTokenKey.Secret, newTokenKey.ID, valid),
+		"other alg":   sign(t, jwt.SigningMethodHS512, newTokenKey.Secret, newTokenKey.ID, valid),
+		"none alg":    sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, newTokenKey.ID, valid),
+		"expired": sign(t, jwt.SigningMethodHS256, newTokenKey.Secret, newTokenKey.ID, tokenClaims{RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "1",
+			IssuedAt:  jwt.NewNumericDate(now.Add(-2 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(now.Add(-time.Hour)),
+		}}),
+		"no expiry": sign(t, jwt.SigningMethodHS256, newTokenKey.Secret, newTokenKey.ID, tokenClaims{RegisteredClaims: jwt.RegisteredClaims{
+			Subject:  "1",
+			IssuedAt: jwt.NewNumericDate(now),
+		}}),
+		"bad subject": sign(t, jwt.SigningMethodHS256, newTokenKey.Secret, newTokenKey.ID, tokenClaims{RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   "jake",
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		}}),
+		"garbage": "not.a.token",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, _, err := ta.Verify(raw); err == nil {
+				t.Error("token was accepted")
+			}
+		})
+	}
+}
+
+func TestNewTokenAuthorityKeys(t *testing.T) {
+	for name, keys := range map[string][]TokenKey{
+		"short secret":   {{ID: "a", Secret: []byte("short")}},
+		"missing id":     {{Secret: newTokenKey.Secret}},
+		"duplicate id":   {newTokenKey, newTokenKey},
+		"no signing key": {oldTokenKey},
+		"no keys at all": nil,
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewTokenAuthority(newTokenKey.ID, time.Hour, keys...); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+func TestParseTokenKeys(t *testing.T) {
+	keys, err := ParseTokenKeys(" 2023:old-secret , ,2024:new:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(keys))
+	}
+	if keys[0].ID != "2023" || string(keys[0].Secret) != "old-secret" {
+		t.Errorf("got %s:%s", keys[0].ID, keys[0].Secret)
+	}
+	// Only the first colon separates the kid
+	if keys[1].ID != "2024" || string(keys[1].Secret) != "new:secret" {
+		t.Errorf("got %s:%s", keys[1].ID, keys[1].Secret)
+	}
+
+	if _, err := ParseTokenKeys("no-separator"); err == nil {
+		t.Error("got no error for a pair without a kid")
+	}
+}
+
+func TestAPITokenAuthentication(t *testing.T) {
+	ts := newTestServer(t)
+	_, token := ts.register(t, "jake")
+
+	get := func(t *testing.T, authorization string) int {
+		t.Helper()
+
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/user", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	for authorization, want := range map[string]int{
+		"Token " + token:  http.StatusOK,
+		"Bearer " + token: http.StatusOK,
+		"Basic " + token:  http.StatusUnauthorized,
+		"Token nope":      http.StatusUnauthorized,
+		"":                http.StatusUnauthorized,
+	} {
+		if got := get(t, authorization); got != want {
+			t.Errorf("%q: got status %d, want %d", authorization, got, want)
+		}
+	}
+}
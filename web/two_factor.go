@@ -0,0 +1,227 @@
+package web
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/delaneyj/toolbelt"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"zombiezen.com/go/sqlite"
+)
+
+const (
+	totpIssuer        = "Conduit"
+	totpPeriod        = 30 * time.Second
+	recoveryCodeCount = 10
+
+	// twoFactorLoginTimeout is how long after the password the code can be
+	// entered
+	twoFactorLoginTimeout = 5 * time.Minute
+)
+
+var (
+	errTwoFactorCodeInvalid  = errors.New("invalid two-factor code")
+	errTwoFactorCodeRequired = errors.New("two-factor code required")
+	errTwoFactorLoginExpired = errors.New("sign in again, this attempt has expired")
+	errTwoFactorSetupExpired = errors.New("start setting up two-factor authentication again")
+)
+
+var totpOpts = totp.ValidateOpts{
+	Period:    uint(totpPeriod / time.Second),
+	Digits:    otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1,
+}
+
+// totpCredential is the authenticator app userID set up, nil if they didn't.
+// It is only used to sign in once confirmed.
+func totpCredential(tx *sqlite.Conn, userID int64) (*zz.TotpCredentialModel, error) {
+	res, err := zz.OnceTotpCredentialByUser(tx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get totp credential: %w", err)
+	}
+	if res == nil {
+		return nil, nil
+	}
+	return &zz.TotpCredentialModel{
+		Id:          res.Id,
+		UserId:      res.UserId,
+		Secret:      res.Secret,
+		ConfirmedAt: res.ConfirmedAt,
+		LastStep:    res.LastStep,
+		CreatedAt:   res.CreatedAt,
+	}, nil
+}
+
+func totpConfirmed(cred *zz.TotpCredentialModel) bool {
+	return cred != nil && cred.ConfirmedAt.After(time.Time{})
+}
+
+// twoFactorEnabled reports whether userID needs a code to sign in.
+func twoFactorEnabled(tx *sqlite.Conn, userID int64) (bool, error) {
+	cred, err := totpCredential(tx, userID)
+	if err != nil {
+		return false, err
+	}
+	return totpConfirmed(cred), nil
+}
+
+// totpKey is what the authenticator app is told about secret, through the
+// QR code or by hand.
+func totpKey(u *zz.UserModel, secret string) (*otp.Key, error) {
+	b, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode totp secret: %w", err)
+	}
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: u.Email,
+		Period:      totpOpts.Period,
+		Secret:      b,
+		Digits:      totpOpts.Digits,
+		Algorithm:   totpOpts.Algorithm,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create totp key: %w", err)
+	}
+	return key, nil
+}
+
+func newTOTPSecret(u *zz.UserModel) (string, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: u.Email,
+		Period:      totpOpts.Period,
+		Digits:      totpOpts.Digits,
+		Algorithm:   totpOpts.Algorithm,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to generate totp secret: %w", err)
+	}
+	return key.Secret(), nil
+}
+
+// checkTOTP returns the time step code is for, allowing for a step of clock
+// drift either way, or zero when it isn't valid. Codes for steps up to
+// cred.LastStep were used already.
+func checkTOTP(cred *zz.TotpCredentialModel, code string, now time.Time) int64 {
+	code = strings.TrimSpace(code)
+	if len(code) != totpOpts.Digits.Length() {
+		return 0
+	}
+	for _, drift := range []time.Duration{-totpPeriod, 0, totpPeriod} {
+		t := now.Add(drift)
+		step := t.Unix() / int64(totpOpts.Period)
+		if step <= cred.LastStep {
+			continue
+		}
+		expected, err := totp.GenerateCodeCustom(cred.Secret, t, totpOpts)
+		if err != nil {
+			return 0
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return 0
+}
+
+// normalizeRecoveryCode ignores case and the dash in the middle, as codes
+// are likely typed in by hand.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// replaceRecoveryCodes gives userID a new set of recovery codes, which are
+// only ever shown this once.
+func replaceRecoveryCodes(tx *sqlite.Conn, userID int64) ([]string, error) {
+	if err := zz.OnceDeleteRecoveryCodesByUser(tx, userID); err != nil {
+		return nil, fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+
+	now := time.Now()
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, fmt.Errorf("failed to generate recovery code: %w", err)
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+
+		if err := zz.OnceCreateRecoveryCode(tx, &zz.RecoveryCodeModel{
+			Id:        toolbelt.NextID(),
+			UserId:    userID,
+			CodeHash:  hashRecoveryCode(code),
+			CreatedAt: now,
+		}); err != nil {
+			return nil, fmt.Errorf("failed to create recovery code: %w", err)
+		}
+	}
+	return codes, nil
+}
+
+// checkSecondFactor accepts a code from the authenticator app or one of the
+// recovery codes of userID, using it up either way.
+func checkSecondFactor(tx *sqlite.Conn, userID int64, code string) error {
+	cred, err := totpCredential(tx, userID)
+	if err != nil {
+		return err
+	}
+	if !totpConfirmed(cred) {
+		return errTwoFactorCodeInvalid
+	}
+
+	if step := checkTOTP(cred, code, time.Now()); step > 0 {
+		cred.LastStep = step
+		if err := zz.OnceUpdateTotpCredential(tx, cred); err != nil {
+			return fmt.Errorf("failed to update totp credential: %w", err)
+		}
+		return nil
+	}
+
+	recoveryCode, err := zz.OnceRecoveryCodeByHash(tx, zz.RecoveryCodeByHashParams{
+		UserId:   userID,
+		CodeHash: hashRecoveryCode(code),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get recovery code: %w", err)
+	}
+	if recoveryCode == nil {
+		return errTwoFactorCodeInvalid
+	}
+	if err := zz.OnceDeleteRecoveryCode(tx, recoveryCode.Id); err != nil {
+		return fmt.Errorf("failed to delete recovery code: %w", err)
+	}
+	return nil
+}
+
+// ResetTwoFactor turns off two-factor authentication for userID, for when
+// they lost their authenticator app and recovery codes. It reports whether it
+// was on.
+func ResetTwoFactor(tx *sqlite.Conn, userID int64) (bool, error) {
+	enabled, err := twoFactorEnabled(tx, userID)
+	if err != nil {
+		return false, err
+	}
+	if err := zz.OnceDeleteTotpCredentialsByUser(tx, userID); err != nil {
+		return false, fmt.Errorf("failed to delete totp credentials: %w", err)
+	}
+	if err := zz.OnceDeleteRecoveryCodesByUser(tx, userID); err != nil {
+		return false, fmt.Errorf("failed to delete recovery codes: %w", err)
+	}
+	return enabled, nil
+}
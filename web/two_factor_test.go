@@ -0,0 +1,331 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/delaneyj/realworld-datastar/sql/zz"
+	"github.com/pquerna/otp/totp"
+	"zombiezen.com/go/sqlite"
+)
+
+var (
+	totpSecretPattern   = regexp.MustCompile(`<code>([A-Z2-7]+)</code>`)
+	recoveryCodePattern = regexp.MustCompile(`<code>([a-z2-7]{4}-[a-z2-7]{4})</code>`)
+)
+
+// totpCode is what an authenticator app shows for secret during step.
+func totpCode(t *testing.T, secret string, step int64) string {
+	t.Helper()
+
+	code, err := totp.GenerateCodeCustom(secret, time.Unix(step*int64(totpOpts.Period), 0), totpOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func currentTOTPStep() int64 {
+	return time.Now().Unix() / int64(totpOpts.Period)
+}
+
+// enableTwoFactor sets up an authenticator app for client through the
+// settings, using the code of the current step, and returns the secret and
+// the recovery codes.
+func enableTwoFactor(t *testing.T, ts *testServer, client *http.Client) (secret string, codes []string) {
+	t.Helper()
+
+	status, page := ts.get(t, client, "/settings/two-factor")
+	if status != http.StatusOK {
+		t.Fatalf("starting setup: got status %d", status)
+	}
+	m := totpSecretPattern.FindStringSubmatch(page)
+	if m == nil {
+		t.Fatalf("setup page doesn't show the secret: %s", page)
+	}
+	secret = m[1]
+
+	_, body := ts.datastar(t, client, http.MethodPost, "/settings/two-factor", TwoFactorForm{Code: totpCode(t, secret, currentTOTPStep())})
+	for _, m := range recoveryCodePattern.FindAllStringSubmatch(body, -1) {
+		codes = append(codes, m[1])
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d: %s", len(codes), recoveryCodeCount, body)
+	}
+	return secret, codes
+}
+
+// lastTOTPStep is the newest step a code was used for by userID.
+func lastTOTPStep(t *testing.T, ts *testServer, userID int64) int64 {
+	t.Helper()
+
+	var cred *zz.TotpCredentialModel
+	if err := ts.db.ReadTX(context.Background(), func(tx *sqlite.Conn) (err error) {
+		cred, err = totpCredential(tx, userID)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if cred == nil {
+		t.Fatal("no totp credential")
+	}
+	return cred.LastStep
+}
+
+// passwordStep signs in a new browser with the password, which leaves it
+// waiting for the code.
+func passwordStep(t *testing.T, ts *testServer, username string) *http.Client {
+	t.Helper()
+
+	ts.forgetLoginAttempts(t)
+	client := ts.browser(t)
+	_, body := ts.datastar(t, client, http.MethodPost, "/auth/login", map[string]string{
+		"email":    username + "@example.com",
+		"password": "password1234",
+	})
+	if !strings.Contains(body, "redirect /auth/two-factor") {
+		t.Fatalf("password step didn't ask for a code: %s", body)
+	}
+	return client
+}
+
+// forgetLoginAttempts lets the next attempt through right away, rather than
+// after backing off for the failed ones before it.
+func (ts *testServer) forgetLoginAttempts(t *testing.T) {
+	t.Helper()
+
+	ts.exec(t, `DELETE FROM login_attempts`)
+}
+
+// submitTwoFactorCode enters code in the second step of signing in client.
+func submitTwoFactorCode(t *testing.T, ts *testServer, client *http.Client, code string) string {
+	t.Helper()
+
+	ts.forgetLoginAttempts(t)
+	_, body := ts.datastar(t, client, http.MethodPost, "/auth/two-factor", TwoFactorForm{Code: code})
+	return body
+}
+
+func TestCheckTOTP(t *testing.T) {
+	const secret = "JBSWY3DPEHPK3PXP"
+	now := time.Unix(1_700_000_015, 0)
+	step := now.Unix() / int64(totpOpts.Period)
+	cred := &zz.TotpCredentialModel{Secret: secret}
+
+	for name, tc := range map[string]struct {
+		code     string
+		lastStep int64
+		want     int64
+	}{
+		"current step":           {code: totpCode(t, secret, step), want: step},
+		"with spaces":            {code: " " + totpCode(t, secret, step) + " ", want: step},
+		"step behind":            {code: totpCode(t, secret, step-1), want: step - 1},
+		"step ahead":             {code: totpCode(t, secret, step+1), want: step + 1},
+		"two steps behind":       {code: totpCode(t, secret, step-2)},
+		"two steps ahead":        {code: totpCode(t, secret, step+2)},
+		"used step":              {code: totpCode(t, secret, step), lastStep: step},
+		"step before a used one": {code: totpCode(t, secret, step-1), lastStep: step},
+		"step after a used one":  {code: totpCode(t, secret, step+1), lastStep: step, want: step + 1},
+		"too short":              {code: "12345"},
+		"not a code":             {code: "abcdef"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cred.LastStep = tc.lastStep
+			if got := checkTOTP(cred, tc.code, now); got != tc.want {
+				t.Errorf("got step %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRecoveryCodeHash(t *testing.T) {
+	if hashRecoveryCode("ABCD-EFGH") != hashRecoveryCode(" abcd efgh") {
+		t.Error("case, spaces and dashes change the hash")
+	}
+	if hashRecoveryCode("abcd-efgh") == hashRecoveryCode("abcd-efgi") {
+		t.Error("different codes have the same hash")
+	}
+}
+
+func TestTwoFactorSetup(t *testing.T) {
+	ts := newTestServer(t)
+	userID, _ := ts.register(t, "jake")
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+
+	_, page := ts.get(t, jake, "/settings/two-factor")
+	secret := totpSecretPattern.FindStringSubmatch(page)[1]
+	res, err := jake.Get(ts.URL + "/settings/two-factor/qr.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "image/png" || res.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf("QR code: got status %d, %s, %s", res.StatusCode, res.Header.Get("Content-Type"), res.Header.Get("Cache-Control"))
+	}
+
+	// A wrong code leaves it off
+	wrong := totpCode(t, secret, currentTOTPStep()-5)
+	if _, body := ts.datastar(t, jake, http.MethodPost, "/settings/two-factor", TwoFactorForm{Code: wrong}); !strings.Contains(body, errTwoFactorCodeInvalid.Error()) {
+		t.Errorf("wrong code: %s", body)
+	}
+	client := ts.browser(t)
+	ts.signIn(t, client, "jake")
+	if !signedIn(t, ts, client) {
+		t.Error("signing in asks for a code after a wrong one")
+	}
+
+	// Every visit starts over with a new secret
+	secret, _ = enableTwoFactor(t, ts, jake)
+	if status, _ := ts.get(t, jake, "/settings/two-factor/qr.png"); status != http.StatusNotFound {
+		t.Errorf("QR code once set up: got status %d, want %d", status, http.StatusNotFound)
+	}
+	if status, _ := ts.get(t, jake, "/settings/two-factor"); status != http.StatusSeeOther {
+		t.Errorf("setup once set up: got status %d, want %d", status, http.StatusSeeOther)
+	}
+	if _, body := ts.datastar(t, jake, http.MethodPost, "/settings/two-factor", TwoFactorForm{Code: totpCode(t, secret, currentTOTPStep())}); !strings.Contains(body, errTwoFactorSetupExpired.Error()) {
+		t.Errorf("confirming twice: %s", body)
+	}
+	passwordStep(t, ts, "jake")
+
+	// Turning it off takes a code too
+	if _, body := ts.datastar(t, jake, http.MethodPost, "/settings/two-factor/disable", TwoFactorForm{Code: wrong}); !strings.Contains(body, errTwoFactorCodeInvalid.Error()) {
+		t.Errorf("turning off with a wrong code: %s", body)
+	}
+	code := totpCode(t, secret, lastTOTPStep(t, ts, userID)+1)
+	if _, body := ts.datastar(t, jake, http.MethodPost, "/settings/two-factor/disable", TwoFactorForm{Code: code}); !strings.Contains(body, "redirect /settings") {
+		t.Fatalf("turning off: %s", body)
+	}
+	ts.forgetLoginAttempts(t)
+	client = ts.browser(t)
+	ts.signIn(t, client, "jake")
+	if !signedIn(t, ts, client) {
+		t.Error("signing in asks for a code after turning it off")
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	ts := newTestServer(t)
+	userID, _ := ts.register(t, "jake")
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+	secret, _ := enableTwoFactor(t, ts, jake)
+
+	client := passwordStep(t, ts, "jake")
+	if signedIn(t, ts, client) {
+		t.Fatal("signed in with just the password")
+	}
+
+	// The code used to turn it on can't be used again
+	used := totpCode(t, secret, lastTOTPStep(t, ts, userID))
+	if body := submitTwoFactorCode(t, ts, client, used); !strings.Contains(body, errTwoFactorCodeInvalid.Error()) {
+		t.Errorf("replayed setup code: %s", body)
+	}
+
+	next := totpCode(t, secret, lastTOTPStep(t, ts, userID)+1)
+	if body := submitTwoFactorCode(t, ts, client, next); !strings.Contains(body, "redirect /") {
+		t.Fatalf("valid code: %s", body)
+	}
+	if !signedIn(t, ts, client) {
+		t.Error("not signed in after the code")
+	}
+
+	// Nor can a code someone saw being typed in
+	other := passwordStep(t, ts, "jake")
+	if body := submitTwoFactorCode(t, ts, other, next); !strings.Contains(body, errTwoFactorCodeInvalid.Error()) {
+		t.Errorf("replayed login code: %s", body)
+	}
+	if signedIn(t, ts, other) {
+		t.Error("signed in with a replayed code")
+	}
+
+	if body := submitTwoFactorCode(t, ts, ts.browser(t), next); !strings.Contains(body, errTwoFactorLoginExpired.Error()) {
+		t.Errorf("code without the password step: %s", body)
+	}
+	if status, _ := ts.get(t, nil, "/auth/two-factor"); status != http.StatusSeeOther {
+		t.Errorf("code page without the password step: got status %d, want %d", status, http.StatusSeeOther)
+	}
+}
+
+func TestTwoFactorLoginPasswordReset(t *testing.T) {
+	ts := newTestServer(t)
+	userID, _ := ts.register(t, "jake")
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+	secret, _ := enableTwoFactor(t, ts, jake)
+
+	// The password was changed between the password step and the code
+	client := passwordStep(t, ts, "jake")
+	ts.exec(t, `UPDATE users SET session_version = session_version + 1 WHERE id = ?`, userID)
+	code := totpCode(t, secret, lastTOTPStep(t, ts, userID)+1)
+	if body := submitTwoFactorCode(t, ts, client, code); !strings.Contains(body, errTwoFactorLoginExpired.Error()) {
+		t.Errorf("code after a password reset: %s", body)
+	}
+}
+
+func TestTwoFactorRecoveryCodes(t *testing.T) {
+	ts := newTestServer(t)
+	ts.register(t, "jake")
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+	_, codes := enableTwoFactor(t, ts, jake)
+
+	// Typed in by hand
+	client := passwordStep(t, ts, "jake")
+	if body := submitTwoFactorCode(t, ts, client, strings.ToUpper(codes[0])); !strings.Contains(body, "redirect /") {
+		t.Fatalf("recovery code: %s", body)
+	}
+
+	// Each works once
+	client = passwordStep(t, ts, "jake")
+	if body := submitTwoFactorCode(t, ts, client, codes[0]); !strings.Contains(body, errTwoFactorCodeInvalid.Error()) {
+		t.Errorf("used recovery code: %s", body)
+	}
+
+	// New codes replace the old ones
+	_, body := ts.datastar(t, jake, http.MethodPost, "/settings/two-factor/recovery-codes", TwoFactorForm{Code: codes[1]})
+	newCodes := recoveryCodePattern.FindAllStringSubmatch(body, -1)
+	if len(newCodes) != recoveryCodeCount {
+		t.Fatalf("got %d new recovery codes: %s", len(newCodes), body)
+	}
+	if body := submitTwoFactorCode(t, ts, client, codes[2]); !strings.Contains(body, errTwoFactorCodeInvalid.Error()) {
+		t.Errorf("replaced recovery code: %s", body)
+	}
+	if body := submitTwoFactorCode(t, ts, client, newCodes[0][1]); !strings.Contains(body, "redirect /") {
+		t.Errorf("new recovery code: %s", body)
+	}
+}
+
+func TestTwoFactorAPILogin(t *testing.T) {
+	ts := newTestServer(t)
+	userID, _ := ts.register(t, "jake")
+	jake := ts.browser(t)
+	ts.signIn(t, jake, "jake")
+	secret, _ := enableTwoFactor(t, ts, jake)
+
+	login := func(t *testing.T, code string) (int, apiErrorsResponse) {
+		t.Helper()
+
+		ts.forgetLoginAttempts(t)
+		res := apiErrorsResponse{}
+		status := ts.api(t, http.MethodPost, "/api/users/login", "", map[string]any{
+			"user": map[string]string{"email": "jake@example.com", "password": "password1234", "code": code},
+		}, &res)
+		return status, res
+	}
+
+	if status, res := login(t, ""); status != http.StatusUnauthorized || len(res.Errors.Body) != 1 || res.Errors.Body[0] != errTwoFactorCodeRequired.Error() {
+		t.Errorf("without a code: got status %d with %v", status, res.Errors.Body)
+	}
+	code := totpCode(t, secret, lastTOTPStep(t, ts, userID)+1)
+	if status, _ := login(t, code); status != http.StatusOK {
+		t.Errorf("with a code: got status %d, want %d", status, http.StatusOK)
+	}
+	if status, res := login(t, code); status != http.StatusUnauthorized || len(res.Errors.Body) != 1 || res.Errors.Body[0] != errTwoFactorCodeInvalid.Error() {
+		t.Errorf("replayed code: got status %d with %v", status, res.Errors.Body)
+	}
+}